@@ -0,0 +1,428 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ABC记谱法解析，支持 L/M/Q/K 头、音符、八度、临时升降号、时值、休止、和弦、连音线和反复记号
+type abcParser struct {
+	unit      float64         // 默认音长(全音符的分数)
+	meter     float64         // 一小节的长度(全音符的分数)
+	bpm       float64         // 每分钟拍数
+	beat      float64         // 一拍的长度(全音符的分数)
+	key       map[byte]int    // 调号中的升降
+	measure   map[string]int  // 本小节临时升降号，键为音名+八度
+	pos       float64         // 当前位置(全音符)
+	seconds   float64         // 当前位置(秒)
+	notes     []ScoreNote     // 已解析的音符
+	ties      map[int]int     // 连音线等待连接的音符下标，键为音高
+	repeatAt  int             // 反复起点的音符下标
+	repeatPos [2]float64      // 反复起点的位置(全音符, 秒)
+	report    *unsupportedLog // 不支持的结构
+}
+
+// 调号对应的升降数量，正数为升号
+var abcKeySignatures = map[string]int{
+	"C": 0, "G": 1, "D": 2, "A": 3, "E": 4, "B": 5, "F#": 6, "C#": 7,
+	"F": -1, "Bb": -2, "Eb": -3, "Ab": -4, "Db": -5, "Gb": -6, "Cb": -7,
+	"Am": 0, "Em": 1, "Bm": 2, "F#m": 3, "C#m": 4, "G#m": 5, "D#m": 6, "A#m": 7,
+	"Dm": -1, "Gm": -2, "Cm": -3, "Fm": -4, "Bbm": -5, "Ebm": -6, "Abm": -7,
+}
+
+var abcSharpOrder = "FCGDAEB"
+
+func abcKey(name string) (map[byte]int, bool) {
+	name = strings.TrimSpace(name)
+	if i := strings.IndexByte(name, ' '); i >= 0 {
+		name = name[:i]
+	}
+	name = strings.Replace(strings.Replace(name, "min", "m", 1), "maj", "", 1)
+	if name == "" || strings.EqualFold(name, "none") {
+		return map[byte]int{}, true
+	}
+	n, ok := abcKeySignatures[name]
+	if !ok {
+		return map[byte]int{}, false
+	}
+	key := map[byte]int{}
+	for i := 0; i < n; i++ {
+		key[abcSharpOrder[i]] = 1
+	}
+	for i := 0; i < -n; i++ {
+		key[abcSharpOrder[6-i]] = -1
+	}
+	return key, true
+}
+
+// 解析 "1/8"、"3/4" 形式的分数
+func parseABCFraction(s string) (float64, bool) {
+	num, den, ok := strings.Cut(strings.TrimSpace(s), "/")
+	if !ok {
+		v, err := strconv.ParseFloat(num, 64)
+		return v, err == nil
+	}
+	a, err1 := strconv.ParseFloat(strings.TrimSpace(num), 64)
+	b, err2 := strconv.ParseFloat(strings.TrimSpace(den), 64)
+	if err1 != nil || err2 != nil || b == 0 {
+		return 0, false
+	}
+	return a / b, true
+}
+
+// 读取ABC乐谱，只解析第一首(X:)曲子
+func readABC(src string, report *ImportReport, unsupported *unsupportedLog) ([]ScoreNote, error) {
+	p := &abcParser{unit: 0, bpm: 120, beat: 0.25, key: map[byte]int{}, measure: map[string]int{}, ties: map[int]int{}, report: unsupported}
+	inBody := false
+	tunes := 0
+	for n, line := range strings.Split(src, "\n") {
+		line = strings.TrimRight(line, "\r")
+		if i := strings.IndexByte(line, '%'); i >= 0 {
+			line = line[:i]
+		}
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		if len(line) >= 2 && line[1] == ':' && ((line[0] >= 'A' && line[0] <= 'Z') || (line[0] >= 'a' && line[0] <= 'z')) && !strings.HasPrefix(line, "|:") {
+			field, value := line[0], strings.TrimSpace(line[2:])
+			switch field {
+			case 'X':
+				tunes++
+				if tunes > 1 {
+					unsupported.add("additional tunes after the first X: ignored")
+					goto done
+				}
+			case 'T':
+				if value != "" {
+					report.Parts = append(report.Parts, value)
+				}
+			case 'L':
+				v, ok := parseABCFraction(value)
+				if !ok || v <= 0 {
+					return nil, fmt.Errorf("line %d: invalid unit note length %q", n+1, value)
+				}
+				p.unit = v
+			case 'M':
+				switch value {
+				case "C", "C|":
+					p.meter = 1
+				default:
+					if v, ok := parseABCFraction(value); ok {
+						p.meter = v
+					}
+				}
+			case 'Q':
+				if err := p.tempo(value); err != nil {
+					return nil, fmt.Errorf("line %d: %v", n+1, err)
+				}
+			case 'K':
+				key, ok := abcKey(value)
+				if !ok {
+					unsupported.add("key %q (按C大调处理)", value)
+				}
+				p.key = key
+				inBody = true
+			case 'V':
+				unsupported.add("multiple voices (V:)")
+			case 'w', 'W':
+			}
+			continue
+		}
+		if !inBody {
+			continue
+		}
+		if p.unit == 0 {
+			// 未指定 L: 时按拍号决定默认音长
+			p.unit = 0.125
+			if p.meter > 0 && p.meter < 0.75 {
+				p.unit = 0.0625
+			}
+		}
+		if err := p.parseLine(line); err != nil {
+			return nil, fmt.Errorf("line %d: %v", n+1, err)
+		}
+	}
+done:
+	report.Notes = len(p.notes)
+	return p.notes, nil
+}
+
+// Q:1/4=120、Q:120 或 Q:"Allegro" 1/4=120
+func (p *abcParser) tempo(value string) error {
+	if i := strings.LastIndexByte(value, '"'); i >= 0 {
+		value = strings.TrimSpace(value[i+1:])
+	}
+	if value == "" {
+		return nil
+	}
+	beat, bpm, ok := strings.Cut(value, "=")
+	if !ok {
+		bpm, beat = beat, ""
+	}
+	v, err := strconv.ParseFloat(strings.TrimSpace(bpm), 64)
+	if err != nil || v <= 0 {
+		return fmt.Errorf("invalid tempo %q", value)
+	}
+	p.bpm = v
+	if beat != "" {
+		total := 0.0
+		for _, part := range strings.Fields(beat) {
+			f, ok := parseABCFraction(part)
+			if !ok {
+				return fmt.Errorf("invalid tempo %q", value)
+			}
+			total += f
+		}
+		p.beat = total
+	} else if p.unit > 0 {
+		p.beat = p.unit
+	}
+	return nil
+}
+
+// 全音符分数换算为秒
+func (p *abcParser) toSeconds(length float64) float64 {
+	return length / p.beat * 60 / p.bpm
+}
+
+func (p *abcParser) advance(length float64) {
+	p.pos += length
+	p.seconds += p.toSeconds(length)
+}
+
+func (p *abcParser) parseLine(line string) error {
+	i := 0
+	for i < len(line) {
+		c := line[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\\' || c == '`':
+			i++
+		case c == '|' || c == ':' || c == '[' && i+1 < len(line) && (line[i+1] == '|' || line[i+1] >= '1' && line[i+1] <= '9'):
+			// 小节线和反复记号
+			j := i
+			for j < len(line) && strings.IndexByte("|:[]123456789", line[j]) >= 0 {
+				j++
+			}
+			p.barline(line[i:j])
+			i = j
+		case c == '"':
+			// 和弦名称或文字注释
+			j := strings.IndexByte(line[i+1:], '"')
+			if j < 0 {
+				return fmt.Errorf("col %d: unterminated string", i+1)
+			}
+			i += j + 2
+		case c == '!' || c == '+':
+			j := strings.IndexByte(line[i+1:], c)
+			if j < 0 {
+				return fmt.Errorf("col %d: unterminated decoration", i+1)
+			}
+			p.report.add("decoration %s", line[i:i+j+2])
+			i += j + 2
+		case c == '{':
+			j := strings.IndexByte(line[i:], '}')
+			if j < 0 {
+				return fmt.Errorf("col %d: unterminated grace notes", i+1)
+			}
+			p.report.add("grace notes")
+			i += j + 1
+		case c == '(':
+			if i+1 < len(line) && line[i+1] >= '2' && line[i+1] <= '9' {
+				p.report.add("tuplet (按原时值处理)")
+				i += 2
+			} else {
+				p.report.add("slur")
+				i++
+			}
+		case c == ')':
+			i++
+		case c == '.' || c == '~' || strings.IndexByte("HLMOPSTuv", c) >= 0:
+			p.report.add("decoration %c", c)
+			i++
+		case c == '[':
+			// 和弦 [CEG]
+			j := strings.IndexByte(line[i:], ']')
+			if j < 0 {
+				return fmt.Errorf("col %d: unterminated chord", i+1)
+			}
+			chord := line[i+1 : i+j]
+			if k := strings.IndexByte(chord, ':'); k >= 0 {
+				p.report.add("inline field [%s]", chord)
+				i += j + 1
+				continue
+			}
+			i += j + 1
+			mult, n := parseABCLength(line[i:])
+			i += n
+			longest := 0.0
+			for k := 0; k < len(chord); {
+				length, used, err := p.note(chord[k:], mult, true)
+				if err != nil {
+					return fmt.Errorf("col %d: %v", i+1, err)
+				}
+				if used == 0 {
+					k++
+					continue
+				}
+				if length > longest {
+					longest = length
+				}
+				k += used
+			}
+			p.advance(longest)
+		case c == 'z' || c == 'x' || c == 'Z':
+			mult, n := parseABCLength(line[i+1:])
+			if c == 'Z' && p.meter > 0 {
+				// 整小节休止，Z4 表示休止4小节
+				p.advance(p.meter * mult)
+			} else {
+				p.advance(p.unit * mult)
+			}
+			i += 1 + n
+		case strings.IndexByte("^_=ABCDEFGabcdefg", c) >= 0:
+			length, used, err := p.note(line[i:], 1, false)
+			if err != nil {
+				return fmt.Errorf("col %d: %v", i+1, err)
+			}
+			p.advance(length)
+			i += used
+		default:
+			p.report.add("symbol %q", string(c))
+			i++
+		}
+	}
+	return nil
+}
+
+// 处理小节线：:| 把上一个反复起点之后的音符再演奏一遍，|: 和双小节线记录新的反复起点
+func (p *abcParser) barline(bar string) {
+	p.measure = map[string]int{}
+	if strings.ContainsAny(bar, "123456789") {
+		p.report.add("first/second endings (按顺序演奏)")
+	}
+	if strings.HasPrefix(bar, ":") {
+		section := append([]ScoreNote{}, p.notes[p.repeatAt:]...)
+		offset := p.seconds - p.repeatPos[1]
+		for _, n := range section {
+			n.Start += offset
+			p.notes = append(p.notes, n)
+		}
+		p.pos += p.pos - p.repeatPos[0]
+		p.seconds += offset
+	}
+	if strings.HasPrefix(bar, ":") || strings.HasSuffix(bar, ":") || strings.Contains(bar, "||") || strings.Contains(bar, "|]") || strings.Contains(bar, "[|") {
+		p.repeatAt, p.repeatPos = len(p.notes), [2]float64{p.pos, p.seconds}
+	}
+}
+
+// 解析一个音符，返回时值(全音符分数)和用掉的字符数；inChord时不推进时间
+func (p *abcParser) note(s string, mult float64, inChord bool) (float64, int, error) {
+	i := 0
+	accidental, explicit := 0, false
+	for i < len(s) && strings.IndexByte("^_=", s[i]) >= 0 {
+		explicit = true
+		switch s[i] {
+		case '^':
+			accidental++
+		case '_':
+			accidental--
+		}
+		i++
+	}
+	if i >= len(s) || strings.IndexByte("ABCDEFGabcdefg", s[i]) < 0 {
+		if inChord && !explicit {
+			return 0, 0, nil
+		}
+		return 0, 0, fmt.Errorf("expected note name")
+	}
+	letter := s[i]
+	octave := 4
+	if letter >= 'a' {
+		octave = 5
+		letter -= 'a' - 'A'
+	}
+	i++
+	for i < len(s) && (s[i] == '\'' || s[i] == ',') {
+		if s[i] == '\'' {
+			octave++
+		} else {
+			octave--
+		}
+		i++
+	}
+	length, n := parseABCLength(s[i:])
+	i += n
+	length *= mult * p.unit
+
+	name := fmt.Sprintf("%c%d", letter, octave)
+	if explicit {
+		p.measure[name] = accidental
+	} else if a, ok := p.measure[name]; ok {
+		accidental = a
+	} else {
+		accidental = p.key[letter]
+	}
+	pitch := (octave+1)*12 + musicXMLSteps[string(letter)] + accidental
+
+	// 连音线：与前一个同音高音符连接，延长其时值
+	idx, tied := p.ties[pitch]
+	delete(p.ties, pitch)
+	if tied {
+		p.notes[idx].Duration = p.seconds + p.toSeconds(length) - p.notes[idx].Start
+	} else {
+		p.notes = append(p.notes, ScoreNote{Pitch: pitch, Start: p.seconds, Duration: p.toSeconds(length)})
+		idx = len(p.notes) - 1
+	}
+	if i < len(s) && s[i] == '-' {
+		p.ties[pitch] = idx
+		i++
+	}
+	return length, i, nil
+}
+
+// 解析时值倍数：2、/2、3/2、/、//
+func parseABCLength(s string) (float64, int) {
+	i := 0
+	for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+		i++
+	}
+	num := 1.0
+	if i > 0 {
+		num, _ = strconv.ParseFloat(s[:i], 64)
+	}
+	if i < len(s) && s[i] == '/' {
+		j := i + 1
+		for j < len(s) && s[j] >= '0' && s[j] <= '9' {
+			j++
+		}
+		den := 2.0
+		if j > i+1 {
+			den, _ = strconv.ParseFloat(s[i+1:j], 64)
+		} else {
+			for j < len(s) && s[j] == '/' {
+				den *= 2
+				j++
+			}
+		}
+		if den == 0 {
+			den = 1
+		}
+		return num / den, j
+	}
+	return num, i
+}
+
+// 导入ABC乐谱并规划指法
+func importABC(raw []byte, opts PlanOptions) (MusicData, *ImportReport, error) {
+	report := &ImportReport{Format: "abc"}
+	var unsupported unsupportedLog
+	notes, err := readABC(string(raw), report, &unsupported)
+	report.Unsupported = unsupported.list()
+	if err != nil {
+		return MusicData{}, report, err
+	}
+	data, plan, err := planFingering(notes, appConfig.Keyboard, opts)
+	report.Plan = plan
+	return data, report, err
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+// 四分音符一拍，每拍1秒
+const abcHeader = "X:1\nT:test\nL:1/4\nQ:1/4=60\nK:C\n"
+
+func TestReadABC(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want []ScoreNote
+	}{
+		{"melody", abcHeader + "C D E", []ScoreNote{{60, 0, 1, ""}, {62, 1, 1, ""}, {64, 2, 1, ""}}},
+		{"octaves", abcHeader + "C, C c c'", []ScoreNote{{48, 0, 1, ""}, {60, 1, 1, ""}, {72, 2, 1, ""}, {84, 3, 1, ""}}},
+		{"lengths", abcHeader + "C2 D/2 E/ F3/2", []ScoreNote{{60, 0, 2, ""}, {62, 2, 0.5, ""}, {64, 2.5, 0.5, ""}, {65, 3, 1.5, ""}}},
+		{"rests", abcHeader + "C z D x2 E", []ScoreNote{{60, 0, 1, ""}, {62, 2, 1, ""}, {64, 5, 1, ""}}},
+		{"key signature", "X:1\nL:1/4\nQ:1/4=60\nK:D\nF C =F", []ScoreNote{{66, 0, 1, ""}, {61, 1, 1, ""}, {65, 2, 1, ""}}},
+		{"accidentals last to the barline", abcHeader + "^F F _B | F B", []ScoreNote{{66, 0, 1, ""}, {66, 1, 1, ""}, {70, 2, 1, ""}, {65, 3, 1, ""}, {71, 4, 1, ""}}},
+		{"chord", abcHeader + "[CEG]2 C", []ScoreNote{{60, 0, 2, ""}, {64, 0, 2, ""}, {67, 0, 2, ""}, {60, 2, 1, ""}}},
+		{"tie", abcHeader + "C2- C D", []ScoreNote{{60, 0, 3, ""}, {62, 3, 1, ""}}},
+		{"tie across barline", abcHeader + "E- | E E", []ScoreNote{{64, 0, 2, ""}, {64, 2, 1, ""}}},
+		{"tie to a different pitch is ignored", abcHeader + "C- D", []ScoreNote{{60, 0, 1, ""}, {62, 1, 1, ""}}},
+		{"repeat", abcHeader + "C |: D E :| F", []ScoreNote{{60, 0, 1, ""}, {62, 1, 1, ""}, {64, 2, 1, ""}, {62, 3, 1, ""}, {64, 4, 1, ""}, {65, 5, 1, ""}}},
+		{"repeat from the start", abcHeader + "C D :| E", []ScoreNote{{60, 0, 1, ""}, {62, 1, 1, ""}, {60, 2, 1, ""}, {62, 3, 1, ""}, {64, 4, 1, ""}}},
+		{"tied note inside a repeat", abcHeader + "|: C- C :| D", []ScoreNote{{60, 0, 2, ""}, {60, 2, 2, ""}, {62, 4, 1, ""}}},
+		{"consecutive repeats", abcHeader + "|: C :|: D :|", []ScoreNote{{60, 0, 1, ""}, {60, 1, 1, ""}, {62, 2, 1, ""}, {62, 3, 1, ""}}},
+		{"default tempo", "X:1\nL:1/4\nK:C\nC D", []ScoreNote{{60, 0, 0.5, ""}, {62, 0.5, 0.5, ""}}},
+		{"only the first tune", abcHeader + "C\nX:2\nK:C\nD", []ScoreNote{{60, 0, 1, ""}}},
+		{"comments and annotations", abcHeader + "\"Am\"C % 注释 D\n!p!D", []ScoreNote{{60, 0, 1, ""}, {62, 1, 1, ""}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			report := &ImportReport{}
+			notes, err := readABC(tt.src, report, &unsupportedLog{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(notes) != len(tt.want) {
+				t.Fatalf("got %+v, want %+v", notes, tt.want)
+			}
+			for i, n := range notes {
+				w := tt.want[i]
+				if n.Pitch != w.Pitch || math.Abs(n.Start-w.Start) > 1e-9 || math.Abs(n.Duration-w.Duration) > 1e-9 {
+					t.Errorf("note %d: got %+v, want %+v", i, n, w)
+				}
+			}
+			if report.Notes != len(tt.want) {
+				t.Errorf("report counts %d notes", report.Notes)
+			}
+		})
+	}
+}
+
+func TestReadABCErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want string
+	}{
+		{"bad unit length", "X:1\nL:0\nK:C\nC", "line 2"},
+		{"bad tempo", "X:1\nQ:1/4=fast\nK:C\nC", "line 2"},
+		{"unterminated chord", abcHeader + "C\n[CE", "line 7"},
+		{"unterminated string", abcHeader + "\"Am C", "line 6"},
+		{"accidental without note", abcHeader + "C ^ D", "line 6"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := readABC(tt.src, &ImportReport{}, &unsupportedLog{})
+			if err == nil || !strings.HasPrefix(err.Error(), tt.want) {
+				t.Errorf("got %v, want error at %s", err, tt.want)
+			}
+		})
+	}
+}
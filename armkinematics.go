@@ -0,0 +1,123 @@
+package main
+
+import (
+	"math"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"musicsongling/kinematics"
+)
+
+// JointValues 六个关节角，0.001°单位，与 send_joint 一致
+type JointValues struct {
+	J1 int `json:"j1"`
+	J2 int `json:"j2"`
+	J3 int `json:"j3"`
+	J4 int `json:"j4"`
+	J5 int `json:"j5"`
+	J6 int `json:"j6"`
+}
+
+func (j JointValues) array() [6]int {
+	return [6]int{j.J1, j.J2, j.J3, j.J4, j.J5, j.J6}
+}
+
+func (j JointValues) joints() kinematics.Joints {
+	var q kinematics.Joints
+	for i, v := range j.array() {
+		q[i] = float64(v) / 1000
+	}
+	return q
+}
+
+func jointValuesOf(q kinematics.Joints) JointValues {
+	m := func(v float64) int { return int(math.Round(v * 1000)) }
+	return JointValues{m(q[0]), m(q[1]), m(q[2]), m(q[3]), m(q[4]), m(q[5])}
+}
+
+// 位姿(0.001mm/0.001°)与运动学位姿互转
+func poseOf(p kinematics.Pose) [6]int {
+	m := func(v float64) int { return int(math.Round(v * 1000)) }
+	return [6]int{m(p.X), m(p.Y), m(p.Z), m(p.RX), m(p.RY), m(p.RZ)}
+}
+
+func poseRequestJSON(p [6]int) gin.H {
+	return gin.H{"x": p[0], "y": p[1], "z": p[2], "rx": p[3], "ry": p[4], "rz": p[5]}
+}
+
+// 位姿是否在side侧机械臂的工作空间内，side为空时不检查
+func workspaceStatus(side string, pose [6]int) gin.H {
+	if side != "left" && side != "right" || !appConfig.Workspace.Enabled {
+		return nil
+	}
+	frame, ws := appConfig.Collision.Left, appConfig.Workspace.Left
+	if side == "right" {
+		frame, ws = appConfig.Collision.Right, appConfig.Workspace.Right
+	}
+	if err := checkWorkspace(appConfig.Workspace, frame, ws, pose, pose, appConfig.Collision.CheckStep); err != nil {
+		return gin.H{"valid": false, "error": err.Error()}
+	}
+	return gin.H{"valid": true}
+}
+
+// 正运动学：关节角 -> 末端位姿
+func forwardKinematicsHandler(c *gin.Context) {
+	var req struct {
+		JointValues
+		Side string `json:"side"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+		return
+	}
+	if err := kinematics.Piper.CheckLimits(req.joints()); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "joint angle out of range", "details": err.Error()})
+		return
+	}
+	pose := poseOf(kinematics.Piper.FK(req.joints()))
+	resp := gin.H{"pose": poseRequestJSON(pose)}
+	if ws := workspaceStatus(req.Side, pose); ws != nil {
+		resp["workspace"] = ws
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// 逆运动学：末端位姿 -> 关节角，current 为当前关节角，用于从多个解中选择最近的一个
+func inverseKinematicsHandler(c *gin.Context) {
+	var req struct {
+		PoseRequest
+		Current *JointValues `json:"current"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+		return
+	}
+	target := kinematics.Pose{
+		X: float64(req.X) / 1000, Y: float64(req.Y) / 1000, Z: float64(req.Z) / 1000,
+		RX: float64(req.RX) / 1000, RY: float64(req.RY) / 1000, RZ: float64(req.RZ) / 1000,
+	}
+	var ref kinematics.Joints
+	if req.Current != nil {
+		ref = req.Current.joints()
+	}
+	pose := [6]int{req.X, req.Y, req.Z, req.RX, req.RY, req.RZ}
+	ws := workspaceStatus(req.Side, pose)
+	solutions, err := kinematics.Piper.IK(target, ref)
+	if err != nil {
+		resp := gin.H{"error": err.Error()}
+		if ws != nil {
+			resp["workspace"] = ws
+		}
+		c.JSON(http.StatusUnprocessableEntity, resp)
+		return
+	}
+	all := make([]JointValues, len(solutions))
+	for i, q := range solutions {
+		all[i] = jointValuesOf(q)
+	}
+	resp := gin.H{"joints": all[0], "solutions": all}
+	if ws != nil {
+		resp["workspace"] = ws
+	}
+	c.JSON(http.StatusOK, resp)
+}
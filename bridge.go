@@ -0,0 +1,359 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// BridgeConfig 本地CAN服务的地址和连接参数
+type BridgeConfig struct {
+	URL              string  `json:"url"`              // CAN服务地址
+	Timeout          float64 `json:"timeout"`          // 单次请求超时(秒)
+	Retries          int     `json:"retries"`          // 幂等帧失败后的重试次数
+	Backoff          float64 `json:"backoff"`          // 第一次重试前的等待(秒)，之后每次翻倍
+	BreakerThreshold int     `json:"breakerThreshold"` // 连续失败多少次后熔断，0表示不熔断
+	BreakerCooldown  float64 `json:"breakerCooldown"`  // 熔断后多久允许试探请求(秒)
+	Batch            bool    `json:"batch"`            // 同一接口的一组帧合并为一次请求发送
+	BatchRecheck     float64 `json:"batchRecheck"`     // 服务不支持批量发送时，多久后重新尝试(秒)
+}
+
+func defaultBridgeConfig() BridgeConfig {
+	return BridgeConfig{
+		URL:              "http://localhost:5260",
+		Timeout:          1,
+		Retries:          2,
+		Backoff:          0.05,
+		BreakerThreshold: 5,
+		BreakerCooldown:  2,
+		Batch:            true,
+		BatchRecheck:     60,
+	}
+}
+
+// 设置绝对目标或状态的帧，重复发送结果相同，可以安全重试
+var idempotentFrameIDs = map[uint32]bool{
+	0x150: true, // 急停/恢复
+	0x151: true, // 运动控制模式
+	0x152: true, // 末端位姿 X/Y
+	0x153: true, // 末端位姿 Z/RX
+	0x154: true, // 末端位姿 RY/RZ
+	0x155: true, // 关节角 J1/J2
+	0x156: true, // 关节角 J3/J4
+	0x157: true, // 关节角 J5/J6
+	0x471: true, // 使能/失能
+	0x27:  true, // L10 右手手指位置
+	0x28:  true, // L10 左手手指位置
+}
+
+var errBridgeOpen = fmt.Errorf("CAN service circuit breaker is open")
+
+// CanBridge 共享的CAN服务客户端，带超时、重试和熔断
+type CanBridge struct {
+	mu       sync.Mutex
+	client   *http.Client
+	failures int       // 连续失败次数
+	openedAt time.Time // 熔断开始时间，零值表示未熔断
+	trial    bool      // 熔断后正在进行试探请求
+	stats    struct {
+		Requests int `json:"requests"`
+		Failures int `json:"failures"`
+		Retries  int `json:"retries"`
+		Rejected int `json:"rejected"` // 熔断期间直接拒绝的请求
+	}
+	batchUnsupportedAt time.Time             // 服务不支持批量接口的时间，零值表示支持或未知
+	latency            map[string]*Histogram // 每组帧的发送耗时，按 batch/sequential 区分
+}
+
+var canBridge = &CanBridge{}
+
+func (b *CanBridge) httpClient() *http.Client {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.client == nil {
+		b.client = &http.Client{
+			Timeout: time.Duration(appConfig.Bridge.Timeout * float64(time.Second)),
+			Transport: &http.Transport{
+				MaxIdleConns:        32,
+				MaxIdleConnsPerHost: 32,
+				IdleConnTimeout:     90 * time.Second,
+			},
+		}
+	}
+	return b.client
+}
+
+// 熔断期间拒绝请求，冷却时间过后只放行一个试探请求
+func (b *CanBridge) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.stats.Requests++
+	if b.openedAt.IsZero() {
+		return true
+	}
+	cooldown := time.Duration(appConfig.Bridge.BreakerCooldown * float64(time.Second))
+	if !b.trial && time.Since(b.openedAt) >= cooldown {
+		b.trial = true
+		return true
+	}
+	b.stats.Rejected++
+	return false
+}
+
+func (b *CanBridge) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err == nil {
+		if !b.openedAt.IsZero() {
+			slog.Info("CAN服务恢复，熔断关闭")
+		}
+		b.failures, b.openedAt, b.trial = 0, time.Time{}, false
+		return
+	}
+	b.stats.Failures++
+	b.failures++
+	threshold := appConfig.Bridge.BreakerThreshold
+	if b.trial || threshold > 0 && b.failures >= threshold && b.openedAt.IsZero() {
+		slog.Warn("CAN服务连续失败，熔断", "failures", b.failures, "err", err)
+		b.openedAt, b.trial = time.Now(), false
+	}
+}
+
+// 服务端返回4xx表示请求本身有问题，不重试
+type bridgeStatusError struct {
+	status int
+	body   string
+}
+
+func (e *bridgeStatusError) Error() string {
+	return fmt.Sprintf("CAN service error: %s", e.body)
+}
+
+func (b *CanBridge) once(method, path string, body []byte) ([]byte, error) {
+	req, err := http.NewRequest(method, appConfig.Bridge.URL+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := b.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return data, &bridgeStatusError{resp.StatusCode, string(data)}
+	}
+	return data, nil
+}
+
+// 发送请求，retry为true时对网络错误和5xx按退避重试
+func (b *CanBridge) do(method, path string, body []byte, retry bool) ([]byte, error) {
+	cfg := appConfig.Bridge
+	attempts := 1
+	if retry && cfg.Retries > 0 {
+		attempts += cfg.Retries
+	}
+	backoff := time.Duration(cfg.Backoff * float64(time.Second))
+	var lastErr error
+	for i := 0; i < attempts; i++ {
+		if i > 0 {
+			b.mu.Lock()
+			b.stats.Retries++
+			b.mu.Unlock()
+			metricBridgeRetries.inc(path)
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		if !b.allow() {
+			metricBridgeErrors.inc(path, "breaker")
+			return nil, errBridgeOpen
+		}
+		start := time.Now()
+		data, err := b.once(method, path, body)
+		metricBridgeDuration.observe(time.Since(start).Seconds(), path)
+		statusErr, isStatus := err.(*bridgeStatusError)
+		switch {
+		case isStatus:
+			metricBridgeErrors.inc(path, "status")
+		case err != nil:
+			metricBridgeErrors.inc(path, "network")
+		}
+		if isStatus && statusErr.status < 500 {
+			// 请求本身被拒绝，说明服务可用
+			b.record(nil)
+			return data, err
+		}
+		b.record(err)
+		if err == nil {
+			return data, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// 一组帧的发送耗时(秒)
+func (b *CanBridge) observe(mode string, d time.Duration) {
+	b.mu.Lock()
+	if b.latency == nil {
+		b.latency = map[string]*Histogram{}
+	}
+	h := b.latency[mode]
+	if h == nil {
+		h = newHistogram(latencyBuckets)
+		b.latency[mode] = h
+	}
+	b.mu.Unlock()
+	h.Observe(d.Seconds())
+}
+
+// 是否走批量接口：未开启或服务不支持时逐帧发送，超过 BatchRecheck 后重新尝试
+func (b *CanBridge) batchEnabled() bool {
+	cfg := appConfig.Bridge
+	if !cfg.Batch {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.batchUnsupportedAt.IsZero() {
+		return true
+	}
+	if time.Since(b.batchUnsupportedAt) >= time.Duration(cfg.BatchRecheck*float64(time.Second)) {
+		b.batchUnsupportedAt = time.Time{}
+		return true
+	}
+	return false
+}
+
+func (b *CanBridge) setBatchUnsupported() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.batchUnsupportedAt.IsZero() {
+		slog.Warn("CAN服务不支持批量发送，改为逐帧发送")
+	}
+	b.batchUnsupportedAt = time.Now()
+}
+
+// 批量接口请求体：POST /api/can/batch，服务按顺序在同一接口上发送全部帧
+type canBatch struct {
+	Interface string       `json:"interface"`
+	Frames    []CanMessage `json:"frames"`
+}
+
+// 服务没有批量接口：405/501，或404且响应不是带 error 的JSON；
+// 有批量接口时服务对请求本身返回的404(例如接口不存在)是发送错误，不改为逐帧发送
+func batchUnsupported(err error) bool {
+	statusErr, ok := err.(*bridgeStatusError)
+	if !ok {
+		return false
+	}
+	switch statusErr.status {
+	case http.StatusMethodNotAllowed, http.StatusNotImplemented:
+		return true
+	case http.StatusNotFound:
+		var body struct {
+			Error string `json:"error"`
+		}
+		return json.Unmarshal([]byte(statusErr.body), &body) != nil || body.Error == ""
+	}
+	return false
+}
+
+// 启动时发送一个空的批量请求，探测服务是否有批量接口；服务不可达时保持未知，发送时再判断
+func (b *CanBridge) probeBatch() {
+	if !appConfig.Bridge.Batch {
+		return
+	}
+	jsonData, err := json.Marshal(canBatch{Frames: []CanMessage{}})
+	if err != nil {
+		return
+	}
+	if _, err := b.once(http.MethodPost, "/api/can/batch", jsonData); batchUnsupported(err) {
+		b.setBatchUnsupported()
+	}
+}
+
+// 按顺序发送同一接口的一组帧，优先一次批量请求，服务不支持时逐帧发送
+func forwardFramesToCanService(iface string, frames []CanMessage) error {
+	retry := true
+	for i := range frames {
+		frames[i].Interface = iface
+		retry = retry && idempotentFrame(frames[i].Id)
+	}
+	start := time.Now()
+	if canBridge.batchEnabled() {
+		jsonData, err := json.Marshal(canBatch{Interface: iface, Frames: frames})
+		if err != nil {
+			return fmt.Errorf("marshal message failed: %v", err)
+		}
+		_, err = canBridge.do(http.MethodPost, "/api/can/batch", jsonData, retry)
+		if err == nil {
+			canBridge.observe("batch", time.Since(start))
+			for _, msg := range frames {
+				canRecorder.record(false, msg)
+				metricFramesSent.inc(msg.Interface, canIDLabel(msg.Id))
+			}
+			return nil
+		}
+		if !batchUnsupported(err) {
+			if _, ok := err.(*bridgeStatusError); ok {
+				return err
+			}
+			return fmt.Errorf("send to CAN service failed: %v", err)
+		}
+		canBridge.setBatchUnsupported()
+		start = time.Now()
+	}
+	for _, msg := range frames {
+		if err := forwardToCanService(msg); err != nil {
+			return fmt.Errorf("frame 0x%X: %v", msg.Id, err)
+		}
+	}
+	canBridge.observe("sequential", time.Since(start))
+	return nil
+}
+
+func idempotentFrame(id uint32) bool {
+	return idempotentFrameIDs[id]
+}
+
+// 查询CAN服务连接状态
+func bridgeStatusHandler(c *gin.Context) {
+	canBridge.mu.Lock()
+	defer canBridge.mu.Unlock()
+	state := "closed"
+	if !canBridge.openedAt.IsZero() {
+		state = "open"
+	}
+	batch := "supported"
+	if !appConfig.Bridge.Batch {
+		batch = "disabled"
+	} else if !canBridge.batchUnsupportedAt.IsZero() {
+		batch = "unsupported"
+	}
+	latency := gin.H{}
+	for mode, h := range canBridge.latency {
+		latency[mode] = h.Snapshot()
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"config":   appConfig.Bridge,
+		"breaker":  state,
+		"failures": canBridge.failures,
+		"stats":    canBridge.stats,
+		"batch":    batch,
+		"latency":  latency,
+	})
+}
@@ -0,0 +1,574 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// CalibrationConfig 延迟校准：测量指令发出到手指按下、机械臂到位的延迟，演奏时按设备提前发送
+//
+// 手指反馈约定：灵巧手在指令ID上回传与指令相同布局的帧 [0x01, 6个手指位置]；
+// 机械臂用位姿反馈 0x2A3 中的Z判断到位。
+type CalibrationConfig struct {
+	Enabled         bool                     `json:"enabled"`         // 演奏时是否按测得的延迟提前发送
+	Repeats         int                      `json:"repeats"`         // 每个手指/机械臂测量的次数，取中位数
+	Timeout         float64                  `json:"timeout"`         // 等待反馈或声音的最长时间(秒)
+	FingerTolerance int                      `json:"fingerTolerance"` // 反馈的手指位置与目标的最大偏差
+	ArmDistance     float64                  `json:"armDistance"`     // 测量机械臂时抬起的高度(mm)
+	ArmTolerance    float64                  `json:"armTolerance"`    // 机械臂到位的最大偏差(mm)
+	Interval        float64                  `json:"interval"`        // 录音校准时两次按压的间隔(秒)
+	OnsetRatio      float64                  `json:"onsetRatio"`      // 录音能量超过按压前底噪的倍数视为发声
+	OnsetLevel      float64                  `json:"onsetLevel"`      // 发声的最小幅度(满幅为1)
+	Devices         map[string]DeviceLatency `json:"devices"`         // 接口 -> 测得的延迟
+}
+
+func defaultCalibrationConfig() CalibrationConfig {
+	return CalibrationConfig{
+		Enabled:         true,
+		Repeats:         3,
+		Timeout:         1,
+		FingerTolerance: 20,
+		ArmDistance:     10,
+		ArmTolerance:    1,
+		Interval:        0.8,
+		OnsetRatio:      4,
+		OnsetLevel:      0.02,
+	}
+}
+
+// DeviceLatency 一个接口上设备的延迟(秒)，灵巧手按手指记录，机械臂记录到位延迟
+type DeviceLatency struct {
+	Fingers    map[string]float64 `json:"fingers,omitempty"`
+	Arm        float64            `json:"arm,omitempty"`
+	Method     string             `json:"method"` // feedback / wav / manual
+	MeasuredAt time.Time          `json:"measuredAt"`
+}
+
+// 校准时手指按住的时间
+const calibrationPress = 200 * time.Millisecond
+
+// 同一时间只运行一个校准；calibrationMu 保护录音校准的按压计划
+var calibrationRun sync.Mutex
+var calibrationMu sync.Mutex
+
+// 当前的校准配置；Devices 修改时整体替换，读取后不再加锁
+func calibrationConfig() CalibrationConfig {
+	configMu.Lock()
+	defer configMu.Unlock()
+	return appConfig.Calibration
+}
+
+// 在 configMu 下复制当前的设备延迟表，修改后整体替换并保存
+func updateDeviceLatencies(update func(devices map[string]DeviceLatency)) error {
+	return updateAppConfig(func(cfg *AppConfig) {
+		devices := map[string]DeviceLatency{}
+		for iface, d := range cfg.Calibration.Devices {
+			devices[iface] = d
+		}
+		update(devices)
+		cfg.Calibration.Devices = devices
+	})
+}
+
+func seconds(v float64) time.Duration {
+	return time.Duration(v * float64(time.Second))
+}
+
+func median(values []float64) float64 {
+	s := append([]float64{}, values...)
+	sort.Float64s(s)
+	if len(s)%2 == 1 {
+		return s[len(s)/2]
+	}
+	return (s[len(s)/2-1] + s[len(s)/2]) / 2
+}
+
+// 合并测量结果并保存到配置文件
+func storeLatencies(results map[string]DeviceLatency) error {
+	return updateDeviceLatencies(func(devices map[string]DeviceLatency) {
+		for iface, d := range results {
+			cur := devices[iface]
+			if len(d.Fingers) > 0 {
+				fingers := map[string]float64{}
+				for name, v := range cur.Fingers {
+					fingers[name] = v
+				}
+				for name, v := range d.Fingers {
+					fingers[name] = v
+				}
+				cur.Fingers = fingers
+			}
+			if d.Arm > 0 {
+				cur.Arm = d.Arm
+			}
+			cur.Method, cur.MeasuredAt = d.Method, d.MeasuredAt
+			devices[iface] = cur
+		}
+	})
+}
+
+// 演奏时一侧的延迟补偿
+type sideTiming struct {
+	press  map[string]time.Duration // 手指按下前等待的时间：最慢的手指不等，快的手指晚发
+	settle time.Duration            // 机械臂移动后的等待：下一个节拍的手指提前 lead 发出，只需等机械臂延迟超出 lead 的部分
+}
+
+// 从节拍开始(提前 lead)到这一侧发完全部指令、可以开始下一个节拍的时间(秒)
+func (s sideTiming) busy(action HandAction, tempo float64) float64 {
+	hold := 0.0
+	for i, name := range action.Fingers {
+		hold = math.Max(hold, s.press[name].Seconds()+action.Time[i]/tempo)
+	}
+	if action.Move.X == 0 && action.Move.Y == 0 {
+		return hold
+	}
+	return hold + appConfig.Trajectory.moveDuration(action.Move) + s.settle.Seconds()
+}
+
+// 演奏时的延迟补偿：时钟提前 lead 开始节拍，各手指再按自己的延迟错开，使按下的时刻一致
+type playbackTiming struct {
+	lead        time.Duration // 最慢的手指延迟
+	left, right sideTiming
+}
+
+// 按工位当前绑定的接口计算延迟补偿，没有测量过的手指按0处理
+func calibratedTiming(ifaces RigInterfaces) playbackTiming {
+	cfg := calibrationConfig()
+	var t playbackTiming
+	if !cfg.Enabled {
+		return t
+	}
+	devices := cfg.Devices
+	for _, hand := range []string{ifaces.LeftHand, ifaces.RightHand} {
+		for _, v := range devices[hand].Fingers {
+			t.lead = max(t.lead, seconds(v))
+		}
+	}
+	side := func(hand, arm string) sideTiming {
+		s := sideTiming{press: map[string]time.Duration{}, settle: max(seconds(devices[arm].Arm)-t.lead, 0)}
+		for name := range fingerIndexMap {
+			s.press[name] = t.lead - seconds(devices[hand].Fingers[name])
+		}
+		return s
+	}
+	t.left = side(ifaces.LeftHand, ifaces.LeftArm)
+	t.right = side(ifaces.RightHand, ifaces.RightArm)
+	return t
+}
+
+// 轮询反馈直到 reached，返回从发送到该帧到达CAN服务的时间(秒)
+func pollFeedback(iface string, id uint32, sent time.Time, timeout float64, reached func(data []byte) bool) (float64, error) {
+	deadline := sent.Add(seconds(timeout))
+	for time.Now().Before(deadline) {
+		data, age, err := queryFeedbackFrame(iface, id)
+		if err != nil {
+			return 0, err
+		}
+		at := time.Now().Add(-seconds(age))
+		if at.After(sent) && reached(data) {
+			return at.Sub(sent).Seconds(), nil
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return 0, fmt.Errorf("no feedback 0x%X on %s within %.1fs", id, iface, timeout)
+}
+
+// 测量一个手指：按下到反馈位置到达目标，每次测量后抬起
+func (r *Rig) measureFinger(hand, finger string, cfg CalibrationConfig) (float64, error) {
+	preset := r.fingerPreset()
+	idx := fingerIndexMap[finger]
+	id := r.handIDOf(hand)
+	var samples []float64
+	for k := 0; k < cfg.Repeats; k++ {
+		state := append([]byte{}, preset...)
+		state[idx] = byte(fingerDown)
+		sent := time.Now()
+		if err := sendL10FingerCommand(hand, state, id); err != nil {
+			return 0, err
+		}
+		lat, err := pollFeedback(hand, id, sent, cfg.Timeout, func(data []byte) bool {
+			return len(data) > idx+1 && abs(int(data[idx+1])-fingerDown) <= cfg.FingerTolerance
+		})
+		time.Sleep(calibrationPress)
+		if releaseErr := sendL10FingerCommand(hand, preset, id); err == nil {
+			err = releaseErr
+		}
+		if err != nil {
+			return 0, fmt.Errorf("%s %s: %v", hand, finger, err)
+		}
+		samples = append(samples, lat)
+		time.Sleep(calibrationPress)
+	}
+	return median(samples), nil
+}
+
+// 测量机械臂：从当前位姿抬起 armDistance 到Z反馈到位，每次测量后放回
+func (r *Rig) measureArm(arm string, cfg CalibrationConfig) (float64, error) {
+	tol := int(cfg.ArmTolerance * 1000)
+	zReached := func(z int) func([]byte) bool {
+		return func(data []byte) bool {
+			v, _, err := bytesToIntPair(data)
+			return err == nil && abs(v-z) <= tol
+		}
+	}
+	var samples []float64
+	for k := 0; k < cfg.Repeats; k++ {
+		pose, err := queryArmPose(arm)
+		if err != nil {
+			return 0, fmt.Errorf("%s: %v", arm, err)
+		}
+		target := pose
+		target[2] += int(cfg.ArmDistance * 1000)
+		sent := time.Now()
+		if err := sendPoseCommand(target[0], target[1], target[2], target[3], target[4], target[5], 100, arm); err != nil {
+			return 0, fmt.Errorf("%s: %v", arm, err)
+		}
+		lat, err := pollFeedback(arm, 0x2A3, sent, cfg.Timeout, zReached(target[2]))
+		back := time.Now()
+		if moveErr := sendPoseCommand(pose[0], pose[1], pose[2], pose[3], pose[4], pose[5], 100, arm); moveErr != nil {
+			return 0, fmt.Errorf("%s: %v", arm, moveErr)
+		}
+		if err != nil {
+			return 0, fmt.Errorf("%s: %v", arm, err)
+		}
+		if _, err := pollFeedback(arm, 0x2A3, back, cfg.Timeout, zReached(pose[2])); err != nil {
+			return 0, fmt.Errorf("%s: %v", arm, err)
+		}
+		samples = append(samples, lat)
+	}
+	return median(samples), nil
+}
+
+// 校准请求：side 为空时校准两侧，fingers 为空时校准所有手指
+type CalibrationRequest struct {
+	Side    string   `json:"side"`
+	Fingers []string `json:"fingers"`
+	Arm     bool     `json:"arm"` // 是否同时校准机械臂(只支持反馈校准)
+}
+
+// 要校准的灵巧手和机械臂接口
+func (r *Rig) calibrationTargets(req *CalibrationRequest) (hands, arms map[string]string, err error) {
+	if req.Side != "" && req.Side != "left" && req.Side != "right" {
+		return nil, nil, fmt.Errorf("side must be left or right")
+	}
+	if len(req.Fingers) == 0 {
+		for name := range fingerIndexMap {
+			req.Fingers = append(req.Fingers, name)
+		}
+		sort.Strings(req.Fingers)
+	}
+	for _, f := range req.Fingers {
+		if _, ok := fingerIndexMap[f]; !ok {
+			return nil, nil, fmt.Errorf("unknown finger %q", f)
+		}
+	}
+	ifaces := r.interfaces()
+	hands, arms = map[string]string{}, map[string]string{}
+	for _, s := range []struct{ side, hand, arm string }{
+		{"left", ifaces.LeftHand, ifaces.LeftArm},
+		{"right", ifaces.RightHand, ifaces.RightArm},
+	} {
+		if req.Side != "" && req.Side != s.side {
+			continue
+		}
+		if s.hand != "" {
+			hands[s.side] = s.hand
+		}
+		if s.arm != "" && req.Arm {
+			arms[s.side] = s.arm
+		}
+	}
+	if len(hands) == 0 && len(arms) == 0 {
+		return nil, nil, fmt.Errorf("no interface bound")
+	}
+	return hands, arms, nil
+}
+
+// 开始校准前检查：同时只允许一个校准，演奏中不能校准
+func (r *Rig) beginCalibration(c *gin.Context) bool {
+	if !calibrationRun.TryLock() {
+		c.JSON(http.StatusConflict, gin.H{"error": "calibration already running"})
+		return false
+	}
+	if r.jobActive() {
+		calibrationRun.Unlock()
+		c.JSON(http.StatusConflict, gin.H{"error": "rig is playing"})
+		return false
+	}
+	return true
+}
+
+// 通过反馈帧测量延迟并保存
+func feedbackCalibrationHandler(c *gin.Context) {
+	var req CalibrationRequest
+	if err := c.ShouldBindJSON(&req); err != nil && err != io.EOF {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+		return
+	}
+	rig := currentRig(c)
+	hands, arms, err := rig.calibrationTargets(&req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !rig.beginCalibration(c) {
+		return
+	}
+	defer calibrationRun.Unlock()
+	cfg := calibrationConfig()
+	results := map[string]DeviceLatency{}
+	now := time.Now()
+	for _, hand := range hands {
+		d := DeviceLatency{Fingers: map[string]float64{}, Method: "feedback", MeasuredAt: now}
+		for _, finger := range req.Fingers {
+			lat, err := rig.measureFinger(hand, finger, cfg)
+			if err != nil {
+				c.JSON(http.StatusBadGateway, gin.H{"error": err.Error(), "measured": results})
+				return
+			}
+			d.Fingers[finger] = lat
+		}
+		results[hand] = d
+	}
+	for _, arm := range arms {
+		lat, err := rig.measureArm(arm, cfg)
+		if err != nil {
+			c.JSON(http.StatusBadGateway, gin.H{"error": err.Error(), "measured": results})
+			return
+		}
+		results[arm] = DeviceLatency{Arm: lat, Method: "feedback", MeasuredAt: now}
+	}
+	if err := storeLatencies(results); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "measured": results})
+		return
+	}
+	rig.logger().Info("延迟校准完成", "method", "feedback", "measured", results)
+	c.JSON(http.StatusOK, gin.H{"status": "success", "measured": results})
+}
+
+// 录音校准的一次按压
+type CalibrationPress struct {
+	Interface string  `json:"interface"`
+	Finger    string  `json:"finger"`
+	Sent      float64 `json:"sent"` // 相对开始请求的发送时间(秒)
+}
+
+// 录音校准计划：按固定间隔依次按下每个手指，录音上传后在每次按压之后找发声时刻
+type CalibrationPlan struct {
+	ID        string             `json:"id"`
+	StartedAt time.Time          `json:"startedAt"`
+	Presses   []CalibrationPress `json:"presses"`
+}
+
+var calibrationPlan *CalibrationPlan
+
+// 录音校准第一步：界面开始录音后调用，按计划依次按压并返回每次按压的发送时间
+func startWAVCalibrationHandler(c *gin.Context) {
+	start := time.Now()
+	var req CalibrationRequest
+	if err := c.ShouldBindJSON(&req); err != nil && err != io.EOF {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+		return
+	}
+	req.Arm = false
+	rig := currentRig(c)
+	hands, _, err := rig.calibrationTargets(&req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !rig.beginCalibration(c) {
+		return
+	}
+	defer calibrationRun.Unlock()
+	cfg := calibrationConfig()
+	preset := rig.fingerPreset()
+	plan := &CalibrationPlan{ID: fmt.Sprintf("cal-%d", start.UnixMilli()), StartedAt: start}
+	// 第一次按压前留出一个间隔，用来估计底噪
+	due := start
+	for _, side := range []string{"left", "right"} {
+		hand, ok := hands[side]
+		if !ok {
+			continue
+		}
+		for _, finger := range req.Fingers {
+			for k := 0; k < cfg.Repeats; k++ {
+				due = due.Add(seconds(cfg.Interval))
+				time.Sleep(time.Until(due))
+				state := append([]byte{}, preset...)
+				state[fingerIndexMap[finger]] = byte(fingerDown)
+				sent := time.Now()
+				err := sendL10FingerCommand(hand, state, rig.handID(side))
+				time.Sleep(calibrationPress)
+				sendL10FingerCommand(hand, preset, rig.handID(side))
+				if err != nil {
+					c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+					return
+				}
+				plan.Presses = append(plan.Presses, CalibrationPress{hand, finger, sent.Sub(start).Seconds()})
+			}
+		}
+	}
+	calibrationMu.Lock()
+	calibrationPlan = plan
+	calibrationMu.Unlock()
+	c.JSON(http.StatusOK, gin.H{"status": "success", "plan": plan})
+}
+
+// 在录音中找按压之后的发声时刻：2ms窗口的均方根超过按压前50ms的底噪倍数和最小幅度
+func detectOnset(samples []float64, rate int, from float64, timeout float64, cfg CalibrationConfig) (float64, bool) {
+	win := max(rate/500, 1)
+	rms := func(start int) float64 {
+		sum := 0.0
+		for _, v := range samples[start : start+win] {
+			sum += v * v
+		}
+		return math.Sqrt(sum / float64(win))
+	}
+	begin := int(from * float64(rate))
+	noise := 0.0
+	n := 0
+	for i := max(begin-rate/20, 0); i+win <= begin && i+win <= len(samples); i += win {
+		noise += rms(i)
+		n++
+	}
+	if n > 0 {
+		noise /= float64(n)
+	}
+	level := math.Max(noise*cfg.OnsetRatio, cfg.OnsetLevel)
+	end := min(begin+int(timeout*float64(rate)), len(samples))
+	for i := max(begin, 0); i+win <= end; i += win {
+		if rms(i) > level {
+			return float64(i) / float64(rate), true
+		}
+	}
+	return 0, false
+}
+
+// 录音校准第二步：上传录音(file)，offset 为开始请求发出时录音的位置(秒)
+func wavCalibrationHandler(c *gin.Context) {
+	calibrationMu.Lock()
+	plan := calibrationPlan
+	calibrationMu.Unlock()
+	if plan == nil || (c.PostForm("plan") != "" && c.PostForm("plan") != plan.ID) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "calibration plan not found"})
+		return
+	}
+	offset, err := strconv.ParseFloat(c.PostForm("offset"), 64)
+	if err != nil || offset < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid offset"})
+		return
+	}
+	fh, err := c.FormFile("file")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "missing file"})
+		return
+	}
+	f, err := fh.Open()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	samples, rate, err := readWAV(data)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	cfg := calibrationConfig()
+	type onset struct {
+		CalibrationPress
+		Latency *float64 `json:"latency"` // 没有检测到发声时为空
+	}
+	var onsets []onset
+	found := map[string]map[string][]float64{}
+	for _, p := range plan.Presses {
+		o := onset{CalibrationPress: p}
+		at := offset + p.Sent
+		if t, ok := detectOnset(samples, rate, at, cfg.Timeout, cfg); ok {
+			lat := t - at
+			o.Latency = &lat
+			if found[p.Interface] == nil {
+				found[p.Interface] = map[string][]float64{}
+			}
+			found[p.Interface][p.Finger] = append(found[p.Interface][p.Finger], lat)
+		}
+		onsets = append(onsets, o)
+	}
+	if len(found) == 0 {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "no onset detected", "onsets": onsets})
+		return
+	}
+	results := map[string]DeviceLatency{}
+	now := time.Now()
+	for iface, fingers := range found {
+		d := DeviceLatency{Fingers: map[string]float64{}, Method: "wav", MeasuredAt: now}
+		for finger, lats := range fingers {
+			d.Fingers[finger] = median(lats)
+		}
+		results[iface] = d
+	}
+	if err := storeLatencies(results); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "measured": results})
+		return
+	}
+	slog.Info("延迟校准完成", "method", "wav", "measured", results)
+	c.JSON(http.StatusOK, gin.H{"status": "success", "measured": results, "onsets": onsets})
+}
+
+func getCalibrationHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"calibration": calibrationConfig()})
+}
+
+// 手动设置一个接口的延迟
+func putDeviceLatencyHandler(c *gin.Context) {
+	var d DeviceLatency
+	if err := c.ShouldBindJSON(&d); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+		return
+	}
+	if d.Arm < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "latency must not be negative"})
+		return
+	}
+	for name, v := range d.Fingers {
+		if _, ok := fingerIndexMap[name]; !ok || v < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid finger latency %q", name)})
+			return
+		}
+	}
+	d.Method, d.MeasuredAt = "manual", time.Now()
+	err := updateDeviceLatencies(func(devices map[string]DeviceLatency) {
+		devices[c.Param("iface")] = d
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "success", "device": d})
+}
+
+func deleteDeviceLatencyHandler(c *gin.Context) {
+	err := updateDeviceLatencies(func(devices map[string]DeviceLatency) {
+		delete(devices, c.Param("iface"))
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "success"})
+}
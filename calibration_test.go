@@ -0,0 +1,162 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMedian(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []float64
+		want   float64
+	}{
+		{"single", []float64{0.08}, 0.08},
+		{"odd count", []float64{0.3, 0.1, 0.2}, 0.2},
+		{"even count", []float64{0.4, 0.1, 0.3, 0.2}, 0.25},
+		{"outlier", []float64{0.05, 0.06, 2, 0.05, 0.07}, 0.06},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in := append([]float64{}, tt.values...)
+			if got := median(tt.values); math.Abs(got-tt.want) > 1e-12 {
+				t.Errorf("median(%v) = %v, want %v", tt.values, got, tt.want)
+			}
+			if !reflect.DeepEqual(in, tt.values) {
+				t.Errorf("median reordered its input: %v", tt.values)
+			}
+		})
+	}
+}
+
+func useCalibration(t *testing.T, cfg CalibrationConfig) {
+	saved := appConfig.Calibration
+	t.Cleanup(func() { appConfig.Calibration = saved })
+	appConfig.Calibration = cfg
+}
+
+var testLatencies = map[string]DeviceLatency{
+	"can0": {Fingers: map[string]float64{"index": 0.08, "middle": 0.05}},
+	"can1": {Fingers: map[string]float64{"index": 0.12}},
+	"can2": {Arm: 0.3},
+	"can9": {Fingers: map[string]float64{"index": 1}}, // 其他工位的接口，不影响本工位
+}
+
+// 最慢的手指决定提前量，快的手指晚发，使所有手指同时按下
+func TestCalibratedTiming(t *testing.T) {
+	ifaces := defaultRigConfig().Interfaces
+	tests := []struct {
+		name        string
+		cfg         CalibrationConfig
+		lead        time.Duration
+		left, right map[string]time.Duration
+		settle      time.Duration
+	}{
+		{"disabled", CalibrationConfig{Enabled: false, Devices: testLatencies}, 0, nil, nil, 0},
+		{
+			"measured devices",
+			CalibrationConfig{Enabled: true, Devices: testLatencies},
+			120 * time.Millisecond,
+			map[string]time.Duration{"index": 40 * time.Millisecond, "middle": 70 * time.Millisecond, "ring": 120 * time.Millisecond},
+			map[string]time.Duration{"index": 0, "pinky": 120 * time.Millisecond},
+			// 手指提前 lead 发出，机械臂只需再等超出 lead 的部分
+			180 * time.Millisecond,
+		},
+		{"nothing measured", CalibrationConfig{Enabled: true}, 0, map[string]time.Duration{"index": 0}, map[string]time.Duration{"index": 0}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useCalibration(t, tt.cfg)
+			timing := calibratedTiming(ifaces)
+			if timing.lead != tt.lead {
+				t.Errorf("lead %v, want %v", timing.lead, tt.lead)
+			}
+			for name, want := range tt.left {
+				if got := timing.left.press[name]; !closeDuration(got, want) {
+					t.Errorf("left %s waits %v, want %v", name, got, want)
+				}
+			}
+			for name, want := range tt.right {
+				if got := timing.right.press[name]; !closeDuration(got, want) {
+					t.Errorf("right %s waits %v, want %v", name, got, want)
+				}
+			}
+			if !closeDuration(timing.left.settle, tt.settle) || timing.right.settle != 0 {
+				t.Errorf("settle left %v right %v, want %v and 0", timing.left.settle, timing.right.settle, tt.settle)
+			}
+		})
+	}
+}
+
+// 浮点秒换算为 Duration 有纳秒级误差
+func closeDuration(a, b time.Duration) bool {
+	return (a - b).Abs() < time.Microsecond
+}
+
+// 8kHz录音：0.25秒处开始发声
+func testRecording(noise, tone float64) []float64 {
+	const rate = 8000
+	samples := make([]float64, rate/2)
+	for i := range samples {
+		samples[i] = noise * math.Sin(float64(i))
+		if i >= rate/4 {
+			samples[i] = tone * math.Sin(2*math.Pi*440*float64(i)/rate)
+		}
+	}
+	return samples
+}
+
+func TestDetectOnset(t *testing.T) {
+	cfg := defaultCalibrationConfig()
+	tests := []struct {
+		name    string
+		samples []float64
+		from    float64
+		timeout float64
+		want    float64
+		found   bool
+	}{
+		{"quiet room", testRecording(0.001, 0.5), 0.2, 1, 0.25, true},
+		{"noisy room", testRecording(0.05, 0.5), 0.2, 1, 0.25, true},
+		{"tone below noise floor", testRecording(0.05, 0.1), 0.2, 1, 0, false},
+		{"timeout before the tone", testRecording(0.001, 0.5), 0.1, 0.1, 0, false},
+		{"search past the end", testRecording(0.001, 0.5), 0.6, 1, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, found := detectOnset(tt.samples, 8000, tt.from, tt.timeout, cfg)
+			if found != tt.found {
+				t.Fatalf("found = %v, want %v", found, tt.found)
+			}
+			// 检测窗口2ms
+			if found && math.Abs(got-tt.want) > 0.002 {
+				t.Errorf("onset at %.4fs, want %.4fs", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSideTimingBusy(t *testing.T) {
+	s := sideTiming{press: map[string]time.Duration{"index": 40 * time.Millisecond, "middle": 0}, settle: 100 * time.Millisecond}
+	move := ArmMovement{Y: 1}
+	tests := []struct {
+		name   string
+		action HandAction
+		tempo  float64
+		want   float64
+	}{
+		{"idle", HandAction{}, 1, 0},
+		{"staggered fingers", HandAction{Fingers: []string{"index", "middle"}, Time: []float64{0.2, 0.22}}, 1, 0.24},
+		{"tempo shortens presses", HandAction{Fingers: []string{"middle"}, Time: []float64{0.4}}, 2, 0.2},
+		{"move adds trajectory and settle", HandAction{Fingers: []string{"middle"}, Time: []float64{0.2}, Move: move}, 1, 0.3 + appConfig.Trajectory.moveDuration(move)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := s.busy(tt.action, tt.tempo); math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("busy = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+)
+
+// 命令行子命令，不带参数运行时启动Web服务
+//
+//	go run . dsl compile score.txt [-o score.json]
+//	go run . dsl decompile score.json [-o score.txt]
+//	go run . import musicxml score.musicxml [-o score.json]
+//	go run . import abc tune.abc -split pitch [-o score.json]
+//	go run . export midi score.json -o score.mid
+func runCLI(args []string) int {
+	if len(args) >= 2 && args[0] == "dsl" {
+		return runDSLCommand(args[1], args[2:])
+	}
+	if len(args) >= 2 && args[0] == "import" {
+		return runImportCommand(args[1], args[2:])
+	}
+	if len(args) >= 2 && args[0] == "export" && args[1] == "midi" {
+		return runExportMIDICommand(args[2:])
+	}
+	fmt.Fprintln(os.Stderr, "usage: musicsongling dsl compile|decompile <file> [-o out]")
+	fmt.Fprintln(os.Stderr, "       musicsongling import musicxml|abc <file> [-o out] [-split auto|pitch|left|right]")
+	fmt.Fprintln(os.Stderr, "       musicsongling export midi <score.json> -o out.mid")
+	return 2
+}
+
+// 导入其他格式的乐谱，导入报告输出到标准错误
+func runImportCommand(format string, args []string) int {
+	fs := flag.NewFlagSet("import "+format, flag.ContinueOnError)
+	out := fs.String("o", "", "output file (default stdout)")
+	opts := defaultPlanOptions()
+	fs.StringVar(&opts.Split, "split", opts.Split, "hand split strategy: auto, pitch, left, right")
+	fs.IntVar(&opts.SplitPoint, "split-point", opts.SplitPoint, "lowest right-hand pitch for -split pitch")
+	in, err := parseCLIArgs(fs, args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "usage: musicsongling import %s <file> [-o out] [-split auto|pitch|left|right]\n", format)
+		return 2
+	}
+	raw, err := os.ReadFile(in)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	loadAppConfig()
+	data, report, err := importScore(format, raw, opts)
+	if report != nil {
+		writeCLIJSON(os.Stderr, report)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", in, err)
+		return 1
+	}
+	w, closeOut, err := openCLIOutput(*out)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer closeOut()
+	if err := writeCLIJSON(w, data); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// 把MusicData导出为MIDI文件
+func runExportMIDICommand(args []string) int {
+	fs := flag.NewFlagSet("export midi", flag.ContinueOnError)
+	out := fs.String("o", "", "output file")
+	in, err := parseCLIArgs(fs, args)
+	if err != nil || *out == "" {
+		fmt.Fprintln(os.Stderr, "usage: musicsongling export midi <score.json> -o out.mid")
+		return 2
+	}
+	raw, err := os.ReadFile(in)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	var data MusicData
+	if err := json.Unmarshal(raw, &data); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", in, err)
+		return 1
+	}
+	loadAppConfig()
+	w, closeOut, err := openCLIOutput(*out)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer closeOut()
+	if err := writeMIDI(w, scoreToNotes(data, appConfig.Keyboard)); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+func runDSLCommand(cmd string, args []string) int {
+	fs := flag.NewFlagSet("dsl "+cmd, flag.ContinueOnError)
+	out := fs.String("o", "", "output file (default stdout)")
+	in, err := parseCLIArgs(fs, args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "usage: musicsongling dsl %s <file> [-o out]\n", cmd)
+		return 2
+	}
+	raw, err := os.ReadFile(in)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	w, closeOut, err := openCLIOutput(*out)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer closeOut()
+
+	switch cmd {
+	case "compile":
+		data, err := compileDSL(string(raw))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", in, err)
+			return 1
+		}
+		err = writeCLIJSON(w, data)
+	case "decompile":
+		var data MusicData
+		if err = json.Unmarshal(raw, &data); err == nil {
+			err = decompileDSL(data, w)
+		}
+	default:
+		err = fmt.Errorf("unknown dsl command %q", cmd)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// 解析参数并返回输入文件，输入文件可以在flag之前或之后：
+// flag解析在第一个非flag参数处停止，取出它作为输入文件后继续解析剩余参数
+func parseCLIArgs(fs *flag.FlagSet, args []string) (string, error) {
+	if err := fs.Parse(args); err != nil {
+		return "", err
+	}
+	if fs.NArg() == 0 {
+		return "", fmt.Errorf("missing input file")
+	}
+	in := fs.Arg(0)
+	if err := fs.Parse(fs.Args()[1:]); err != nil {
+		return "", err
+	}
+	if fs.NArg() > 0 {
+		return "", fmt.Errorf("unexpected argument %q", fs.Arg(0))
+	}
+	return in, nil
+}
+
+func openCLIOutput(path string) (io.Writer, func(), error) {
+	if path == "" {
+		return os.Stdout, func() {}, nil
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return f, func() { f.Close() }, nil
+}
+
+func writeCLIJSON(w io.Writer, v interface{}) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "    ")
+	enc.SetEscapeHTML(false)
+	return enc.Encode(v)
+}
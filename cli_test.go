@@ -0,0 +1,48 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestParseCLIArgs(t *testing.T) {
+	tests := []struct {
+		name  string
+		args  []string
+		in    string
+		out   string
+		split string
+		err   string
+	}{
+		{"file only", []string{"tune.abc"}, "tune.abc", "", "auto", ""},
+		{"flags after file", []string{"tune.abc", "-split", "pitch", "-o", "tune.json"}, "tune.abc", "tune.json", "pitch", ""},
+		{"flags before file", []string{"-split", "pitch", "tune.abc"}, "tune.abc", "", "pitch", ""},
+		{"flags around file", []string{"-o", "tune.json", "tune.abc", "-split=left"}, "tune.abc", "tune.json", "left", ""},
+		{"missing file", []string{"-split", "pitch"}, "", "", "", "missing input file"},
+		{"two files", []string{"a.abc", "b.abc"}, "", "", "", "unexpected argument"},
+		{"unknown flag", []string{"tune.abc", "-x"}, "", "", "", "not defined"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := flag.NewFlagSet("import abc", flag.ContinueOnError)
+			fs.SetOutput(io.Discard)
+			out := fs.String("o", "", "")
+			split := fs.String("split", "auto", "")
+			in, err := parseCLIArgs(fs, tt.args)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if in != tt.in || *out != tt.out || *split != tt.split {
+				t.Errorf("got in=%q o=%q split=%q, want %q %q %q", in, *out, *split, tt.in, tt.out, tt.split)
+			}
+		})
+	}
+}
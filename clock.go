@@ -0,0 +1,399 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ClockConfig 外部时钟：伴奏WAV的播放位置由界面上报，MIDI时钟/时间码由本地UDP发送
+type ClockConfig struct {
+	Listen  string  `json:"listen"`  // MIDI时钟/时间码UDP监听地址，为空不监听
+	BPM     float64 `json:"bpm"`     // MIDI时钟的名义速度，用于把时钟脉冲换算为秒，预备拍也使用该速度
+	Latency float64 `json:"latency"` // 默认延迟补偿(秒)，指令提前该时间发送
+	CountIn int     `json:"countIn"` // 默认预备拍数
+	Timeout float64 `json:"timeout"` // 外部时钟超过该时间(秒)没有更新视为停止
+	// 节拍晚于时钟超过该时间(秒)时跳过不按，只移动机械臂，避免暂停或落后后把错过的节拍一起弹出；0表示不跳过
+	SkipLate float64 `json:"skipLate"`
+}
+
+func defaultClockConfig() ClockConfig {
+	return ClockConfig{Listen: "127.0.0.1:5300", BPM: 120, Timeout: 1, SkipLate: 0.3}
+}
+
+// 节拍已经错过，由演奏跳过
+var errStepSkipped = fmt.Errorf("step skipped")
+
+// 外部时钟来源
+const (
+	clockWAV  = "wav"  // 界面上报伴奏播放位置
+	clockMIDI = "midi" // MIDI时钟(0xF8，每拍24个脉冲)
+	clockMTC  = "mtc"  // MIDI时间码
+)
+
+// ExternalClock 外部时钟，两次更新之间按速率外推位置
+type ExternalClock struct {
+	mu       sync.Mutex
+	source   string
+	position float64 // 最近一次更新时的位置(秒)
+	at       time.Time
+	running  bool
+	rate     float64 // 位置相对真实时间的速率
+	maxAhead float64 // 外推的最大距离(秒)，0为不限制
+	updates  int
+
+	// MIDI时钟
+	ticks    int64
+	lastTick time.Time
+	// MIDI时间码四分帧
+	quarter [8]byte
+	pieces  byte
+}
+
+// ClockStatus 外部时钟状态
+type ClockStatus struct {
+	Source    string     `json:"source"`
+	Position  float64    `json:"position"` // 外推后的当前位置(秒)
+	Running   bool       `json:"running"`
+	Rate      float64    `json:"rate"`
+	Updates   int        `json:"updates"`
+	UpdatedAt *time.Time `json:"updatedAt,omitempty"`
+}
+
+var backingClock = &ExternalClock{rate: 1}
+
+func (c *ExternalClock) setLocked(source string, position float64, running bool, now time.Time) {
+	c.source = source
+	c.position = position
+	c.running = running
+	c.at = now
+	c.updates++
+}
+
+// 界面上报伴奏播放位置
+func (c *ExternalClock) report(position float64, playing bool, rate float64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.setLocked(clockWAV, position, playing, time.Now())
+	c.rate = rate
+	c.maxAhead = 0
+}
+
+// 返回当前位置、是否在走、来源；超过超时没有更新视为停止
+func (c *ExternalClock) now() (float64, bool, string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.nowLocked(time.Now())
+}
+
+func (c *ExternalClock) nowLocked(now time.Time) (float64, bool, string) {
+	if !c.running {
+		return c.position, false, c.source
+	}
+	elapsed := now.Sub(c.at).Seconds()
+	if timeout := appConfig.Clock.Timeout; timeout > 0 && elapsed > timeout {
+		return c.position, false, c.source
+	}
+	ahead := elapsed * c.rate
+	if c.maxAhead > 0 && ahead > c.maxAhead {
+		ahead = c.maxAhead
+	}
+	return c.position + ahead, true, c.source
+}
+
+func (c *ExternalClock) status() ClockStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	pos, running, source := c.nowLocked(time.Now())
+	s := ClockStatus{Source: source, Position: pos, Running: running, Rate: c.rate, Updates: c.updates}
+	if !c.at.IsZero() {
+		at := c.at
+		s.UpdatedAt = &at
+	}
+	return s
+}
+
+// 一个MIDI时钟脉冲的名义时长(秒)
+func midiTickSeconds() float64 {
+	bpm := appConfig.Clock.BPM
+	if bpm <= 0 {
+		bpm = 120
+	}
+	return 60 / bpm / 24
+}
+
+// 处理一个UDP报文中的MIDI消息：时钟(F8)、开始/继续/停止(FA/FB/FC)、
+// 歌曲位置(F2)、时间码四分帧(F1)和完整帧(F0 7F .. 01 01 hh mm ss ff F7)
+func (c *ExternalClock) handleMIDI(data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	tick := midiTickSeconds()
+	for i := 0; i < len(data); i++ {
+		switch b := data[i]; b {
+		case 0xF8:
+			// 停止时时钟脉冲照常发送，但不推进位置
+			if c.source != clockMIDI || !c.running {
+				c.lastTick = now
+				continue
+			}
+			c.ticks++
+			// 按脉冲间隔估计速率，外推不超过一个脉冲，时钟停下时位置不会跑过头
+			if !c.lastTick.IsZero() {
+				if interval := now.Sub(c.lastTick).Seconds(); interval > 0 && interval < 0.5 {
+					c.rate = 0.8*c.rate + 0.2*(tick/interval)
+				}
+			}
+			c.lastTick = now
+			c.setLocked(clockMIDI, float64(c.ticks)*tick, true, now)
+			c.maxAhead = tick
+		case 0xFA:
+			c.ticks = 0
+			c.lastTick = time.Time{}
+			c.rate = 1
+			c.setLocked(clockMIDI, 0, true, now)
+			c.maxAhead = tick
+		case 0xFB:
+			c.setLocked(clockMIDI, float64(c.ticks)*tick, true, now)
+			c.maxAhead = tick
+		case 0xFC:
+			pos, _, _ := c.nowLocked(now)
+			c.setLocked(c.source, pos, false, now)
+		case 0xF2:
+			// 歌曲位置以16分音符计，每个16分音符6个脉冲
+			if i+2 < len(data) {
+				c.ticks = (int64(data[i+1]) | int64(data[i+2])<<7) * 6
+				c.setLocked(clockMIDI, float64(c.ticks)*tick, c.running, now)
+				i += 2
+			}
+		case 0xF1:
+			if i+1 < len(data) {
+				c.quarterFrame(data[i+1], now)
+				i++
+			}
+		case 0xF0:
+			end := i + 1
+			for end < len(data) && data[end] != 0xF7 {
+				end++
+			}
+			msg := data[i:min(end+1, len(data))]
+			if len(msg) >= 10 && msg[1] == 0x7F && msg[3] == 0x01 && msg[4] == 0x01 {
+				c.setLocked(clockMTC, mtcSeconds(msg[5], msg[6], msg[7], msg[8]), c.running, now)
+			}
+			i = end
+		}
+	}
+}
+
+// 时间码四分帧：8个凑齐一个完整时间码，凑齐时已经过了2帧
+func (c *ExternalClock) quarterFrame(value byte, now time.Time) {
+	piece := value >> 4 & 0x07
+	c.quarter[piece] = value & 0x0F
+	c.pieces |= 1 << piece
+	if piece != 7 || c.pieces != 0xFF {
+		return
+	}
+	c.pieces = 0
+	q := c.quarter
+	hh := q[6] | q[7]<<4
+	pos := mtcSeconds(hh, q[4]|q[5]<<4, q[2]|q[3]<<4, q[0]|q[1]<<4)
+	pos += 2 / mtcFrameRate(hh)
+	c.setLocked(clockMTC, pos, true, now)
+	c.rate = 1
+	c.maxAhead = 0
+}
+
+// 时间码小时字节的第5、6位是帧率
+func mtcFrameRate(hh byte) float64 {
+	return []float64{24, 25, 29.97, 30}[hh>>5&0x03]
+}
+
+func mtcSeconds(hh, mm, ss, ff byte) float64 {
+	return float64(hh&0x1F)*3600 + float64(mm&0x3F)*60 + float64(ss&0x3F) + float64(ff&0x1F)/mtcFrameRate(hh)
+}
+
+// 监听本地UDP，每个报文包含若干MIDI消息
+func startClockListener() {
+	addr := appConfig.Clock.Listen
+	if addr == "" {
+		return
+	}
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		slog.Error("外部时钟监听失败", "addr", addr, "err", err)
+		return
+	}
+	slog.Info("外部时钟监听", "addr", "udp://"+addr)
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				slog.Error("外部时钟读取失败", "err", err)
+				return
+			}
+			backingClock.handleMIDI(buf[:n])
+		}
+	}()
+}
+
+// SyncOptions 跟随外部时钟演奏
+type SyncOptions struct {
+	Source  string   `json:"source"`  // wav / midi / mtc，为空时接受任意来源
+	Offset  float64  `json:"offset"`  // 预备拍在时钟上的起始位置(秒)，预备拍之后是乐谱的第一个节拍
+	CountIn *int     `json:"countIn"` // 预备拍数，为空使用 clock.countIn
+	BPM     float64  `json:"bpm"`     // 预备拍速度，0 使用 clock.bpm
+	Latency *float64 `json:"latency"` // 延迟补偿(秒)，为空使用 clock.latency
+}
+
+func checkSyncOptions(opts *SyncOptions) error {
+	if opts == nil {
+		return nil
+	}
+	switch opts.Source {
+	case "", clockWAV, clockMIDI, clockMTC:
+	default:
+		return fmt.Errorf("unknown clock source %q", opts.Source)
+	}
+	if opts.Offset < 0 || opts.BPM < 0 {
+		return fmt.Errorf("sync offset and bpm must not be negative")
+	}
+	if opts.CountIn != nil && *opts.CountIn < 0 {
+		return fmt.Errorf("countIn must not be negative")
+	}
+	if opts.Latency != nil && *opts.Latency < 0 {
+		return fmt.Errorf("latency must not be negative")
+	}
+	return nil
+}
+
+// SyncStatus 跟随外部时钟演奏的状态
+type SyncStatus struct {
+	Source      string  `json:"source"`
+	Position    float64 `json:"position"` // 外部时钟位置(秒)
+	Running     bool    `json:"running"`
+	Start       float64 `json:"start"`   // 乐谱第一个节拍在时钟上的位置(秒)
+	Latency     float64 `json:"latency"` // 延迟补偿(秒)
+	CountIn     int     `json:"countIn"` // 剩余预备拍
+	Waiting     bool    `json:"waiting"` // 等待时钟走到下一个节拍
+	Lateness    float64 `json:"lateness"`
+	MaxLateness float64 `json:"maxLateness"`
+	Skipped     int     `json:"skipped"` // 错过而跳过的节拍数
+}
+
+// clockSync 把乐谱的节拍锁定到外部时钟
+type clockSync struct {
+	rig      *Rig
+	source   string
+	onsets   []float64
+	beat     float64 // 一拍的时长(秒)
+	countIn  int
+	skipLate float64
+	status   SyncStatus
+	reported time.Time
+}
+
+func newClockSync(r *Rig, opts SyncOptions, music []MusicNote) *clockSync {
+	cfg := appConfig.Clock
+	s := &clockSync{rig: r, source: opts.Source, onsets: musicTimeline(music, 1), countIn: cfg.CountIn, skipLate: cfg.SkipLate}
+	bpm := opts.BPM
+	if bpm <= 0 {
+		bpm = cfg.BPM
+	}
+	if bpm <= 0 {
+		bpm = 120
+	}
+	s.beat = 60 / bpm
+	if opts.CountIn != nil {
+		s.countIn = *opts.CountIn
+	}
+	s.status.Latency = cfg.Latency
+	if opts.Latency != nil {
+		s.status.Latency = *opts.Latency
+	}
+	s.status.Start = opts.Offset + float64(s.countIn)*s.beat
+	return s
+}
+
+func (s *clockSync) waitStep(i int, lead time.Duration) error {
+	target := s.status.Start + s.onsets[i] - s.status.Latency - lead.Seconds()
+	lastBeat := -1
+	for {
+		if err := s.rig.waitPlaybackResume(); err != nil {
+			return err
+		}
+		pos, running, source := backingClock.now()
+		if s.source != "" && source != s.source {
+			running = false
+		}
+		s.status.Source, s.status.Position, s.status.Running = source, pos, running
+		if running && pos >= target {
+			late := pos - target
+			s.status.Waiting, s.status.CountIn = false, 0
+			if s.skipLate > 0 && late > s.skipLate {
+				s.status.Skipped++
+				s.rig.logger().Warn("节拍已错过，跳过", "note", i, "late", late, "position", pos)
+				s.report(true)
+				return errStepSkipped
+			}
+			s.status.Lateness = late
+			s.status.MaxLateness = math.Max(s.status.MaxLateness, late)
+			metricLateness.observe(late, s.rig.ID, "clock")
+			s.report(true)
+			return nil
+		}
+		s.status.Waiting = true
+		if i == 0 && s.countIn > 0 {
+			// 第一个节拍之前数预备拍
+			left := int(math.Ceil((s.status.Start - pos) / s.beat))
+			s.status.CountIn = max(0, min(left, s.countIn))
+			if running && left <= s.countIn && s.status.CountIn != lastBeat && s.status.CountIn > 0 {
+				s.rig.logger().Info("预备拍", "beat", s.countIn-s.status.CountIn+1, "position", pos)
+				lastBeat = s.status.CountIn
+			}
+		}
+		s.report(false)
+		wait := 20 * time.Millisecond
+		if running {
+			wait = min(wait, time.Duration((target-pos)*float64(time.Second)))
+		}
+		time.Sleep(wait)
+	}
+}
+
+// 更新任务中的同步状态，等待时限制频率
+func (s *clockSync) report(force bool) {
+	if !force && time.Since(s.reported) < 100*time.Millisecond {
+		return
+	}
+	s.reported = time.Now()
+	s.rig.updateSyncStatus(s.status)
+}
+
+// 界面上报伴奏WAV的播放位置，建议播放时每100~250ms上报一次，暂停、跳转时立即上报
+func clockPositionHandler(c *gin.Context) {
+	var req struct {
+		Position *float64 `json:"position"`
+		Playing  bool     `json:"playing"`
+		Rate     float64  `json:"rate"` // 播放速率，0为1
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || req.Position == nil || *req.Position < 0 || req.Rate < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+		return
+	}
+	if req.Rate == 0 {
+		req.Rate = 1
+	}
+	backingClock.report(*req.Position, req.Playing, req.Rate)
+	c.JSON(http.StatusOK, gin.H{"status": "success", "clock": backingClock.status()})
+}
+
+func clockStatusHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"clock": backingClock.status(), "config": appConfig.Clock})
+}
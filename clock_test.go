@@ -0,0 +1,84 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestMTCSeconds(t *testing.T) {
+	tests := []struct {
+		name           string
+		hh, mm, ss, ff byte
+		want           float64
+	}{
+		{"zero", 0x00, 0, 0, 0, 0},
+		{"24fps", 0x00, 0, 1, 12, 1.5},
+		{"25fps", 0x20 | 1, 2, 3, 10, 3723.4},
+		{"29.97fps", 0x40, 0, 10, 0, 10},
+		{"30fps", 0x60, 0, 0, 15, 0.5},
+		{"high bits ignored", 0x60 | 2, 0xC0 | 5, 0xC0 | 6, 0xE0 | 3, 7200 + 300 + 6 + 0.1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := mtcSeconds(tt.hh, tt.mm, tt.ss, tt.ff); math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("mtcSeconds(%#x, %d, %d, %d) = %v, want %v", tt.hh, tt.mm, tt.ss, tt.ff, got, tt.want)
+			}
+		})
+	}
+}
+
+// 按标准顺序拆成8个四分帧消息 F1 0n
+func quarterFrames(hh, mm, ss, ff byte) []byte {
+	var msg []byte
+	for piece, v := range []byte{ff, ss, mm, hh} {
+		msg = append(msg, 0xF1, byte(2*piece)<<4|v&0x0F, 0xF1, byte(2*piece+1)<<4|v>>4)
+	}
+	return msg
+}
+
+func TestQuarterFrameAssembly(t *testing.T) {
+	tests := []struct {
+		name    string
+		msg     []byte
+		updated bool
+		want    float64
+	}{
+		// 凑齐8个四分帧时已经过了2帧
+		{"25fps", quarterFrames(0x20|1, 2, 3, 10), true, 3723.4 + 2.0/25},
+		{"30fps", quarterFrames(0x60, 0, 59, 29), true, 59 + 31.0/30},
+		{"24fps high hour bit", quarterFrames(0x10, 0, 0, 0), true, 16*3600 + 2.0/24},
+		{"missing piece", append(quarterFrames(0x20, 0, 1, 0)[:6], quarterFrames(0x20, 0, 1, 0)[8:]...), false, 0},
+		{"incomplete", quarterFrames(0x20, 0, 1, 0)[:14], false, 0},
+		{"full frame sysex", []byte{0xF0, 0x7F, 0x7F, 0x01, 0x01, 0x20 | 1, 2, 3, 10, 0xF7}, true, 3723.4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &ExternalClock{rate: 1}
+			c.handleMIDI(tt.msg)
+			if updated := c.updates > 0; updated != tt.updated {
+				t.Fatalf("updated = %v, want %v", updated, tt.updated)
+			}
+			if !tt.updated {
+				return
+			}
+			if c.source != clockMTC {
+				t.Errorf("source %q, want %q", c.source, clockMTC)
+			}
+			if math.Abs(c.position-tt.want) > 1e-9 {
+				t.Errorf("position %v, want %v", c.position, tt.want)
+			}
+		})
+	}
+}
+
+// 连续两个完整的四分帧序列，各自更新一次
+func TestQuarterFrameRepeats(t *testing.T) {
+	c := &ExternalClock{rate: 1}
+	c.handleMIDI(append(quarterFrames(0x20, 0, 1, 0), quarterFrames(0x20, 0, 1, 8)...))
+	if c.updates != 2 {
+		t.Fatalf("got %d updates, want 2", c.updates)
+	}
+	if want := 1 + 10.0/25; math.Abs(c.position-want) > 1e-9 {
+		t.Errorf("position %v, want %v", c.position, want)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+)
+
+// AppConfig 服务端配置，启动时从配置文件读取，文件中没有的字段保持默认值
+type AppConfig struct {
+	Keyboard    KeyboardModel     `json:"keyboard"`    // 键盘与手位模型
+	Collision   CollisionConfig   `json:"collision"`   // 双臂防碰撞
+	Workspace   WorkspaceConfig   `json:"workspace"`   // 笛卡尔工作空间限制
+	Trajectory  TrajectoryConfig  `json:"trajectory"`  // 机械臂平滑轨迹
+	Watchdog    WatchdogConfig    `json:"watchdog"`    // 心跳看门狗
+	Shutdown    ShutdownConfig    `json:"shutdown"`    // 退出时的安全关闭流程
+	Preflight   PreflightConfig   `json:"preflight"`   // 演奏前检查
+	Bridge      BridgeConfig      `json:"bridge"`      // CAN服务连接
+	Recorder    RecorderConfig    `json:"recorder"`    // CAN帧录制
+	Rigs        []RigConfig       `json:"rigs"`        // 工位，没有 default 时使用默认接口
+	Ensemble    EnsembleConfig    `json:"ensemble"`    // 多工位合奏
+	Clock       ClockConfig       `json:"clock"`       // 外部时钟(伴奏、MIDI时钟、时间码)
+	Calibration CalibrationConfig `json:"calibration"` // 设备延迟校准
+	Log         LogConfig         `json:"log"`         // 结构化日志
+}
+
+// 配置文件路径，可通过环境变量 PIANO_CONFIG 指定
+var appConfigPath = "config.json"
+
+var appConfig = defaultAppConfig()
+
+// 保护运行中修改的配置(工位、校准结果)和配置文件的写入
+var configMu sync.Mutex
+
+func defaultAppConfig() AppConfig {
+	return AppConfig{
+		Keyboard:    defaultKeyboardModel(),
+		Collision:   defaultCollisionConfig(),
+		Workspace:   defaultWorkspaceConfig(),
+		Trajectory:  defaultTrajectoryConfig(),
+		Watchdog:    defaultWatchdogConfig(),
+		Shutdown:    defaultShutdownConfig(),
+		Preflight:   defaultPreflightConfig(),
+		Bridge:      defaultBridgeConfig(),
+		Recorder:    defaultRecorderConfig(),
+		Ensemble:    defaultEnsembleConfig(),
+		Clock:       defaultClockConfig(),
+		Calibration: defaultCalibrationConfig(),
+		Log:         defaultLogConfig(),
+	}
+}
+
+// 读取配置文件，文件不存在时使用默认配置
+func loadAppConfig() {
+	if p := os.Getenv("PIANO_CONFIG"); p != "" {
+		appConfigPath = p
+	}
+	data, err := os.ReadFile(appConfigPath)
+	if os.IsNotExist(err) {
+		slog.Info("配置文件不存在，使用默认配置", "path", appConfigPath)
+		return
+	}
+	if err != nil {
+		slog.Error("读取配置文件失败", "path", appConfigPath, "err", err)
+		return
+	}
+	cfg := defaultAppConfig()
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		slog.Error("解析配置文件失败", "path", appConfigPath, "err", err)
+		return
+	}
+	appConfig = cfg
+}
+
+// 在 configMu 下修改配置并保存到配置文件
+func updateAppConfig(update func(cfg *AppConfig)) error {
+	configMu.Lock()
+	defer configMu.Unlock()
+	update(&appConfig)
+	return saveAppConfig()
+}
+
+// 保存当前配置到配置文件，调用方需持有 configMu
+func saveAppConfig() error {
+	data, err := json.MarshalIndent(appConfig, "", "    ")
+	if err != nil {
+		return fmt.Errorf("marshal config failed: %v", err)
+	}
+	if err := os.WriteFile(appConfigPath, data, 0644); err != nil {
+		return fmt.Errorf("write config failed: %v", err)
+	}
+	return nil
+}
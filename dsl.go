@@ -0,0 +1,433 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 文本乐谱格式，每行一条指令或一个节拍，# 之后为注释
+//
+//	default L move=1 y=19 R move=-3 y=27   预设位置
+//	dur 100                                 手指未写时长时的默认按压时长(毫秒)
+//	tempo 1.5                               速度倍率，之后的时长都除以该值
+//	L i r150 y+1 R m p y-1                  一个节拍：L/R 切换手，i/m/r/p 为食指/中指/无名指/小指，
+//	                                        可跟按压时长(毫秒)，x±N/y±N 为节拍结束后机械臂的移动
+//	. *12                                   休止(空节拍)，任意节拍行可用 *N 重复N次
+//	section A ... end                       命名段落，段落内容原地展开，之后可用 play A 重放
+//	repeat 2 ... end                        重复段落
+var dslFingerLetters = map[byte]string{'i': "index", 'm': "middle", 'r': "ring", 'p': "pinky"}
+
+// DSLError 带行列号的语法错误
+type DSLError struct {
+	Line int
+	Col  int
+	Msg  string
+}
+
+func (e *DSLError) Error() string {
+	return fmt.Sprintf("line %d, col %d: %s", e.Line, e.Col, e.Msg)
+}
+
+type dslToken struct {
+	text string
+	col  int
+}
+
+// 按空白切分一行，列号从1开始按字符计数
+func tokenizeDSLLine(line string) []dslToken {
+	if i := strings.IndexByte(line, '#'); i >= 0 {
+		line = line[:i]
+	}
+	var tokens []dslToken
+	col, start, startCol := 1, -1, 0
+	for i, r := range line {
+		if r == ' ' || r == '\t' || r == '\r' {
+			if start >= 0 {
+				tokens = append(tokens, dslToken{line[start:i], startCol})
+				start = -1
+			}
+		} else if start < 0 {
+			start, startCol = i, col
+		}
+		col++
+	}
+	if start >= 0 {
+		tokens = append(tokens, dslToken{line[start:], startCol})
+	}
+	return tokens
+}
+
+type dslBlock struct {
+	kind  string // root, section, repeat
+	name  string
+	count int
+	line  int
+	steps []MusicNote
+}
+
+// 把文本乐谱编译为MusicData
+func compileDSL(src string) (MusicData, error) {
+	var data MusicData
+	dur, tempo := 100.0, 1.0
+	sections := map[string][]MusicNote{}
+	stack := []*dslBlock{{kind: "root"}}
+
+	for n, line := range strings.Split(src, "\n") {
+		lineNo := n + 1
+		tokens := tokenizeDSLLine(line)
+		if len(tokens) == 0 {
+			continue
+		}
+		errAt := func(t dslToken, format string, args ...interface{}) error {
+			return &DSLError{lineNo, t.col, fmt.Sprintf(format, args...)}
+		}
+		top := stack[len(stack)-1]
+		head := tokens[0]
+		switch head.text {
+		case "dur", "tempo":
+			if len(tokens) != 2 {
+				return data, errAt(head, "%s expects one number", head.text)
+			}
+			v, err := strconv.ParseFloat(tokens[1].text, 64)
+			if err != nil || v <= 0 {
+				return data, errAt(tokens[1], "invalid %s %q", head.text, tokens[1].text)
+			}
+			if head.text == "dur" {
+				dur = v
+			} else {
+				tempo = v
+			}
+		case "default":
+			if err := parseDSLDefault(tokens, &data, errAt); err != nil {
+				return data, err
+			}
+		case "section", "play":
+			if len(tokens) != 2 {
+				return data, errAt(head, "%s expects a name", head.text)
+			}
+			name := tokens[1].text
+			if head.text == "play" {
+				steps, ok := sections[name]
+				if !ok {
+					return data, errAt(tokens[1], "unknown section %q", name)
+				}
+				top.steps = append(top.steps, steps...)
+				continue
+			}
+			if _, ok := sections[name]; ok {
+				return data, errAt(tokens[1], "section %q already defined", name)
+			}
+			stack = append(stack, &dslBlock{kind: "section", name: name, line: lineNo})
+		case "repeat":
+			if len(tokens) != 2 {
+				return data, errAt(head, "repeat expects a count")
+			}
+			count, err := strconv.Atoi(tokens[1].text)
+			if err != nil || count < 1 {
+				return data, errAt(tokens[1], "invalid repeat count %q", tokens[1].text)
+			}
+			stack = append(stack, &dslBlock{kind: "repeat", count: count, line: lineNo})
+		case "end":
+			if len(tokens) != 1 {
+				return data, errAt(tokens[1], "unexpected %q after end", tokens[1].text)
+			}
+			if top.kind == "root" {
+				return data, errAt(head, "end without section or repeat")
+			}
+			stack = stack[:len(stack)-1]
+			parent := stack[len(stack)-1]
+			if top.kind == "section" {
+				sections[top.name] = top.steps
+				parent.steps = append(parent.steps, top.steps...)
+			} else {
+				for i := 0; i < top.count; i++ {
+					parent.steps = append(parent.steps, top.steps...)
+				}
+			}
+		default:
+			steps, err := parseDSLStep(tokens, dur, tempo, errAt)
+			if err != nil {
+				return data, err
+			}
+			top.steps = append(top.steps, steps...)
+		}
+	}
+	if len(stack) > 1 {
+		open := stack[len(stack)-1]
+		return data, &DSLError{open.line, 1, fmt.Sprintf("%s not closed with end", open.kind)}
+	}
+
+	data.Music = stack[0].steps
+	for i := range data.Music {
+		data.Music[i].Index = i
+	}
+	return data, nil
+}
+
+// default L move=1 y=19 R move=-3 y=27
+func parseDSLDefault(tokens []dslToken, data *MusicData, errAt func(dslToken, string, ...interface{}) error) error {
+	var pos *ArmPosition
+	for _, t := range tokens[1:] {
+		switch t.text {
+		case "L":
+			pos = &data.DefaultPosition.Left
+			continue
+		case "R":
+			pos = &data.DefaultPosition.Right
+			continue
+		}
+		if pos == nil {
+			return errAt(t, "expected L or R before %q", t.text)
+		}
+		key, value, ok := strings.Cut(t.text, "=")
+		v, err := strconv.Atoi(value)
+		if !ok || err != nil {
+			return errAt(t, "expected key=integer, got %q", t.text)
+		}
+		switch key {
+		case "move":
+			pos.Move = v
+		case "x":
+			pos.X = v
+		case "y":
+			pos.Y = v
+		case "z":
+			pos.Z = v
+		default:
+			return errAt(t, "unknown default field %q", key)
+		}
+	}
+	return nil
+}
+
+// L i r150 y+1 R m p y-1 *2
+func parseDSLStep(tokens []dslToken, dur, tempo float64, errAt func(dslToken, string, ...interface{}) error) ([]MusicNote, error) {
+	note := MusicNote{
+		Left:  HandAction{Fingers: []string{}, Time: []float64{}},
+		Right: HandAction{Fingers: []string{}, Time: []float64{}},
+	}
+	count := 1
+	if last := tokens[len(tokens)-1]; strings.HasPrefix(last.text, "*") {
+		c, err := strconv.Atoi(last.text[1:])
+		if err != nil || c < 1 {
+			return nil, errAt(last, "invalid step count %q", last.text)
+		}
+		count = c
+		tokens = tokens[:len(tokens)-1]
+	}
+	if len(tokens) == 1 && tokens[0].text == "." {
+		return repeatStep(note, count), nil
+	}
+
+	var action *HandAction
+	for _, t := range tokens {
+		switch t.text {
+		case "L":
+			action = &note.Left
+			continue
+		case "R":
+			action = &note.Right
+			continue
+		}
+		if action == nil {
+			return nil, errAt(t, "expected L, R or . at start of step, got %q", t.text)
+		}
+		c := t.text[0]
+		switch {
+		case c == 'x' || c == 'y':
+			v, err := strconv.Atoi(t.text[1:])
+			if err != nil {
+				return nil, errAt(t, "invalid arm shift %q", t.text)
+			}
+			if c == 'x' {
+				action.Move.X += v
+			} else {
+				action.Move.Y += v
+			}
+		case dslFingerLetters[c] != "":
+			d := dur
+			if len(t.text) > 1 {
+				v, err := strconv.ParseFloat(t.text[1:], 64)
+				if err != nil || v < 0 {
+					return nil, errAt(t, "invalid duration in %q", t.text)
+				}
+				d = v
+			}
+			action.Fingers = append(action.Fingers, dslFingerLetters[c])
+			action.Time = append(action.Time, d/1000/tempo)
+		default:
+			r, _ := utf8.DecodeRuneInString(t.text)
+			return nil, errAt(t, "unknown finger or shift %q", string(r))
+		}
+	}
+	return repeatStep(note, count), nil
+}
+
+func repeatStep(note MusicNote, count int) []MusicNote {
+	steps := make([]MusicNote, count)
+	for i := range steps {
+		steps[i] = note
+	}
+	return steps
+}
+
+// 把MusicData反编译为文本乐谱，相同的连续节拍合并为 *N；乐谱不合法(如未知手指)时返回错误
+func decompileDSL(data MusicData, w io.Writer) error {
+	if err := validateMusicData(data); err != nil {
+		return err
+	}
+	var b strings.Builder
+	var def []string
+	for _, side := range []struct {
+		name string
+		pos  ArmPosition
+	}{{"L", data.DefaultPosition.Left}, {"R", data.DefaultPosition.Right}} {
+		if side.pos == (ArmPosition{}) {
+			continue
+		}
+		def = append(def, side.name)
+		for _, f := range []struct {
+			key string
+			v   int
+		}{{"move", side.pos.Move}, {"x", side.pos.X}, {"y", side.pos.Y}, {"z", side.pos.Z}} {
+			if f.v != 0 {
+				def = append(def, fmt.Sprintf("%s=%d", f.key, f.v))
+			}
+		}
+	}
+	if len(def) > 0 {
+		fmt.Fprintf(&b, "default %s\n", strings.Join(def, " "))
+	}
+
+	// 最常用的时长作为默认时长
+	counts := map[string]int{}
+	for _, note := range data.Music {
+		for _, t := range append(append([]float64{}, note.Left.Time...), note.Right.Time...) {
+			counts[formatDSLMillis(t)]++
+		}
+	}
+	dur := "100"
+	keys := make([]string, 0, len(counts))
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if counts[k] > counts[dur] {
+			dur = k
+		}
+	}
+	fmt.Fprintf(&b, "dur %s\n", dur)
+
+	var prev string
+	run := 0
+	flush := func() {
+		if run == 1 {
+			b.WriteString(prev + "\n")
+		} else if run > 1 {
+			fmt.Fprintf(&b, "%s *%d\n", prev, run)
+		}
+	}
+	for _, note := range data.Music {
+		line := formatDSLStep(note, dur)
+		if line == prev {
+			run++
+			continue
+		}
+		flush()
+		prev, run = line, 1
+	}
+	flush()
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func formatDSLStep(note MusicNote, dur string) string {
+	var parts []string
+	for _, side := range []struct {
+		name   string
+		action HandAction
+	}{{"L", note.Left}, {"R", note.Right}} {
+		a := side.action
+		if len(a.Fingers) == 0 && a.Move == (ArmMovement{}) {
+			continue
+		}
+		parts = append(parts, side.name)
+		for i, f := range a.Fingers {
+			token := f[:1]
+			if i < len(a.Time) {
+				if ms := formatDSLMillis(a.Time[i]); ms != dur {
+					token += ms
+				}
+			}
+			parts = append(parts, token)
+		}
+		if a.Move.X != 0 {
+			parts = append(parts, fmt.Sprintf("x%+d", a.Move.X))
+		}
+		if a.Move.Y != 0 {
+			parts = append(parts, fmt.Sprintf("y%+d", a.Move.Y))
+		}
+	}
+	if len(parts) == 0 {
+		return "."
+	}
+	return strings.Join(parts, " ")
+}
+
+// 秒转毫秒文本，去掉浮点误差
+func formatDSLMillis(sec float64) string {
+	ms := math.Round(sec*1e9) / 1e6
+	return strconv.FormatFloat(ms, 'f', -1, 64)
+}
+
+// 文本乐谱编译为MusicData，请求体为文本
+func compileDSLHandler(c *gin.Context) {
+	src, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+		return
+	}
+	data, err := compileDSL(string(src))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"musicData": data})
+}
+
+// MusicData反编译为文本乐谱
+func decompileDSLHandler(c *gin.Context) {
+	var data MusicData
+	if err := c.ShouldBindJSON(&data); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+		return
+	}
+	if err := validateMusicData(data); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.Status(http.StatusOK)
+	c.Header("Content-Type", "text/plain; charset=utf-8")
+	decompileDSL(data, c.Writer)
+}
+
+// 以文本乐谱格式获取乐谱库中的乐谱
+func scoreDSLHandler(c *gin.Context) {
+	_, data, err := scoreStore.Get(c.Param("id"))
+	if err != nil {
+		c.JSON(scoreErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.Status(http.StatusOK)
+	c.Header("Content-Type", "text/plain; charset=utf-8")
+	decompileDSL(data, c.Writer)
+}
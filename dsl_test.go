@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 两份乐谱的节拍相同，按压时长允许反编译时的舍入误差
+func sameMusic(t *testing.T, got, want MusicData) {
+	t.Helper()
+	if got.DefaultPosition != want.DefaultPosition {
+		t.Fatalf("default position: got %+v, want %+v", got.DefaultPosition, want.DefaultPosition)
+	}
+	if len(got.Music) != len(want.Music) {
+		t.Fatalf("got %d steps, want %d", len(got.Music), len(want.Music))
+	}
+	for i := range want.Music {
+		g, w := got.Music[i], want.Music[i]
+		if g.Index != w.Index {
+			t.Fatalf("step %d: index %d, want %d", i, g.Index, w.Index)
+		}
+		for _, side := range []struct {
+			name string
+			g, w HandAction
+		}{{"left", g.Left, w.Left}, {"right", g.Right, w.Right}} {
+			if side.g.Move != side.w.Move || strings.Join(side.g.Fingers, ",") != strings.Join(side.w.Fingers, ",") || len(side.g.Time) != len(side.w.Time) {
+				t.Fatalf("step %d %s: got %+v, want %+v", i, side.name, side.g, side.w)
+			}
+			for j := range side.w.Time {
+				if math.Abs(side.g.Time[j]-side.w.Time[j]) > 1e-6 {
+					t.Fatalf("step %d %s time %d: got %v, want %v", i, side.name, j, side.g.Time[j], side.w.Time[j])
+				}
+			}
+		}
+	}
+}
+
+// 编译、反编译再编译，节拍不变；反编译的结果再反编译不变
+func TestDSLRoundTrip(t *testing.T) {
+	tests := []struct {
+		name  string
+		src   string
+		steps int
+	}{
+		{"single step", "L i", 1},
+		{"both hands with moves", "L i m150 y+1 R r p x-2 y-1", 1},
+		{"default position", "default L move=1 y=19 R move=-3 y=27\nR i\n. *3\nL p200", 5},
+		{"dur and tempo", "dur 250\nL i\ntempo 1.5\nL i r120 R m\n", 2},
+		{"rests and repeats", "L i\n. *2\nrepeat 3\n  R m y+1\n  R m y-1\nend\n", 9},
+		{"sections", "section A\n  L i\n  R p\nend\nplay A\n. *4\nplay A\n", 10},
+		{"comments", "# 开头\nL i # 食指\n\nR m\n", 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := compileDSL(tt.src)
+			if err != nil {
+				t.Fatalf("compile: %v", err)
+			}
+			if len(data.Music) != tt.steps {
+				t.Fatalf("got %d steps, want %d", len(data.Music), tt.steps)
+			}
+			var first strings.Builder
+			if err := decompileDSL(data, &first); err != nil {
+				t.Fatalf("decompile: %v", err)
+			}
+			again, err := compileDSL(first.String())
+			if err != nil {
+				t.Fatalf("compile decompiled %q: %v", first.String(), err)
+			}
+			sameMusic(t, again, data)
+			var second strings.Builder
+			if err := decompileDSL(again, &second); err != nil {
+				t.Fatalf("decompile again: %v", err)
+			}
+			if second.String() != first.String() {
+				t.Errorf("decompile not stable:\n%s\n---\n%s", first.String(), second.String())
+			}
+		})
+	}
+}
+
+func TestDSLErrors(t *testing.T) {
+	tests := []struct {
+		name      string
+		src       string
+		line, col int
+	}{
+		{"unknown finger", "L i\nR q", 2, 3},
+		{"step without hand", "i m", 1, 1},
+		{"bad repeat count", "repeat 0\nL i\nend", 1, 8},
+		{"unclosed section", "L i\nsection A\nL i", 2, 1},
+		{"unknown section", "play B", 1, 6},
+		{"end without block", "L i\nend", 2, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := compileDSL(tt.src)
+			dslErr, ok := err.(*DSLError)
+			if !ok {
+				t.Fatalf("got %v, want a DSLError", err)
+			}
+			if dslErr.Line != tt.line || dslErr.Col != tt.col {
+				t.Errorf("got line %d col %d (%s), want line %d col %d", dslErr.Line, dslErr.Col, dslErr.Msg, tt.line, tt.col)
+			}
+		})
+	}
+}
+
+// 不合法的乐谱不反编译，接口返回400
+func TestDecompileDSLInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{"empty finger", `{"music":[{"left":{"fingers":[""],"time":[0.2]}}]}`, `unknown finger ""`},
+		{"unknown finger", `{"music":[{"right":{"fingers":["thumb"],"time":[0.2]}}]}`, `unknown finger "thumb"`},
+		{"missing time", `{"music":[{"left":{"fingers":["index"]}}]}`, "1 fingers but 0 times"},
+		{"no music", `{}`, "no music"},
+	}
+	gin.SetMode(gin.TestMode)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var data MusicData
+			if err := json.Unmarshal([]byte(tt.body), &data); err != nil {
+				t.Fatal(err)
+			}
+			var src strings.Builder
+			if err := decompileDSL(data, &src); err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("decompile: got %v, want %q", err, tt.want)
+			}
+
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest(http.MethodPost, "/api/dsl/decompile", strings.NewReader(tt.body))
+			decompileDSLHandler(c)
+			var resp struct{ Error string }
+			json.Unmarshal(w.Body.Bytes(), &resp)
+			if w.Code != http.StatusBadRequest || !strings.Contains(resp.Error, tt.want) {
+				t.Errorf("handler: status %d %q, want 400 %q", w.Code, resp.Error, tt.want)
+			}
+		})
+	}
+}
+
+// 自带的乐谱反编译再编译，节拍不变
+func TestDSLBundledScores(t *testing.T) {
+	files, err := filepath.Glob("json/*.json")
+	if err != nil || len(files) == 0 {
+		t.Fatalf("no bundled scores: %v", err)
+	}
+	for _, file := range files {
+		t.Run(filepath.Base(file), func(t *testing.T) {
+			raw, err := os.ReadFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var data MusicData
+			if err := json.Unmarshal(raw, &data); err != nil {
+				t.Fatal(err)
+			}
+			var src strings.Builder
+			if err := decompileDSL(data, &src); err != nil {
+				t.Fatalf("decompile: %v", err)
+			}
+			again, err := compileDSL(src.String())
+			if err != nil {
+				t.Fatalf("compile decompiled score: %v", err)
+			}
+			sameMusic(t, again, data)
+		})
+	}
+}
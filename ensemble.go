@@ -0,0 +1,643 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// EnsembleConfig 多工位合奏配置
+type EnsembleConfig struct {
+	Dir            string  `json:"dir"`            // 合奏乐谱保存目录
+	LeadIn         float64 `json:"leadIn"`         // 所有声部就绪后到公共起点的时间(秒)
+	DriftTolerance float64 `json:"driftTolerance"` // 声部落后公共时间轴超过该值(秒)时校正
+	Correct        bool    `json:"correct"`        // 是否校正：落后的声部拉动公共时间轴，其他工位等待
+}
+
+func defaultEnsembleConfig() EnsembleConfig {
+	return EnsembleConfig{Dir: "ensembles", LeadIn: 1, DriftTolerance: 0.03, Correct: true}
+}
+
+// EnsemblePart 合奏中的一个声部，由一个工位演奏
+type EnsemblePart struct {
+	Name       string        `json:"name"`
+	Rig        string        `json:"rig"`
+	ScoreID    string        `json:"scoreId,omitempty"`   // 乐谱库中的乐谱ID，设置后忽略 musicData
+	MusicData  *MusicData    `json:"musicData,omitempty"` // 内联乐谱
+	Interfaces RigInterfaces `json:"interfaces"`          // 为空的接口使用工位当前的绑定
+	Offset     float64       `json:"offset"`              // 声部在公共时间轴上的起始时间(秒，原速)
+}
+
+// EnsembleScore 合奏乐谱：把声部分配给工位，所有声部共用一条时间轴
+type EnsembleScore struct {
+	ID    string         `json:"id"`
+	Name  string         `json:"name"`
+	Tempo float64        `json:"tempo"` // 速度倍率，所有声部相同
+	Parts []EnsemblePart `json:"parts"`
+}
+
+// 合奏状态，结束状态与演奏任务相同
+const (
+	ensemblePreparing = "preparing" // 移动到预设位置，等待所有声部就绪
+)
+
+// 演奏中的声部
+type ensemblePart struct {
+	EnsemblePart
+	rig         *Rig
+	data        MusicData
+	onsets      []float64
+	ready, done bool
+	err         error
+	step        int           // 已开始的节拍，-1 表示还没有开始
+	lateness    time.Duration // 最近一个节拍开始时落后公共时间轴的时间
+	maxLateness time.Duration
+	heldFor     int // 其他工位已经在等待的节拍，只记录一次日志
+}
+
+// Ensemble 一次合奏，同一时间只有一个
+type Ensemble struct {
+	mu          sync.Mutex
+	id          string
+	score       EnsembleScore
+	parts       []*ensemblePart
+	state       string
+	start       time.Time     // 公共时间轴起点(单调时钟)
+	offset      time.Duration // 暂停和校正累计的时间轴偏移
+	pausedAt    time.Time
+	corrections int
+	aborting    bool
+}
+
+var ensembleMu sync.Mutex
+var currentEnsemble *Ensemble
+
+func ensemblePath(id string) string {
+	return filepath.Join(appConfig.Ensemble.Dir, id+".json")
+}
+
+func loadEnsembleScore(id string) (EnsembleScore, error) {
+	var score EnsembleScore
+	if !validScoreID(id) {
+		return score, invalidScore("invalid ensemble id")
+	}
+	data, err := os.ReadFile(ensemblePath(id))
+	if os.IsNotExist(err) {
+		return score, errScoreNotFound
+	}
+	if err != nil {
+		return score, fmt.Errorf("read ensemble failed: %v", err)
+	}
+	if err := json.Unmarshal(data, &score); err != nil {
+		return score, fmt.Errorf("parse ensemble failed: %v", err)
+	}
+	score.ID = id
+	return score, nil
+}
+
+func saveEnsembleScore(score EnsembleScore) error {
+	if err := os.MkdirAll(appConfig.Ensemble.Dir, 0755); err != nil {
+		return fmt.Errorf("create ensemble dir failed: %v", err)
+	}
+	data, err := json.MarshalIndent(score, "", "    ")
+	if err != nil {
+		return fmt.Errorf("marshal ensemble failed: %v", err)
+	}
+	if err := os.WriteFile(ensemblePath(score.ID), data, 0644); err != nil {
+		return fmt.Errorf("write ensemble failed: %v", err)
+	}
+	return nil
+}
+
+// 检查合奏乐谱：每个声部对应一个不同的已有工位，乐谱合法
+func (s EnsembleScore) resolve() ([]*ensemblePart, error) {
+	if len(s.Parts) == 0 {
+		return nil, fmt.Errorf("ensemble has no parts")
+	}
+	seen := map[string]string{}
+	var parts []*ensemblePart
+	for i, p := range s.Parts {
+		name := p.Name
+		if name == "" {
+			name = fmt.Sprintf("parts[%d]", i)
+		}
+		rig := getRig(p.Rig)
+		if rig == nil {
+			return nil, fmt.Errorf("%s: rig %q not found", name, p.Rig)
+		}
+		if other, ok := seen[p.Rig]; ok {
+			return nil, fmt.Errorf("%s and %s both use rig %s", other, name, p.Rig)
+		}
+		seen[p.Rig] = name
+		if p.Offset < 0 {
+			return nil, fmt.Errorf("%s: negative offset", name)
+		}
+		var data MusicData
+		switch {
+		case p.ScoreID != "":
+			_, d, err := scoreStore.Get(p.ScoreID)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", name, err)
+			}
+			data = d
+		case p.MusicData != nil:
+			data = *p.MusicData
+		default:
+			return nil, fmt.Errorf("%s: scoreId or musicData is required", name)
+		}
+		if err := validateMusicData(data); err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		p.Name = name
+		parts = append(parts, &ensemblePart{EnsemblePart: p, rig: rig, data: data, step: -1, heldFor: -1})
+	}
+	return parts, nil
+}
+
+// 声部第i个节拍在公共时间轴上的时刻，调用方持有锁
+func (e *Ensemble) due(p *ensemblePart, i int) time.Time {
+	at := (p.Offset/e.score.Tempo + p.onsets[i]) * float64(time.Second)
+	return e.start.Add(e.offset + time.Duration(at))
+}
+
+// 声部就绪后等待其他声部，全部就绪时确定公共起点
+func (e *Ensemble) arrive(p *ensemblePart) error {
+	e.mu.Lock()
+	p.ready = true
+	all := true
+	for _, other := range e.parts {
+		all = all && other.ready
+	}
+	if all && e.start.IsZero() {
+		e.start = time.Now().Add(time.Duration(appConfig.Ensemble.LeadIn * float64(time.Second)))
+		e.state = jobRunning
+		slog.Info("合奏所有声部就绪", "ensemble", e.id, "leadIn", appConfig.Ensemble.LeadIn)
+	}
+	e.mu.Unlock()
+	for {
+		if p.rig.killPiano.Load() {
+			return errPlaybackKilled
+		}
+		e.mu.Lock()
+		started := !e.start.IsZero()
+		e.mu.Unlock()
+		if started {
+			return nil
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// 声部当前落后公共时间轴的时间：下一个节拍已经到时但还没有开始，调用方持有锁
+func (e *Ensemble) lag(p *ensemblePart, now time.Time) time.Duration {
+	if !p.ready || p.done || p.step+1 >= len(p.onsets) {
+		return 0
+	}
+	return max(now.Sub(e.due(p, p.step+1)), 0)
+}
+
+// 其他声部落后超过容差时把公共时间轴后移，本声部等待；返回是否后移
+func (e *Ensemble) holdForLaggards(p *ensemblePart) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	cfg := appConfig.Ensemble
+	if !cfg.Correct {
+		return false
+	}
+	now := time.Now()
+	var worst time.Duration
+	var laggard *ensemblePart
+	for _, other := range e.parts {
+		if lag := e.lag(other, now); other != p && lag > worst {
+			worst, laggard = lag, other
+		}
+	}
+	if worst <= time.Duration(cfg.DriftTolerance*float64(time.Second)) {
+		return false
+	}
+	e.offset += worst
+	e.corrections++
+	if laggard.heldFor != laggard.step+1 {
+		laggard.heldFor = laggard.step + 1
+		p.rig.logger().Warn("合奏声部落后，其他工位等待", "ensemble", e.id, "part", laggard.Name, "note", laggard.step+1, "lag", worst.Seconds())
+	}
+	return true
+}
+
+// 记录声部落后公共时间轴的时间，超过容差时把时间轴整体后移，其他工位等待该声部
+func (e *Ensemble) observe(p *ensemblePart, i int, late time.Duration) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	p.step, p.lateness = i, late
+	metricLateness.observe(late.Seconds(), p.rig.ID, "ensemble")
+	if late > p.maxLateness {
+		p.maxLateness = late
+	}
+	cfg := appConfig.Ensemble
+	if cfg.Correct && late > time.Duration(cfg.DriftTolerance*float64(time.Second)) {
+		e.offset += late
+		e.corrections++
+		p.rig.logger().Warn("合奏声部落后，公共时间轴后移", "ensemble", e.id, "part", p.Name, "note", i, "late", late.Seconds())
+	}
+}
+
+// 声部结束；出错或被终止时终止其他声部
+func (e *Ensemble) partDone(p *ensemblePart, err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	p.done, p.err = true, err
+	if err != nil && !e.aborting {
+		e.aborting = true
+		p.rig.logger().Error("合奏声部结束，终止其他声部", "ensemble", e.id, "part", p.Name, "err", err)
+		for _, other := range e.parts {
+			if other != p {
+				other.rig.killPlayback()
+			}
+		}
+	}
+	state := jobFinished
+	for _, other := range e.parts {
+		switch {
+		case !other.done:
+			return
+		case other.err == errPlaybackKilled && state == jobFinished:
+			state = jobKilled
+		case other.err != nil && other.err != errPlaybackKilled:
+			state = jobFailed
+		}
+	}
+	e.state = state
+	slog.Info("合奏结束", "ensemble", e.id, "state", state)
+}
+
+func (e *Ensemble) playPart(p *ensemblePart) error {
+	p.rig.bindInterfaces(PianoConfig{Interfaces: p.Interfaces})
+	if err := p.rig.prepareScore(p.data); err != nil {
+		return err
+	}
+	if err := e.arrive(p); err != nil {
+		return err
+	}
+	return p.rig.playmusic(p.data.Music, e.score.Tempo, &ensembleClock{e, p})
+}
+
+// ensembleClock 按公共时间轴开始每个节拍
+type ensembleClock struct {
+	ens  *Ensemble
+	part *ensemblePart
+}
+
+func (c *ensembleClock) waitStep(i int, lead time.Duration) error {
+	e, p := c.ens, c.part
+	for {
+		if p.rig.killPiano.Load() {
+			return errPlaybackKilled
+		}
+		// 单个工位被暂停(界面或看门狗)时暂停整个合奏
+		if p.rig.stopPiano.Load() {
+			e.pauseFrom(p)
+			if err := p.rig.waitPlaybackResume(); err != nil {
+				return err
+			}
+		}
+		e.mu.Lock()
+		due := e.due(p, i).Add(-lead)
+		e.mu.Unlock()
+		wait := time.Until(due)
+		if wait <= 0 {
+			if e.holdForLaggards(p) {
+				continue
+			}
+			e.observe(p, i, -wait)
+			return nil
+		}
+		time.Sleep(min(wait, 20*time.Millisecond))
+	}
+}
+
+// 暂停所有声部，恢复时公共时间轴后移暂停的时长
+func (e *Ensemble) pause() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.pauseLocked()
+}
+
+// 声部所在工位被单独暂停时暂停整个合奏；在锁内重新检查，避免和恢复同时发生时再次暂停
+func (e *Ensemble) pauseFrom(p *ensemblePart) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if p.rig.stopPiano.Load() {
+		e.pauseLocked()
+	}
+}
+
+func (e *Ensemble) pauseLocked() bool {
+	if e.state != jobRunning {
+		return false
+	}
+	e.state, e.pausedAt = jobPaused, time.Now()
+	for _, p := range e.parts {
+		p.rig.pausePlayback()
+	}
+	return true
+}
+
+func (e *Ensemble) resume() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.state != jobPaused {
+		return false
+	}
+	e.offset += time.Since(e.pausedAt)
+	e.state = jobRunning
+	for _, p := range e.parts {
+		p.rig.resumePlayback()
+	}
+	return true
+}
+
+func (e *Ensemble) kill() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, p := range e.parts {
+		p.rig.killPlayback()
+	}
+}
+
+func (e *Ensemble) active() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.state == ensemblePreparing || e.state == jobRunning || e.state == jobPaused
+}
+
+// 合奏状态：每个声部的任务、进度和落后时间，声部之间的最大偏差
+func (e *Ensemble) status() gin.H {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	parts := []gin.H{}
+	var minLag, maxLag time.Duration
+	running := 0
+	now := time.Now()
+	if e.state == jobPaused {
+		now = e.pausedAt
+	}
+	for _, p := range e.parts {
+		lag := e.lag(p, now)
+		parts = append(parts, gin.H{
+			"name":        p.Name,
+			"rig":         p.rig.ID,
+			"job":         p.rig.currentPlaybackJob(),
+			"step":        p.step,
+			"total":       len(p.data.Music),
+			"lag":         lag.Seconds(),
+			"lateness":    p.lateness.Seconds(),
+			"maxLateness": p.maxLateness.Seconds(),
+		})
+		if p.done || !p.ready {
+			continue
+		}
+		if running == 0 || lag < minLag {
+			minLag = lag
+		}
+		if running == 0 || lag > maxLag {
+			maxLag = lag
+		}
+		running++
+	}
+	resp := gin.H{
+		"id":          e.id,
+		"score":       e.score.ID,
+		"state":       e.state,
+		"parts":       parts,
+		"drift":       (maxLag - minLag).Seconds(), // 声部之间当前落后时间的最大差
+		"offset":      e.offset.Seconds(),
+		"corrections": e.corrections,
+	}
+	// 公共时间轴上的当前位置，暂停时停在暂停时刻
+	if !e.start.IsZero() {
+		resp["position"] = now.Sub(e.start.Add(e.offset)).Seconds()
+	}
+	return resp
+}
+
+// 开始合奏：检查所有工位空闲，每个声部作为所在工位的演奏任务启动
+func startEnsemble(score EnsembleScore, parts []*ensemblePart) (*Ensemble, error) {
+	ensembleMu.Lock()
+	defer ensembleMu.Unlock()
+	if currentEnsemble != nil && currentEnsemble.active() {
+		return nil, fmt.Errorf("ensemble %s is still running", currentEnsemble.id)
+	}
+	for _, p := range parts {
+		if p.rig.jobActive() {
+			return nil, fmt.Errorf("rig %s is playing", p.rig.ID)
+		}
+		if err := interfaceConflict(p.rig.ID, p.rig.effectiveInterfaces(PianoConfig{Interfaces: p.Interfaces})); err != nil {
+			return nil, fmt.Errorf("%s: %v", p.Name, err)
+		}
+		p.onsets = musicTimeline(p.data.Music, score.Tempo)
+	}
+	e := &Ensemble{
+		id:    fmt.Sprintf("ensemble-%d", time.Now().UnixMilli()),
+		score: score,
+		parts: parts,
+		state: ensemblePreparing,
+	}
+	for i, p := range parts {
+		p := p
+		_, err := p.rig.startPlaybackJob("ensemble:"+p.Name, func() error {
+			err := e.playPart(p)
+			e.partDone(p, err)
+			return err
+		})
+		if err != nil {
+			// 已经启动的声部终止
+			for _, started := range parts[:i] {
+				started.rig.killPlayback()
+			}
+			return nil, fmt.Errorf("%s: %v", p.Name, err)
+		}
+	}
+	currentEnsemble = e
+	return e, nil
+}
+
+func getEnsemble() *Ensemble {
+	ensembleMu.Lock()
+	defer ensembleMu.Unlock()
+	return currentEnsemble
+}
+
+func listEnsemblesHandler(c *gin.Context) {
+	entries, err := os.ReadDir(appConfig.Ensemble.Dir)
+	if err != nil && !os.IsNotExist(err) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	list := []gin.H{}
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok || entry.IsDir() {
+			continue
+		}
+		score, err := loadEnsembleScore(id)
+		if err != nil {
+			continue
+		}
+		rigs := []string{}
+		for _, p := range score.Parts {
+			rigs = append(rigs, p.Rig)
+		}
+		list = append(list, gin.H{"id": id, "name": score.Name, "parts": len(score.Parts), "rigs": rigs})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i]["id"].(string) < list[j]["id"].(string) })
+	c.JSON(http.StatusOK, gin.H{"ensembles": list})
+}
+
+func getEnsembleHandler(c *gin.Context) {
+	score, err := loadEnsembleScore(c.Param("id"))
+	if err != nil {
+		c.JSON(scoreErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, score)
+}
+
+// 保存合奏乐谱，声部引用的工位和乐谱必须存在
+func saveEnsembleHandler(c *gin.Context) {
+	var score EnsembleScore
+	if err := c.ShouldBindJSON(&score); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+		return
+	}
+	score.ID = c.Param("id")
+	if !validScoreID(score.ID) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid ensemble id"})
+		return
+	}
+	if _, err := score.resolve(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := saveEnsembleScore(score); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "success", "ensemble": score})
+}
+
+func deleteEnsembleHandler(c *gin.Context) {
+	id := c.Param("id")
+	if _, err := loadEnsembleScore(id); err != nil {
+		c.JSON(scoreErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	if err := os.Remove(ensemblePath(id)); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "success"})
+}
+
+// 开始合奏，请求体为 {"id": 已保存的合奏乐谱} 或 {"ensemble": 合奏乐谱}，可选 tempo 覆盖速度
+func startEnsembleHandler(c *gin.Context) {
+	var req struct {
+		ID       string         `json:"id"`
+		Ensemble *EnsembleScore `json:"ensemble"`
+		Tempo    float64        `json:"tempo"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+		return
+	}
+	var score EnsembleScore
+	switch {
+	case req.ID != "":
+		s, err := loadEnsembleScore(req.ID)
+		if err != nil {
+			c.JSON(scoreErrorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		score = s
+	case req.Ensemble != nil:
+		score = *req.Ensemble
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "id or ensemble is required"})
+		return
+	}
+	if req.Tempo > 0 {
+		score.Tempo = req.Tempo
+	}
+	if score.Tempo <= 0 {
+		score.Tempo = 1
+	}
+	parts, err := score.resolve()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	// 自动检查每个声部所在的工位
+	if appConfig.Preflight.OnStart {
+		reports := gin.H{}
+		ok := true
+		for _, p := range parts {
+			report := runPreflight(p.rig, PianoConfig{Interfaces: p.Interfaces}, map[string]MusicData{p.Name: p.data})
+			reports[p.Name] = report
+			ok = ok && report.OK
+		}
+		if !ok {
+			slog.Warn("合奏演奏前检查失败", "reports", reports)
+			c.JSON(http.StatusPreconditionFailed, gin.H{"error": "preflight failed", "preflight": reports})
+			return
+		}
+	}
+	e, err := startEnsemble(score, parts)
+	if err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "success", "ensemble": e.status()})
+}
+
+// 合奏的暂停、恢复和终止作用于所有声部
+func ensembleControlHandler(action string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		e := getEnsemble()
+		if e == nil || !e.active() {
+			c.JSON(http.StatusConflict, gin.H{"error": "no ensemble is playing"})
+			return
+		}
+		ok := true
+		switch action {
+		case "stop":
+			ok = e.pause()
+		case "resume":
+			ok = e.resume()
+		case "kill":
+			e.kill()
+		}
+		if !ok {
+			c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("cannot %s ensemble in state %s", action, e.status()["state"])})
+			return
+		}
+		slog.Info("合奏控制", "action", action)
+		c.JSON(http.StatusOK, gin.H{"status": "success"})
+	}
+}
+
+func ensembleStatusHandler(c *gin.Context) {
+	e := getEnsemble()
+	if e == nil {
+		c.JSON(http.StatusOK, gin.H{"ensemble": nil})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"ensemble": e.status()})
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// 两个声部的合奏，公共时间轴在start开始，每个声部每秒一个节拍
+func testEnsemble(start time.Time) (*Ensemble, *ensemblePart, *ensemblePart) {
+	a := &ensemblePart{EnsemblePart: EnsemblePart{Name: "a"}, rig: newRig(RigConfig{ID: "a"}), onsets: []float64{0, 1, 2, 3}, ready: true, step: -1, heldFor: -1}
+	b := &ensemblePart{EnsemblePart: EnsemblePart{Name: "b"}, rig: newRig(RigConfig{ID: "b"}), onsets: []float64{0, 1, 2, 3}, ready: true, step: -1, heldFor: -1}
+	e := &Ensemble{id: "test", score: EnsembleScore{Tempo: 1}, parts: []*ensemblePart{a, b}, start: start}
+	return e, a, b
+}
+
+func useEnsembleConfig(t *testing.T, cfg EnsembleConfig) {
+	saved := appConfig.Ensemble
+	t.Cleanup(func() { appConfig.Ensemble = saved })
+	appConfig.Ensemble = cfg
+}
+
+func TestEnsembleDue(t *testing.T) {
+	start := time.Now()
+	e, a, _ := testEnsemble(start)
+	e.score.Tempo = 2
+	a.Offset = 4
+	e.offset = 300 * time.Millisecond
+	// 声部偏移按速度缩放，节拍起始时间已经是实际时间
+	if got, want := e.due(a, 1).Sub(start), 3300*time.Millisecond; got != want {
+		t.Errorf("due = %v, want %v", got, want)
+	}
+}
+
+func TestEnsembleLag(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name  string
+		setup func(p *ensemblePart)
+		want  time.Duration
+	}{
+		{"next step overdue", func(p *ensemblePart) { p.step = 0 }, 500 * time.Millisecond},
+		{"next step not due yet", func(p *ensemblePart) { p.step = 1 }, 0},
+		{"not ready", func(p *ensemblePart) { p.step, p.ready = 0, false }, 0},
+		{"done", func(p *ensemblePart) { p.step, p.done = 0, true }, 0},
+		{"last step started", func(p *ensemblePart) { p.step = 3 }, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, a, _ := testEnsemble(now.Add(-1500 * time.Millisecond))
+			tt.setup(a)
+			if got := e.lag(a, now); got != tt.want {
+				t.Errorf("lag = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEnsembleObserve(t *testing.T) {
+	tests := []struct {
+		name        string
+		correct     bool
+		late        time.Duration
+		offset      time.Duration
+		corrections int
+	}{
+		{"on time", true, 0, 0, 0},
+		{"within tolerance", true, 20 * time.Millisecond, 0, 0},
+		{"drift shifts the timeline", true, 120 * time.Millisecond, 120 * time.Millisecond, 1},
+		{"correction disabled", false, 120 * time.Millisecond, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useEnsembleConfig(t, EnsembleConfig{DriftTolerance: 0.03, Correct: tt.correct})
+			e, a, _ := testEnsemble(time.Now())
+			e.observe(a, 2, tt.late)
+			if e.offset != tt.offset || e.corrections != tt.corrections {
+				t.Errorf("offset %v corrections %d, want %v and %d", e.offset, e.corrections, tt.offset, tt.corrections)
+			}
+			if a.step != 2 || a.lateness != tt.late || a.maxLateness != tt.late {
+				t.Errorf("part not updated: step %d lateness %v max %v", a.step, a.lateness, a.maxLateness)
+			}
+		})
+	}
+}
+
+func TestEnsembleHoldForLaggards(t *testing.T) {
+	tests := []struct {
+		name    string
+		correct bool
+		aStep   int // 本声部已开始的节拍
+		bStep   int // 另一声部已开始的节拍
+		behind  time.Duration
+		hold    bool
+	}{
+		{"other part lagging", true, 1, 0, 200 * time.Millisecond, true},
+		{"other part within tolerance", true, 1, 0, 10 * time.Millisecond, false},
+		{"other part on schedule", true, 1, 1, 200 * time.Millisecond, false},
+		{"own lag does not hold", true, 0, 1, 200 * time.Millisecond, false},
+		{"correction disabled", false, 1, 0, 200 * time.Millisecond, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useEnsembleConfig(t, EnsembleConfig{DriftTolerance: 0.03, Correct: tt.correct})
+			// 第1拍已经到时 behind
+			e, a, b := testEnsemble(time.Now().Add(-time.Second - tt.behind))
+			a.step, b.step = tt.aStep, tt.bStep
+			if got := e.holdForLaggards(a); got != tt.hold {
+				t.Fatalf("holdForLaggards = %v, want %v", got, tt.hold)
+			}
+			if !tt.hold {
+				if e.offset != 0 || e.corrections != 0 {
+					t.Errorf("timeline moved without a hold: offset %v", e.offset)
+				}
+				return
+			}
+			// 时间轴后移落后的时间，另一声部的下一拍正好到时
+			if e.offset < tt.behind || e.offset > tt.behind+100*time.Millisecond {
+				t.Errorf("offset %v, want about %v", e.offset, tt.behind)
+			}
+			if e.corrections != 1 || b.heldFor != 1 {
+				t.Errorf("corrections %d heldFor %d", e.corrections, b.heldFor)
+			}
+			if lag := e.lag(b, time.Now()); lag > 100*time.Millisecond {
+				t.Errorf("laggard still %v behind after hold", lag)
+			}
+		})
+	}
+}
+
+func TestEnsembleResolve(t *testing.T) {
+	useRigs(t, studioRig)
+	music := testScore("index")
+	tests := []struct {
+		name  string
+		parts []EnsemblePart
+		want  string
+	}{
+		{"two rigs", []EnsemblePart{{Rig: "default", MusicData: &music}, {Rig: "studio", MusicData: &music, Offset: 2}}, ""},
+		{"no parts", nil, "no parts"},
+		{"unknown rig", []EnsemblePart{{Name: "bass", Rig: "lab", MusicData: &music}}, `bass: rig "lab" not found`},
+		{"same rig twice", []EnsemblePart{{Rig: "default", MusicData: &music}, {Rig: "default", MusicData: &music}}, "both use rig default"},
+		{"negative offset", []EnsemblePart{{Rig: "default", MusicData: &music, Offset: -1}}, "negative offset"},
+		{"no score", []EnsemblePart{{Rig: "default"}}, "scoreId or musicData is required"},
+		{"invalid score", []EnsemblePart{{Rig: "default", MusicData: &MusicData{}}}, "score has no music"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parts, err := EnsembleScore{Tempo: 1, Parts: tt.parts}.resolve()
+			if tt.want == "" {
+				if err != nil || len(parts) != len(tt.parts) {
+					t.Errorf("got %d parts, %v", len(parts), err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"sync"
+)
+
+// Histogram 固定分桶的直方图，计数按上界累计(le)
+type Histogram struct {
+	mu      sync.Mutex
+	buckets []float64 // 升序的桶上界
+	counts  []uint64  // 每个桶的计数(不累计)，最后一个为 +Inf
+	sum     float64
+	count   uint64
+}
+
+// 延迟直方图的默认分桶(秒)
+var latencyBuckets = []float64{0.0005, 0.001, 0.002, 0.005, 0.01, 0.02, 0.05, 0.1, 0.2, 0.5, 1}
+
+func newHistogram(buckets []float64) *Histogram {
+	return &Histogram{buckets: buckets, counts: make([]uint64, len(buckets)+1)}
+}
+
+func (h *Histogram) Observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	i := 0
+	for i < len(h.buckets) && v > h.buckets[i] {
+		i++
+	}
+	h.counts[i]++
+	h.sum += v
+	h.count++
+}
+
+// HistogramSnapshot 直方图快照，Buckets 为累计计数
+type HistogramSnapshot struct {
+	Count   uint64            `json:"count"`
+	Sum     float64           `json:"sum"`
+	Mean    float64           `json:"mean"`
+	P50     float64           `json:"p50"`
+	P99     float64           `json:"p99"`
+	Bounds  []float64         `json:"-"`
+	Buckets []uint64          `json:"-"`
+	Le      map[string]uint64 `json:"buckets"`
+}
+
+func (h *Histogram) Snapshot() HistogramSnapshot {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := HistogramSnapshot{Count: h.count, Sum: h.sum, Bounds: h.buckets, Le: map[string]uint64{}}
+	if h.count > 0 {
+		s.Mean = h.sum / float64(h.count)
+	}
+	var total uint64
+	for i, c := range h.counts {
+		total += c
+		s.Buckets = append(s.Buckets, total)
+		if i < len(h.buckets) {
+			s.Le[formatBound(h.buckets[i])] = total
+		} else {
+			s.Le["+Inf"] = total
+		}
+	}
+	s.P50 = s.quantile(0.5)
+	s.P99 = s.quantile(0.99)
+	return s
+}
+
+// 用桶上界估计分位数，落在 +Inf 桶时返回最大的上界(JSON不能表示Inf)
+func (s HistogramSnapshot) quantile(q float64) float64 {
+	if s.Count == 0 || len(s.Bounds) == 0 {
+		return 0
+	}
+	rank := uint64(math.Ceil(q * float64(s.Count)))
+	for i, c := range s.Buckets {
+		if c >= rank && i < len(s.Bounds) {
+			return s.Bounds[i]
+		}
+	}
+	return s.Bounds[len(s.Bounds)-1]
+}
+
+func formatBound(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
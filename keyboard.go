@@ -0,0 +1,109 @@
+package main
+
+import "fmt"
+
+// 琴键宽度(mm)，机械臂每移动一个单位对应一个白键
+const armStepMM = 21
+
+// 手指从食指到小指的顺序
+var fingerOrder = []string{"index", "middle", "ring", "pinky"}
+
+// KeyboardModel 描述键盘与两只手的相对位置
+type KeyboardModel struct {
+	LowestKey     int        `json:"lowestKey"`     // 键盘最低音(MIDI编号)
+	HighestKey    int        `json:"highestKey"`    // 键盘最高音(MIDI编号)
+	MinSeparation int        `json:"minSeparation"` // 右手食指与左手食指之间最少相隔的白键数
+	Left          HandLayout `json:"left"`
+	Right         HandLayout `json:"right"`
+}
+
+// HandLayout 描述单只手在键盘上的位置
+type HandLayout struct {
+	HomeKey   int `json:"homeKey"`   // 弹琴预设位姿、move=0 时食指所在白键(MIDI编号)
+	Direction int `json:"direction"` // 机械臂Y轴正方向对应音高升高为1，降低为-1
+	MinMove   int `json:"minMove"`   // 相对预设位姿可到达的最小移动单位
+	MaxMove   int `json:"maxMove"`   // 相对预设位姿可到达的最大移动单位
+}
+
+func defaultKeyboardModel() KeyboardModel {
+	return KeyboardModel{
+		LowestKey:     21,
+		HighestKey:    108,
+		MinSeparation: 2,
+		Left:          HandLayout{HomeKey: 60, Direction: 1, MinMove: -10, MaxMove: 10},
+		Right:         HandLayout{HomeKey: 67, Direction: 1, MinMove: -10, MaxMove: 10},
+	}
+}
+
+func (kb KeyboardModel) hand(side string) HandLayout {
+	if side == "left" {
+		return kb.Left
+	}
+	return kb.Right
+}
+
+// 白键在一个八度内的序号，黑键为-1
+var whiteKeyOfPitchClass = []int{0, -1, 1, -1, 2, 3, -1, 4, -1, 5, -1, 6}
+var pitchClassOfWhiteKey = []int{0, 2, 4, 5, 7, 9, 11}
+
+func isWhiteKey(pitch int) bool {
+	return whiteKeyOfPitchClass[((pitch%12)+12)%12] >= 0
+}
+
+// 白键的全局序号，C-1 为0
+func whiteIndex(pitch int) int {
+	return (pitch/12)*7 + whiteKeyOfPitchClass[pitch%12]
+}
+
+func whitePitch(idx int) int {
+	return (idx/7)*12 + pitchClassOfWhiteKey[idx%7]
+}
+
+// 手指相对食指的白键偏移，右手向高音方向展开，左手向低音方向展开
+func fingerOffset(side, finger string) int {
+	off := fingerIndexMap[finger] - fingerIndexMap["index"]
+	if side == "left" {
+		return -off
+	}
+	return off
+}
+
+// 食指所在白键序号
+func (kb KeyboardModel) indexWhite(side string, move int) int {
+	h := kb.hand(side)
+	return whiteIndex(h.HomeKey) + move*h.Direction
+}
+
+// 给定手的位置(移动单位)和手指，返回按下的琴键
+func (kb KeyboardModel) keyOf(side string, move int, finger string) int {
+	return whitePitch(kb.indexWhite(side, move) + fingerOffset(side, finger))
+}
+
+// 给定手的位置，返回能按到该琴键的手指
+func (kb KeyboardModel) fingerFor(side string, move int, pitch int) (string, bool) {
+	if !isWhiteKey(pitch) {
+		return "", false
+	}
+	w := whiteIndex(pitch)
+	for _, f := range fingerOrder {
+		if kb.indexWhite(side, move)+fingerOffset(side, f) == w {
+			return f, true
+		}
+	}
+	return "", false
+}
+
+// 两手位置是否满足可达范围和最小间隔
+func (kb KeyboardModel) validPair(left, right int) bool {
+	if left < kb.Left.MinMove || left > kb.Left.MaxMove || right < kb.Right.MinMove || right > kb.Right.MaxMove {
+		return false
+	}
+	return kb.indexWhite("right", right)-kb.indexWhite("left", left) >= kb.MinSeparation
+}
+
+var pitchNames = []string{"C", "C#", "D", "D#", "E", "F", "F#", "G", "G#", "A", "A#", "B"}
+
+// MIDI编号转音名，例如 60 -> C4
+func pitchName(pitch int) string {
+	return fmt.Sprintf("%s%d", pitchNames[((pitch%12)+12)%12], pitch/12-1)
+}
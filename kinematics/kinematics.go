@@ -0,0 +1,304 @@
+// Package kinematics 六轴机械臂的正/逆运动学，长度单位mm，角度单位度
+package kinematics
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// Joints 六个关节角(度)
+type Joints [6]float64
+
+// Pose 末端位姿，位置(mm)和欧拉角(度)，旋转顺序为 R = Rz(RZ)·Ry(RY)·Rx(RX)
+type Pose struct {
+	X  float64 `json:"x"`
+	Y  float64 `json:"y"`
+	Z  float64 `json:"z"`
+	RX float64 `json:"rx"`
+	RY float64 `json:"ry"`
+	RZ float64 `json:"rz"`
+}
+
+// Link 改进DH参数(Craig)，A/D 单位mm，Alpha/Offset 单位弧度
+type Link struct {
+	A      float64
+	Alpha  float64
+	D      float64
+	Offset float64 // 关节角零位偏移，theta = q + Offset
+}
+
+// Limit 关节角范围(度)
+type Limit struct {
+	Min float64 `json:"min"`
+	Max float64 `json:"max"`
+}
+
+// Model 机械臂模型
+type Model struct {
+	Name   string
+	Links  [6]Link
+	Limits [6]Limit
+}
+
+// Piper AgileX Piper 机械臂，关节范围与 send_joint 的校验一致
+var Piper = Model{
+	Name: "piper",
+	Links: [6]Link{
+		{A: 0, Alpha: 0, D: 123, Offset: 0},
+		{A: 0, Alpha: -math.Pi / 2, D: 0, Offset: -172.22 * math.Pi / 180},
+		{A: 285.03, Alpha: 0, D: 0, Offset: -102.78 * math.Pi / 180},
+		{A: -21.98, Alpha: math.Pi / 2, D: 250.75, Offset: 0},
+		{A: 0, Alpha: -math.Pi / 2, D: 0, Offset: 0},
+		{A: 0, Alpha: math.Pi / 2, D: 91, Offset: 0},
+	},
+	Limits: [6]Limit{{-154, 154}, {0, 195}, {-175, 0}, {-102, 102}, {-75, 75}, {-120, 120}},
+}
+
+type mat4 [4][4]float64
+
+func (a mat4) mul(b mat4) mat4 {
+	var out mat4
+	for i := 0; i < 4; i++ {
+		for j := 0; j < 4; j++ {
+			for k := 0; k < 4; k++ {
+				out[i][j] += a[i][k] * b[k][j]
+			}
+		}
+	}
+	return out
+}
+
+// 改进DH的连杆变换 RotX(alpha)·TransX(a)·RotZ(theta)·TransZ(d)
+func (l Link) transform(theta float64) mat4 {
+	ct, st := math.Cos(theta), math.Sin(theta)
+	ca, sa := math.Cos(l.Alpha), math.Sin(l.Alpha)
+	return mat4{
+		{ct, -st, 0, l.A},
+		{st * ca, ct * ca, -sa, -sa * l.D},
+		{st * sa, ct * sa, ca, ca * l.D},
+		{0, 0, 0, 1},
+	}
+}
+
+func (m Model) matrix(q Joints) mat4 {
+	t := mat4{{1, 0, 0, 0}, {0, 1, 0, 0}, {0, 0, 1, 0}, {0, 0, 0, 1}}
+	for i, l := range m.Links {
+		t = t.mul(l.transform(q[i]*math.Pi/180 + l.Offset))
+	}
+	return t
+}
+
+// FK 正运动学
+func (m Model) FK(q Joints) Pose {
+	t := m.matrix(q)
+	ry := math.Atan2(-t[2][0], math.Hypot(t[0][0], t[1][0]))
+	var rx, rz float64
+	if math.Abs(math.Cos(ry)) < 1e-9 {
+		// 万向锁，RZ取0
+		rx = math.Atan2(-t[1][2], t[1][1])
+	} else {
+		rx = math.Atan2(t[2][1], t[2][2])
+		rz = math.Atan2(t[1][0], t[0][0])
+	}
+	deg := 180 / math.Pi
+	return Pose{t[0][3], t[1][3], t[2][3], rx * deg, ry * deg, rz * deg}
+}
+
+// 欧拉角转旋转矩阵
+func (p Pose) rotation() [3][3]float64 {
+	rad := math.Pi / 180
+	cx, sx := math.Cos(p.RX*rad), math.Sin(p.RX*rad)
+	cy, sy := math.Cos(p.RY*rad), math.Sin(p.RY*rad)
+	cz, sz := math.Cos(p.RZ*rad), math.Sin(p.RZ*rad)
+	return [3][3]float64{
+		{cz * cy, cz*sy*sx - sz*cx, cz*sy*cx + sz*sx},
+		{sz * cy, sz*sy*sx + cz*cx, sz*sy*cx - cz*sx},
+		{-sy, cy * sx, cy * cx},
+	}
+}
+
+// CheckLimits 检查关节角是否在范围内
+func (m Model) CheckLimits(q Joints) error {
+	for i, l := range m.Limits {
+		if q[i] < l.Min || q[i] > l.Max {
+			return fmt.Errorf("j%d=%.3f° outside [%.0f, %.0f]", i+1, q[i], l.Min, l.Max)
+		}
+	}
+	return nil
+}
+
+func (m Model) clamp(q Joints) Joints {
+	for i, l := range m.Limits {
+		q[i] = math.Max(l.Min, math.Min(l.Max, q[i]))
+	}
+	return q
+}
+
+// IK 收敛精度和迭代参数
+const (
+	ikPosTolerance = 0.1  // mm
+	ikRotTolerance = 0.05 // 度
+	ikIterations   = 300
+	ikDamping      = 5   // mm
+	ikRotWeight    = 200 // 姿态误差(弧度)折算为mm的权重
+)
+
+// 末端误差：位置(mm)和按权重折算的姿态误差
+func (m Model) residual(q Joints, target mat4) [6]float64 {
+	t := m.matrix(q)
+	var e [6]float64
+	for i := 0; i < 3; i++ {
+		e[i] = target[i][3] - t[i][3]
+	}
+	// 姿态误差 0.5 * Σ cross(当前列, 目标列)
+	for c := 0; c < 3; c++ {
+		a := [3]float64{t[0][c], t[1][c], t[2][c]}
+		b := [3]float64{target[0][c], target[1][c], target[2][c]}
+		e[3] += 0.5 * (a[1]*b[2] - a[2]*b[1]) * ikRotWeight
+		e[4] += 0.5 * (a[2]*b[0] - a[0]*b[2]) * ikRotWeight
+		e[5] += 0.5 * (a[0]*b[1] - a[1]*b[0]) * ikRotWeight
+	}
+	return e
+}
+
+// 从一个初值开始用阻尼最小二乘迭代，关节角始终限制在范围内
+func (m Model) solveFrom(seed Joints, target mat4) (Joints, bool) {
+	q := m.clamp(seed)
+	const h = 1e-4
+	for iter := 0; iter < ikIterations; iter++ {
+		e := m.residual(q, target)
+		pos := math.Sqrt(e[0]*e[0] + e[1]*e[1] + e[2]*e[2])
+		rot := math.Sqrt(e[3]*e[3]+e[4]*e[4]+e[5]*e[5]) / ikRotWeight * 180 / math.Pi
+		if pos < ikPosTolerance && rot < ikRotTolerance {
+			return q, true
+		}
+		// 数值雅可比，列为每个关节(弧度)对误差的偏导
+		var jac [6][6]float64
+		for j := 0; j < 6; j++ {
+			dq := q
+			dq[j] += h * 180 / math.Pi
+			de := m.residual(dq, target)
+			for i := 0; i < 6; i++ {
+				jac[i][j] = (e[i] - de[i]) / h
+			}
+		}
+		// (JᵀJ + λ²I)Δ = Jᵀe
+		var a [6][6]float64
+		var b [6]float64
+		for i := 0; i < 6; i++ {
+			for j := 0; j < 6; j++ {
+				for k := 0; k < 6; k++ {
+					a[i][j] += jac[k][i] * jac[k][j]
+				}
+			}
+			a[i][i] += ikDamping * ikDamping
+			for k := 0; k < 6; k++ {
+				b[i] += jac[k][i] * e[k]
+			}
+		}
+		delta, ok := solve6(a, b)
+		if !ok {
+			return q, false
+		}
+		for j := range q {
+			// 单次最多转动10度，避免发散
+			d := math.Max(-10, math.Min(10, delta[j]*180/math.Pi))
+			q[j] += d
+		}
+		q = m.clamp(q)
+	}
+	return q, false
+}
+
+// 高斯消元解6元线性方程组
+func solve6(a [6][6]float64, b [6]float64) ([6]float64, bool) {
+	var x [6]float64
+	for c := 0; c < 6; c++ {
+		p := c
+		for r := c + 1; r < 6; r++ {
+			if math.Abs(a[r][c]) > math.Abs(a[p][c]) {
+				p = r
+			}
+		}
+		if math.Abs(a[p][c]) < 1e-12 {
+			return x, false
+		}
+		a[c], a[p] = a[p], a[c]
+		b[c], b[p] = b[p], b[c]
+		for r := c + 1; r < 6; r++ {
+			f := a[r][c] / a[c][c]
+			for k := c; k < 6; k++ {
+				a[r][k] -= f * a[c][k]
+			}
+			b[r] -= f * b[c]
+		}
+	}
+	for r := 5; r >= 0; r-- {
+		s := b[r]
+		for k := r + 1; k < 6; k++ {
+			s -= a[r][k] * x[k]
+		}
+		x[r] = s / a[r][r]
+	}
+	return x, true
+}
+
+// IK 逆运动学，返回范围内的所有不同解，按与参考关节角的距离排序，第一个为推荐解
+func (m Model) IK(target Pose, ref Joints) ([]Joints, error) {
+	r := target.rotation()
+	goal := mat4{
+		{r[0][0], r[0][1], r[0][2], target.X},
+		{r[1][0], r[1][1], r[1][2], target.Y},
+		{r[2][0], r[2][1], r[2][2], target.Z},
+		{0, 0, 0, 1},
+	}
+	// 初值：参考关节角、零位，以及朝向目标的肘部/腕部不同构型
+	seeds := []Joints{ref, {}}
+	base := math.Atan2(target.Y, target.X) * 180 / math.Pi
+	for _, j2 := range []float64{30, 90, 150} {
+		for _, j3 := range []float64{-30, -90, -150} {
+			for _, j5 := range []float64{-45, 45} {
+				seeds = append(seeds, Joints{base, j2, j3, 0, j5, 0})
+			}
+		}
+	}
+
+	var solutions []Joints
+	for _, seed := range seeds {
+		q, ok := m.solveFrom(seed, goal)
+		if !ok || m.CheckLimits(q) != nil {
+			continue
+		}
+		dup := false
+		for _, s := range solutions {
+			dup = dup || maxDiff(s, q) < 0.5
+		}
+		if !dup {
+			solutions = append(solutions, q)
+		}
+	}
+	if len(solutions) == 0 {
+		return nil, fmt.Errorf("no inverse kinematics solution within joint limits")
+	}
+	sort.SliceStable(solutions, func(i, j int) bool { return distance(solutions[i], ref) < distance(solutions[j], ref) })
+	return solutions, nil
+}
+
+func maxDiff(a, b Joints) float64 {
+	d := 0.0
+	for i := range a {
+		d = math.Max(d, math.Abs(a[i]-b[i]))
+	}
+	return d
+}
+
+// 与参考关节角的距离，靠近基座的关节权重更大
+func distance(a, b Joints) float64 {
+	weights := [6]float64{3, 3, 2, 1, 1, 1}
+	d := 0.0
+	for i := range a {
+		d += weights[i] * (a[i] - b[i]) * (a[i] - b[i])
+	}
+	return d
+}
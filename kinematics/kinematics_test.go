@@ -0,0 +1,54 @@
+package kinematics
+
+import (
+	"math"
+	"testing"
+)
+
+// 正解得到的位姿再求逆解，推荐解的正解应回到同一位姿
+func TestFKIKRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		q    Joints
+	}{
+		{"piano preset", Joints{0, 60, -60, 0, 30, 0}},
+		{"left of base", Joints{45, 80, -90, 10, -20, 15}},
+		{"right of base", Joints{-60, 100, -120, -30, 40, -45}},
+		{"elbow high", Joints{20, 40, -30, 50, 60, 90}},
+		{"wrist rolled", Joints{-10, 120, -150, 80, -60, -100}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := Piper.CheckLimits(tt.q); err != nil {
+				t.Fatalf("test joints out of limits: %v", err)
+			}
+			pose := Piper.FK(tt.q)
+			solutions, err := Piper.IK(pose, tt.q)
+			if err != nil {
+				t.Fatalf("IK(%+v): %v", pose, err)
+			}
+			got := Piper.FK(solutions[0])
+			if d := math.Hypot(math.Hypot(got.X-pose.X, got.Y-pose.Y), got.Z-pose.Z); d > 0.01 {
+				t.Errorf("position off by %.4fmm: got %+v, want %+v", d, got, pose)
+			}
+			want, have := pose.rotation(), got.rotation()
+			for i := range want {
+				for j := range want[i] {
+					if math.Abs(want[i][j]-have[i][j]) > 1e-4 {
+						t.Fatalf("rotation differs: got %+v, want %+v", got, pose)
+					}
+				}
+			}
+			// 以原关节角为参考时推荐解就是原关节角
+			if d := maxDiff(solutions[0], tt.q); d > 0.01 {
+				t.Errorf("first solution %v differs from reference %v by %.4f°", solutions[0], tt.q, d)
+			}
+		})
+	}
+}
+
+func TestIKUnreachable(t *testing.T) {
+	if _, err := Piper.IK(Pose{X: 2000, Z: 100, RY: 90}, Joints{}); err == nil {
+		t.Fatal("expected no solution for a pose out of reach")
+	}
+}
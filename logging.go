@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// LogConfig 日志配置：输出到标准错误，演奏任务另外写一份任务日志文件
+type LogConfig struct {
+	Level      string `json:"level"`      // debug / info / warn / error
+	Format     string `json:"format"`     // json / text
+	JobDir     string `json:"jobDir"`     // 任务日志目录，为空时不写任务日志
+	JobLevel   string `json:"jobLevel"`   // 任务日志的级别，debug 时包含每个音符和手指
+	MaxJobLogs int    `json:"maxJobLogs"` // 保留的任务日志文件数，0为不限制
+}
+
+func defaultLogConfig() LogConfig {
+	return LogConfig{Level: "info", Format: "json", JobDir: "logs", JobLevel: "debug", MaxJobLogs: 100}
+}
+
+// 运行中可以修改的输出级别
+var logLevel = new(slog.LevelVar)
+
+func parseLogLevel(s string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(s)); err != nil {
+		return 0, fmt.Errorf("invalid log level %q", s)
+	}
+	return level, nil
+}
+
+// 按配置设置默认日志，log 包的输出也经过这里
+func setupLogging() {
+	cfg := appConfig.Log
+	level, err := parseLogLevel(cfg.Level)
+	if err != nil {
+		level = slog.LevelInfo
+	}
+	logLevel.Set(level)
+	opts := &slog.HandlerOptions{Level: slog.LevelDebug}
+	var base slog.Handler
+	if cfg.Format == "text" {
+		base = slog.NewTextHandler(os.Stderr, opts)
+	} else {
+		base = slog.NewJSONHandler(os.Stderr, opts)
+	}
+	slog.SetDefault(slog.New(&logHandler{base: base}))
+	if err != nil {
+		slog.Warn("日志级别无效，使用 info", "level", cfg.Level)
+	}
+}
+
+// 一个任务日志文件
+type jobLog struct {
+	file    *os.File
+	handler slog.Handler
+}
+
+var jobLogMu sync.Mutex
+var jobLogs = map[string]*jobLog{}
+
+// logHandler 按 logLevel 输出；通过 With("job", id) 绑定任务的记录同时写入该任务的日志文件
+type logHandler struct {
+	base    slog.Handler
+	job     string
+	attrs   []slog.Attr // With 绑定的字段，写任务日志时补上
+	grouped bool        // 分组后的记录不写任务日志
+}
+
+func (h *logHandler) file() *jobLog {
+	if h.job == "" || h.grouped {
+		return nil
+	}
+	jobLogMu.Lock()
+	defer jobLogMu.Unlock()
+	return jobLogs[h.job]
+}
+
+func (h *logHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	if level >= logLevel.Level() {
+		return true
+	}
+	if j := h.file(); j != nil {
+		return j.handler.Enabled(ctx, level)
+	}
+	return false
+}
+
+func (h *logHandler) Handle(ctx context.Context, r slog.Record) error {
+	var err error
+	if r.Level >= logLevel.Level() {
+		err = h.base.Handle(ctx, r)
+	}
+	if j := h.file(); j != nil && j.handler.Enabled(ctx, r.Level) {
+		rec := slog.NewRecord(r.Time, r.Level, r.Message, r.PC)
+		rec.AddAttrs(h.attrs...)
+		r.Attrs(func(a slog.Attr) bool {
+			rec.AddAttrs(a)
+			return true
+		})
+		j.handler.Handle(ctx, rec)
+	}
+	return err
+}
+
+func (h *logHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	n := *h
+	n.base = h.base.WithAttrs(attrs)
+	n.attrs = append(append([]slog.Attr{}, h.attrs...), attrs...)
+	for _, a := range attrs {
+		if a.Key == "job" && !h.grouped {
+			n.job = a.Value.String()
+		}
+	}
+	return &n
+}
+
+func (h *logHandler) WithGroup(name string) slog.Handler {
+	n := *h
+	n.base = h.base.WithGroup(name)
+	n.grouped = true
+	return &n
+}
+
+// 创建任务日志文件，超过 maxJobLogs 时删除最旧的
+func openJobLog(id string) {
+	cfg := appConfig.Log
+	if cfg.JobDir == "" {
+		return
+	}
+	level, err := parseLogLevel(cfg.JobLevel)
+	if err != nil {
+		level = slog.LevelDebug
+	}
+	if err := os.MkdirAll(cfg.JobDir, 0755); err != nil {
+		slog.Error("创建任务日志目录失败", "dir", cfg.JobDir, "err", err)
+		return
+	}
+	if cfg.MaxJobLogs > 0 {
+		pruneJobLogs(cfg.JobDir, cfg.MaxJobLogs-1)
+	}
+	f, err := os.Create(filepath.Join(cfg.JobDir, id+".log"))
+	if err != nil {
+		slog.Error("创建任务日志失败", "job", id, "err", err)
+		return
+	}
+	jobLogMu.Lock()
+	jobLogs[id] = &jobLog{file: f, handler: slog.NewJSONHandler(f, &slog.HandlerOptions{Level: level})}
+	jobLogMu.Unlock()
+}
+
+func closeJobLog(id string) {
+	jobLogMu.Lock()
+	j := jobLogs[id]
+	delete(jobLogs, id)
+	jobLogMu.Unlock()
+	if j != nil {
+		j.file.Close()
+	}
+}
+
+// JobLogFile 任务日志文件
+type JobLogFile struct {
+	Job     string    `json:"job"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+}
+
+// 列出任务日志，最新的在前
+func listJobLogs(dir string) ([]JobLogFile, error) {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return []JobLogFile{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read log dir failed: %v", err)
+	}
+	files := []JobLogFile{}
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".log") {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, JobLogFile{Job: strings.TrimSuffix(e.Name(), ".log"), Size: info.Size(), ModTime: info.ModTime()})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].ModTime.After(files[j].ModTime) })
+	return files, nil
+}
+
+func pruneJobLogs(dir string, keep int) {
+	files, err := listJobLogs(dir)
+	if err != nil {
+		return
+	}
+	for _, f := range files[min(keep, len(files)):] {
+		os.Remove(filepath.Join(dir, f.Job+".log"))
+	}
+}
+
+func listJobLogsHandler(c *gin.Context) {
+	files, err := listJobLogs(appConfig.Log.JobDir)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"logs": files})
+}
+
+// 下载任务日志(JSON Lines)
+func downloadJobLogHandler(c *gin.Context) {
+	id := c.Param("job")
+	if appConfig.Log.JobDir == "" || id == "" || filepath.Base(id) != id || strings.HasPrefix(id, ".") {
+		c.JSON(http.StatusNotFound, gin.H{"error": "log not found"})
+		return
+	}
+	path := filepath.Join(appConfig.Log.JobDir, id+".log")
+	if _, err := os.Stat(path); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "log not found"})
+		return
+	}
+	c.FileAttachment(path, id+".log")
+}
+
+// 查询和修改输出级别(不写入配置文件)
+func getLogLevelHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"level": strings.ToLower(logLevel.Level().String())})
+}
+
+func setLogLevelHandler(c *gin.Context) {
+	var req struct {
+		Level string `json:"level"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+		return
+	}
+	level, err := parseLogLevel(req.Level)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	logLevel.Set(level)
+	slog.Info("日志级别已修改", "level", req.Level)
+	c.JSON(http.StatusOK, gin.H{"status": "success", "level": strings.ToLower(level.String())})
+}
+
+// 记录API请求，替代 gin 默认的文本访问日志
+func requestLogger() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+		level := slog.LevelDebug
+		if c.Writer.Status() >= http.StatusInternalServerError {
+			level = slog.LevelWarn
+		}
+		slog.Log(c.Request.Context(), level, "request",
+			"method", c.Request.Method,
+			"path", c.Request.URL.Path,
+			"status", c.Writer.Status(),
+			"duration", time.Since(start).Seconds(),
+			"client", c.ClientIP())
+	}
+}
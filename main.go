@@ -1,17 +1,18 @@
 package main
 
 import (
-	"bytes"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
-	"log"
+	"log/slog"
 	"net/http"
+	"os"
 	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"musicsongling/kinematics"
 )
 
 type CanMessage struct {
@@ -20,13 +21,10 @@ type CanMessage struct {
 	Data      []byte `json:"data"`
 }
 type PianoConfig struct {
-	Interfaces struct {
-		LeftHand  string `json:"leftHand"`
-		RightHand string `json:"rightHand"`
-		LeftArm   string `json:"leftArm"`
-		RightArm  string `json:"rightArm"`
-	} `json:"interfaces"`
-	MusicData MusicData `json:"musicData"`
+	Interfaces RigInterfaces `json:"interfaces"` // 为空的接口使用工位当前的绑定
+	MusicData  MusicData     `json:"musicData"`
+	ScoreID    string        `json:"scoreId"` // 乐谱库中的乐谱ID，设置后忽略 musicData
+	Sync       *SyncOptions  `json:"sync"`    // 设置后跟随外部时钟演奏
 }
 
 type MusicData struct {
@@ -74,6 +72,7 @@ type PoseRequest struct {
 	RY        int    `json:"ry"`
 	RZ        int    `json:"rz"`
 	Speed     int    `json:"speed"` // 0-100
+	Side      string `json:"side"`  // 可选，left/right，用于双臂防碰撞检查
 }
 
 // 手指映射
@@ -84,30 +83,6 @@ var fingerIndexMap = map[string]int{
 	"pinky":  5,
 }
 
-// 手指弹琴预设值
-var O7FingerPianoPreset = []byte{0, 255, 235, 235, 235, 235, 100}
-var L10FingerPianoPreset = []byte{0, 0, 225, 225, 225, 225}
-
-// 左臂弹琴预设值，对应xyzrxyz
-var leftArmPianoPreset = []int{400, 0, 251, 0, 80, 0}
-
-// 右臂弹琴预设值，对应xyzrxyz
-var rightArmPianoPreset = []int{400, 0, 240, 0, 85, 0}
-
-var L10currentleftFinger = []byte{0, 0, 225, 225, 225, 225}
-var L10currentrightFinger = []byte{0, 0, 225, 225, 225, 225}
-var O7currentleftFinger = []byte{0, 255, 235, 235, 235, 235, 100}
-var O7currentrightFinger = []byte{0, 255, 235, 235, 235, 235, 100}
-
-// 机械臂和灵巧手canid
-var LeftHand = "can0"
-var RightHand = "can1"
-var LeftArm = "can2"
-var RightArm = "can3"
-
-var killPiano = false
-var stopPiano = false
-
 type ArmPianoPresetReq struct {
 	Side   string `json:"side"`   // "left" or "right"
 	Values []int  `json:"values"` // 6个关节/位姿
@@ -118,15 +93,147 @@ type FingerPianoPresetReq struct {
 }
 
 func main() {
-	r := gin.Default()
+	if len(os.Args) > 1 {
+		os.Exit(runCLI(os.Args[1:]))
+	}
+	loadAppConfig()
+	setupLogging()
+	initRigs()
+	go canBridge.probeBatch()
+	r := gin.New()
+	r.Use(requestLogger(), gin.Recovery())
+	r.Use(metricsMiddleware())
+	r.Use(rejectDuringShutdown())
 	// 静态文件服务
 	r.Static("/static", "./static")
 	r.GET("/", func(c *gin.Context) {
 		c.File("./static/index.html")
 	})
 
+	// ====================== 工位路由组 (/api/rigs/*) ======================
+	// 旧路由 /api/* 使用默认工位，/api/rigs/:rig/* 使用指定工位
+	registerRigRoutes(r.Group("/api", withRig()))
+	r.GET("/api/rigs", listRigsHandler)
+	r.POST("/api/rigs", createRigHandler)
+	rigGroup := r.Group("/api/rigs/:rig", withRig())
+	{
+		rigGroup.GET("", getRigHandler)
+		rigGroup.PUT("", updateRigHandler)
+		rigGroup.DELETE("", deleteRigHandler)
+		registerRigRoutes(rigGroup)
+	}
+
+	// ====================== 合奏路由组 (/api/ensembles/*, /api/ensemble/*) ======================
+	ensemblesGroup := r.Group("/api/ensembles")
+	{
+		// 合奏乐谱，保存在 ensemble.dir 目录
+		ensemblesGroup.GET("", listEnsemblesHandler)
+		ensemblesGroup.GET("/:id", getEnsembleHandler)
+		ensemblesGroup.PUT("/:id", saveEnsembleHandler)
+		ensemblesGroup.DELETE("/:id", deleteEnsembleHandler)
+	}
+	ensembleGroup := r.Group("/api/ensemble")
+	{
+		ensembleGroup.POST("/start", startEnsembleHandler)
+		// 暂停、恢复、终止所有声部
+		ensembleGroup.POST("/stop", ensembleControlHandler("stop"))
+		ensembleGroup.POST("/resume", ensembleControlHandler("resume"))
+		ensembleGroup.POST("/kill", ensembleControlHandler("kill"))
+		ensembleGroup.GET("/status", ensembleStatusHandler)
+	}
+
+	// ====================== 指法规划路由组 (/api/planner/*) ======================
+	plannerGroup := r.Group("/api/planner")
+	{
+		// 根据音符序列自动分配左右手、手指和机械臂移动
+		plannerGroup.POST("/plan", planHandler)
+		// 上传MIDI文件并规划
+		plannerGroup.POST("/midi", planMIDIHandler)
+		// MusicData导出为MIDI文件
+		plannerGroup.POST("/export_midi", exportMIDIHandler)
+	}
+
+	// ====================== 乐谱库路由组 (/api/scores/*) ======================
+	scoreGroup := r.Group("/api/scores")
+	{
+		scoreGroup.GET("", listScoresHandler)
+		scoreGroup.POST("", uploadScoreHandler)
+		// 导入其他格式的乐谱，?format=dsl|musicxml
+		scoreGroup.POST("/import", importScoreHandler)
+		scoreGroup.GET("/:id", getScoreHandler)
+		scoreGroup.PUT("/:id", replaceScoreHandler)
+		scoreGroup.DELETE("/:id", deleteScoreHandler)
+		scoreGroup.POST("/:id/rename", renameScoreHandler)
+		scoreGroup.GET("/:id/versions", scoreVersionsHandler)
+		scoreGroup.GET("/:id/versions/:version", scoreVersionHandler)
+		// 以文本乐谱格式获取
+		scoreGroup.GET("/:id/dsl", scoreDSLHandler)
+		// 导出为MIDI文件
+		scoreGroup.GET("/:id/midi", scoreMIDIHandler)
+	}
+
+	// ====================== 文本乐谱路由组 (/api/dsl/*) ======================
+	dslGroup := r.Group("/api/dsl")
+	{
+		dslGroup.POST("/compile", compileDSLHandler)
+		dslGroup.POST("/decompile", decompileDSLHandler)
+	}
+
+	// ====================== 外部时钟路由组 (/api/clock/*) ======================
+	clockGroup := r.Group("/api/clock")
+	{
+		// 界面上报伴奏WAV播放位置；MIDI时钟/时间码通过 clock.listen 的UDP端口输入
+		clockGroup.POST("/position", clockPositionHandler)
+		clockGroup.GET("/status", clockStatusHandler)
+	}
+
+	// 查询和手动设置各接口的延迟，测量在工位的 /calibration 路由下
+	r.GET("/api/calibration", getCalibrationHandler)
+	r.PUT("/api/calibration/devices/:iface", putDeviceLatencyHandler)
+	r.DELETE("/api/calibration/devices/:iface", deleteDeviceLatencyHandler)
+
+	// Prometheus 指标
+	r.GET("/metrics", metricsHandler)
+
+	// ====================== 日志路由组 (/api/logs/*) ======================
+	logsGroup := r.Group("/api/logs")
+	{
+		// 输出级别，修改后立即生效，不写入配置文件
+		logsGroup.GET("/level", getLogLevelHandler)
+		logsGroup.PUT("/level", setLogLevelHandler)
+		// 每个演奏任务的日志文件(JSON Lines)，保存在 log.jobDir
+		logsGroup.GET("/jobs", listJobLogsHandler)
+		logsGroup.GET("/jobs/:job", downloadJobLogHandler)
+	}
+
+	// 查询CAN服务连接状态(熔断、重试统计)
+	r.GET("/api/bridge/status", bridgeStatusHandler)
+
+	// ====================== CAN帧录制路由组 (/api/can/*) ======================
+	canGroup := r.Group("/api/can")
+	{
+		canGroup.POST("/record/start", startRecordingHandler)
+		canGroup.POST("/record/stop", stopRecordingHandler)
+		canGroup.GET("/record", recordingStatusHandler)
+		canGroup.GET("/recordings", listRecordingsHandler)
+		canGroup.GET("/recordings/:name", downloadRecordingHandler)
+	}
+
+	// 查询CAN设备接口
+	r.GET("/api/can_interfaces", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"interfaces": QueryNumberofCanDevices()})
+	})
+	startWatchdog()
+	startClockListener()
+	slog.Info("server running", "url", "http://localhost:6130")
+	runServer(r, ":6130")
+
+}
+
+// 注册工位相关的路由，处理函数通过 currentRig 取得工位
+func registerRigRoutes(api *gin.RouterGroup) {
 	// ====================== 机械臂路由组 (/api/arm/*) ======================
-	armGroup := r.Group("/api/arm")
+	armGroup := api.Group("/arm")
 	{
 		// 发送关节控制指令
 		armGroup.POST("/send_joint", func(c *gin.Context) {
@@ -146,12 +253,7 @@ func main() {
 			}
 
 			// 验证关节角度范围
-			if !validateJointRange(req.J1, -154000, 154000) ||
-				!validateJointRange(req.J2, 0, 195000) ||
-				!validateJointRange(req.J3, -175000, 0) ||
-				!validateJointRange(req.J4, -102000, 102000) ||
-				!validateJointRange(req.J5, -75000, 75000) ||
-				!validateJointRange(req.J6, -120000, 120000) {
+			if !validateJoints([6]int{req.J1, req.J2, req.J3, req.J4, req.J5, req.J6}) {
 				c.JSON(http.StatusBadRequest, gin.H{"error": "joint angle out of range"})
 				return
 			}
@@ -162,55 +264,9 @@ func main() {
 				return
 			}
 
-			// 发送J1-J2 (0x155)
-			data155 := intPairToBytes(req.J1, req.J2)
-			msgj12 := CanMessage{
-				Interface: req.Interface,
-				Id:        0x155,
-				Data:      data155,
-			}
-			if err := forwardToCanService(msgj12); err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "send J1-J2 failed", "details": err.Error()})
-				return
-			}
-
-			// 发送J3-J4 (0x156)
-			data156 := intPairToBytes(req.J3, req.J4)
-			msgj34 := CanMessage{
-				Interface: req.Interface,
-				Id:        0x156,
-				Data:      data156,
-			}
-			if err := forwardToCanService(msgj34); err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "send J3-J4 failed", "details": err.Error()})
-				return
-			}
-
-			// 发送J5-J6 (0x157)
-			data157 := intPairToBytes(req.J5, req.J6)
-			msgj56 := CanMessage{
-				Interface: req.Interface,
-				Id:        0x157,
-				Data:      data157,
-			}
-			if err := forwardToCanService(msgj56); err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "send J5-J6 failed", "details": err.Error()})
-				return
-			}
-
-			// 发送运动控制指令 (0x151)
-			controlMsg := CanMessage{
-				Interface: req.Interface, // 使用第一个接口发送控制指令
-				Id:        0x151,
-				Data: []byte{
-					0x01,            // 控制模式
-					0x01,            // 关节控制
-					byte(req.Speed), // 速度
-					0, 0, 0, 0, 0,   // 后面的字节默认为0
-				},
-			}
-			if err := forwardToCanService(controlMsg); err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "send control command failed", "details": err.Error()})
+			joints := [6]int{req.J1, req.J2, req.J3, req.J4, req.J5, req.J6}
+			if err := sendJointCommand(req.Interface, joints, req.Speed); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "send joint command failed", "details": err.Error()})
 				return
 			}
 
@@ -265,53 +321,60 @@ func main() {
 				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
 				return
 			}
-			msgj12 := CanMessage{
-				Interface: req.Interface,
-				Id:        0x155,
-				Data:      []byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00},
+			zero := make([]byte, 8)
+			frames := []CanMessage{
+				{Id: 0x155, Data: zero},
+				{Id: 0x156, Data: zero},
+				{Id: 0x157, Data: zero},
+				{Id: 0x151, Data: []byte{
+					0x01,          // 控制模式
+					0x01,          // 关节控制
+					0x64,          // 速度
+					0, 0, 0, 0, 0, // 后面的字节默认为0
+				}},
 			}
-
-			if err := forwardToCanService(msgj12); err != nil {
+			if err := forwardFramesToCanService(req.Interface, frames); err != nil {
 				c.JSON(http.StatusInternalServerError, gin.H{"error": "to zero failed", "details": err.Error()})
 				return
 			}
-			msgj34 := CanMessage{
-				Interface: req.Interface,
-				Id:        0x156,
-				Data:      []byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00},
-			}
-			if err := forwardToCanService(msgj34); err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "to zero failed", "details": err.Error()})
+
+			c.JSON(http.StatusOK, gin.H{"status": "to zero"})
+		})
+
+		// 急停与恢复
+		armGroup.POST("/emergency_stop", func(c *gin.Context) {
+			req := CanMessage{}
+			if err := c.ShouldBindJSON(&req); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
 				return
 			}
-			msgj56 := CanMessage{
-				Interface: req.Interface,
-				Id:        0x157,
-				Data:      []byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00},
-			}
-			if err := forwardToCanService(msgj56); err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "to zero failed", "details": err.Error()})
+			if err := emergencyStopArm(req.Interface); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "emergency stop failed", "details": err.Error()})
 				return
 			}
-			// 发送运动控制指令 (0x151)
-			controlMsg := CanMessage{
-				Interface: req.Interface, // 使用第一个接口发送控制指令
-				Id:        0x151,
-				Data: []byte{
-					0x01,          // 控制模式
-					0x01,          // 关节控制
-					0x64,          // 速度
-					0, 0, 0, 0, 0, // 后面的字节默认为0
-				},
+			c.JSON(http.StatusOK, gin.H{"status": "stopped"})
+		})
+		armGroup.POST("/emergency_resume", func(c *gin.Context) {
+			req := CanMessage{}
+			if err := c.ShouldBindJSON(&req); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+				return
 			}
-			if err := forwardToCanService(controlMsg); err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "send control command failed", "details": err.Error()})
+			if err := emergencyResumeArm(req.Interface); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "emergency resume failed", "details": err.Error()})
 				return
 			}
-
-			c.JSON(http.StatusOK, gin.H{"status": "to zero"})
+			c.JSON(http.StatusOK, gin.H{"status": "resumed"})
 		})
 
+		// 正/逆运动学，预览和验证目标
+		armGroup.POST("/fk", forwardKinematicsHandler)
+		armGroup.POST("/ik", inverseKinematicsHandler)
+		// 平滑轨迹移动
+		armGroup.POST("/move_smooth", moveSmoothHandler)
+		// 机械臂Y序列和原子操作序列(move/joints/wait/speed)
+		armGroup.POST("/y_sequence", ySequenceHandler)
+
 		// 发送位姿指令的路由处理
 		armGroup.POST("/send_pose", func(c *gin.Context) {
 			var req PoseRequest
@@ -319,12 +382,21 @@ func main() {
 				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
 				return
 			}
-			fmt.Println("req: ", req)
+			rig := currentRig(c)
+			rig.logger().Debug("发送位姿", "interface", req.Interface, "pose", []int{req.X, req.Y, req.Z, req.RX, req.RY, req.RZ}, "speed", req.Speed)
+			rig.setManualArmSide(req.Interface, req.Side)
 			if err := sendPoseCommand(req.X, req.Y, req.Z, req.RX, req.RY, req.RZ, req.Speed, req.Interface); err != nil {
+				var safetyErr *SafetyError
+				if errors.As(err, &safetyErr) {
+					c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+					return
+				}
 				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 				return
 			}
 
+			metricArmMoves.inc(req.Interface, "manual")
+			rig.teach.recordArm(req)
 			c.JSON(http.StatusOK, gin.H{"status": "pose commands sent"})
 		})
 
@@ -339,19 +411,18 @@ func main() {
 				c.JSON(400, gin.H{"error": "must be 6 values"})
 				return
 			}
-			if req.Side == "left" {
-				leftArmPianoPreset = req.Values
-				fmt.Println("leftArmPianoPreset: ", leftArmPianoPreset)
-			} else if req.Side == "right" {
-				rightArmPianoPreset = req.Values
-				fmt.Println("rightArmPianoPreset: ", rightArmPianoPreset)
+			rig := currentRig(c)
+			rig.setArmPreset(req.Side, req.Values)
+			slog.Info("更新机械臂弹琴预设", "rig", rig.ID, "side", req.Side, "preset", rig.armPreset(req.Side))
+			if err := saveRigs(); err != nil {
+				slog.Error("保存工位配置失败", "err", err)
 			}
 
 			c.JSON(200, gin.H{"status": "success"})
 		})
 	}
 	// ====================== 手指路由组 (/api/hand/*) ======================
-	handGroup := r.Group("/api/hand")
+	handGroup := api.Group("/hand")
 	{
 		handGroup.POST("/o7/control", func(c *gin.Context) {
 			var msg CanMessage
@@ -363,7 +434,7 @@ func main() {
 				http.Error(c.Writer, "数据长度错误", http.StatusBadRequest)
 				return
 			}
-			fmt.Println("msg: ", msg)
+			slog.Debug("O7控制", "interface", msg.Interface, "can_id", canIDLabel(msg.Id), "data", fmt.Sprint(msg.Data))
 			if err := forwardToCanService(msg); err != nil {
 				http.Error(c.Writer, fmt.Sprintf("发送失败: %v", err), http.StatusInternalServerError)
 				return
@@ -382,8 +453,11 @@ func main() {
 				c.JSON(400, gin.H{"error": "must be 7 values"})
 				return
 			}
-			O7FingerPianoPreset = values.Values
-			fmt.Println("O7FingerPianoPreset: ", O7FingerPianoPreset)
+			currentRig(c).setFingerPreset("o7", values.Values)
+			slog.Info("更新O7手指弹琴预设", "rig", currentRig(c).ID, "preset", fmt.Sprint(values.Values))
+			if err := saveRigs(); err != nil {
+				slog.Error("保存工位配置失败", "err", err)
+			}
 			c.JSON(200, gin.H{"status": "success"})
 		})
 		handGroup.POST("/o7/speed", func(c *gin.Context) {
@@ -398,6 +472,8 @@ func main() {
 			}
 			c.JSON(http.StatusOK, gin.H{"status": "success"})
 		})
+		// 手部原子操作序列(press/release/fingers/wait/parallel)
+		handGroup.POST("/atomic", runSequenceHandler("sequence:hand", "hand"))
 		handGroup.POST("/l10/control", func(c *gin.Context) {
 			var msg CanMessage
 			if err := json.NewDecoder(c.Request.Body).Decode(&msg); err != nil {
@@ -408,6 +484,7 @@ func main() {
 				http.Error(c.Writer, fmt.Sprintf("发送失败: %v", err), http.StatusInternalServerError)
 				return
 			}
+			currentRig(c).teach.recordHand(msg)
 			c.JSON(http.StatusOK, gin.H{"status": "success"})
 		})
 		handGroup.POST("/l10/speed", func(c *gin.Context) {
@@ -428,14 +505,17 @@ func main() {
 				c.JSON(400, gin.H{"error": "invalid request"})
 				return
 			}
-			L10FingerPianoPreset = values.Values
-			fmt.Println("L10FingerPianoPreset: ", L10FingerPianoPreset)
+			currentRig(c).setFingerPreset("l10", values.Values)
+			slog.Info("更新L10手指弹琴预设", "rig", currentRig(c).ID, "preset", fmt.Sprint(values.Values))
+			if err := saveRigs(); err != nil {
+				slog.Error("保存工位配置失败", "err", err)
+			}
 			c.JSON(200, gin.H{"status": "success"})
 		})
 
 	}
 	// ====================== 钢琴演奏路由组 (/api/piano/*) ======================
-	pianoGroup := r.Group("/api/piano")
+	pianoGroup := api.Group("/piano")
 	{
 		pianoGroup.POST("/start", func(c *gin.Context) {
 			var config PianoConfig
@@ -443,94 +523,175 @@ func main() {
 				c.JSON(400, gin.H{"error": "invalid request"})
 				return
 			}
+			if err := checkSyncOptions(config.Sync); err != nil {
+				c.JSON(400, gin.H{"error": err.Error()})
+				return
+			}
+			if config.ScoreID != "" {
+				_, data, err := scoreStore.Get(config.ScoreID)
+				if err != nil {
+					c.JSON(scoreErrorStatus(err), gin.H{"error": err.Error()})
+					return
+				}
+				config.MusicData = data
+			}
+			rig := currentRig(c)
+			if err := interfaceConflict(rig.ID, rig.effectiveInterfaces(config)); err != nil {
+				c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+				return
+			}
+			preflight, ok := preflightBeforeStart(c, rig, config, nil)
+			if !ok {
+				return
+			}
 			//fmt.Println("config: ", config)
-			// 启动钢琴演奏，调用函数playPiano
-			playPiano(config)
-			c.JSON(200, gin.H{"status": "success"})
+			// 启动钢琴演奏任务，在后台调用函数playPiano
+			job, err := rig.startPlaybackJob(config.ScoreID, func() error {
+				return rig.playPiano(config)
+			})
+			if err != nil {
+				c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(200, gin.H{"status": "success", "job": job, "preflight": preflight})
 		})
+		// 演奏前检查，请求体与 /start 相同
+		pianoGroup.POST("/preflight", preflightHandler)
 		pianoGroup.POST("/stop", func(c *gin.Context) {
-			// 暂停发送，修改全局变量以暂停发送
-			stopPiano = true
-			fmt.Println("stop")
+			// 暂停发送，修改工位状态以暂停发送
+			rig := currentRig(c)
+			rig.logger().Info("暂停演奏")
+			rig.pausePlayback()
 			c.JSON(200, gin.H{"status": "success"})
 		})
-		//恢复发送，修改全局变量以恢复发送
+		//恢复发送，修改工位状态以恢复发送
 		pianoGroup.POST("/resume", func(c *gin.Context) {
-			stopPiano = false
-			fmt.Println("resume")
+			rig := currentRig(c)
+			rig.logger().Info("恢复演奏")
+			rig.resumePlayback()
 			c.JSON(200, gin.H{"status": "success"})
 		})
 		pianoGroup.POST("/kill", func(c *gin.Context) {
-			// 终止发送，修改全局变量以停止发送
-			killPiano = true
-			fmt.Println("kill")
+			// 终止发送，修改工位状态以停止发送
+			rig := currentRig(c)
+			rig.logger().Info("终止演奏")
+			rig.killPlayback()
 			c.JSON(200, gin.H{"status": "success"})
 		})
+		// 上传MusicXML，转换为MusicData并返回导入报告
+		pianoGroup.POST("/import_musicxml", importMusicXMLHandler)
+		// 查询当前演奏任务状态
+		pianoGroup.GET("/status", func(c *gin.Context) {
+			c.JSON(200, gin.H{"job": currentRig(c).currentPlaybackJob()})
+		})
 
 	}
 
-	// 查询CAN设备接口
-	r.GET("/api/can_interfaces", func(c *gin.Context) {
-		c.JSON(http.StatusOK, gin.H{"interfaces": QueryNumberofCanDevices()})
-	})
-	fmt.Println("server running on port http://localhost:6130")
-	r.Run(":6130")
-
-}
+	// ====================== 播放列表路由组 (/api/playlist/*) ======================
+	playlistGroup := api.Group("/playlist")
+	{
+		playlistGroup.GET("", getPlaylistHandler)
+		playlistGroup.DELETE("", clearPlaylistHandler)
+		playlistGroup.POST("/items", addPlaylistItemHandler)
+		playlistGroup.DELETE("/items/:id", removePlaylistItemHandler)
+		playlistGroup.POST("/reorder", reorderPlaylistHandler)
+		playlistGroup.POST("/start", startPlaylistHandler)
+		// 跳过当前曲目
+		playlistGroup.POST("/skip", skipPlaylistHandler)
+	}
 
-// 发送位姿指令的函数
-func sendPoseCommand(x, y, z, rx, ry, rz, speed int, canId string) error {
-	// 验证速度范围
-	if speed < 0 || speed > 100 {
-		return fmt.Errorf("speed must be 0-100")
+	// ====================== 看门狗路由组 (/api/watchdog/*) ======================
+	watchdogGroup := api.Group("/watchdog")
+	{
+		// 界面定时发送工位的心跳，超时后暂停或终止该工位的演奏
+		watchdogGroup.POST("/heartbeat", heartbeatHandler)
+		watchdogGroup.GET("/status", watchdogStatusHandler)
 	}
 
-	// 发送X-Y (0x152)
-	data152 := intPairToBytes(x, y)
-	msgxy := CanMessage{
-		Interface: canId,
-		Id:        0x152,
-		Data:      data152,
+	// ====================== 安全检查路由组 (/api/safety/*) ======================
+	safetyGroup := api.Group("/safety")
+	{
+		safetyGroup.GET("/status", safetyStatusHandler)
 	}
-	if err := forwardToCanService(msgxy); err != nil {
-		return fmt.Errorf("send X-Y failed: %v", err)
+
+	// 手和机械臂混合的原子操作序列，作为演奏任务执行
+	api.POST("/sequence", runSequenceHandler("sequence:mixed", ""))
+
+	// ====================== 示教录制路由组 (/api/teach/*) ======================
+	teachGroup := api.Group("/teach")
+	{
+		// 录制期间 /api/hand/l10/control 和 /api/arm/send_pose 的指令带时间戳记录下来
+		teachGroup.POST("/start", startTeachHandler)
+		teachGroup.POST("/stop", stopTeachHandler)
+		teachGroup.GET("", getTeachHandler)
+		teachGroup.PUT("/events", replaceTeachEventsHandler)
+		teachGroup.POST("/convert", convertTeachHandler)
+		teachGroup.POST("/save", saveTeachHandler)
 	}
 
-	// 发送Z-RX (0x153)
-	data153 := intPairToBytes(z, rx)
-	msgzrx := CanMessage{
-		Interface: canId,
-		Id:        0x153,
-		Data:      data153,
+	// ====================== 延迟校准路由组 (/api/calibration/*) ======================
+	calibrationGroup := api.Group("/calibration")
+	{
+		// 用反馈帧测量工位上每个手指和机械臂的延迟
+		calibrationGroup.POST("/feedback", feedbackCalibrationHandler)
+		// 录音校准：开始录音后依次按压，再上传录音找发声时刻
+		calibrationGroup.POST("/wav/start", startWAVCalibrationHandler)
+		calibrationGroup.POST("/wav", wavCalibrationHandler)
 	}
-	if err := forwardToCanService(msgzrx); err != nil {
-		return fmt.Errorf("send Z-RX failed: %v", err)
+
+	// 回放CAN录制作为演奏任务运行，用 /api/piano/stop、resume、kill 控制
+	api.POST("/can/replay", replayHandler)
+}
+
+// 发送关节角指令(0.001°)，关节范围和速度由调用方检查
+func sendJointCommand(iface string, joints [6]int, speed int) error {
+	// J1-J2 (0x155)、J3-J4 (0x156)、J5-J6 (0x157)，最后发送运动控制指令 (0x151)
+	frames := []CanMessage{
+		{Id: 0x155, Data: intPairToBytes(joints[0], joints[1])},
+		{Id: 0x156, Data: intPairToBytes(joints[2], joints[3])},
+		{Id: 0x157, Data: intPairToBytes(joints[4], joints[5])},
+		{Id: 0x151, Data: []byte{
+			0x01,          // 控制模式
+			0x01,          // 关节控制
+			byte(speed),   // 速度
+			0, 0, 0, 0, 0, // 后面的字节默认为0
+		}},
 	}
+	return forwardFramesToCanService(iface, frames)
+}
 
-	// 发送RY-RZ (0x154)
-	data154 := intPairToBytes(ry, rz)
-	msgryrz := CanMessage{
-		Interface: canId,
-		Id:        0x154,
-		Data:      data154,
+// 发送位姿指令的函数
+func sendPoseCommand(x, y, z, rx, ry, rz, speed int, canId string) error {
+	// 验证速度范围
+	if speed < 0 || speed > 100 {
+		return fmt.Errorf("speed must be 0-100")
+	}
+	// 工作空间和双臂防碰撞检查
+	if err := guardWorkspace(canId, [6]int{x, y, z, rx, ry, rz}); err != nil {
+		return err
 	}
-	if err := forwardToCanService(msgryrz); err != nil {
-		return fmt.Errorf("send RY-RZ failed: %v", err)
+	if err := guardArmMove(canId, [6]int{x, y, z, rx, ry, rz}); err != nil {
+		return err
 	}
+	return sendPoseFrames(x, y, z, rx, ry, rz, speed, canId)
+}
 
-	// 发送运动控制指令 (0x151)
-	controlMsg := CanMessage{
-		Interface: canId,
-		Id:        0x151,
-		Data: []byte{
+// 发送位姿帧，不做安全检查；平滑轨迹的中间点在发送前已按整段检查
+func sendPoseFrames(x, y, z, rx, ry, rz, speed int, canId string) error {
+	// X-Y (0x152)、Z-RX (0x153)、RY-RZ (0x154)，最后发送运动控制指令 (0x151)
+	frames := []CanMessage{
+		{Id: 0x152, Data: intPairToBytes(x, y)},
+		{Id: 0x153, Data: intPairToBytes(z, rx)},
+		{Id: 0x154, Data: intPairToBytes(ry, rz)},
+		{Id: 0x151, Data: []byte{
 			0x01,          // 控制模式
 			0x00,          // 点位控制
 			byte(speed),   // 速度
 			0, 0, 0, 0, 0, // 后面的字节默认为0
-		},
+		}},
 	}
-	if err := forwardToCanService(controlMsg); err != nil {
-		return fmt.Errorf("send control command failed: %v", err)
+	if err := forwardFramesToCanService(canId, frames); err != nil {
+		return fmt.Errorf("send pose failed: %v", err)
 	}
 
 	return nil
@@ -541,34 +702,79 @@ func sendPoseCommand(x, y, z, rx, ry, rz, speed int, canId string) error {
 var fingerDown = int(255 * 0.6)
 
 // 钢琴演奏函数，设定好预设值，然后开始演奏
-func playPiano(config PianoConfig) {
-	//绑定canid
-	LeftHand = config.Interfaces.LeftHand
-	RightHand = config.Interfaces.RightHand
-	LeftArm = config.Interfaces.LeftArm
-	RightArm = config.Interfaces.RightArm
-
-	fmt.Println("LeftHand: ", LeftHand, "RightHand: ", RightHand, "LeftArm: ", LeftArm, "RightArm: ", RightArm)
+func (r *Rig) playPiano(config PianoConfig) error {
+	r.bindInterfaces(config)
+	if config.Sync != nil {
+		if err := r.prepareScore(config.MusicData); err != nil {
+			return err
+		}
+		return r.playmusic(config.MusicData.Music, 1, newClockSync(r, *config.Sync, config.MusicData.Music))
+	}
+	return r.playScore(config.MusicData, 1)
+}
+
+// 请求中的接口覆盖工位当前的绑定，为空的保持不变
+func (r *Rig) effectiveInterfaces(config PianoConfig) RigInterfaces {
+	cur := r.interfaces()
+	for _, f := range []struct {
+		dst *string
+		src string
+	}{
+		{&cur.LeftHand, config.Interfaces.LeftHand},
+		{&cur.RightHand, config.Interfaces.RightHand},
+		{&cur.LeftArm, config.Interfaces.LeftArm},
+		{&cur.RightArm, config.Interfaces.RightArm},
+	} {
+		if f.src != "" {
+			*f.dst = f.src
+		}
+	}
+	return cur
+}
+
+// 绑定canid
+func (r *Rig) bindInterfaces(config PianoConfig) {
+	ifaces := r.effectiveInterfaces(config)
+	r.mu.Lock()
+	r.iface = ifaces
+	r.mu.Unlock()
+
+	r.logger().Info("绑定接口", "leftHand", ifaces.LeftHand, "rightHand", ifaces.RightHand, "leftArm", ifaces.LeftArm, "rightArm", ifaces.RightArm)
+}
+
+// 演奏一首乐谱，tempo为速度倍率
+func (r *Rig) playScore(data MusicData, tempo float64) error {
+	if err := r.prepareScore(data); err != nil {
+		return err
+	}
+	// 发送music的序列
+	return r.playmusic(data.Music, tempo, nil)
+}
+
+// 演奏前从预设值开始，有预设位置时先移动过去
+func (r *Rig) prepareScore(data MusicData) error {
+	copy(r.leftArmPose, r.armPreset("left"))
+	copy(r.rightArmPose, r.armPreset("right"))
 	//将手臂移动到预设位置
-	if config.MusicData.DefaultPosition != (struct {
+	if data.DefaultPosition != (struct {
 		Left  ArmPosition `json:"left"`
 		Right ArmPosition `json:"right"`
 	}{}) {
-		movedefault(config.MusicData.DefaultPosition)
-		fmt.Println("已经移动到预设位置！！马上准备演奏！！")
+		if err := r.movedefault(data.DefaultPosition); err != nil {
+			return err
+		}
+		r.logger().Info("已经移动到预设位置，准备演奏")
 	} else {
-		fmt.Println("没有预设位置，请手动调整预设位置")
+		r.logger().Warn("没有预设位置，请手动调整预设位置")
 	}
-
-	// 发送music的序列
-	playmusic(config.MusicData.Music)
+	return nil
 }
 
 // 移动到预设位置
-func movedefault(default_position struct {
+func (r *Rig) movedefault(default_position struct {
 	Left  ArmPosition `json:"left"`
 	Right ArmPosition `json:"right"`
-}) {
+}) error {
 	//兼容自定义好的预设位置
 	// fmt.Println("default_position: ", default_position)
 	// // 发送左臂的序列,在预设的x,y,z,rx,ry,rz的基础上，加上预设的值
@@ -587,75 +793,194 @@ func movedefault(default_position struct {
 	// //发送右臂的序列
 	// sendPoseCommand(rightArmPianoPreset[0], rightArmPianoPreset[1], rightArmPianoPreset[2], rightArmPianoPreset[3], rightArmPianoPreset[4], rightArmPianoPreset[5], 100, RightArm)
 	//手动调整版本
-	leftArmPianoPreset[2] += default_position.Left.Move * 21
-	rightArmPianoPreset[2] += default_position.Right.Move * 21
-	sendArmPoseCommand(LeftArm, leftArmPianoPreset)
-	sendArmPoseCommand(RightArm, rightArmPianoPreset)
+	ifaces := r.interfaces()
+	copy(r.leftArmPose, r.armPreset("left"))
+	copy(r.rightArmPose, r.armPreset("right"))
+	r.leftArmPose[2] += default_position.Left.Move * armStepMM
+	r.rightArmPose[2] += default_position.Right.Move * armStepMM
+	if err := sendArmPoseCommand(ifaces.LeftArm, r.leftArmPose); err != nil {
+		return err
+	}
+	return sendArmPoseCommand(ifaces.RightArm, r.rightArmPose)
 }
 
 // index , middle , ring , pinky。分别代表食指，中指，无名指，小指。
 var LEFT_HAND_ID uint32 = 0x28
 var RIGHT_HAND_ID uint32 = 0x27
 
-func playmusic(music []MusicNote) {
-	// 初始化当前手指和机械臂位姿
-	copy(L10currentleftFinger, L10FingerPianoPreset)
-	copy(L10currentrightFinger, L10FingerPianoPreset)
+// StepClock 节拍时钟：每个节拍开始前调用 waitStep，返回时开始该节拍；
+// 节拍末尾不再固定休眠，由时钟决定下一个节拍的开始时间，没有外部时钟时按演奏时间轴(timelineClock)。
+// lead 为延迟补偿，时钟提前该时间开始节拍
+type StepClock interface {
+	waitStep(i int, lead time.Duration) error
+}
 
-	for _, note := range music {
+func (r *Rig) playmusic(music []MusicNote, tempo float64, clock StepClock) error {
+	// 初始化当前手指和机械臂位姿
+	preset := r.fingerPreset()
+	r.leftFinger = append([]byte{}, preset...)
+	r.rightFinger = append([]byte{}, preset...)
+	ifaces := r.interfaces()
+	timing := calibratedTiming(ifaces)
+	// 没有外部时钟时按演奏时间轴开始节拍，手指和机械臂的延迟补偿都计入时间轴
+	if clock == nil {
+		clock = &timelineClock{rig: r, onsets: playbackTimeline(music, tempo, timing)}
+	}
+	log := r.logger()
+
+	for i, note := range music {
+		// 由时钟处理暂停
+		err := clock.waitStep(i, timing.lead)
+		if err == errStepSkipped {
+			// 错过的节拍不按，机械臂仍然移动，保持后面节拍的位置
+			if err := r.skipStep(note, ifaces); err != nil {
+				return fmt.Errorf("step %d: %v", i, err)
+			}
+			r.updatePlaybackProgress(i+1, len(music))
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		// 暂停时等待恢复，终止时退出
+		if err := r.waitPlaybackResume(); err != nil {
+			return err
+		}
+		noteLog := log.With("note", i)
 		var wg sync.WaitGroup
+		var leftErr, rightErr error
 		wg.Add(2)
 		go func() {
-			handleOneSide(note.Left, &L10currentleftFinger, &leftArmPianoPreset, LeftHand, LeftArm, RIGHT_HAND_ID)
+			leftErr = handleOneSide(note.Left, preset, &r.leftFinger, &r.leftArmPose, ifaces.LeftHand, ifaces.LeftArm, r.handID("left"), tempo, timing.left, noteLog.With("side", "left"))
 			wg.Done()
 		}()
 		go func() {
-			handleOneSide(note.Right, &L10currentrightFinger, &rightArmPianoPreset, RightHand, RightArm, RIGHT_HAND_ID)
+			rightErr = handleOneSide(note.Right, preset, &r.rightFinger, &r.rightArmPose, ifaces.RightHand, ifaces.RightArm, r.handID("right"), tempo, timing.right, noteLog.With("side", "right"))
 			wg.Done()
 		}()
 		wg.Wait()
-		fmt.Println("note: ", note)
+		noteLog.Debug("节拍完成", "left", note.Left.Fingers, "right", note.Right.Fingers)
+		// 安全检查拒绝或CAN服务发送失败时中止演奏，此时手指已经抬起
+		if leftErr != nil {
+			return fmt.Errorf("step %d: %v", i, leftErr)
+		}
+		if rightErr != nil {
+			return fmt.Errorf("step %d: %v", i, rightErr)
+		}
+		metricNotesPlayed.add(float64(len(note.Left.Fingers)), r.ID, "left")
+		metricNotesPlayed.add(float64(len(note.Right.Fingers)), r.ID, "right")
+		r.updatePlaybackProgress(i+1, len(music))
+	}
+	return nil
+}
+
+// 跳过一个节拍：不按手指，只按节拍的移动量移动两只机械臂
+func (r *Rig) skipStep(note MusicNote, ifaces RigInterfaces) error {
+	for _, s := range []struct {
+		action HandAction
+		pose   *[]int
+		arm    string
+	}{{note.Left, &r.leftArmPose, ifaces.LeftArm}, {note.Right, &r.rightArmPose, ifaces.RightArm}} {
+		units := max(abs(s.action.Move.X), abs(s.action.Move.Y))
+		if units == 0 {
+			continue
+		}
+		from := append([]int{}, (*s.pose)...)
+		(*s.pose)[0] += s.action.Move.X * armStepMM
+		(*s.pose)[1] += s.action.Move.Y * armStepMM
+		if err := moveArm(s.arm, from, *s.pose, units); err != nil {
+			return err
+		}
 	}
+	return nil
 }
 
-func handleOneSide(action HandAction, fingerState *[]byte, armPose *[]int, handCan string, armCan string, handId uint32) {
+func handleOneSide(action HandAction, preset []byte, fingerState *[]byte, armPose *[]int, handCan string, armCan string, handId uint32, tempo float64, timing sideTiming, log *slog.Logger) error {
 	var wg sync.WaitGroup
+	var errMu sync.Mutex
+	var fingerErr error
+	keepErr := func(err error) {
+		errMu.Lock()
+		if fingerErr == nil {
+			fingerErr = err
+		}
+		errMu.Unlock()
+	}
 	wg.Add(len(action.Fingers))
 	// 1. 并发执行所有手指动作
 	for i, fingerName := range action.Fingers {
 		go func(idx int, name string, duration float64) {
-			// 按压
+			// 按压，比最慢的手指快的晚发，使按下的时刻一致
+			time.Sleep(timing.press[name])
 			(*fingerState)[fingerIndexMap[name]] = byte(fingerDown)
-			sendL10FingerCommand(handCan, *fingerState, handId)
+			if err := sendL10FingerCommand(handCan, *fingerState, handId); err != nil {
+				keepErr(err)
+			}
+			log.Debug("手指按下", "finger", name, "interface", handCan, "can_id", canIDLabel(handId), "duration", duration)
+			pressed := time.Now()
 			// 按压持续
-			time.Sleep(time.Duration(duration * float64(time.Second)))
-			// 恢复
-			(*fingerState)[fingerIndexMap[name]] = L10FingerPianoPreset[fingerIndexMap[name]]
-			sendL10FingerCommand(handCan, *fingerState, handId)
+			time.Sleep(time.Duration(duration / tempo * float64(time.Second)))
+			// 恢复，按压失败时也要尝试抬起
+			(*fingerState)[fingerIndexMap[name]] = preset[fingerIndexMap[name]]
+			if err := sendL10FingerCommand(handCan, *fingerState, handId); err != nil {
+				keepErr(err)
+			}
+			metricPressDuration.observe(time.Since(pressed).Seconds(), handCan)
+			log.Debug("手指抬起", "finger", name, "interface", handCan, "can_id", canIDLabel(handId))
 			wg.Done()
 		}(i, fingerName, action.Time[i])
 	}
-	// 2. 等待所有手指动作完成
+	// 2. 等待所有手指动作完成，发送失败时不再移动机械臂
 	wg.Wait()
-	// 3. 机械臂移动
-	(*armPose)[0] += action.Move.X * 21
-	(*armPose)[1] += action.Move.Y * 21
-	sendArmPoseCommand(armCan, *armPose)
-	// 4. 固定休眠0.2s，模拟机械臂移动时间
-	time.Sleep(150 * time.Millisecond)
+	if fingerErr != nil {
+		return fingerErr
+	}
+	// 3. 机械臂移动，移动较远时走抬起-平移-放下的平滑轨迹
+	from := append([]int{}, (*armPose)...)
+	(*armPose)[0] += action.Move.X * armStepMM
+	(*armPose)[1] += action.Move.Y * armStepMM
+	units := max(abs(action.Move.X), abs(action.Move.Y))
+	log.Debug("机械臂移动", "interface", armCan, "units", units, "pose", *armPose)
+	if err := moveArm(armCan, from, *armPose, units); err != nil {
+		return err
+	}
+	// 4. 下一个节拍的手指提前发出，机械臂延迟超出提前量时等待到位；节拍间隔由时钟控制
+	if units > 0 {
+		time.Sleep(timing.settle)
+	}
+	return nil
+}
+
+// 每个节拍结束后留给机械臂移动的时间，计入节拍时长
+const armMoveGap = 150 * time.Millisecond
+
+// 发送机械臂位姿(mm/°)
+func sendArmPoseCommand(armCan string, armPose []int) error {
+	err := sendPoseCommand(armPose[0]*1000, armPose[1]*1000, armPose[2]*1000, armPose[3]*1000, armPose[4]*1000, armPose[5]*1000, 100, armCan)
+	return armPlaybackError(armCan, err)
 }
 
-func sendArmPoseCommand(armCan string, armPose []int) {
-	sendPoseCommand(armPose[0]*1000, armPose[1]*1000, armPose[2]*1000, armPose[3]*1000, armPose[4]*1000, armPose[5]*1000, 100, armCan)
+// 演奏中发送失败(重试后仍失败或安全检查拒绝)时返回错误，由演奏任务中止
+func armPlaybackError(armCan string, err error) error {
+	var safetyErr *SafetyError
+	if err != nil && !errors.As(err, &safetyErr) {
+		slog.Warn("发送机械臂位姿失败", "interface", armCan, "err", err)
+		return fmt.Errorf("arm %s: %v", armCan, err)
+	}
+	return err
 }
 
-func sendL10FingerCommand(handCan string, fingerState []byte, handId uint32) {
+func sendL10FingerCommand(handCan string, fingerState []byte, handId uint32) error {
 	msg := CanMessage{
 		Interface: handCan,
 		Id:        handId, //是left的话，id是0x28，是right的话，id是0x27
 		Data:      append([]byte{0x01}, fingerState...),
 	}
-	forwardToCanService(msg)
+	if err := forwardToCanService(msg); err != nil {
+		slog.Warn("发送手指指令失败", "interface", handCan, "can_id", canIDLabel(handId), "err", err)
+		return fmt.Errorf("hand %s: %v", handCan, err)
+	}
+	return nil
 }
 
 // 将两个int32转换为8字节数据 (每个int32占4字节，已经是0.001°单位)
@@ -676,6 +1001,16 @@ func intPairToBytes(val1, val2 int) []byte {
 
 // 查询CAN设备列表
 func QueryNumberofCanDevices() []string {
+	interfaces, err := queryCanDevices()
+	if err != nil {
+		slog.Error("获取CAN设备列表失败", "err", err)
+		return []string{}
+	}
+	return interfaces
+}
+
+// 查询CAN服务上可用的接口
+func queryCanDevices() ([]string, error) {
 	type ResponseData struct {
 		Count      int      `json:"count"`
 		Interfaces []string `json:"interfaces"`
@@ -686,26 +1021,17 @@ func QueryNumberofCanDevices() []string {
 		Data   ResponseData `json:"data"`
 	}
 
-	resp, err := http.Get("http://localhost:5260/api/setup/available")
+	body, err := canBridge.do(http.MethodGet, "/api/setup/available", nil, true)
 	if err != nil {
-		log.Printf("获取CAN设备列表失败: %v", err)
-		return []string{}
-	}
-	defer resp.Body.Close()
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		log.Printf("读取响应失败: %v", err)
-		return []string{}
+		return nil, fmt.Errorf("query CAN devices failed: %v", err)
 	}
 
 	var apiResponse ApiResponse
 	if err := json.Unmarshal(body, &apiResponse); err != nil {
-		log.Printf("解析JSON失败: %v", err)
-		return []string{}
+		return nil, fmt.Errorf("parse response failed: %v", err)
 	}
 
-	return apiResponse.Data.Interfaces
+	return apiResponse.Data.Interfaces, nil
 }
 
 // 验证关节角度范围
@@ -713,6 +1039,16 @@ func validateJointRange(value, min, max int) bool {
 	return value >= min && value <= max
 }
 
+// 按机械臂模型的关节范围验证关节角(0.001°)
+func validateJoints(joints [6]int) bool {
+	for i, l := range kinematics.Piper.Limits {
+		if !validateJointRange(joints[i], int(l.Min*1000), int(l.Max*1000)) {
+			return false
+		}
+	}
+	return true
+}
+
 // 转发到本地CAN服务
 func forwardToCanService(msg CanMessage) error {
 	jsonData, err := json.Marshal(msg)
@@ -720,16 +1056,14 @@ func forwardToCanService(msg CanMessage) error {
 		return fmt.Errorf("marshal message failed: %v", err)
 	}
 
-	resp, err := http.Post("http://localhost:5260/api/can", "application/json", bytes.NewReader(jsonData))
-	if err != nil {
+	if _, err := canBridge.do(http.MethodPost, "/api/can", jsonData, idempotentFrame(msg.Id)); err != nil {
+		if _, ok := err.(*bridgeStatusError); ok {
+			return err
+		}
 		return fmt.Errorf("send to CAN service failed: %v", err)
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("CAN service error: %s", string(body))
-	}
+	canRecorder.record(false, msg)
+	metricFramesSent.inc(msg.Interface, canIDLabel(msg.Id))
 
 	return nil
 }
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Prometheus 文本格式的指标，GET /metrics 输出
+
+// 一个指标族：输出 HELP/TYPE 和所有标签组合的样本
+type metricFamily interface {
+	write(w io.Writer)
+}
+
+var metricFamilies []metricFamily
+
+// 标签值按 Prometheus 文本格式转义
+func labelPairs(names, values []string, extra ...string) string {
+	var parts []string
+	for i, name := range names {
+		parts = append(parts, fmt.Sprintf(`%s="%s"`, name, escapeLabel(values[i])))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		parts = append(parts, fmt.Sprintf(`%s="%s"`, extra[i], escapeLabel(extra[i+1])))
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func escapeLabel(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+// counterVec 按标签计数
+type counterVec struct {
+	name, help string
+	labels     []string
+	mu         sync.Mutex
+	values     map[string]float64
+	keys       map[string][]string
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	c := &counterVec{name: name, help: help, labels: labels, values: map[string]float64{}, keys: map[string][]string{}}
+	metricFamilies = append(metricFamilies, c)
+	return c
+}
+
+func (c *counterVec) add(v float64, values ...string) {
+	key := strings.Join(values, "\x00")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.keys[key]; !ok {
+		c.keys[key] = values
+	}
+	c.values[key] += v
+}
+
+func (c *counterVec) inc(values ...string) {
+	c.add(1, values...)
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	keys := make([]string, 0, len(c.values))
+	for k := range c.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, labelPairs(c.labels, c.keys[k]), formatBound(c.values[k]))
+	}
+}
+
+// histogramVec 按标签分组的直方图
+type histogramVec struct {
+	name, help string
+	labels     []string
+	buckets    []float64
+	mu         sync.Mutex
+	values     map[string]*Histogram
+	keys       map[string][]string
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	h := &histogramVec{name: name, help: help, labels: labels, buckets: buckets, values: map[string]*Histogram{}, keys: map[string][]string{}}
+	metricFamilies = append(metricFamilies, h)
+	return h
+}
+
+func (h *histogramVec) observe(v float64, values ...string) {
+	key := strings.Join(values, "\x00")
+	h.mu.Lock()
+	hist := h.values[key]
+	if hist == nil {
+		hist = newHistogram(h.buckets)
+		h.values[key] = hist
+		h.keys[key] = values
+	}
+	h.mu.Unlock()
+	hist.Observe(v)
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	keys := make([]string, 0, len(h.values))
+	for k := range h.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s := h.values[k].Snapshot()
+		values := h.keys[k]
+		for i, bound := range s.Bounds {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labelPairs(h.labels, values, "le", formatBound(bound)), s.Buckets[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labelPairs(h.labels, values, "le", "+Inf"), s.Count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, labelPairs(h.labels, values), formatBound(s.Sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, labelPairs(h.labels, values), s.Count)
+	}
+}
+
+// gaugeFunc 输出时才计算的仪表
+type gaugeFunc struct {
+	name, help string
+	labels     []string
+	collect    func(emit func(v float64, values ...string))
+}
+
+func newGaugeFunc(name, help string, collect func(emit func(v float64, values ...string)), labels ...string) *gaugeFunc {
+	g := &gaugeFunc{name: name, help: help, labels: labels, collect: collect}
+	metricFamilies = append(metricFamilies, g)
+	return g
+}
+
+func (g *gaugeFunc) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", g.name, g.help, g.name)
+	g.collect(func(v float64, values ...string) {
+		fmt.Fprintf(w, "%s%s %s\n", g.name, labelPairs(g.labels, values), formatBound(v))
+	})
+}
+
+// 时长直方图的分桶(秒)：按压、调度延迟
+var durationBuckets = []float64{0.01, 0.025, 0.05, 0.1, 0.2, 0.3, 0.5, 0.75, 1, 1.5, 2, 5}
+
+var (
+	metricFramesSent = newCounterVec("piano_can_frames_sent_total",
+		"CAN frames sent to the CAN service.", "interface", "id")
+	metricBridgeDuration = newHistogramVec("piano_bridge_request_duration_seconds",
+		"Duration of HTTP requests to the CAN service, per attempt.", latencyBuckets, "path")
+	metricBridgeErrors = newCounterVec("piano_bridge_errors_total",
+		"Failed CAN service requests: network, status (HTTP error) or breaker (rejected while open).", "path", "kind")
+	metricBridgeRetries = newCounterVec("piano_bridge_retries_total",
+		"Retried CAN service requests.", "path")
+	metricNotesPlayed = newCounterVec("piano_notes_played_total",
+		"Finger presses played by playback jobs.", "rig", "side")
+	metricLateness = newHistogramVec("piano_schedule_lateness_seconds",
+		"How late each step started: against the calibrated playback timeline in free mode, the external clock or the ensemble timeline otherwise.", durationBuckets, "rig", "mode")
+	metricPressDuration = newHistogramVec("piano_finger_press_duration_seconds",
+		"Time between press and release commands of a finger during playback.", durationBuckets, "interface")
+	metricArmMoves = newCounterVec("piano_arm_moves_total",
+		"Arm moves: playback steps (direct/trajectory) and manual API moves.", "interface", "kind")
+	metricJobs = newCounterVec("piano_playback_jobs_total",
+		"Playback jobs by state: started and the final state.", "rig", "state")
+	metricPreflightFailures = newCounterVec("piano_preflight_failures_total",
+		"Failed preflight checks.", "check")
+	metricHTTPRequests = newCounterVec("piano_http_requests_total",
+		"API requests handled.", "method", "route", "status")
+	metricHTTPDuration = newHistogramVec("piano_http_request_duration_seconds",
+		"API request duration.", latencyBuckets, "method", "route")
+	_ = newGaugeFunc("piano_playback_job_state",
+		"Current (or last) playback job of each rig, 1 for its state.", collectJobStates, "rig", "state")
+)
+
+func collectJobStates(emit func(v float64, values ...string)) {
+	for _, rig := range allRigs() {
+		if job := rig.currentPlaybackJob(); job != nil {
+			emit(1, rig.ID, job.State)
+		}
+	}
+}
+
+// CAN ID 标签，与日志中的写法一致
+func canIDLabel(id uint32) string {
+	return fmt.Sprintf("0x%X", id)
+}
+
+// 统计API请求，没有匹配路由的请求记为 unmatched
+func metricsMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		metricHTTPRequests.inc(c.Request.Method, route, fmt.Sprint(c.Writer.Status()))
+		metricHTTPDuration.observe(time.Since(start).Seconds(), c.Request.Method, route)
+	}
+}
+
+func metricsHandler(c *gin.Context) {
+	c.Header("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	c.Status(http.StatusOK)
+	for _, f := range metricFamilies {
+		f.write(c.Writer)
+	}
+}
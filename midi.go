@@ -0,0 +1,359 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ScoreNote 键盘层面的一个音符
+type ScoreNote struct {
+	Pitch    int     `json:"pitch"`          // MIDI音高
+	Start    float64 `json:"start"`          // 起始时间(秒)
+	Duration float64 `json:"duration"`       // 时值(秒)
+	Hand     string  `json:"hand,omitempty"` // 可选，指定 "left" 或 "right"
+}
+
+type midiTempo struct {
+	tick  int
+	usPQN int // 每四分音符微秒数
+}
+
+type midiNoteEvent struct {
+	tick    int
+	on      bool
+	channel int
+	pitch   int
+}
+
+// 读取标准MIDI文件，返回按起始时间排序的音符，打击乐通道(10)被忽略
+func readMIDI(r io.Reader) ([]ScoreNote, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("read midi failed: %v", err)
+	}
+	buf := bytes.NewReader(data)
+
+	var chunk [4]byte
+	var length uint32
+	if _, err := io.ReadFull(buf, chunk[:]); err != nil || string(chunk[:]) != "MThd" {
+		return nil, fmt.Errorf("not a midi file")
+	}
+	if err := binary.Read(buf, binary.BigEndian, &length); err != nil || length < 6 {
+		return nil, fmt.Errorf("invalid midi header")
+	}
+	var header struct {
+		Format   uint16
+		Tracks   uint16
+		Division uint16
+	}
+	if err := binary.Read(buf, binary.BigEndian, &header); err != nil {
+		return nil, fmt.Errorf("invalid midi header")
+	}
+	if header.Division&0x8000 != 0 {
+		return nil, fmt.Errorf("SMPTE time division is not supported")
+	}
+	buf.Seek(int64(length-6), io.SeekCurrent)
+
+	tempos := []midiTempo{{0, 500000}}
+	var events []midiNoteEvent
+	for t := 0; t < int(header.Tracks); t++ {
+		if _, err := io.ReadFull(buf, chunk[:]); err != nil {
+			return nil, fmt.Errorf("track %d: %v", t, err)
+		}
+		if err := binary.Read(buf, binary.BigEndian, &length); err != nil {
+			return nil, fmt.Errorf("track %d: %v", t, err)
+		}
+		body := make([]byte, length)
+		if _, err := io.ReadFull(buf, body); err != nil {
+			return nil, fmt.Errorf("track %d: truncated", t)
+		}
+		if string(chunk[:]) != "MTrk" {
+			continue
+		}
+		ev, tp, err := parseMIDITrack(body)
+		if err != nil {
+			return nil, fmt.Errorf("track %d: %v", t, err)
+		}
+		events = append(events, ev...)
+		tempos = append(tempos, tp...)
+	}
+
+	sort.SliceStable(tempos, func(i, j int) bool { return tempos[i].tick < tempos[j].tick })
+	sort.SliceStable(events, func(i, j int) bool { return events[i].tick < events[j].tick })
+	seconds := func(tick int) float64 {
+		sec, last := 0.0, tempos[0]
+		for _, tp := range tempos[1:] {
+			if tp.tick > tick {
+				break
+			}
+			sec += float64(tp.tick-last.tick) * float64(last.usPQN) / 1e6 / float64(header.Division)
+			last = tp
+		}
+		return sec + float64(tick-last.tick)*float64(last.usPQN)/1e6/float64(header.Division)
+	}
+
+	var notes []ScoreNote
+	open := map[[2]int][]int{}
+	for _, ev := range events {
+		if ev.channel == 9 {
+			continue
+		}
+		key := [2]int{ev.channel, ev.pitch}
+		if ev.on {
+			open[key] = append(open[key], ev.tick)
+			continue
+		}
+		if len(open[key]) == 0 {
+			continue
+		}
+		start := open[key][0]
+		open[key] = open[key][1:]
+		notes = append(notes, ScoreNote{
+			Pitch:    ev.pitch,
+			Start:    seconds(start),
+			Duration: seconds(ev.tick) - seconds(start),
+		})
+	}
+	sort.SliceStable(notes, func(i, j int) bool {
+		if notes[i].Start != notes[j].Start {
+			return notes[i].Start < notes[j].Start
+		}
+		return notes[i].Pitch < notes[j].Pitch
+	})
+	return notes, nil
+}
+
+func parseMIDITrack(body []byte) ([]midiNoteEvent, []midiTempo, error) {
+	var events []midiNoteEvent
+	var tempos []midiTempo
+	tick, pos := 0, 0
+	var status byte
+	for pos < len(body) {
+		delta, n := readVLQ(body[pos:])
+		if n == 0 {
+			return nil, nil, fmt.Errorf("invalid delta time")
+		}
+		pos += n
+		tick += delta
+		if pos >= len(body) {
+			return nil, nil, fmt.Errorf("truncated event")
+		}
+		b := body[pos]
+		switch {
+		case b == 0xFF:
+			if pos+2 > len(body) {
+				return nil, nil, fmt.Errorf("truncated meta event")
+			}
+			typ := body[pos+1]
+			l, n := readVLQ(body[pos+2:])
+			start := pos + 2 + n
+			if n == 0 || start+l > len(body) {
+				return nil, nil, fmt.Errorf("truncated meta event")
+			}
+			if typ == 0x51 && l == 3 {
+				us := int(body[start])<<16 | int(body[start+1])<<8 | int(body[start+2])
+				tempos = append(tempos, midiTempo{tick, us})
+			}
+			pos = start + l
+			if typ == 0x2F {
+				return events, tempos, nil
+			}
+		case b == 0xF0 || b == 0xF7:
+			l, n := readVLQ(body[pos+1:])
+			pos += 1 + n + l
+		default:
+			if b&0x80 != 0 {
+				status = b
+				pos++
+			} else if status == 0 {
+				return nil, nil, fmt.Errorf("running status without status byte")
+			}
+			size := 2
+			if status&0xF0 == 0xC0 || status&0xF0 == 0xD0 {
+				size = 1
+			}
+			if pos+size > len(body) {
+				return nil, nil, fmt.Errorf("truncated channel event")
+			}
+			ch := int(status & 0x0F)
+			switch status & 0xF0 {
+			case 0x90:
+				events = append(events, midiNoteEvent{tick, body[pos+1] > 0, ch, int(body[pos])})
+			case 0x80:
+				events = append(events, midiNoteEvent{tick, false, ch, int(body[pos])})
+			}
+			pos += size
+		}
+	}
+	return events, tempos, nil
+}
+
+// 读取变长数值，返回数值和占用字节数
+func readVLQ(b []byte) (int, int) {
+	v := 0
+	for i := 0; i < len(b) && i < 4; i++ {
+		v = v<<7 | int(b[i]&0x7F)
+		if b[i]&0x80 == 0 {
+			return v, i + 1
+		}
+	}
+	return 0, 0
+}
+
+// MIDI导出的时间精度：每四分音符480 tick，固定120bpm，即每秒960 tick
+const (
+	midiPPQ          = 480
+	midiTicksPerSec  = 960
+	midiExportTempo  = 500000
+	midiExportVolume = 80
+)
+
+// 根据预设位姿和机械臂步距还原乐谱实际按下的琴键，时间来自按压时长和节拍间隔。
+// 预设位置的 move 由 movedefault 加在Z轴上，不改变手在琴键方向的位置，所以从预设位姿的琴键开始
+func scoreToNotes(data MusicData, kb KeyboardModel) []ScoreNote {
+	var notes []ScoreNote
+	pos := map[string]int{"left": 0, "right": 0}
+	onsets := musicTimeline(data.Music, 1)
+	for i, note := range data.Music {
+		for _, side := range []struct {
+			name   string
+			action HandAction
+		}{{"left", note.Left}, {"right", note.Right}} {
+			for j, f := range side.action.Fingers {
+				if j >= len(side.action.Time) {
+					break
+				}
+				notes = append(notes, ScoreNote{
+					Pitch:    kb.keyOf(side.name, pos[side.name], f),
+					Start:    onsets[i],
+					Duration: side.action.Time[j],
+					Hand:     side.name,
+				})
+			}
+			pos[side.name] += side.action.Move.Y
+		}
+	}
+	return notes
+}
+
+// 写标准MIDI文件(格式1)：第一轨为速度，之后右手、左手各一轨
+func writeMIDI(w io.Writer, notes []ScoreNote) error {
+	tempoTrack := []byte{0x00, 0xFF, 0x51, 0x03, byte(midiExportTempo >> 16), byte(midiExportTempo >> 8 & 0xFF), byte(midiExportTempo & 0xFF)}
+	tracks := [][]byte{appendEndOfTrack(tempoTrack)}
+	for ch, hand := range []string{"right", "left"} {
+		type event struct {
+			tick int
+			on   bool
+			key  int
+		}
+		var events []event
+		for _, n := range notes {
+			if n.Hand != hand && !(hand == "right" && n.Hand == "") {
+				continue
+			}
+			start := int(math.Round(n.Start * midiTicksPerSec))
+			end := int(math.Round((n.Start + n.Duration) * midiTicksPerSec))
+			if end <= start {
+				end = start + 1
+			}
+			events = append(events, event{start, true, n.Pitch}, event{end, false, n.Pitch})
+		}
+		// 同一tick先松开再按下
+		sort.SliceStable(events, func(i, j int) bool {
+			if events[i].tick != events[j].tick {
+				return events[i].tick < events[j].tick
+			}
+			return !events[i].on && events[j].on
+		})
+		name := "Right Hand"
+		if hand == "left" {
+			name = "Left Hand"
+		}
+		track := append([]byte{0x00, 0xFF, 0x03, byte(len(name))}, name...)
+		last := 0
+		for _, ev := range events {
+			track = appendVLQ(track, ev.tick-last)
+			last = ev.tick
+			if ev.on {
+				track = append(track, 0x90|byte(ch), byte(ev.key), midiExportVolume)
+			} else {
+				track = append(track, 0x80|byte(ch), byte(ev.key), 0)
+			}
+		}
+		tracks = append(tracks, appendEndOfTrack(track))
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("MThd")
+	binary.Write(&buf, binary.BigEndian, []uint32{6})
+	binary.Write(&buf, binary.BigEndian, []uint16{1, uint16(len(tracks)), midiPPQ})
+	for _, t := range tracks {
+		buf.WriteString("MTrk")
+		binary.Write(&buf, binary.BigEndian, uint32(len(t)))
+		buf.Write(t)
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func appendEndOfTrack(track []byte) []byte {
+	return append(track, 0x00, 0xFF, 0x2F, 0x00)
+}
+
+func appendVLQ(b []byte, v int) []byte {
+	var tmp [4]byte
+	n := 0
+	for {
+		tmp[n] = byte(v & 0x7F)
+		n++
+		v >>= 7
+		if v == 0 || n == 4 {
+			break
+		}
+	}
+	for i := n - 1; i >= 0; i-- {
+		if i > 0 {
+			b = append(b, tmp[i]|0x80)
+		} else {
+			b = append(b, tmp[i])
+		}
+	}
+	return b
+}
+
+// 下载乐谱库中乐谱的MIDI文件
+func scoreMIDIHandler(c *gin.Context) {
+	_, data, err := scoreStore.Get(c.Param("id"))
+	if err != nil {
+		c.JSON(scoreErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename*=UTF-8''%s.mid", url.PathEscape(c.Param("id"))))
+	c.Status(http.StatusOK)
+	c.Header("Content-Type", "audio/midi")
+	writeMIDI(c.Writer, scoreToNotes(data, appConfig.Keyboard))
+}
+
+// 请求体为MusicData，返回MIDI文件
+func exportMIDIHandler(c *gin.Context) {
+	var data MusicData
+	if err := c.ShouldBindJSON(&data); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+		return
+	}
+	if err := validateMusicData(data); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.Status(http.StatusOK)
+	c.Header("Content-Type", "audio/midi")
+	writeMIDI(c.Writer, scoreToNotes(data, appConfig.Keyboard))
+}
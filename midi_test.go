@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"math"
+	"testing"
+)
+
+func TestScoreToNotes(t *testing.T) {
+	kb := defaultKeyboardModel()
+	step := func(left, right HandAction) MusicNote { return MusicNote{Left: left, Right: right} }
+	press := func(f string, move int) HandAction {
+		return HandAction{Fingers: []string{f}, Time: []float64{0.2}, Move: ArmMovement{Y: move}}
+	}
+	tests := []struct {
+		name  string
+		data  MusicData
+		want  []int
+		hands []string
+	}{
+		{
+			name:  "home keys",
+			data:  MusicData{Music: []MusicNote{step(press("index", 0), press("index", 0)), step(press("pinky", 0), HandAction{})}},
+			want:  []int{60, 67, 55},
+			hands: []string{"left", "right", "left"},
+		},
+		{
+			name:  "moves apply after the step",
+			data:  MusicData{Music: []MusicNote{step(HandAction{}, press("index", 2)), step(HandAction{}, press("index", -1)), step(HandAction{}, press("middle", 0))}},
+			want:  []int{67, 71, 71},
+			hands: []string{"right", "right", "right"},
+		},
+		{
+			// 预设位置的 move 是Z轴高度，不改变按下的琴键
+			name: "default position move does not shift keys",
+			data: func() MusicData {
+				d := MusicData{Music: []MusicNote{step(press("index", 0), press("index", 0))}}
+				d.DefaultPosition.Left.Move, d.DefaultPosition.Right.Move = 3, -2
+				return d
+			}(),
+			want:  []int{60, 67},
+			hands: []string{"left", "right"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			notes := scoreToNotes(tt.data, kb)
+			if len(notes) != len(tt.want) {
+				t.Fatalf("got %+v, want pitches %v", notes, tt.want)
+			}
+			for i, n := range notes {
+				if n.Pitch != tt.want[i] || n.Hand != tt.hands[i] {
+					t.Errorf("note %d: got %s %s, want %s %s", i, n.Hand, pitchName(n.Pitch), tt.hands[i], pitchName(tt.want[i]))
+				}
+			}
+		})
+	}
+}
+
+// 导出的MIDI再读回来，音高和时间不变
+func TestWriteMIDIRoundTrip(t *testing.T) {
+	notes := []ScoreNote{
+		{Pitch: 60, Start: 0, Duration: 0.5, Hand: "left"},
+		{Pitch: 67, Start: 0, Duration: 0.25, Hand: "right"},
+		{Pitch: 69, Start: 0.5, Duration: 0.5, Hand: "right"},
+	}
+	var buf bytes.Buffer
+	if err := writeMIDI(&buf, notes); err != nil {
+		t.Fatal(err)
+	}
+	got, err := readMIDI(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(notes) {
+		t.Fatalf("got %+v", got)
+	}
+	for _, want := range notes {
+		found := false
+		for _, n := range got {
+			found = found || n.Pitch == want.Pitch && math.Abs(n.Start-want.Start) < 1e-3 && math.Abs(n.Duration-want.Duration) < 1e-3
+		}
+		if !found {
+			t.Errorf("note %+v missing from %+v", want, got)
+		}
+	}
+}
@@ -0,0 +1,432 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ImportReport 乐谱导入报告
+type ImportReport struct {
+	Format      string     `json:"format"`
+	Parts       []string   `json:"parts,omitempty"`
+	Notes       int        `json:"notes"`       // 读取到的音符数(连音线合并后)
+	Unsupported []string   `json:"unsupported"` // 不支持而被忽略的结构
+	Plan        PlanReport `json:"plan"`        // 指法规划结果
+}
+
+// 记录不支持的结构，相同内容只记录一次并计数
+type unsupportedLog struct {
+	order  []string
+	counts map[string]int
+}
+
+func (u *unsupportedLog) add(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	if u.counts == nil {
+		u.counts = map[string]int{}
+	}
+	if u.counts[msg] == 0 {
+		u.order = append(u.order, msg)
+	}
+	u.counts[msg]++
+}
+
+func (u *unsupportedLog) list() []string {
+	out := []string{}
+	for _, msg := range u.order {
+		if n := u.counts[msg]; n > 1 {
+			msg = fmt.Sprintf("%s (x%d)", msg, n)
+		}
+		out = append(out, msg)
+	}
+	return out
+}
+
+type xmlNote struct {
+	Pitch *struct {
+		Step   string  `xml:"step"`
+		Alter  float64 `xml:"alter"`
+		Octave int     `xml:"octave"`
+	} `xml:"pitch"`
+	Rest      *struct{} `xml:"rest"`
+	Unpitched *struct{} `xml:"unpitched"`
+	Chord     *struct{} `xml:"chord"`
+	Grace     *struct{} `xml:"grace"`
+	Cue       *struct{} `xml:"cue"`
+	Duration  int       `xml:"duration"`
+	Staff     int       `xml:"staff"`
+	Ties      []struct {
+		Type string `xml:"type,attr"`
+	} `xml:"tie"`
+	Notations struct {
+		Ornaments  *struct{} `xml:"ornaments"`
+		Arpeggiate *struct{} `xml:"arpeggiate"`
+		Fermata    *struct{} `xml:"fermata"`
+	} `xml:"notations"`
+}
+
+type xmlAttributes struct {
+	Divisions int `xml:"divisions"`
+	Staves    int `xml:"staves"`
+}
+
+type xmlSound struct {
+	Tempo    float64 `xml:"tempo,attr"`
+	Dynamics float64 `xml:"dynamics,attr"`
+}
+
+type xmlDirection struct {
+	Types []struct {
+		Dynamics *struct {
+			Marks []struct {
+				XMLName xml.Name
+			} `xml:",any"`
+		} `xml:"dynamics"`
+		Metronome *struct {
+			BeatUnit  string  `xml:"beat-unit"`
+			PerMinute float64 `xml:"per-minute"`
+		} `xml:"metronome"`
+		Pedal *struct{} `xml:"pedal"`
+	} `xml:"direction-type"`
+	Sound *xmlSound `xml:"sound"`
+}
+
+type xmlTempo struct {
+	quarter float64 // 以四分音符计的位置
+	bpm     float64
+}
+
+// 读取MusicXML(支持压缩的 .mxl)，转换为键盘音符
+func readMusicXML(raw []byte, report *ImportReport, unsupported *unsupportedLog) ([]ScoreNote, error) {
+	if bytes.HasPrefix(raw, []byte("PK")) {
+		var err error
+		if raw, err = unzipMusicXML(raw); err != nil {
+			return nil, err
+		}
+	}
+	dec := xml.NewDecoder(bytes.NewReader(raw))
+	dec.Strict = false
+
+	partNames := map[string]string{}
+	var notes []ScoreNote
+	tempos := []xmlTempo{}
+	type partNote struct {
+		note    ScoreNote // Start/Duration 暂以四分音符计
+		tieNext bool
+	}
+
+	var partID string
+	var part []partNote
+	divisions := 1
+	staves := 1
+	pos := 0     // 当前位置(divisions)
+	lastPos := 0 // 上一个音符的起始位置，用于和弦
+	quarter := func(d int) float64 { return float64(d) / float64(divisions) }
+
+	flushPart := func() {
+		// 合并连音线：tie start 的音符与下一个同音高音符连接
+		var merged []ScoreNote
+		open := map[int]int{}
+		for _, pn := range part {
+			if idx, ok := open[pn.note.Pitch]; ok && merged[idx].Start+merged[idx].Duration >= pn.note.Start-1e-6 {
+				merged[idx].Duration = pn.note.Start + pn.note.Duration - merged[idx].Start
+				if !pn.tieNext {
+					delete(open, pn.note.Pitch)
+				}
+				continue
+			}
+			merged = append(merged, pn.note)
+			if pn.tieNext {
+				open[pn.note.Pitch] = len(merged) - 1
+			}
+		}
+		notes = append(notes, merged...)
+		part = nil
+	}
+
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("parse musicxml failed: %v", err)
+		}
+		start, ok := tok.(xml.StartElement)
+		if !ok {
+			if end, ok := tok.(xml.EndElement); ok && end.Name.Local == "part" {
+				flushPart()
+			}
+			continue
+		}
+		switch start.Name.Local {
+		case "score-timewise":
+			return nil, fmt.Errorf("score-timewise MusicXML is not supported, export as partwise")
+		case "score-part":
+			var sp struct {
+				ID   string `xml:"id,attr"`
+				Name string `xml:"part-name"`
+			}
+			if err := dec.DecodeElement(&sp, &start); err != nil {
+				return nil, err
+			}
+			partNames[sp.ID] = sp.Name
+		case "part":
+			partID, pos, lastPos, staves, divisions = "", 0, 0, 1, 1
+			for _, a := range start.Attr {
+				if a.Name.Local == "id" {
+					partID = a.Value
+				}
+			}
+			name := partNames[partID]
+			if name == "" {
+				name = partID
+			}
+			report.Parts = append(report.Parts, name)
+		case "attributes":
+			var attr xmlAttributes
+			if err := dec.DecodeElement(&attr, &start); err != nil {
+				return nil, err
+			}
+			if attr.Divisions > 0 {
+				divisions = attr.Divisions
+			}
+			if attr.Staves > 0 {
+				staves = attr.Staves
+			}
+		case "backup", "forward":
+			var d struct {
+				Duration int `xml:"duration"`
+			}
+			if err := dec.DecodeElement(&d, &start); err != nil {
+				return nil, err
+			}
+			if start.Name.Local == "backup" {
+				pos -= d.Duration
+			} else {
+				pos += d.Duration
+			}
+		case "sound":
+			var s xmlSound
+			if err := dec.DecodeElement(&s, &start); err != nil {
+				return nil, err
+			}
+			if s.Tempo > 0 {
+				tempos = append(tempos, xmlTempo{quarter(pos), s.Tempo})
+			}
+		case "direction":
+			var d xmlDirection
+			if err := dec.DecodeElement(&d, &start); err != nil {
+				return nil, err
+			}
+			if d.Sound != nil && d.Sound.Tempo > 0 {
+				tempos = append(tempos, xmlTempo{quarter(pos), d.Sound.Tempo})
+			}
+			for _, t := range d.Types {
+				if t.Metronome != nil && t.Metronome.PerMinute > 0 && (d.Sound == nil || d.Sound.Tempo == 0) {
+					tempos = append(tempos, xmlTempo{quarter(pos), t.Metronome.PerMinute * beatUnitQuarters(t.Metronome.BeatUnit)})
+				}
+				if t.Dynamics != nil {
+					for _, m := range t.Dynamics.Marks {
+						unsupported.add("dynamics %s (灵巧手按压力度固定)", m.XMLName.Local)
+					}
+				}
+				if t.Pedal != nil {
+					unsupported.add("pedal")
+				}
+			}
+		case "repeat", "ending":
+			unsupported.add("%s (反复记号未展开)", start.Name.Local)
+			dec.Skip()
+		case "note":
+			var n xmlNote
+			if err := dec.DecodeElement(&n, &start); err != nil {
+				return nil, err
+			}
+			if n.Chord != nil {
+				pos = lastPos
+			}
+			lastPos = pos
+			switch {
+			case n.Grace != nil:
+				unsupported.add("grace note")
+				continue
+			case n.Cue != nil:
+				unsupported.add("cue note")
+			case n.Unpitched != nil:
+				unsupported.add("unpitched note")
+			case n.Pitch != nil:
+				if n.Notations.Ornaments != nil {
+					unsupported.add("ornament")
+				}
+				if n.Notations.Arpeggiate != nil {
+					unsupported.add("arpeggiate")
+				}
+				if n.Notations.Fermata != nil {
+					unsupported.add("fermata")
+				}
+				hand := ""
+				if staves >= 2 {
+					hand = "right"
+					if n.Staff >= 2 {
+						hand = "left"
+					}
+				}
+				pn := partNote{note: ScoreNote{
+					Pitch:    musicXMLPitch(n.Pitch.Step, n.Pitch.Alter, n.Pitch.Octave),
+					Start:    quarter(pos),
+					Duration: quarter(n.Duration),
+					Hand:     hand,
+				}}
+				for _, t := range n.Ties {
+					pn.tieNext = pn.tieNext || t.Type == "start"
+				}
+				part = append(part, pn)
+			}
+			pos += n.Duration
+		}
+	}
+
+	// 四分音符位置换算为秒
+	if len(tempos) == 0 {
+		tempos = append(tempos, xmlTempo{0, 120})
+		unsupported.add("no tempo marking, assuming 120 bpm")
+	}
+	sort.SliceStable(tempos, func(i, j int) bool { return tempos[i].quarter < tempos[j].quarter })
+	if tempos[0].quarter > 0 {
+		tempos = append([]xmlTempo{{0, tempos[0].bpm}}, tempos...)
+	}
+	seconds := func(q float64) float64 {
+		sec := 0.0
+		for i, t := range tempos {
+			end := q
+			if i+1 < len(tempos) && tempos[i+1].quarter < q {
+				end = tempos[i+1].quarter
+			}
+			if end > t.quarter {
+				sec += (end - t.quarter) * 60 / t.bpm
+			}
+		}
+		return sec
+	}
+	for i := range notes {
+		end := seconds(notes[i].Start + notes[i].Duration)
+		notes[i].Start = seconds(notes[i].Start)
+		notes[i].Duration = end - notes[i].Start
+	}
+	sort.SliceStable(notes, func(i, j int) bool { return notes[i].Start < notes[j].Start })
+	report.Notes = len(notes)
+	return notes, nil
+}
+
+var musicXMLSteps = map[string]int{"C": 0, "D": 2, "E": 4, "F": 5, "G": 7, "A": 9, "B": 11}
+
+func musicXMLPitch(step string, alter float64, octave int) int {
+	return (octave+1)*12 + musicXMLSteps[strings.ToUpper(step)] + int(alter)
+}
+
+// 节拍单位换算为四分音符数
+func beatUnitQuarters(unit string) float64 {
+	switch unit {
+	case "whole":
+		return 4
+	case "half":
+		return 2
+	case "eighth":
+		return 0.5
+	case "16th":
+		return 0.25
+	}
+	return 1
+}
+
+// 从 .mxl 压缩包中取出主乐谱文件
+func unzipMusicXML(raw []byte) ([]byte, error) {
+	zr, err := zip.NewReader(bytes.NewReader(raw), int64(len(raw)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid mxl archive: %v", err)
+	}
+	read := func(name string) ([]byte, error) {
+		f, err := zr.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		return io.ReadAll(f)
+	}
+	root := ""
+	if container, err := read("META-INF/container.xml"); err == nil {
+		var c struct {
+			Rootfiles []struct {
+				Path string `xml:"full-path,attr"`
+			} `xml:"rootfiles>rootfile"`
+		}
+		if xml.Unmarshal(container, &c) == nil && len(c.Rootfiles) > 0 {
+			root = c.Rootfiles[0].Path
+		}
+	}
+	if root == "" {
+		for _, f := range zr.File {
+			if ext := path.Ext(f.Name); (ext == ".xml" || ext == ".musicxml") && !strings.HasPrefix(f.Name, "META-INF/") {
+				root = f.Name
+				break
+			}
+		}
+	}
+	if root == "" {
+		return nil, fmt.Errorf("no score found in mxl archive")
+	}
+	return read(root)
+}
+
+// 导入MusicXML并规划指法
+func importMusicXML(raw []byte, opts PlanOptions) (MusicData, *ImportReport, error) {
+	report := &ImportReport{Format: "musicxml"}
+	var unsupported unsupportedLog
+	notes, err := readMusicXML(raw, report, &unsupported)
+	report.Unsupported = unsupported.list()
+	if err != nil {
+		return MusicData{}, report, err
+	}
+	data, plan, err := planFingering(notes, appConfig.Keyboard, opts)
+	report.Plan = plan
+	return data, report, err
+}
+
+// 上传MusicXML转换为MusicData，?save=标题 时同时保存到乐谱库，?split= 指定左右手分配策略
+func importMusicXMLHandler(c *gin.Context) {
+	raw, _, err := readUploadBody(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	opts, err := planOptionsFromQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	data, report, err := importMusicXML(raw, opts)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "report": report})
+		return
+	}
+	resp := gin.H{"musicData": data, "report": report}
+	if title := c.Query("save"); title != "" {
+		meta, err := scoreStore.Create(title, data)
+		if err != nil {
+			c.JSON(scoreErrorStatus(err), gin.H{"error": err.Error(), "report": report})
+			return
+		}
+		resp["meta"] = meta
+	}
+	c.JSON(http.StatusOK, resp)
+}
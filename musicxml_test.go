@@ -0,0 +1,131 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"math"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// 单声部的partwise乐谱，每四分音符2个divisions
+func partwise(staves int, measures string) string {
+	return `<?xml version="1.0"?>
+<score-partwise><part-list><score-part id="P1"><part-name>Piano</part-name></score-part></part-list>
+<part id="P1"><measure number="1"><attributes><divisions>2</divisions><staves>` + strconv.Itoa(staves) + `</staves></attributes>` +
+		measures + `</measure></part></score-partwise>`
+}
+
+func xmlPitch(step string, octave, duration int, extra string) string {
+	return `<note><pitch><step>` + step + `</step><octave>` + strconv.Itoa(octave) + `</octave></pitch><duration>` +
+		strconv.Itoa(duration) + `</duration>` + extra + `</note>`
+}
+
+const xmlTempo120 = `<direction><sound tempo="120"/></direction>`
+
+func TestReadMusicXML(t *testing.T) {
+	tests := []struct {
+		name        string
+		xml         string
+		want        []ScoreNote
+		unsupported []string
+	}{
+		{
+			name: "melody",
+			xml:  partwise(1, xmlTempo120+xmlPitch("C", 4, 2, "")+xmlPitch("D", 4, 2, "")+`<note><rest/><duration>2</duration></note>`+xmlPitch("E", 4, 1, "")),
+			want: []ScoreNote{{Pitch: 60, Start: 0, Duration: 0.5}, {Pitch: 62, Start: 0.5, Duration: 0.5}, {Pitch: 64, Start: 1.5, Duration: 0.25}},
+		},
+		{
+			name: "chord and accidental",
+			xml:  partwise(1, xmlTempo120+xmlPitch("C", 4, 2, "")+xmlPitch("E", 4, 2, "<chord/>")+`<note><pitch><step>F</step><alter>1</alter><octave>4</octave></pitch><duration>2</duration></note>`),
+			want: []ScoreNote{{Pitch: 60, Start: 0, Duration: 0.5}, {Pitch: 64, Start: 0, Duration: 0.5}, {Pitch: 66, Start: 0.5, Duration: 0.5}},
+		},
+		{
+			name: "tied notes merge",
+			xml:  partwise(1, xmlTempo120+xmlPitch("C", 4, 4, `<tie type="start"/>`)+xmlPitch("C", 4, 2, `<tie type="stop"/>`)+xmlPitch("C", 4, 2, "")),
+			want: []ScoreNote{{Pitch: 60, Start: 0, Duration: 1.5}, {Pitch: 60, Start: 1.5, Duration: 0.5}},
+		},
+		{
+			name: "grand staff assigns hands",
+			xml: partwise(2, xmlTempo120+xmlPitch("G", 4, 4, "<staff>1</staff>")+`<backup><duration>4</duration></backup>`+
+				xmlPitch("C", 3, 4, "<staff>2</staff>")),
+			want: []ScoreNote{{Pitch: 67, Start: 0, Duration: 1, Hand: "right"}, {Pitch: 48, Start: 0, Duration: 1, Hand: "left"}},
+		},
+		{
+			name: "metronome in half notes",
+			xml:  partwise(1, `<direction><direction-type><metronome><beat-unit>half</beat-unit><per-minute>30</per-minute></metronome></direction-type></direction>`+xmlPitch("C", 4, 2, "")),
+			want: []ScoreNote{{Pitch: 60, Start: 0, Duration: 1}},
+		},
+		{
+			name: "tempo change",
+			xml:  partwise(1, xmlTempo120+xmlPitch("C", 4, 2, "")+`<direction><sound tempo="60"/></direction>`+xmlPitch("D", 4, 2, "")),
+			want: []ScoreNote{{Pitch: 60, Start: 0, Duration: 0.5}, {Pitch: 62, Start: 0.5, Duration: 1}},
+		},
+		{
+			name: "unsupported structures are reported",
+			xml: partwise(1, `<direction><direction-type><dynamics><ff/></dynamics></direction-type></direction>`+
+				xmlPitch("C", 4, 0, "<grace/>")+xmlPitch("C", 4, 2, "")+`<barline><repeat direction="backward"/></barline>`+xmlPitch("D", 4, 2, "")),
+			want:        []ScoreNote{{Pitch: 60, Start: 0, Duration: 0.5}, {Pitch: 62, Start: 0.5, Duration: 0.5}},
+			unsupported: []string{"dynamics ff", "grace note", "repeat", "no tempo marking"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			report := &ImportReport{}
+			var unsupported unsupportedLog
+			notes, err := readMusicXML([]byte(tt.xml), report, &unsupported)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(notes) != len(tt.want) {
+				t.Fatalf("got %+v, want %+v", notes, tt.want)
+			}
+			for i, n := range notes {
+				w := tt.want[i]
+				if n.Pitch != w.Pitch || n.Hand != w.Hand || math.Abs(n.Start-w.Start) > 1e-9 || math.Abs(n.Duration-w.Duration) > 1e-9 {
+					t.Errorf("note %d: got %+v, want %+v", i, n, w)
+				}
+			}
+			if report.Notes != len(tt.want) {
+				t.Errorf("report counts %d notes", report.Notes)
+			}
+			got := unsupported.list()
+			if len(got) != len(tt.unsupported) {
+				t.Fatalf("unsupported %q, want %q", got, tt.unsupported)
+			}
+			for i, prefix := range tt.unsupported {
+				if !strings.HasPrefix(got[i], prefix) {
+					t.Errorf("unsupported[%d] = %q, want prefix %q", i, got[i], prefix)
+				}
+			}
+		})
+	}
+}
+
+func TestReadMusicXMLCompressed(t *testing.T) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, content := range map[string]string{
+		"META-INF/container.xml": `<container><rootfiles><rootfile full-path="score/main.xml"/></rootfiles></container>`,
+		"score/main.xml":         partwise(1, xmlTempo120+xmlPitch("A", 4, 2, "")),
+	} {
+		w, _ := zw.Create(name)
+		w.Write([]byte(content))
+	}
+	zw.Close()
+	notes, err := readMusicXML(buf.Bytes(), &ImportReport{}, &unsupportedLog{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(notes) != 1 || notes[0].Pitch != 69 {
+		t.Errorf("got %+v", notes)
+	}
+}
+
+func TestReadMusicXMLTimewise(t *testing.T) {
+	_, err := readMusicXML([]byte(`<score-timewise></score-timewise>`), &ImportReport{}, &unsupportedLog{})
+	if err == nil || !strings.Contains(err.Error(), "timewise") {
+		t.Errorf("got %v, want timewise error", err)
+	}
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// PlanOptions 指法规划参数
+type PlanOptions struct {
+	MoveCost    float64 `json:"moveCost"`    // 每只手每次移动的固定代价
+	TravelCost  float64 `json:"travelCost"`  // 每移动一个单位的代价
+	MinPress    float64 `json:"minPress"`    // 最短按压时间(秒)
+	ChordWindow float64 `json:"chordWindow"` // 起始时间相差小于该值的音符视为同时按下(秒)
+	Split       string  `json:"split"`       // 未指定手的音符如何分配：auto 自动，pitch 按分界音高，left/right 全部由一只手弹
+	SplitPoint  int     `json:"splitPoint"`  // split=pitch 时右手的最低音(MIDI编号)
+}
+
+// PlanReport 规划结果统计
+type PlanReport struct {
+	Notes    int      `json:"notes"`    // 成功分配的音符数
+	Dropped  int      `json:"dropped"`  // 无法弹奏而丢弃的音符数
+	Moves    int      `json:"moves"`    // 机械臂移动次数(两只手分别计数)
+	Travel   int      `json:"travel"`   // 机械臂移动总距离(单位)
+	Warnings []string `json:"warnings"` // 丢弃原因等提示
+}
+
+func defaultPlanOptions() PlanOptions {
+	return PlanOptions{MoveCost: 1, TravelCost: 0.2, MinPress: 0.05, ChordWindow: 0.02, Split: "auto", SplitPoint: 60}
+}
+
+// 从查询参数 split、splitPoint 读取规划参数
+func planOptionsFromQuery(c *gin.Context) (PlanOptions, error) {
+	opts := defaultPlanOptions()
+	opts.Split = c.DefaultQuery("split", opts.Split)
+	if v := c.Query("splitPoint"); v != "" {
+		p, err := strconv.Atoi(v)
+		if err != nil {
+			return opts, fmt.Errorf("invalid splitPoint %q", v)
+		}
+		opts.SplitPoint = p
+	}
+	return opts, checkPlanSplit(opts.Split)
+}
+
+// 检查左右手分配策略
+func checkPlanSplit(split string) error {
+	switch split {
+	case "auto", "pitch", "left", "right":
+		return nil
+	}
+	return fmt.Errorf("invalid split %q", split)
+}
+
+// 按分配策略给未指定手的音符指定左右手
+func splitHands(notes []ScoreNote, opts PlanOptions) []ScoreNote {
+	out := make([]ScoreNote, len(notes))
+	for i, n := range notes {
+		if n.Hand == "" {
+			switch opts.Split {
+			case "pitch":
+				n.Hand = "left"
+				if n.Pitch >= opts.SplitPoint {
+					n.Hand = "right"
+				}
+			case "left", "right":
+				n.Hand = opts.Split
+			}
+		}
+		out[i] = n
+	}
+	return out
+}
+
+type handPair struct{ left, right int }
+
+// 一组同时按下的音符
+type noteEvent struct {
+	start float64
+	notes []ScoreNote
+}
+
+// 为音符序列分配左右手、手指和机械臂移动，使总移动次数和距离最小
+func planFingering(notes []ScoreNote, kb KeyboardModel, opts PlanOptions) (MusicData, PlanReport, error) {
+	var data MusicData
+	report := PlanReport{Warnings: []string{}}
+
+	// 1. 分配左右手，过滤无法弹奏的音符
+	var playable []ScoreNote
+	for _, n := range splitHands(notes, opts) {
+		switch {
+		case n.Pitch < kb.LowestKey || n.Pitch > kb.HighestKey:
+			report.Warnings = append(report.Warnings, fmt.Sprintf("%.2fs %s 超出键盘范围", n.Start, pitchName(n.Pitch)))
+		case !isWhiteKey(n.Pitch):
+			report.Warnings = append(report.Warnings, fmt.Sprintf("%.2fs %s 是黑键，灵巧手无法弹奏", n.Start, pitchName(n.Pitch)))
+		case n.Hand != "" && n.Hand != "left" && n.Hand != "right":
+			return data, report, fmt.Errorf("invalid hand %q at %.2fs", n.Hand, n.Start)
+		default:
+			playable = append(playable, n)
+			continue
+		}
+		report.Dropped++
+	}
+	if len(playable) == 0 {
+		return data, report, fmt.Errorf("no playable notes")
+	}
+
+	// 2. 按起始时间分组为和弦
+	sort.SliceStable(playable, func(i, j int) bool { return playable[i].Start < playable[j].Start })
+	var events []noteEvent
+	for _, n := range playable {
+		if len(events) > 0 && n.Start-events[len(events)-1].start < opts.ChordWindow {
+			ev := &events[len(events)-1]
+			dup := false
+			for _, m := range ev.notes {
+				dup = dup || m.Pitch == n.Pitch
+			}
+			if !dup {
+				ev.notes = append(ev.notes, n)
+			}
+			continue
+		}
+		events = append(events, noteEvent{start: n.Start, notes: []ScoreNote{n}})
+	}
+
+	// 3. 每个和弦的候选手位：覆盖音符最多的所有合法位置
+	candidates := make([][]handPair, len(events))
+	for i, ev := range events {
+		best := -1
+		for l := kb.Left.MinMove; l <= kb.Left.MaxMove; l++ {
+			for r := kb.Right.MinMove; r <= kb.Right.MaxMove; r++ {
+				if !kb.validPair(l, r) {
+					continue
+				}
+				covered := len(assignFingers(ev.notes, kb, handPair{l, r}))
+				if covered > best {
+					best = covered
+					candidates[i] = candidates[i][:0]
+				}
+				if covered == best {
+					candidates[i] = append(candidates[i], handPair{l, r})
+				}
+			}
+		}
+		if len(candidates[i]) == 0 {
+			return data, report, fmt.Errorf("keyboard model has no valid hand positions")
+		}
+	}
+
+	// 4. 动态规划求最小移动代价
+	transition := func(a, b handPair) float64 {
+		cost := 0.0
+		for _, d := range []int{b.left - a.left, b.right - a.right} {
+			if d != 0 {
+				cost += opts.MoveCost + opts.TravelCost*math.Abs(float64(d))
+			}
+		}
+		return cost
+	}
+	cost := make([][]float64, len(events))
+	from := make([][]int, len(events))
+	for i := range events {
+		cost[i] = make([]float64, len(candidates[i]))
+		from[i] = make([]int, len(candidates[i]))
+		for j, s := range candidates[i] {
+			if i == 0 {
+				cost[i][j] = transition(handPair{}, s)
+				continue
+			}
+			cost[i][j] = math.Inf(1)
+			for k, p := range candidates[i-1] {
+				if c := cost[i-1][k] + transition(p, s); c < cost[i][j] {
+					cost[i][j], from[i][j] = c, k
+				}
+			}
+		}
+	}
+	path := make([]handPair, len(events))
+	last := 0
+	for j := range cost[len(events)-1] {
+		if cost[len(events)-1][j] < cost[len(events)-1][last] {
+			last = j
+		}
+	}
+	for i := len(events) - 1; i >= 0; i-- {
+		path[i] = candidates[i][last]
+		last = from[i][last]
+	}
+
+	// 5. 生成MusicData，第一步先把手移到起始位置，预设位置保持不动
+	gap := armMoveGap.Seconds()
+	var music []MusicNote
+	addStep := func() *MusicNote {
+		music = append(music, MusicNote{
+			Index: len(music),
+			Left:  HandAction{Fingers: []string{}, Time: []float64{}},
+			Right: HandAction{Fingers: []string{}, Time: []float64{}},
+		})
+		return &music[len(music)-1]
+	}
+	prev := handPair{}
+	if path[0] != prev {
+		addStep()
+	}
+	for i, ev := range events {
+		if i > 0 || len(music) > 0 {
+			step := &music[len(music)-1]
+			step.Left.Move.Y = path[i].left - prev.left
+			step.Right.Move.Y = path[i].right - prev.right
+			for _, d := range []int{step.Left.Move.Y, step.Right.Move.Y} {
+				if d != 0 {
+					report.Moves++
+					report.Travel += int(math.Abs(float64(d)))
+				}
+			}
+		}
+		prev = path[i]
+
+		// 移到下一个手位走平滑轨迹时，轨迹时长也要从间隔中扣除
+		interval, travel := 0.0, 0.0
+		if i+1 < len(events) {
+			interval = events[i+1].start - ev.start
+			travel = math.Max(appConfig.Trajectory.moveDuration(ArmMovement{Y: path[i+1].left - path[i].left}),
+				appConfig.Trajectory.moveDuration(ArmMovement{Y: path[i+1].right - path[i].right}))
+		}
+		step := addStep()
+		fingers := assignFingers(ev.notes, kb, path[i])
+		longest := 0.0
+		for _, n := range ev.notes {
+			f, ok := fingers[n.Pitch]
+			if !ok {
+				report.Dropped++
+				report.Warnings = append(report.Warnings, fmt.Sprintf("%.2fs %s 超出手的跨度", n.Start, pitchName(n.Pitch)))
+				continue
+			}
+			press := n.Duration
+			if interval > 0 {
+				press = math.Min(press, interval-gap-travel)
+			}
+			press = round2(math.Max(press, opts.MinPress))
+			longest = math.Max(longest, press)
+			action := &step.Right
+			if f.side == "left" {
+				action = &step.Left
+			}
+			action.Fingers = append(action.Fingers, f.finger)
+			action.Time = append(action.Time, press)
+			report.Notes++
+		}
+		// 用空节拍填充休止，每个空节拍耗时一个间隔，最后一个节拍另加轨迹时长
+		if interval > 0 {
+			rests := int(math.Round((interval - longest - gap - travel) / gap))
+			for r := 0; r < rests; r++ {
+				addStep()
+			}
+		}
+	}
+	data.Music = music
+	return data, report, nil
+}
+
+type fingerChoice struct{ side, finger string }
+
+// 在给定手位下为和弦中的每个音符分配手指，返回音高到手指的映射
+func assignFingers(notes []ScoreNote, kb KeyboardModel, pos handPair) map[int]fingerChoice {
+	out := map[int]fingerChoice{}
+	for _, n := range notes {
+		if n.Hand != "right" {
+			if f, ok := kb.fingerFor("left", pos.left, n.Pitch); ok {
+				out[n.Pitch] = fingerChoice{"left", f}
+				continue
+			}
+		}
+		if n.Hand != "left" {
+			if f, ok := kb.fingerFor("right", pos.right, n.Pitch); ok {
+				out[n.Pitch] = fingerChoice{"right", f}
+			}
+		}
+	}
+	return out
+}
+
+func round2(v float64) float64 {
+	return math.Round(v*100) / 100
+}
+
+// 规划请求，notes 为键盘层面的音符序列
+type PlanRequest struct {
+	Notes   []ScoreNote  `json:"notes"`
+	Options *PlanOptions `json:"options"`
+}
+
+func planHandler(c *gin.Context) {
+	// 请求中的参数覆盖在默认值上，没有给出的字段保持默认
+	opts := defaultPlanOptions()
+	req := PlanRequest{Options: &opts}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+		return
+	}
+	if err := checkPlanSplit(opts.Split); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	respondPlan(c, req.Notes, opts)
+}
+
+// 上传MIDI文件(表单字段 file)进行规划，查询参数 split、splitPoint 与导入相同
+func planMIDIHandler(c *gin.Context) {
+	opts, err := planOptionsFromQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	fh, err := c.FormFile("file")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "missing file"})
+		return
+	}
+	f, err := fh.Open()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	defer f.Close()
+	notes, err := readMIDI(f)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	respondPlan(c, notes, opts)
+}
+
+func respondPlan(c *gin.Context, notes []ScoreNote, opts PlanOptions) {
+	data, report, err := planFingering(notes, appConfig.Keyboard, opts)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "report": report})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"musicData": data, "report": report})
+}
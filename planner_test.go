@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 按节拍累加机械臂移动，返回每个非空节拍按下的琴键
+func playedKeys(kb KeyboardModel, data MusicData) [][]int {
+	var out [][]int
+	left, right := 0, 0
+	for _, step := range data.Music {
+		var keys []int
+		for _, f := range step.Left.Fingers {
+			keys = append(keys, kb.keyOf("left", left, f))
+		}
+		for _, f := range step.Right.Fingers {
+			keys = append(keys, kb.keyOf("right", right, f))
+		}
+		if len(keys) > 0 {
+			sort.Ints(keys)
+			out = append(out, keys)
+		}
+		left += step.Left.Move.Y
+		right += step.Right.Move.Y
+	}
+	return out
+}
+
+func TestPlanFingering(t *testing.T) {
+	kb := defaultKeyboardModel()
+	tests := []struct {
+		name    string
+		notes   []ScoreNote
+		want    [][]int
+		moves   int
+		travel  int
+		dropped int
+	}{
+		{
+			name:  "home position needs no moves",
+			notes: []ScoreNote{{Pitch: 60, Start: 0, Duration: 0.3}, {Pitch: 67, Start: 0.5, Duration: 0.3}, {Pitch: 69, Start: 1, Duration: 0.3}},
+			want:  [][]int{{60}, {67}, {69}},
+		},
+		{
+			name:  "chord across both hands",
+			notes: []ScoreNote{{Pitch: 60, Start: 0, Duration: 0.3}, {Pitch: 67, Start: 0.01, Duration: 0.3}, {Pitch: 55, Start: 0.5, Duration: 0.3}},
+			want:  [][]int{{60, 67}, {55}},
+		},
+		{
+			name:   "cheapest hand moves one key",
+			notes:  []ScoreNote{{Pitch: 62, Start: 0, Duration: 0.3}},
+			want:   [][]int{{62}},
+			moves:  1,
+			travel: 1,
+		},
+		{
+			// 贪心会在C4不动、到D4再移动；动态规划一次移到能同时覆盖两者的位置
+			name:   "one move covers the whole phrase",
+			notes:  []ScoreNote{{Pitch: 60, Start: 0, Duration: 0.3}, {Pitch: 62, Start: 0.5, Duration: 0.3}, {Pitch: 60, Start: 1, Duration: 0.3}},
+			want:   [][]int{{60}, {62}, {60}},
+			moves:  1,
+			travel: 1,
+		},
+		{
+			name:   "forced hand",
+			notes:  []ScoreNote{{Pitch: 64, Start: 0, Duration: 0.3, Hand: "right"}},
+			want:   [][]int{{64}},
+			moves:  1,
+			travel: 2,
+		},
+		{
+			name:    "black keys and out of range notes are dropped",
+			notes:   []ScoreNote{{Pitch: 61, Start: 0, Duration: 0.3}, {Pitch: 120, Start: 0.2, Duration: 0.3}, {Pitch: 67, Start: 0.5, Duration: 0.3}},
+			want:    [][]int{{67}},
+			dropped: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, report, err := planFingering(tt.notes, kb, defaultPlanOptions())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := playedKeys(kb, data); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("played %v, want %v", got, tt.want)
+			}
+			if report.Moves != tt.moves || report.Travel != tt.travel {
+				t.Errorf("moves %d travel %d, want %d and %d", report.Moves, report.Travel, tt.moves, tt.travel)
+			}
+			if report.Dropped != tt.dropped || len(report.Warnings) != tt.dropped {
+				t.Errorf("dropped %d with warnings %v, want %d", report.Dropped, report.Warnings, tt.dropped)
+			}
+			for i, step := range data.Music {
+				if step.Index != i {
+					t.Errorf("step %d has index %d", i, step.Index)
+				}
+			}
+		})
+	}
+}
+
+func TestPlanFingeringErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		notes []ScoreNote
+		want  string
+	}{
+		{"empty", nil, "no playable notes"},
+		{"only black keys", []ScoreNote{{Pitch: 61, Duration: 0.3}}, "no playable notes"},
+		{"invalid hand", []ScoreNote{{Pitch: 60, Duration: 0.3, Hand: "both"}}, "invalid hand"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := planFingering(tt.notes, defaultKeyboardModel(), defaultPlanOptions())
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got error %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestSplitHands(t *testing.T) {
+	notes := []ScoreNote{{Pitch: 55}, {Pitch: 60}, {Pitch: 72}, {Pitch: 48, Hand: "right"}}
+	tests := []struct {
+		split      string
+		splitPoint int
+		want       []string
+	}{
+		{"auto", 60, []string{"", "", "", "right"}},
+		{"pitch", 60, []string{"left", "right", "right", "right"}},
+		{"pitch", 72, []string{"left", "left", "right", "right"}},
+		{"left", 60, []string{"left", "left", "left", "right"}},
+		{"right", 60, []string{"right", "right", "right", "right"}},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s %d", tt.split, tt.splitPoint), func(t *testing.T) {
+			opts := defaultPlanOptions()
+			opts.Split, opts.SplitPoint = tt.split, tt.splitPoint
+			var got []string
+			for _, n := range splitHands(notes, opts) {
+				got = append(got, n.Hand)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// 按音高分手后，低音只用左手、高音只用右手
+func TestPlanFingeringSplit(t *testing.T) {
+	kb := defaultKeyboardModel()
+	notes := []ScoreNote{{Pitch: 62, Start: 0, Duration: 0.3}, {Pitch: 65, Start: 0.5, Duration: 0.3}}
+	opts := defaultPlanOptions()
+	opts.Split, opts.SplitPoint = "pitch", 64
+	data, _, err := planFingering(notes, kb, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sides []string
+	for _, step := range data.Music {
+		if len(step.Left.Fingers) > 0 {
+			sides = append(sides, "left")
+		}
+		if len(step.Right.Fingers) > 0 {
+			sides = append(sides, "right")
+		}
+	}
+	if !reflect.DeepEqual(sides, []string{"left", "right"}) {
+		t.Errorf("notes played by %v, want left then right", sides)
+	}
+	if got := playedKeys(kb, data); !reflect.DeepEqual(got, [][]int{{62}, {65}}) {
+		t.Errorf("played %v", got)
+	}
+}
+
+// 规划接口检查分配策略，MIDI规划使用查询参数中的分配策略
+func TestPlanHandlers(t *testing.T) {
+	var midi bytes.Buffer
+	if err := writeMIDI(&midi, []ScoreNote{{Pitch: 55, Duration: 0.5}, {Pitch: 72, Start: 0.5, Duration: 0.5}}); err != nil {
+		t.Fatal(err)
+	}
+	midiRequest := func(query string) *http.Request {
+		var body bytes.Buffer
+		form := multipart.NewWriter(&body)
+		part, _ := form.CreateFormFile("file", "score.mid")
+		part.Write(midi.Bytes())
+		form.Close()
+		req := httptest.NewRequest(http.MethodPost, "/api/planner/midi"+query, &body)
+		req.Header.Set("Content-Type", form.FormDataContentType())
+		return req
+	}
+	planRequest := func(options string) *http.Request {
+		body := `{"notes":[{"pitch":55,"duration":0.5},{"pitch":72,"start":0.5,"duration":0.5}],"options":` + options + `}`
+		return httptest.NewRequest(http.MethodPost, "/api/planner/plan", strings.NewReader(body))
+	}
+	tests := []struct {
+		name    string
+		handler gin.HandlerFunc
+		req     *http.Request
+		status  int
+		hands   string // 有按键的手，按节拍顺序
+	}{
+		{"plan auto", planHandler, planRequest(`{}`), http.StatusOK, "left,right"},
+		{"plan left", planHandler, planRequest(`{"split":"left"}`), http.StatusOK, "left,left"},
+		{"plan split typo", planHandler, planRequest(`{"split":"pich"}`), http.StatusBadRequest, ""},
+		{"midi auto", planMIDIHandler, midiRequest(""), http.StatusOK, "left,right"},
+		{"midi pitch split", planMIDIHandler, midiRequest("?split=pitch&splitPoint=80"), http.StatusOK, "left,left"},
+		{"midi split typo", planMIDIHandler, midiRequest("?split=lfet"), http.StatusBadRequest, ""},
+	}
+	gin.SetMode(gin.TestMode)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = tt.req
+			tt.handler(c)
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+			var resp struct{ MusicData MusicData }
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			var hands []string
+			for _, note := range resp.MusicData.Music {
+				if len(note.Left.Fingers) > 0 {
+					hands = append(hands, "left")
+				}
+				if len(note.Right.Fingers) > 0 {
+					hands = append(hands, "right")
+				}
+			}
+			if got := strings.Join(hands, ","); got != tt.hands {
+				t.Errorf("hands %s, want %s", got, tt.hands)
+			}
+		})
+	}
+}
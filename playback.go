@@ -0,0 +1,269 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"sync"
+	"time"
+)
+
+// 演奏任务状态
+const (
+	jobRunning  = "running"
+	jobPaused   = "paused"
+	jobFinished = "finished"
+	jobKilled   = "killed"
+	jobFailed   = "failed"
+)
+
+// PlaybackJob 一次演奏任务，每个工位同一时间只有一个任务在运行
+type PlaybackJob struct {
+	ID        string          `json:"id"`
+	Rig       string          `json:"rig"`
+	State     string          `json:"state"`
+	ScoreID   string          `json:"scoreId,omitempty"`
+	Step      int             `json:"step"`  // 已完成的节拍数
+	Total     int             `json:"total"` // 当前乐谱的节拍总数
+	StartedAt time.Time       `json:"startedAt"`
+	UpdatedAt time.Time       `json:"updatedAt"` // 最近一次进度或状态变化
+	EndedAt   *time.Time      `json:"endedAt,omitempty"`
+	Error     string          `json:"error,omitempty"`
+	Playlist  *PlaylistStatus `json:"playlist,omitempty"` // 播放列表任务的队列状态
+	Sync      *SyncStatus     `json:"sync,omitempty"`     // 跟随外部时钟演奏的状态
+}
+
+var errPlaybackKilled = fmt.Errorf("playback killed")
+
+// 播放列表跳过当前曲目时结束演奏的错误，由播放列表处理
+var errPlaybackSkipped = fmt.Errorf("playback skipped")
+
+// 保护所有工位的演奏任务
+var jobMu sync.Mutex
+
+// 启动演奏任务，run在后台执行，返回任务的快照
+func (r *Rig) startPlaybackJob(scoreID string, run func() error) (PlaybackJob, error) {
+	jobMu.Lock()
+	if r.job != nil && (r.job.State == jobRunning || r.job.State == jobPaused) {
+		jobMu.Unlock()
+		return PlaybackJob{}, fmt.Errorf("playback job %s is still %s", r.job.ID, r.job.State)
+	}
+	r.killPiano.Store(false)
+	r.stopPiano.Store(false)
+	r.skipPiano.Store(false)
+	// 默认工位保持原来的任务ID格式
+	id := fmt.Sprintf("job-%d", time.Now().UnixMilli())
+	if r.ID != defaultRigID {
+		id = fmt.Sprintf("job-%s-%d", r.ID, time.Now().UnixMilli())
+	}
+	job := &PlaybackJob{
+		ID:        id,
+		Rig:       r.ID,
+		State:     jobRunning,
+		ScoreID:   scoreID,
+		StartedAt: time.Now(),
+		UpdatedAt: time.Now(),
+	}
+	r.job = job
+	openJobLog(id)
+	logger := slog.With("job", id, "rig", r.ID)
+	r.jobLogger = logger
+	snapshot := *job
+	jobMu.Unlock()
+	metricJobs.inc(r.ID, "started")
+	logger.Info("演奏任务开始", "score", scoreID)
+
+	go func() {
+		err := run()
+		jobMu.Lock()
+		defer jobMu.Unlock()
+		defer closeJobLog(id)
+		now := time.Now()
+		job.EndedAt = &now
+		switch {
+		case err == errPlaybackKilled:
+			job.State = jobKilled
+		case err != nil:
+			job.State = jobFailed
+			job.Error = err.Error()
+		default:
+			job.State = jobFinished
+		}
+		metricJobs.inc(r.ID, job.State)
+		args := []any{"state", job.State, "step", job.Step, "total", job.Total}
+		if job.Error != "" {
+			args = append(args, "err", job.Error)
+		}
+		logger.Info("演奏任务结束", args...)
+		if r.jobLogger == logger {
+			r.jobLogger = nil
+		}
+	}()
+	return snapshot, nil
+}
+
+// 当前演奏任务的日志，记录同时写入任务日志文件；没有任务时只带工位ID
+func (r *Rig) logger() *slog.Logger {
+	jobMu.Lock()
+	defer jobMu.Unlock()
+	if r.jobLogger != nil {
+		return r.jobLogger
+	}
+	return slog.With("rig", r.ID)
+}
+
+// 当前(或最近一次)演奏任务的快照
+func (r *Rig) currentPlaybackJob() *PlaybackJob {
+	jobMu.Lock()
+	defer jobMu.Unlock()
+	if r.job == nil {
+		return nil
+	}
+	snapshot := *r.job
+	if snapshot.Playlist != nil {
+		status := *snapshot.Playlist
+		snapshot.Playlist = &status
+	}
+	return &snapshot
+}
+
+// 任务是否在运行或暂停中
+func (r *Rig) jobActive() bool {
+	job := r.currentPlaybackJob()
+	return job != nil && (job.State == jobRunning || job.State == jobPaused)
+}
+
+func (r *Rig) setPlaybackState(state string) {
+	jobMu.Lock()
+	defer jobMu.Unlock()
+	if r.job != nil && (r.job.State == jobRunning || r.job.State == jobPaused) {
+		r.job.State = state
+		r.job.UpdatedAt = time.Now()
+	}
+}
+
+func (r *Rig) pausePlayback() {
+	r.stopPiano.Store(true)
+	r.setPlaybackState(jobPaused)
+}
+
+func (r *Rig) resumePlayback() {
+	r.stopPiano.Store(false)
+	r.setPlaybackState(jobRunning)
+	rearmWatchdog(r)
+}
+
+func (r *Rig) killPlayback() {
+	r.killPiano.Store(true)
+	r.stopPiano.Store(false)
+}
+
+// 暂停时阻塞，直到恢复、被终止或跳过
+func (r *Rig) waitPlaybackResume() error {
+	for {
+		if r.killPiano.Load() {
+			return errPlaybackKilled
+		}
+		if r.skipPiano.Load() {
+			return errPlaybackSkipped
+		}
+		if !r.stopPiano.Load() {
+			return nil
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func (r *Rig) updatePlaybackProgress(step, total int) {
+	jobMu.Lock()
+	defer jobMu.Unlock()
+	if r.job != nil {
+		r.job.Step = step
+		r.job.Total = total
+		r.job.UpdatedAt = time.Now()
+	}
+}
+
+// 在演奏任务中更新播放列表状态
+func (r *Rig) updatePlaylistStatus(status PlaylistStatus) {
+	jobMu.Lock()
+	defer jobMu.Unlock()
+	if r.job != nil {
+		r.job.Playlist = &status
+		r.job.ScoreID = status.ScoreID
+		r.job.UpdatedAt = time.Now()
+	}
+}
+
+// 在演奏任务中更新外部时钟同步状态，等待时钟不算演奏进度
+func (r *Rig) updateSyncStatus(status SyncStatus) {
+	jobMu.Lock()
+	defer jobMu.Unlock()
+	if r.job != nil {
+		r.job.Sync = &status
+	}
+}
+
+// 一个节拍的时长(秒)：每只手等待最长的按压和平滑轨迹移动，取两只手中较长的，再加上机械臂移动间隔
+func stepDuration(note MusicNote, tempo float64) float64 {
+	longest := 0.0
+	for _, action := range []HandAction{note.Left, note.Right} {
+		side := 0.0
+		for _, t := range action.Time {
+			side = math.Max(side, t)
+		}
+		longest = math.Max(longest, side/tempo+appConfig.Trajectory.moveDuration(action.Move))
+	}
+	return longest + armMoveGap.Seconds()
+}
+
+// 每个节拍的起始时间(秒)
+func musicTimeline(music []MusicNote, tempo float64) []float64 {
+	onsets := make([]float64, len(music))
+	t := 0.0
+	for i, note := range music {
+		onsets[i] = t
+		t += stepDuration(note, tempo)
+	}
+	return onsets
+}
+
+// 没有外部时钟时的演奏时间轴：在乐谱时间轴的基础上，保证每只手按校准的补偿发完指令后再开始下一个节拍
+func playbackTimeline(music []MusicNote, tempo float64, timing playbackTiming) []float64 {
+	onsets := make([]float64, len(music))
+	t := 0.0
+	for i, note := range music {
+		onsets[i] = t
+		t += math.Max(stepDuration(note, tempo), math.Max(timing.left.busy(note.Left, tempo), timing.right.busy(note.Right, tempo)))
+	}
+	return onsets
+}
+
+// timelineClock 没有外部时钟时的节拍时钟，按演奏时间轴提前 lead 开始每个节拍，暂停的时长顺延
+type timelineClock struct {
+	rig    *Rig
+	onsets []float64
+	start  time.Time
+}
+
+func (c *timelineClock) waitStep(i int, lead time.Duration) error {
+	for {
+		paused := c.rig.stopPiano.Load()
+		blocked := time.Now()
+		if err := c.rig.waitPlaybackResume(); err != nil {
+			return err
+		}
+		switch {
+		case c.start.IsZero():
+			c.start = time.Now().Add(lead)
+		case paused:
+			c.start = c.start.Add(time.Since(blocked))
+		}
+		wait := time.Until(c.start.Add(seconds(c.onsets[i]) - lead))
+		if wait <= 0 {
+			metricLateness.observe((-wait).Seconds(), c.rig.ID, "free")
+			return nil
+		}
+		time.Sleep(min(wait, 20*time.Millisecond))
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// PlaylistItem 播放队列中的一首曲目
+type PlaylistItem struct {
+	ID      string  `json:"id"`
+	ScoreID string  `json:"scoreId"`
+	Tempo   float64 `json:"tempo"` // 速度倍率，1为原速
+	Loop    int     `json:"loop"`  // 连续演奏的遍数
+}
+
+// PlaylistStatus 播放列表任务的当前进度，随演奏任务一起上报
+type PlaylistStatus struct {
+	ItemID    string `json:"itemId"`
+	ScoreID   string `json:"scoreId"`
+	Loop      int    `json:"loop"`      // 当前是第几遍
+	Loops     int    `json:"loops"`     // 总遍数
+	Remaining int    `json:"remaining"` // 队列中剩余曲目数
+	Phase     string `json:"phase"`     // playing: 演奏中, homing: 回到预设位置, pausing: 曲间停顿
+}
+
+// Playlist 演奏队列，开始后依次取出队首曲目演奏
+type Playlist struct {
+	mu     sync.Mutex
+	items  []PlaylistItem
+	pause  float64 // 曲间停顿(秒)
+	nextID int
+	rig    *Rig // 演奏队列所属的工位
+}
+
+func (p *Playlist) snapshot() gin.H {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	items := append([]PlaylistItem{}, p.items...)
+	return gin.H{"items": items, "pause": p.pause}
+}
+
+func (p *Playlist) list() []PlaylistItem {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]PlaylistItem{}, p.items...)
+}
+
+func (p *Playlist) add(item PlaylistItem) PlaylistItem {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.nextID++
+	item.ID = fmt.Sprintf("item-%d", p.nextID)
+	p.items = append(p.items, item)
+	return item
+}
+
+func (p *Playlist) remove(id string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, item := range p.items {
+		if item.ID == id {
+			p.items = append(p.items[:i], p.items[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// 按给定ID顺序重排队列，ids必须包含队列中的全部曲目
+func (p *Playlist) reorder(ids []string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(ids) != len(p.items) {
+		return fmt.Errorf("expected %d ids, got %d", len(p.items), len(ids))
+	}
+	byID := map[string]PlaylistItem{}
+	for _, item := range p.items {
+		byID[item.ID] = item
+	}
+	items := make([]PlaylistItem, 0, len(ids))
+	for _, id := range ids {
+		item, ok := byID[id]
+		if !ok {
+			return fmt.Errorf("unknown or duplicate item %q", id)
+		}
+		delete(byID, id)
+		items = append(items, item)
+	}
+	p.items = items
+	return nil
+}
+
+func (p *Playlist) clear() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.items = nil
+}
+
+// 取出队首曲目
+func (p *Playlist) pop() (PlaylistItem, int, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.items) == 0 {
+		return PlaylistItem{}, 0, false
+	}
+	item := p.items[0]
+	p.items = p.items[1:]
+	return item, len(p.items), true
+}
+
+func (p *Playlist) remaining() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.items)
+}
+
+// 跳过当前曲目：结束当前演奏，由run继续下一首。跳过与终止分开记录，期间的终止不会被清除
+func (p *Playlist) requestSkip() {
+	p.rig.skipPiano.Store(true)
+}
+
+func (p *Playlist) takeSkip() bool {
+	return p.rig.skipPiano.Swap(false)
+}
+
+// 依次演奏队列中的曲目，曲目之间回到预设位置并停顿
+func (p *Playlist) run() error {
+	p.takeSkip()
+	for {
+		item, remaining, ok := p.pop()
+		if !ok {
+			return nil
+		}
+		_, data, err := scoreStore.Get(item.ScoreID)
+		if err != nil {
+			p.rig.logger().Warn("播放列表跳过", "score", item.ScoreID, "err", err)
+			continue
+		}
+		status := PlaylistStatus{ItemID: item.ID, ScoreID: item.ScoreID, Loops: item.Loop, Remaining: remaining}
+		for loop := 1; loop <= item.Loop; loop++ {
+			status.Loop, status.Phase = loop, "playing"
+			p.rig.updatePlaylistStatus(status)
+			err := p.rig.playScore(data, item.Tempo)
+			if err == errPlaybackSkipped {
+				p.takeSkip()
+				break
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		// 回到本曲的预设位置，等待下一首
+		status.Phase, status.Remaining = "homing", p.remaining()
+		p.rig.updatePlaylistStatus(status)
+		if err := p.rig.movedefault(data.DefaultPosition); err != nil {
+			return err
+		}
+		if status.Remaining == 0 {
+			continue
+		}
+		status.Phase = "pausing"
+		p.rig.updatePlaylistStatus(status)
+		p.mu.Lock()
+		deadline := time.Now().Add(time.Duration(p.pause * float64(time.Second)))
+		p.mu.Unlock()
+		for time.Now().Before(deadline) {
+			if p.rig.killPiano.Load() {
+				return errPlaybackKilled
+			}
+			if p.takeSkip() {
+				break
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+}
+
+func getPlaylistHandler(c *gin.Context) {
+	rig := currentRig(c)
+	resp := rig.playlist.snapshot()
+	resp["job"] = rig.currentPlaybackJob()
+	c.JSON(http.StatusOK, resp)
+}
+
+func addPlaylistItemHandler(c *gin.Context) {
+	var item PlaylistItem
+	if err := c.ShouldBindJSON(&item); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+		return
+	}
+	if _, _, err := scoreStore.Get(item.ScoreID); err != nil {
+		c.JSON(scoreErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	if item.Tempo <= 0 {
+		item.Tempo = 1
+	}
+	if item.Loop <= 0 {
+		item.Loop = 1
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "success", "item": currentRig(c).playlist.add(item)})
+}
+
+func removePlaylistItemHandler(c *gin.Context) {
+	if !currentRig(c).playlist.remove(c.Param("id")) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "item not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "success"})
+}
+
+func reorderPlaylistHandler(c *gin.Context) {
+	var req struct {
+		IDs []string `json:"ids"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+		return
+	}
+	if err := currentRig(c).playlist.reorder(req.IDs); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "success"})
+}
+
+func clearPlaylistHandler(c *gin.Context) {
+	currentRig(c).playlist.clear()
+	c.JSON(http.StatusOK, gin.H{"status": "success"})
+}
+
+func skipPlaylistHandler(c *gin.Context) {
+	rig := currentRig(c)
+	job := rig.currentPlaybackJob()
+	if job == nil || job.Playlist == nil || (job.State != jobRunning && job.State != jobPaused) {
+		c.JSON(http.StatusConflict, gin.H{"error": "playlist is not playing"})
+		return
+	}
+	rig.playlist.requestSkip()
+	c.JSON(http.StatusOK, gin.H{"status": "success"})
+}
+
+// 开始播放队列，请求体与 /api/piano/start 相同(忽略乐谱)，可选 pause 设置曲间停顿秒数
+func startPlaylistHandler(c *gin.Context) {
+	var req struct {
+		PianoConfig
+		Pause *float64 `json:"pause"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+		return
+	}
+	rig := currentRig(c)
+	playlist := rig.playlist
+	items := playlist.list()
+	if len(items) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "playlist is empty"})
+		return
+	}
+	if err := interfaceConflict(rig.ID, rig.effectiveInterfaces(req.PianoConfig)); err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	preflight, ok := preflightBeforeStart(c, rig, req.PianoConfig, items)
+	if !ok {
+		return
+	}
+	if req.Pause != nil && *req.Pause >= 0 {
+		playlist.mu.Lock()
+		playlist.pause = *req.Pause
+		playlist.mu.Unlock()
+	}
+	job, err := rig.startPlaybackJob("", func() error {
+		rig.bindInterfaces(req.PianoConfig)
+		return playlist.run()
+	})
+	if err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "success", "job": job, "preflight": preflight})
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func playlistIDs(p *Playlist) []string {
+	ids := []string{}
+	for _, item := range p.snapshot()["items"].([]PlaylistItem) {
+		ids = append(ids, item.ID)
+	}
+	return ids
+}
+
+func TestPlaylistQueue(t *testing.T) {
+	tests := []struct {
+		name    string
+		edit    func(p *Playlist) error
+		want    []string
+		wantErr bool
+	}{
+		{"unchanged", func(p *Playlist) error { return nil }, []string{"item-1", "item-2", "item-3"}, false},
+		{"reorder", func(p *Playlist) error { return p.reorder([]string{"item-3", "item-1", "item-2"}) }, []string{"item-3", "item-1", "item-2"}, false},
+		{"reorder missing item", func(p *Playlist) error { return p.reorder([]string{"item-3", "item-1"}) }, []string{"item-1", "item-2", "item-3"}, true},
+		{"reorder duplicate", func(p *Playlist) error { return p.reorder([]string{"item-1", "item-1", "item-2"}) }, []string{"item-1", "item-2", "item-3"}, true},
+		{"reorder unknown", func(p *Playlist) error { return p.reorder([]string{"item-1", "item-2", "item-9"}) }, []string{"item-1", "item-2", "item-3"}, true},
+		{"remove", func(p *Playlist) error {
+			if !p.remove("item-2") {
+				t.Error("remove item-2 failed")
+			}
+			if p.remove("item-2") {
+				t.Error("removed item-2 twice")
+			}
+			return nil
+		}, []string{"item-1", "item-3"}, false},
+		{"clear", func(p *Playlist) error { p.clear(); return nil }, []string{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newRig(RigConfig{ID: "test"}).playlist
+			for _, id := range []string{"a", "b", "c"} {
+				p.add(PlaylistItem{ScoreID: id, Tempo: 1, Loop: 1})
+			}
+			if err := tt.edit(p); (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got := playlistIDs(p); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+
+			// 依次取出队首，剩余数递减
+			for i, id := range tt.want {
+				item, remaining, ok := p.pop()
+				if !ok || item.ID != id || remaining != len(tt.want)-i-1 {
+					t.Fatalf("pop %d: got %s, %d, %v", i, item.ID, remaining, ok)
+				}
+			}
+			if _, _, ok := p.pop(); ok {
+				t.Error("pop from empty playlist succeeded")
+			}
+		})
+	}
+}
+
+// 读不到的乐谱被跳过，队列继续前进直到取空
+func TestPlaylistRunSkipsMissingScores(t *testing.T) {
+	saved := scoreStore
+	scoreStore = &ScoreStore{dir: t.TempDir()}
+	defer func() { scoreStore = saved }()
+
+	p := newRig(RigConfig{ID: "test"}).playlist
+	p.add(PlaylistItem{ScoreID: "missing", Tempo: 1, Loop: 1})
+	p.add(PlaylistItem{ScoreID: "../escape", Tempo: 1, Loop: 2})
+	if err := p.run(); err != nil {
+		t.Fatal(err)
+	}
+	if n := p.remaining(); n != 0 {
+		t.Errorf("%d items left after run", n)
+	}
+}
+
+// 跳过与终止分开记录：取走跳过不会清除期间收到的终止
+func TestPlaylistSkip(t *testing.T) {
+	p := newRig(RigConfig{ID: "test"}).playlist
+	if p.takeSkip() {
+		t.Fatal("skip pending before request")
+	}
+	p.requestSkip()
+	if p.rig.killPiano.Load() {
+		t.Error("skip killed the whole job")
+	}
+	p.rig.killPiano.Store(true)
+	if !p.takeSkip() {
+		t.Fatal("skip not recorded")
+	}
+	if !p.rig.killPiano.Load() {
+		t.Error("taking the skip cleared the kill")
+	}
+	if p.takeSkip() {
+		t.Error("skip taken twice")
+	}
+}
+
+// 不论是否开启演奏前检查，播放列表都不能使用其他工位的接口
+func TestStartPlaylistInterfaceConflict(t *testing.T) {
+	useRigs(t, studioRig)
+	saved := appConfig.Preflight.OnStart
+	t.Cleanup(func() { appConfig.Preflight.OnStart = saved })
+	appConfig.Preflight.OnStart = false
+	playlist := defaultRig().playlist
+	playlist.add(PlaylistItem{ScoreID: "a", Tempo: 1, Loop: 1})
+	t.Cleanup(playlist.clear)
+
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodPost, "/api/playlist/start", strings.NewReader(`{"interfaces":{"leftArm":"can6"}}`))
+	startPlaylistHandler(c)
+	if w.Code != http.StatusConflict {
+		t.Errorf("status %d, want 409: %s", w.Code, w.Body)
+	}
+	if defaultRig().currentPlaybackJob() != nil {
+		t.Error("playlist started on another rig's interface")
+	}
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/url"
+
+	"github.com/gin-gonic/gin"
+)
+
+// PreflightConfig 演奏前检查配置
+//
+// 反馈查询接口约定：GET FeedbackURL?interface=can2&id=0x2A2，返回该接口上该ID最近一帧
+// {"data":[...8字节], "age":距今秒数}，没有收到过时返回404。查询的ID：机械臂状态0x2A1(第2字节0为正常)、
+// 末端位姿0x2A2-0x2A4(两个大端int32，0.001mm/0.001°)、灵巧手为工位的 handIds(与指令相同布局的位置帧)。
+// 未配置时需要反馈的检查只给出警告，RequireFeedback 为 true 时判为失败。
+type PreflightConfig struct {
+	OnStart         bool    `json:"onStart"`         // 开始演奏前自动检查，失败时拒绝启动
+	FeedbackURL     string  `json:"feedbackUrl"`     // CAN反馈查询接口
+	RequireFeedback bool    `json:"requireFeedback"` // 未配置反馈接口时机械臂和灵巧手的检查判为失败
+	FeedbackAge     float64 `json:"feedbackAge"`     // 反馈帧的最大时效(秒)
+	PoseTolerance   float64 `json:"poseTolerance"`   // 机械臂实际位置与弹琴预设值的最大偏差(mm)
+}
+
+func defaultPreflightConfig() PreflightConfig {
+	return PreflightConfig{OnStart: true, FeedbackAge: 1, PoseTolerance: 30}
+}
+
+// 检查结果
+const (
+	preflightOK   = "ok"
+	preflightWarn = "warn"
+	preflightFail = "fail"
+)
+
+type PreflightCheck struct {
+	Name    string `json:"name"`
+	Status  string `json:"status"`
+	Message string `json:"message,omitempty"`
+}
+
+type PreflightReport struct {
+	OK     bool             `json:"ok"`
+	Checks []PreflightCheck `json:"checks"`
+}
+
+func (r *PreflightReport) add(name, status, format string, args ...interface{}) {
+	r.Checks = append(r.Checks, PreflightCheck{name, status, fmt.Sprintf(format, args...)})
+	if status == preflightFail {
+		r.OK = false
+		metricPreflightFailures.inc(name)
+	}
+}
+
+var errNoFeedback = fmt.Errorf("no feedback endpoint configured")
+
+// 查询接口上某个ID最近一帧反馈
+func queryFeedback(iface string, id uint32) ([]byte, error) {
+	data, age, err := queryFeedbackFrame(iface, id)
+	if err != nil {
+		return nil, err
+	}
+	if age > appConfig.Preflight.FeedbackAge {
+		return nil, fmt.Errorf("frame 0x%X on %s is %.1fs old", id, iface, age)
+	}
+	return data, nil
+}
+
+// 查询最近一帧反馈及其时效(秒)，不检查时效
+func queryFeedbackFrame(iface string, id uint32) ([]byte, float64, error) {
+	cfg := appConfig.Preflight
+	if cfg.FeedbackURL == "" {
+		return nil, 0, errNoFeedback
+	}
+	q := url.Values{"interface": {iface}, "id": {fmt.Sprintf("0x%X", id)}}
+	resp, err := canBridge.httpClient().Get(cfg.FeedbackURL + "?" + q.Encode())
+	if err != nil {
+		return nil, 0, fmt.Errorf("query feedback failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, 0, fmt.Errorf("no frame 0x%X received on %s", id, iface)
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, 0, fmt.Errorf("feedback service error: %s", string(body))
+	}
+	var frame struct {
+		Data []byte  `json:"data"`
+		Age  float64 `json:"age"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&frame); err != nil {
+		return nil, 0, fmt.Errorf("invalid feedback: %v", err)
+	}
+	canRecorder.record(true, CanMessage{Interface: iface, Id: id, Data: frame.Data})
+	return frame.Data, frame.Age, nil
+}
+
+// 反馈帧中的两个int32(大端)，与 intPairToBytes 相反
+func bytesToIntPair(data []byte) (int, int, error) {
+	if len(data) < 8 {
+		return 0, 0, fmt.Errorf("short frame")
+	}
+	return int(int32(binary.BigEndian.Uint32(data[0:4]))), int(int32(binary.BigEndian.Uint32(data[4:8]))), nil
+}
+
+// 读取机械臂末端位姿反馈 0x2A2-0x2A4，单位0.001mm/0.001°
+func queryArmPose(iface string) ([6]int, error) {
+	var pose [6]int
+	for i, id := range []uint32{0x2A2, 0x2A3, 0x2A4} {
+		data, err := queryFeedback(iface, id)
+		if err != nil {
+			return pose, err
+		}
+		if pose[2*i], pose[2*i+1], err = bytesToIntPair(data); err != nil {
+			return pose, fmt.Errorf("frame 0x%X: %v", id, err)
+		}
+	}
+	return pose, nil
+}
+
+// 需要反馈的检查：没有配置反馈接口时按 RequireFeedback 给出警告或失败
+func (r *PreflightReport) feedbackCheck(name string, err error, okMsg string) {
+	switch {
+	case err == errNoFeedback && appConfig.Preflight.RequireFeedback:
+		r.add(name, preflightFail, "cannot verify: %v", err)
+	case err == errNoFeedback:
+		r.add(name, preflightWarn, "cannot verify: %v", err)
+	case err != nil:
+		r.add(name, preflightFail, "%v", err)
+	default:
+		r.add(name, preflightOK, "%s", okMsg)
+	}
+}
+
+// 演奏前检查：接口、CAN服务、机械臂使能和位置、灵巧手型号和响应、乐谱
+func runPreflight(rig *Rig, config PianoConfig, scores map[string]MusicData) PreflightReport {
+	report := PreflightReport{OK: true, Checks: []PreflightCheck{}}
+	bound := rig.effectiveInterfaces(config)
+	ifaces := []struct{ role, name string }{
+		{"leftHand", bound.LeftHand},
+		{"rightHand", bound.RightHand},
+		{"leftArm", bound.LeftArm},
+		{"rightArm", bound.RightArm},
+	}
+
+	// 1. 四个接口都已指定且互不相同
+	seen := map[string]string{}
+	bad := false
+	for _, it := range ifaces {
+		switch {
+		case it.name == "":
+			report.add("interfaces", preflightFail, "%s interface is empty", it.role)
+			bad = true
+		case seen[it.name] != "":
+			report.add("interfaces", preflightFail, "%s and %s both use %s", seen[it.name], it.role, it.name)
+			bad = true
+		default:
+			seen[it.name] = it.role
+		}
+	}
+	// 接口不能被其他工位占用
+	if err := interfaceConflict(rig.ID, bound); err != nil {
+		report.add("interfaces", preflightFail, "%v", err)
+		bad = true
+	}
+	if !bad {
+		report.add("interfaces", preflightOK, "")
+	}
+
+	// 演奏只支持 L10 灵巧手
+	hands := rig.handModels()
+	for _, hand := range []struct{ side, model string }{{"left", hands.Left}, {"right", hands.Right}} {
+		if hand.model != "l10" {
+			report.add(hand.side+"HandModel", preflightFail, "%s hand model %s is not supported for playback", hand.side, hand.model)
+		} else {
+			report.add(hand.side+"HandModel", preflightOK, "")
+		}
+	}
+
+	// 2. CAN服务可达，接口存在
+	available, err := queryCanDevices()
+	if err != nil {
+		report.add("canService", preflightFail, "%v", err)
+	} else {
+		report.add("canService", preflightOK, "%d interfaces available", len(available))
+		exists := map[string]bool{}
+		for _, name := range available {
+			exists[name] = true
+		}
+		for _, it := range ifaces {
+			if it.name != "" && !exists[it.name] {
+				report.add("interfaceExists", preflightFail, "%s interface %s not found", it.role, it.name)
+			}
+		}
+	}
+
+	// 3. 机械臂已使能且在弹琴预设值附近
+	for _, arm := range []struct {
+		side, iface string
+		preset      []int
+	}{{"left", bound.LeftArm, rig.armPreset("left")}, {"right", bound.RightArm, rig.armPreset("right")}} {
+		status, err := queryFeedback(arm.iface, 0x2A1)
+		// 0x2A1 第2字节为机械臂状态，0x00 正常，0x01 急停
+		if err == nil && len(status) > 1 && status[1] != 0 {
+			err = fmt.Errorf("%s arm status 0x%02X", arm.side, status[1])
+		}
+		report.feedbackCheck(arm.side+"ArmEnabled", err, "")
+
+		pose, err := queryArmPose(arm.iface)
+		msg := ""
+		if err == nil {
+			d := math.Sqrt(math.Pow(float64(pose[0])/1000-float64(arm.preset[0]), 2) +
+				math.Pow(float64(pose[1])/1000-float64(arm.preset[1]), 2) +
+				math.Pow(float64(pose[2])/1000-float64(arm.preset[2]), 2))
+			msg = fmt.Sprintf("%.1fmm from preset", d)
+			if d > appConfig.Preflight.PoseTolerance {
+				err = fmt.Errorf("%s arm is %s (tolerance %.0fmm)", arm.side, msg, appConfig.Preflight.PoseTolerance)
+			}
+		}
+		report.feedbackCheck(arm.side+"ArmPose", err, msg)
+	}
+
+	// 4. 灵巧手有反馈
+	for _, hand := range []struct{ side, iface string }{{"left", bound.LeftHand}, {"right", bound.RightHand}} {
+		_, err := queryFeedback(hand.iface, rig.handID(hand.side))
+		report.feedbackCheck(hand.side+"HandResponds", err, "")
+	}
+
+	// 5. 乐谱合法，预设位置在工作空间内且两臂不碰撞
+	if len(scores) == 0 {
+		report.add("score", preflightFail, "no score")
+	}
+	for name, data := range scores {
+		if err := validateMusicData(data); err != nil {
+			report.add("score", preflightFail, "%s: %v", name, err)
+			continue
+		}
+		status, msg := preflightOK, fmt.Sprintf("%s: %d steps", name, len(data.Music))
+		if err := checkStartPoses(rig, data); err != nil {
+			status, msg = preflightFail, fmt.Sprintf("%s: %v", name, err)
+		}
+		report.add("score", status, "%s", msg)
+	}
+	return report
+}
+
+// 乐谱的起始位姿(0.001单位)：预设位置加上预设的 move，与 movedefault 一致
+func scoreStartPoses(rig *Rig, data MusicData) (left, right [6]int) {
+	l, r := rig.armPreset("left"), rig.armPreset("right")
+	l[2] += data.DefaultPosition.Left.Move * armStepMM
+	r[2] += data.DefaultPosition.Right.Move * armStepMM
+	for k := range left {
+		left[k], right[k] = l[k]*1000, r[k]*1000
+	}
+	return left, right
+}
+
+// 起始位姿按演奏时的顺序检查：两只手都在工作空间内，左臂到位后右臂移动到起始位姿不碰撞
+func checkStartPoses(rig *Rig, data MusicData) error {
+	left, right := scoreStartPoses(rig, data)
+	for _, p := range []struct {
+		side string
+		pose [6]int
+	}{{"left", left}, {"right", right}} {
+		if ws := workspaceStatus(p.side, p.pose); ws != nil && ws["valid"] == false {
+			return fmt.Errorf("%s start pose %v", p.side, ws["error"])
+		}
+	}
+	cfg := appConfig.Collision
+	if !cfg.Enabled {
+		return nil
+	}
+	segments := map[string]*armSegment{"left": {from: left, to: left, known: true}, "right": {}}
+	if err := checkArmCollision(cfg, segments, "right", right); err != nil {
+		return fmt.Errorf("start poses: %v", err)
+	}
+	return nil
+}
+
+// 演奏或播放列表要用到的乐谱，key为乐谱名称
+func preflightScores(config PianoConfig, playlistItems []PlaylistItem) (map[string]MusicData, error) {
+	scores := map[string]MusicData{}
+	if playlistItems != nil {
+		for _, item := range playlistItems {
+			_, data, err := scoreStore.Get(item.ScoreID)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", item.ScoreID, err)
+			}
+			scores[item.ScoreID] = data
+		}
+		return scores, nil
+	}
+	if config.ScoreID != "" {
+		_, data, err := scoreStore.Get(config.ScoreID)
+		if err != nil {
+			return nil, err
+		}
+		scores[config.ScoreID] = data
+	} else if len(config.MusicData.Music) > 0 {
+		scores["musicData"] = config.MusicData
+	}
+	return scores, nil
+}
+
+// 开始演奏前的自动检查，检查失败时返回 412 和检查报告；未开启自动检查时返回nil
+func preflightBeforeStart(c *gin.Context, rig *Rig, config PianoConfig, playlistItems []PlaylistItem) (*PreflightReport, bool) {
+	if !appConfig.Preflight.OnStart {
+		return nil, true
+	}
+	scores, err := preflightScores(config, playlistItems)
+	if err != nil {
+		c.JSON(scoreErrorStatus(err), gin.H{"error": err.Error()})
+		return nil, false
+	}
+	report := runPreflight(rig, config, scores)
+	if !report.OK {
+		slog.Warn("演奏前检查失败", "rig", rig.ID, "checks", report.Checks)
+		c.JSON(http.StatusPreconditionFailed, gin.H{"error": "preflight failed", "preflight": report})
+		return nil, false
+	}
+	return &report, true
+}
+
+// 单独运行演奏前检查，请求体与 /api/piano/start 相同
+func preflightHandler(c *gin.Context) {
+	var config PianoConfig
+	if err := c.ShouldBindJSON(&config); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+		return
+	}
+	scores, err := preflightScores(config, nil)
+	if err != nil {
+		c.JSON(scoreErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, runPreflight(currentRig(c), config, scores))
+}
@@ -0,0 +1,472 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RecorderConfig CAN帧录制：记录发出的每一帧和收到的反馈，用于复现演奏
+type RecorderConfig struct {
+	Dir    string `json:"dir"`    // 录制文件目录
+	Format string `json:"format"` // 默认格式：candump 或 asc
+}
+
+func defaultRecorderConfig() RecorderConfig {
+	return RecorderConfig{Dir: "recordings", Format: "candump"}
+}
+
+// 录制文件格式
+const (
+	formatCandump = "candump" // candump -l 日志：(秒.微秒) can2 152#0006A1B2，收到的帧行尾加 R
+	formatASC     = "asc"     // Vector ASC：相对时间、通道号、Tx/Rx
+)
+
+// RecordedFrame 录制文件中的一帧，Offset 为相对第一帧的时间
+type RecordedFrame struct {
+	Offset time.Duration
+	Rx     bool // 收到的反馈帧，回放时跳过
+	CanMessage
+}
+
+// CanRecorder 当前录制会话，同一时间只有一个
+type CanRecorder struct {
+	mu       sync.Mutex
+	file     *os.File
+	name     string
+	format   string
+	start    time.Time // 包含单调时钟读数，时间戳按 time.Since 计算
+	frames   int
+	channels map[string]int // ASC 通道号，按接口出现顺序从1开始
+}
+
+var canRecorder = &CanRecorder{}
+
+// 录制名即文件名(不含扩展名)，规则与乐谱ID相同
+func recordingPath(name, format string) string {
+	ext := ".log"
+	if format == formatASC {
+		ext = ".asc"
+	}
+	return filepath.Join(appConfig.Recorder.Dir, name+ext)
+}
+
+func (r *CanRecorder) Start(name, format string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.file != nil {
+		return fmt.Errorf("recording %s is still running", r.name)
+	}
+	if format == "" {
+		format = appConfig.Recorder.Format
+	}
+	if format != formatCandump && format != formatASC {
+		return fmt.Errorf("unknown format %q", format)
+	}
+	if name == "" {
+		name = "session-" + time.Now().Format("20060102-150405")
+	}
+	if !validScoreID(name) {
+		return fmt.Errorf("invalid recording name")
+	}
+	if err := os.MkdirAll(appConfig.Recorder.Dir, 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(recordingPath(name, format))
+	if err != nil {
+		return err
+	}
+	r.file, r.name, r.format, r.frames = f, name, format, 0
+	r.start = time.Now()
+	r.channels = map[string]int{}
+	if format == formatASC {
+		stamp := r.start.Format("Mon Jan 2 15:04:05.000 2006")
+		fmt.Fprintf(f, "date %s\nbase hex  timestamps relative\ninternal events logged\nBegin Triggerblock %s\n", stamp, stamp)
+	}
+	slog.Info("开始录制CAN帧", "file", f.Name())
+	return nil
+}
+
+func (r *CanRecorder) Stop() (string, int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.file == nil {
+		return "", 0, fmt.Errorf("not recording")
+	}
+	if r.format == formatASC {
+		fmt.Fprintf(r.file, "End TriggerBlock\n")
+	}
+	err := r.file.Close()
+	name, frames := r.name, r.frames
+	r.file = nil
+	slog.Info("停止录制CAN帧", "file", name, "frames", frames)
+	return name, frames, err
+}
+
+// 记录一帧，未录制时直接返回
+func (r *CanRecorder) record(rx bool, msg CanMessage) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.file == nil {
+		return
+	}
+	elapsed := time.Since(r.start)
+	var line string
+	switch r.format {
+	case formatASC:
+		ch, ok := r.channels[msg.Interface]
+		if !ok {
+			ch = len(r.channels) + 1
+			r.channels[msg.Interface] = ch
+			// 通道号与接口名的对应关系写成注释，回放时读取
+			fmt.Fprintf(r.file, "// channel %d = %s\n", ch, msg.Interface)
+		}
+		dir := "Tx"
+		if rx {
+			dir = "Rx"
+		}
+		id := fmt.Sprintf("%X", msg.Id)
+		if msg.Id > 0x7FF {
+			id += "x"
+		}
+		data := strings.ToUpper(hex.EncodeToString(msg.Data))
+		var bytes []string
+		for i := 0; i+1 < len(data); i += 2 {
+			bytes = append(bytes, data[i:i+2])
+		}
+		line = fmt.Sprintf("%11.6f %d  %-15s %s   d %d %s\n", elapsed.Seconds(), ch, id, dir, len(msg.Data), strings.Join(bytes, " "))
+	default:
+		ts := r.start.Add(elapsed)
+		id := fmt.Sprintf("%03X", msg.Id)
+		if msg.Id > 0x7FF {
+			id = fmt.Sprintf("%08X", msg.Id)
+		}
+		line = fmt.Sprintf("(%d.%06d) %s %s#%s", ts.Unix(), ts.Nanosecond()/1000, msg.Interface, id, strings.ToUpper(hex.EncodeToString(msg.Data)))
+		if rx {
+			line += " R"
+		}
+		line += "\n"
+	}
+	if _, err := r.file.WriteString(line); err != nil {
+		slog.Error("写入录制文件失败", "err", err)
+		return
+	}
+	r.frames++
+}
+
+func (r *CanRecorder) status() gin.H {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.file == nil {
+		return gin.H{"recording": false}
+	}
+	return gin.H{
+		"recording": true,
+		"name":      r.name,
+		"format":    r.format,
+		"frames":    r.frames,
+		"elapsed":   time.Since(r.start).Seconds(),
+	}
+}
+
+var (
+	candumpLine = regexp.MustCompile(`^\((\d+)\.(\d+)\)\s+(\S+)\s+([0-9A-Fa-f]+)#([0-9A-Fa-f]*)\s*(R|T)?\s*$`)
+	ascChannel  = regexp.MustCompile(`^//\s*channel\s+(\d+)\s*=\s*(\S+)`)
+	ascLine     = regexp.MustCompile(`^\s*(\d+\.\d+)\s+(\d+)\s+([0-9A-Fa-f]+)x?\s+(Tx|Rx)\s+d\s+(\d+)((?:\s+[0-9A-Fa-f]{2})*)`)
+)
+
+// 解析录制文件，按时间顺序返回
+func parseRecording(path string) ([]RecordedFrame, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var frames []RecordedFrame
+	var first time.Duration
+	channels := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := scanner.Text()
+		if m := candumpLine.FindStringSubmatch(line); m != nil {
+			sec, _ := strconv.ParseInt(m[1], 10, 64)
+			frac, _ := strconv.ParseFloat("0."+m[2], 64)
+			id, _ := strconv.ParseUint(m[4], 16, 32)
+			data, err := hex.DecodeString(m[5])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", lineNo, err)
+			}
+			ts := time.Duration(sec)*time.Second + time.Duration(frac*float64(time.Second))
+			if len(frames) == 0 {
+				first = ts
+			}
+			frames = append(frames, RecordedFrame{ts - first, m[6] == "R", CanMessage{m[3], uint32(id), data}})
+			continue
+		}
+		if m := ascChannel.FindStringSubmatch(line); m != nil {
+			channels[m[1]] = m[2]
+			continue
+		}
+		if m := ascLine.FindStringSubmatch(line); m != nil {
+			ts, _ := strconv.ParseFloat(m[1], 64)
+			id, _ := strconv.ParseUint(m[3], 16, 32)
+			data, err := hex.DecodeString(strings.Join(strings.Fields(m[6]), ""))
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", lineNo, err)
+			}
+			iface := channels[m[2]]
+			if iface == "" {
+				// 其他工具录制的文件没有通道注释，用通道号作为接口名，需要在回放时映射
+				iface = m[2]
+			}
+			frames = append(frames, RecordedFrame{time.Duration(ts * float64(time.Second)), m[4] == "Rx", CanMessage{iface, uint32(id), data}})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(frames, func(i, j int) bool { return frames[i].Offset < frames[j].Offset })
+	return frames, nil
+}
+
+// 录制中发出的帧，反馈帧不回放
+func transmittedFrames(frames []RecordedFrame) []RecordedFrame {
+	var tx []RecordedFrame
+	for _, fr := range frames {
+		if !fr.Rx {
+			tx = append(tx, fr)
+		}
+	}
+	return tx
+}
+
+// 回放中一个接口上已收到的位姿帧 0x152-0x154，单位0.001mm/0.001°
+type replayPose struct {
+	pose [6]int
+	have [3]bool
+}
+
+// 回放的位姿帧与正常发送一样经过工作空间和防碰撞检查：收到位姿帧时记录目标，
+// 在点位控制指令 0x151 发出前检查；位姿不完整时无法检查，拒绝回放。force 为true时不检查
+func guardReplayFrame(poses map[string]*replayPose, msg CanMessage, force bool) error {
+	if force {
+		return nil
+	}
+	p := poses[msg.Interface]
+	if p == nil {
+		p = &replayPose{}
+		poses[msg.Interface] = p
+	}
+	switch msg.Id {
+	case 0x152, 0x153, 0x154:
+		a, b, err := bytesToIntPair(msg.Data)
+		if err != nil {
+			return &SafetyError{Reason: fmt.Sprintf("pose frame 0x%X: %v", msg.Id, err)}
+		}
+		k := int(msg.Id - 0x152)
+		p.pose[2*k], p.pose[2*k+1] = a, b
+		p.have[k] = true
+	case 0x151:
+		// 只检查点位控制，关节控制与 /api/arm/send_joint 一样不经过位姿检查
+		if len(msg.Data) < 2 || msg.Data[1] != 0x00 {
+			return nil
+		}
+		if p.have != [3]bool{true, true, true} {
+			return &SafetyError{Reason: fmt.Sprintf("incomplete pose before motion command on %s, use force to replay", msg.Interface)}
+		}
+		if err := guardWorkspace(msg.Interface, p.pose); err != nil {
+			return err
+		}
+		return guardArmMove(msg.Interface, p.pose)
+	}
+	return nil
+}
+
+// 按录制时的时间间隔重新发送帧，speed为回放速度倍数；作为演奏任务运行，可以暂停和终止
+func (r *Rig) replayFrames(frames []RecordedFrame, mapping map[string]string, speed float64, force bool) error {
+	poses := map[string]*replayPose{}
+	base := time.Now()
+	for i, fr := range frames {
+		due := base.Add(time.Duration(float64(fr.Offset) / speed))
+		for {
+			if r.killPiano.Load() {
+				return errPlaybackKilled
+			}
+			if r.stopPiano.Load() {
+				paused := time.Now()
+				if err := r.waitPlaybackResume(); err != nil {
+					return err
+				}
+				// 暂停的时间不计入回放时间轴
+				pausedFor := time.Since(paused)
+				base = base.Add(pausedFor)
+				due = due.Add(pausedFor)
+			}
+			wait := time.Until(due)
+			if wait <= 0 {
+				break
+			}
+			// 分段等待，长间隔时也能及时响应暂停，且不被看门狗判定为卡住
+			if wait > 200*time.Millisecond {
+				wait = 200 * time.Millisecond
+			}
+			time.Sleep(wait)
+			r.updatePlaybackProgress(i, len(frames))
+		}
+		msg := fr.CanMessage
+		if to, ok := mapping[msg.Interface]; ok {
+			msg.Interface = to
+		}
+		if err := guardReplayFrame(poses, msg, force); err != nil {
+			return fmt.Errorf("frame %d (0x%X on %s): %v", i, msg.Id, msg.Interface, err)
+		}
+		if err := forwardToCanService(msg); err != nil {
+			return fmt.Errorf("frame %d (0x%X on %s): %v", i, msg.Id, msg.Interface, err)
+		}
+		r.updatePlaybackProgress(i+1, len(frames))
+	}
+	return nil
+}
+
+// 录制文件路径，不存在时返回错误
+func findRecording(name string) (string, error) {
+	if !validScoreID(name) {
+		return "", invalidScore("invalid recording name")
+	}
+	for _, format := range []string{formatCandump, formatASC} {
+		path := recordingPath(name, format)
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		}
+	}
+	return "", errScoreNotFound
+}
+
+func startRecordingHandler(c *gin.Context) {
+	var req struct {
+		Name   string `json:"name"`
+		Format string `json:"format"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil && err != io.EOF {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+		return
+	}
+	if err := canRecorder.Start(req.Name, req.Format); err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, canRecorder.status())
+}
+
+func stopRecordingHandler(c *gin.Context) {
+	name, frames, err := canRecorder.Stop()
+	if err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"name": name, "frames": frames})
+}
+
+func recordingStatusHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, canRecorder.status())
+}
+
+func listRecordingsHandler(c *gin.Context) {
+	entries, err := os.ReadDir(appConfig.Recorder.Dir)
+	if err != nil && !os.IsNotExist(err) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	list := []gin.H{}
+	for _, e := range entries {
+		ext := filepath.Ext(e.Name())
+		if e.IsDir() || ext != ".log" && ext != ".asc" {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		format := formatCandump
+		if ext == ".asc" {
+			format = formatASC
+		}
+		list = append(list, gin.H{
+			"name":    strings.TrimSuffix(e.Name(), ext),
+			"format":  format,
+			"size":    info.Size(),
+			"updated": info.ModTime(),
+		})
+	}
+	c.JSON(http.StatusOK, gin.H{"recordings": list})
+}
+
+func downloadRecordingHandler(c *gin.Context) {
+	path, err := findRecording(c.Param("name"))
+	if err != nil {
+		c.JSON(scoreErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.FileAttachment(path, filepath.Base(path))
+}
+
+// 回放录制文件，interfaces 把录制时的接口映射到新的接口，未列出的保持不变
+func replayHandler(c *gin.Context) {
+	var req struct {
+		Name       string            `json:"name"`
+		Interfaces map[string]string `json:"interfaces"`
+		Speed      float64           `json:"speed"` // 回放速度倍数，0表示原速
+		Force      bool              `json:"force"` // 不检查机械臂位姿帧的工作空间和防碰撞
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+		return
+	}
+	if req.Speed < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "speed must be positive"})
+		return
+	}
+	if req.Speed == 0 {
+		req.Speed = 1
+	}
+	path, err := findRecording(req.Name)
+	if err != nil {
+		c.JSON(scoreErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	frames, err := parseRecording(path)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("parse recording failed: %v", err)})
+		return
+	}
+	frames = transmittedFrames(frames)
+	if len(frames) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "recording has no transmitted frames"})
+		return
+	}
+	rig := currentRig(c)
+	job, err := rig.startPlaybackJob("replay:"+req.Name, func() error {
+		return rig.replayFrames(frames, req.Interfaces, req.Speed, req.Force)
+	})
+	if err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	duration := frames[len(frames)-1].Offset.Seconds() / req.Speed
+	c.JSON(http.StatusOK, gin.H{"status": "replay started", "job": job, "frames": len(frames), "duration": duration})
+}
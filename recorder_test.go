@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRecording(t *testing.T) {
+	ms := time.Millisecond
+	tests := []struct {
+		name string
+		file string
+		text string
+		want []RecordedFrame
+	}{
+		{
+			name: "candump",
+			file: "a.log",
+			text: "(1700000000.100000) can2 152#0006A1B200000000\n" +
+				"(1700000000.350000) can2 2A1#0000 R\n" +
+				"(1700000000.200000) can0 027#01FF\n" +
+				"garbage line\n",
+			want: []RecordedFrame{
+				{0, false, CanMessage{"can2", 0x152, []byte{0x00, 0x06, 0xA1, 0xB2, 0, 0, 0, 0}}},
+				{100 * ms, false, CanMessage{"can0", 0x27, []byte{0x01, 0xFF}}},
+				{250 * ms, true, CanMessage{"can2", 0x2A1, []byte{0x00, 0x00}}},
+			},
+		},
+		{
+			name: "candump empty data and extended id",
+			file: "b.log",
+			text: "(5.000000) can1 150#\n(5.000500) can1 18FF50E5#01 T\n",
+			want: []RecordedFrame{
+				{0, false, CanMessage{"can1", 0x150, []byte{}}},
+				{500 * time.Microsecond, false, CanMessage{"can1", 0x18FF50E5, []byte{0x01}}},
+			},
+		},
+		{
+			name: "asc with channel comments",
+			file: "c.asc",
+			text: "date Thu Oct 19 10:00:00.000 am 2026\n" +
+				"base hex  timestamps absolute\n" +
+				"// channel 1 = can2\n" +
+				"// channel 2 = can0\n" +
+				"   0.000000 1  152             Tx   d 8 00 06 A1 B2 00 00 00 00\n" +
+				"   0.120000 3  2A1             Rx   d 2 00 01\n" +
+				"   0.050000 2  27              Tx   d 7 01 FF 00 00 00 00 00\n" +
+				"   0.200000 1  18FF50E5x       Tx   d 1 7F\n",
+			want: []RecordedFrame{
+				{0, false, CanMessage{"can2", 0x152, []byte{0x00, 0x06, 0xA1, 0xB2, 0, 0, 0, 0}}},
+				{50 * ms, false, CanMessage{"can0", 0x27, []byte{0x01, 0xFF, 0, 0, 0, 0, 0}}},
+				// 没有通道注释时用通道号作为接口名
+				{120 * ms, true, CanMessage{"3", 0x2A1, []byte{0x00, 0x01}}},
+				{200 * ms, false, CanMessage{"can2", 0x18FF50E5, []byte{0x7F}}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), tt.file)
+			if err := os.WriteFile(path, []byte(tt.text), 0644); err != nil {
+				t.Fatal(err)
+			}
+			got, err := parseRecording(path)
+			if err != nil {
+				t.Fatalf("parseRecording: %v", err)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %d frames, want %d: %+v", len(got), len(tt.want), got)
+			}
+			for i, w := range tt.want {
+				g := got[i]
+				if d := g.Offset - w.Offset; d < -time.Microsecond || d > time.Microsecond {
+					t.Errorf("frame %d offset %v, want %v", i, g.Offset, w.Offset)
+				}
+				if g.Rx != w.Rx || g.Interface != w.Interface || g.Id != w.Id || !bytes.Equal(g.Data, w.Data) {
+					t.Errorf("frame %d: got %+v, want %+v", i, g, w)
+				}
+			}
+		})
+	}
+}
+
+func TestParseRecordingBadData(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bad.log")
+	if err := os.WriteFile(path, []byte("(1.000000) can0 152#00\n(1.100000) can0 153#ABC\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parseRecording(path); err == nil || !strings.HasPrefix(err.Error(), "line 2:") {
+		t.Fatalf("got %v, want an error on line 2", err)
+	}
+}
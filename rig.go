@@ -0,0 +1,484 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RigInterfaces 一个工位的四个CAN接口
+type RigInterfaces struct {
+	LeftHand  string `json:"leftHand"`
+	RightHand string `json:"rightHand"`
+	LeftArm   string `json:"leftArm"`
+	RightArm  string `json:"rightArm"`
+}
+
+// HandModels 左右灵巧手型号，l10 或 o7；演奏只支持 l10
+type HandModels struct {
+	Left  string `json:"left"`
+	Right string `json:"right"`
+}
+
+// HandIDs 左右灵巧手指令的CAN ID，为0时使用 RIGHT_HAND_ID(两只手在各自的接口上都用 0x27)
+type HandIDs struct {
+	Left  uint32 `json:"left"`
+	Right uint32 `json:"right"`
+}
+
+// RigConfig 工位配置，保存在配置文件的 rigs 段，预设值为空时使用默认值
+type RigConfig struct {
+	ID              string        `json:"id"`
+	Name            string        `json:"name"`
+	Interfaces      RigInterfaces `json:"interfaces"`
+	Hands           HandModels    `json:"hands"`
+	HandIDs         HandIDs       `json:"handIds"`
+	LeftArmPreset   []int         `json:"leftArmPreset"`   // 左臂弹琴预设值 xyzrxyz(mm/°)
+	RightArmPreset  []int         `json:"rightArmPreset"`  // 右臂弹琴预设值
+	L10FingerPreset []int         `json:"l10FingerPreset"` // L10 手指弹琴预设值
+	O7FingerPreset  []int         `json:"o7FingerPreset"`  // O7 手指弹琴预设值
+}
+
+const defaultRigID = "default"
+
+// 新工位的默认预设值
+var defaultLeftArmPreset = []int{400, 0, 251, 0, 80, 0}
+var defaultRightArmPreset = []int{400, 0, 240, 0, 85, 0}
+var defaultL10FingerPreset = []byte{0, 0, 225, 225, 225, 225}
+var defaultO7FingerPreset = []byte{0, 255, 235, 235, 235, 235, 100}
+
+func defaultRigConfig() RigConfig {
+	return RigConfig{
+		ID:         defaultRigID,
+		Interfaces: RigInterfaces{LeftHand: "can0", RightHand: "can1", LeftArm: "can2", RightArm: "can3"},
+		Hands:      HandModels{Left: "l10", Right: "l10"},
+	}
+}
+
+// Rig 一个双臂工位：接口绑定、手型号、预设值，以及独立的演奏任务和安全状态
+type Rig struct {
+	ID   string
+	Name string
+
+	mu             sync.Mutex // 保护接口绑定和预设值
+	iface          RigInterfaces
+	hands          HandModels
+	handIDs        HandIDs
+	leftArmPreset  []int
+	rightArmPreset []int
+	l10Preset      []byte
+	o7Preset       []byte
+	manualArmSides map[string]string // 手动控制时记录接口对应的左右臂
+
+	// 演奏任务，由 jobMu 保护
+	job       *PlaybackJob
+	playlist  *Playlist
+	jobLogger *slog.Logger // 演奏任务的日志，带任务ID
+
+	// 演奏控制标志，HTTP处理、看门狗和演奏协程并发读写
+	killPiano atomic.Bool
+	stopPiano atomic.Bool
+	skipPiano atomic.Bool // 播放列表跳过当前曲目
+
+	// 演奏过程中机械臂的当前位姿和手指状态，每次演奏开始时从预设值复制
+	leftArmPose  []int
+	rightArmPose []int
+	leftFinger   []byte
+	rightFinger  []byte
+
+	segments map[string]*armSegment // 两只机械臂最近的运动段，由 safetyMu 保护
+	teach    *TeachSession
+}
+
+var rigsMu sync.Mutex
+var rigs = map[string]*Rig{}
+
+func bytesOf(values []int, def []byte) []byte {
+	if len(values) == 0 {
+		return append([]byte{}, def...)
+	}
+	b := make([]byte, len(values))
+	for i, v := range values {
+		b[i] = byte(v)
+	}
+	return b
+}
+
+func intsOf(values []byte) []int {
+	ints := make([]int, len(values))
+	for i, v := range values {
+		ints[i] = int(v)
+	}
+	return ints
+}
+
+func orDefault(values, def []int) []int {
+	if len(values) == 0 {
+		return append([]int{}, def...)
+	}
+	return append([]int{}, values...)
+}
+
+func newRig(cfg RigConfig) *Rig {
+	r := &Rig{
+		ID:             cfg.ID,
+		Name:           cfg.Name,
+		iface:          cfg.Interfaces,
+		hands:          cfg.Hands,
+		handIDs:        cfg.HandIDs,
+		leftArmPreset:  orDefault(cfg.LeftArmPreset, defaultLeftArmPreset),
+		rightArmPreset: orDefault(cfg.RightArmPreset, defaultRightArmPreset),
+		l10Preset:      bytesOf(cfg.L10FingerPreset, defaultL10FingerPreset),
+		o7Preset:       bytesOf(cfg.O7FingerPreset, defaultO7FingerPreset),
+		manualArmSides: map[string]string{},
+		leftArmPose:    make([]int, 6),
+		rightArmPose:   make([]int, 6),
+		segments:       map[string]*armSegment{"left": {}, "right": {}},
+	}
+	if r.hands.Left == "" {
+		r.hands.Left = "l10"
+	}
+	if r.hands.Right == "" {
+		r.hands.Right = "l10"
+	}
+	if r.handIDs.Left == 0 {
+		r.handIDs.Left = RIGHT_HAND_ID
+	}
+	if r.handIDs.Right == 0 {
+		r.handIDs.Right = RIGHT_HAND_ID
+	}
+	r.leftFinger = append([]byte{}, r.l10Preset...)
+	r.rightFinger = append([]byte{}, r.l10Preset...)
+	r.playlist = &Playlist{pause: 3, rig: r}
+	r.teach = &TeachSession{rig: r}
+	return r
+}
+
+// 按配置文件创建工位，没有 default 时使用默认接口
+func initRigs() {
+	rigsMu.Lock()
+	defer rigsMu.Unlock()
+	rigs = map[string]*Rig{}
+	for _, cfg := range appConfig.Rigs {
+		if !validScoreID(cfg.ID) {
+			slog.Warn("忽略工位配置: 无效ID", "id", cfg.ID)
+			continue
+		}
+		rigs[cfg.ID] = newRig(cfg)
+	}
+	if rigs[defaultRigID] == nil {
+		rigs[defaultRigID] = newRig(defaultRigConfig())
+	}
+}
+
+func getRig(id string) *Rig {
+	rigsMu.Lock()
+	defer rigsMu.Unlock()
+	return rigs[id]
+}
+
+func defaultRig() *Rig {
+	return getRig(defaultRigID)
+}
+
+// 按ID排序的全部工位
+func allRigs() []*Rig {
+	rigsMu.Lock()
+	defer rigsMu.Unlock()
+	list := make([]*Rig, 0, len(rigs))
+	for _, r := range rigs {
+		list = append(list, r)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+func (r *Rig) interfaces() RigInterfaces {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.iface
+}
+
+// 左右灵巧手指令的CAN ID
+func (r *Rig) handID(side string) uint32 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if side == "left" {
+		return r.handIDs.Left
+	}
+	return r.handIDs.Right
+}
+
+// 灵巧手接口对应的CAN ID，不是左手接口时按右手处理
+func (r *Rig) handIDOf(iface string) uint32 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if iface == r.iface.LeftHand {
+		return r.handIDs.Left
+	}
+	return r.handIDs.Right
+}
+
+// 左右臂弹琴预设值的副本
+func (r *Rig) armPreset(side string) []int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if side == "right" {
+		return append([]int{}, r.rightArmPreset...)
+	}
+	return append([]int{}, r.leftArmPreset...)
+}
+
+func (r *Rig) setArmPreset(side string, values []int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if side == "left" {
+		r.leftArmPreset = append([]int{}, values...)
+	} else if side == "right" {
+		r.rightArmPreset = append([]int{}, values...)
+	}
+}
+
+// L10 手指弹琴预设值的副本
+func (r *Rig) fingerPreset() []byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]byte{}, r.l10Preset...)
+}
+
+func (r *Rig) setFingerPreset(model string, values []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if model == "o7" {
+		r.o7Preset = append([]byte{}, values...)
+	} else {
+		r.l10Preset = append([]byte{}, values...)
+	}
+}
+
+func (r *Rig) handModels() HandModels {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.hands
+}
+
+func (r *Rig) config() RigConfig {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return RigConfig{
+		ID:              r.ID,
+		Name:            r.Name,
+		Interfaces:      r.iface,
+		Hands:           r.hands,
+		HandIDs:         r.handIDs,
+		LeftArmPreset:   append([]int{}, r.leftArmPreset...),
+		RightArmPreset:  append([]int{}, r.rightArmPreset...),
+		L10FingerPreset: intsOf(r.l10Preset),
+		O7FingerPreset:  intsOf(r.o7Preset),
+	}
+}
+
+// 接口所属的工位和左右臂，先按工位绑定的接口查找，再按手动控制记录查找；找不到时返回默认工位和空
+func armOf(iface string) (*Rig, string) {
+	if iface == "" {
+		return defaultRig(), ""
+	}
+	list := allRigs()
+	for _, r := range list {
+		cur := r.interfaces()
+		switch iface {
+		case cur.LeftArm:
+			return r, "left"
+		case cur.RightArm:
+			return r, "right"
+		}
+	}
+	for _, r := range list {
+		r.mu.Lock()
+		side := r.manualArmSides[iface]
+		r.mu.Unlock()
+		if side != "" {
+			return r, side
+		}
+	}
+	return defaultRig(), ""
+}
+
+func (r *Rig) setManualArmSide(iface, side string) {
+	if side != "left" && side != "right" {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.manualArmSides[iface] = side
+}
+
+// 其他工位已经使用的接口
+func interfaceConflict(id string, ifaces RigInterfaces) error {
+	used := map[string]string{}
+	for _, r := range allRigs() {
+		if r.ID == id {
+			continue
+		}
+		cur := r.interfaces()
+		for _, name := range []string{cur.LeftHand, cur.RightHand, cur.LeftArm, cur.RightArm} {
+			used[name] = r.ID
+		}
+	}
+	for _, name := range []string{ifaces.LeftHand, ifaces.RightHand, ifaces.LeftArm, ifaces.RightArm} {
+		if other, ok := used[name]; ok && name != "" {
+			return fmt.Errorf("interface %s is used by rig %s", name, other)
+		}
+	}
+	return nil
+}
+
+// 保存全部工位到配置文件，在锁内读取工位，并发修改时保存的是最新的状态
+func saveRigs() error {
+	return updateAppConfig(func(cfg *AppConfig) {
+		var cfgs []RigConfig
+		for _, r := range allRigs() {
+			cfgs = append(cfgs, r.config())
+		}
+		cfg.Rigs = cfgs
+	})
+}
+
+// 工位路由的中间件：按路径中的 :rig 选择工位，旧路由(没有 :rig)使用默认工位
+func withRig() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.Param("rig")
+		if id == "" {
+			id = defaultRigID
+		}
+		r := getRig(id)
+		if r == nil {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "rig not found"})
+			return
+		}
+		c.Set("rig", r)
+		c.Next()
+	}
+}
+
+func currentRig(c *gin.Context) *Rig {
+	if v, ok := c.Get("rig"); ok {
+		return v.(*Rig)
+	}
+	return defaultRig()
+}
+
+func (r *Rig) status() gin.H {
+	return gin.H{"rig": r.config(), "job": r.currentPlaybackJob()}
+}
+
+func listRigsHandler(c *gin.Context) {
+	list := []gin.H{}
+	for _, r := range allRigs() {
+		list = append(list, r.status())
+	}
+	c.JSON(http.StatusOK, gin.H{"rigs": list})
+}
+
+func getRigHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, currentRig(c).status())
+}
+
+func checkRigConfig(cfg RigConfig) error {
+	for _, model := range []string{cfg.Hands.Left, cfg.Hands.Right} {
+		if model != "" && model != "l10" && model != "o7" {
+			return fmt.Errorf("unknown hand model %q", model)
+		}
+	}
+	for _, p := range [][]int{cfg.LeftArmPreset, cfg.RightArmPreset} {
+		if len(p) != 0 && len(p) != 6 {
+			return fmt.Errorf("arm preset must be 6 values")
+		}
+	}
+	return interfaceConflict(cfg.ID, cfg.Interfaces)
+}
+
+// 新建工位
+func createRigHandler(c *gin.Context) {
+	var cfg RigConfig
+	if err := c.ShouldBindJSON(&cfg); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+		return
+	}
+	if !validScoreID(cfg.ID) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid rig id"})
+		return
+	}
+	if err := checkRigConfig(cfg); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	rigsMu.Lock()
+	if rigs[cfg.ID] != nil {
+		rigsMu.Unlock()
+		c.JSON(http.StatusConflict, gin.H{"error": "rig already exists"})
+		return
+	}
+	r := newRig(cfg)
+	rigs[cfg.ID] = r
+	rigsMu.Unlock()
+	if err := saveRigs(); err != nil {
+		slog.Error("保存工位配置失败", "err", err)
+	}
+	c.JSON(http.StatusOK, r.status())
+}
+
+// 修改工位配置，演奏中不允许修改
+func updateRigHandler(c *gin.Context) {
+	r := currentRig(c)
+	cfg := r.config()
+	if err := c.ShouldBindJSON(&cfg); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+		return
+	}
+	cfg.ID = r.ID
+	if err := checkRigConfig(cfg); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if r.jobActive() {
+		c.JSON(http.StatusConflict, gin.H{"error": "rig is playing"})
+		return
+	}
+	updated := newRig(cfg)
+	r.mu.Lock()
+	r.Name = updated.Name
+	r.iface, r.hands, r.handIDs = updated.iface, updated.hands, updated.handIDs
+	r.leftArmPreset, r.rightArmPreset = updated.leftArmPreset, updated.rightArmPreset
+	r.l10Preset, r.o7Preset = updated.l10Preset, updated.o7Preset
+	r.mu.Unlock()
+	if err := saveRigs(); err != nil {
+		slog.Error("保存工位配置失败", "err", err)
+	}
+	c.JSON(http.StatusOK, r.status())
+}
+
+// 删除工位，默认工位和演奏中的工位不能删除
+func deleteRigHandler(c *gin.Context) {
+	r := currentRig(c)
+	if r.ID == defaultRigID {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "cannot delete default rig"})
+		return
+	}
+	if r.jobActive() {
+		c.JSON(http.StatusConflict, gin.H{"error": "rig is playing"})
+		return
+	}
+	rigsMu.Lock()
+	delete(rigs, r.ID)
+	rigsMu.Unlock()
+	if err := saveRigs(); err != nil {
+		slog.Error("保存工位配置失败", "err", err)
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "success"})
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// 用给定的工位配置初始化工位表，测试结束后恢复
+func useRigs(t *testing.T, cfgs ...RigConfig) {
+	t.Helper()
+	savedRigs, savedCfgs := rigs, appConfig.Rigs
+	t.Cleanup(func() {
+		rigsMu.Lock()
+		rigs = savedRigs
+		rigsMu.Unlock()
+		appConfig.Rigs = savedCfgs
+	})
+	appConfig.Rigs = cfgs
+	initRigs()
+}
+
+var studioRig = RigConfig{
+	ID:         "studio",
+	Interfaces: RigInterfaces{LeftHand: "can4", RightHand: "can5", LeftArm: "can6", RightArm: "can7"},
+}
+
+func TestInitRigs(t *testing.T) {
+	tests := []struct {
+		name string
+		cfgs []RigConfig
+		want []string
+	}{
+		{"default rig is always present", nil, []string{"default"}},
+		{"configured rigs", []RigConfig{studioRig}, []string{"default", "studio"}},
+		{"invalid ids are ignored", []RigConfig{studioRig, {ID: "../x"}, {ID: ""}}, []string{"default", "studio"}},
+		{"configured default keeps its interfaces", []RigConfig{{ID: "default", Interfaces: studioRig.Interfaces}}, []string{"default"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useRigs(t, tt.cfgs...)
+			var ids []string
+			for _, r := range allRigs() {
+				ids = append(ids, r.ID)
+			}
+			if strings.Join(ids, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("got rigs %v, want %v", ids, tt.want)
+			}
+			if defaultRig() == nil {
+				t.Fatal("no default rig")
+			}
+		})
+	}
+}
+
+func TestNewRigDefaults(t *testing.T) {
+	r := newRig(RigConfig{ID: "bare"})
+	cfg := r.config()
+	if cfg.Hands != (HandModels{Left: "l10", Right: "l10"}) {
+		t.Errorf("hand models %+v, want l10", cfg.Hands)
+	}
+	if len(cfg.LeftArmPreset) != 6 || len(cfg.RightArmPreset) != 6 || len(cfg.L10FingerPreset) != 6 || len(cfg.O7FingerPreset) != 7 {
+		t.Errorf("presets not filled from defaults: %+v", cfg)
+	}
+	// 预设值是副本，修改返回值不影响工位
+	preset := r.armPreset("left")
+	preset[0] = -1
+	if r.armPreset("left")[0] == -1 {
+		t.Error("armPreset returned the rig's own slice")
+	}
+}
+
+// 两只手默认都用 0x27，配置了 handIds 时按配置
+func TestRigHandIDs(t *testing.T) {
+	tests := []struct {
+		name        string
+		ids         HandIDs
+		left, right uint32
+	}{
+		{"defaults", HandIDs{}, 0x27, 0x27},
+		{"left hand on 0x28", HandIDs{Left: 0x28}, 0x28, 0x27},
+		{"both configured", HandIDs{Left: 0x30, Right: 0x31}, 0x30, 0x31},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newRig(RigConfig{ID: "test", Interfaces: studioRig.Interfaces, HandIDs: tt.ids})
+			if got := r.handID("left"); got != tt.left {
+				t.Errorf("left hand id 0x%X, want 0x%X", got, tt.left)
+			}
+			if got := r.handID("right"); got != tt.right {
+				t.Errorf("right hand id 0x%X, want 0x%X", got, tt.right)
+			}
+			if got := r.handIDOf("can4"); got != tt.left {
+				t.Errorf("left hand interface id 0x%X, want 0x%X", got, tt.left)
+			}
+		})
+	}
+}
+
+func TestArmOf(t *testing.T) {
+	useRigs(t, studioRig)
+	getRig("studio").setManualArmSide("can9", "right")
+	tests := []struct {
+		iface string
+		rig   string
+		side  string
+	}{
+		{"can2", "default", "left"},
+		{"can3", "default", "right"},
+		{"can6", "studio", "left"},
+		{"can7", "studio", "right"},
+		{"can9", "studio", "right"},
+		{"can0", "default", ""},
+		{"", "default", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.iface, func(t *testing.T) {
+			r, side := armOf(tt.iface)
+			if r.ID != tt.rig || side != tt.side {
+				t.Errorf("armOf(%q) = %s %q, want %s %q", tt.iface, r.ID, side, tt.rig, tt.side)
+			}
+		})
+	}
+}
+
+func TestInterfaceConflict(t *testing.T) {
+	useRigs(t, studioRig)
+	tests := []struct {
+		name   string
+		id     string
+		ifaces RigInterfaces
+		want   string
+	}{
+		{"new rig on free interfaces", "lab", RigInterfaces{LeftHand: "can10", RightHand: "can11", LeftArm: "can12", RightArm: "can13"}, ""},
+		{"rig keeps its own interfaces", "studio", studioRig.Interfaces, ""},
+		{"unset interfaces never conflict", "lab", RigInterfaces{}, ""},
+		{"hand used by default rig", "lab", RigInterfaces{LeftHand: "can1"}, "interface can1 is used by rig default"},
+		{"arm used by another rig", "default", RigInterfaces{LeftHand: "can0", RightHand: "can1", LeftArm: "can2", RightArm: "can7"}, "interface can7 is used by rig studio"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := interfaceConflict(tt.id, tt.ifaces)
+			if tt.want == "" {
+				if err != nil {
+					t.Errorf("unexpected conflict: %v", err)
+				}
+				return
+			}
+			if err == nil || err.Error() != tt.want {
+				t.Errorf("got %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckRigConfig(t *testing.T) {
+	useRigs(t)
+	tests := []struct {
+		name    string
+		cfg     RigConfig
+		wantErr bool
+	}{
+		{"valid", studioRig, false},
+		{"o7 hand", RigConfig{ID: "lab", Hands: HandModels{Left: "o7"}}, false},
+		{"unknown hand model", RigConfig{ID: "lab", Hands: HandModels{Right: "l20"}}, true},
+		{"short arm preset", RigConfig{ID: "lab", LeftArmPreset: []int{1, 2, 3}}, true},
+		{"interface conflict", RigConfig{ID: "lab", Interfaces: RigInterfaces{RightArm: "can3"}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := checkRigConfig(tt.cfg); (err != nil) != tt.wantErr {
+				t.Errorf("checkRigConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ArmFrame 机械臂基座在世界坐标系中的位置和末端包络
+type ArmFrame struct {
+	Base       [3]float64 `json:"base"`       // 基座原点在世界坐标系中的位置(mm)
+	Yaw        float64    `json:"yaw"`        // 基座坐标系绕Z轴的旋转角(度)
+	ToolRadius float64    `json:"toolRadius"` // 末端(灵巧手)包络球半径(mm)
+}
+
+// CollisionConfig 双臂防碰撞配置
+type CollisionConfig struct {
+	Enabled       bool     `json:"enabled"`
+	Left          ArmFrame `json:"left"`
+	Right         ArmFrame `json:"right"`
+	MinSeparation float64  `json:"minSeparation"` // 两只手包络之间的最小距离(mm)
+	CheckStep     float64  `json:"checkStep"`     // 直线运动插值检查的步长(mm)
+	Mode          string   `json:"mode"`          // reject: 直接拒绝，hold: 等待另一只手移开，超时后拒绝
+	HoldTimeout   float64  `json:"holdTimeout"`   // hold 模式最长等待时间(秒)
+}
+
+// 默认关闭：基座位置和包络半径只是示例，需要按实际安装测量后再开启，否则会拒绝正常的乐谱
+func defaultCollisionConfig() CollisionConfig {
+	return CollisionConfig{
+		Enabled:       false,
+		Left:          ArmFrame{Base: [3]float64{0, -100, 0}, ToolRadius: 45},
+		Right:         ArmFrame{Base: [3]float64{0, 100, 0}, ToolRadius: 45},
+		MinSeparation: 10,
+		CheckStep:     5,
+		Mode:          "hold",
+		HoldTimeout:   2,
+	}
+}
+
+// SafetyError 安全检查拒绝的运动
+type SafetyError struct {
+	Side   string
+	Reason string
+}
+
+func (e *SafetyError) Error() string {
+	if e.Side == "" {
+		return "arm move rejected: " + e.Reason
+	}
+	return fmt.Sprintf("%s arm move rejected: %s", e.Side, e.Reason)
+}
+
+// 机械臂最近一次指令的运动段，位姿单位为0.001mm/0.001°
+type armSegment struct {
+	from, to [6]int
+	known    bool
+	done     time.Time // 预计运动完成的时间，之后按静止点检查
+}
+
+// 保护所有工位的机械臂运动段
+var safetyMu sync.Mutex
+
+// 根据CAN接口判断是左臂还是右臂，未知返回空
+func armSideOf(iface string) string {
+	_, side := armOf(iface)
+	return side
+}
+
+// 机械臂最近一次通过安全检查的目标位姿，未知时返回false
+func lastArmPose(iface string) ([6]int, bool) {
+	rig, side := armOf(iface)
+	safetyMu.Lock()
+	defer safetyMu.Unlock()
+	seg, ok := rig.segments[side]
+	if !ok || !seg.known {
+		return [6]int{}, false
+	}
+	return seg.to, true
+}
+
+// 基座坐标系下的位姿转为世界坐标(mm)
+func (f ArmFrame) world(pose [6]int) [3]float64 {
+	x, y, z := float64(pose[0])/1000, float64(pose[1])/1000, float64(pose[2])/1000
+	yaw := f.Yaw * math.Pi / 180
+	return [3]float64{
+		f.Base[0] + x*math.Cos(yaw) - y*math.Sin(yaw),
+		f.Base[1] + x*math.Sin(yaw) + y*math.Cos(yaw),
+		f.Base[2] + z,
+	}
+}
+
+func lerp3(a, b [3]float64, t float64) [3]float64 {
+	return [3]float64{a[0] + (b[0]-a[0])*t, a[1] + (b[1]-a[1])*t, a[2] + (b[2]-a[2])*t}
+}
+
+func dist3(a, b [3]float64) float64 {
+	return math.Sqrt((a[0]-b[0])*(a[0]-b[0]) + (a[1]-b[1])*(a[1]-b[1]) + (a[2]-b[2])*(a[2]-b[2]))
+}
+
+// 两条直线运动段之间的最小距离，按步长采样
+func segmentClearance(a0, a1, b0, b1 [3]float64, step float64) float64 {
+	if step <= 0 {
+		step = 5
+	}
+	n := int(math.Min(math.Max(dist3(a0, a1), dist3(b0, b1))/step, 200)) + 1
+	best := math.Inf(1)
+	for i := 0; i <= n; i++ {
+		pa := lerp3(a0, a1, float64(i)/float64(n))
+		for j := 0; j <= n; j++ {
+			if d := dist3(pa, lerp3(b0, b1, float64(j)/float64(n))); d < best {
+				best = d
+			}
+		}
+	}
+	return best
+}
+
+// 检查side侧机械臂移动到target是否与同一工位另一只机械臂的运动段碰撞
+func checkArmCollision(cfg CollisionConfig, segments map[string]*armSegment, side string, target [6]int) error {
+	self, other := segments[side], segments["right"]
+	selfFrame, otherFrame := cfg.Left, cfg.Right
+	if side == "right" {
+		other = segments["left"]
+		selfFrame, otherFrame = cfg.Right, cfg.Left
+	}
+	if !other.known {
+		return nil
+	}
+	from := target
+	if self.known {
+		from = self.to
+	}
+	a0, a1 := selfFrame.world(from), selfFrame.world(target)
+	b0, b1 := otherFrame.world(other.from), otherFrame.world(other.to)
+	clearance := segmentClearance(a0, a1, b0, b1, cfg.CheckStep) - selfFrame.ToolRadius - otherFrame.ToolRadius
+	if clearance < cfg.MinSeparation {
+		return &SafetyError{side, fmt.Sprintf("clearance %.1fmm below minimum %.1fmm", clearance, cfg.MinSeparation)}
+	}
+	// 左手必须始终在右手的左侧(世界Y更小)
+	if side == "left" && a1[1] >= b1[1] || side == "right" && a1[1] <= b1[1] {
+		return &SafetyError{side, "arms would cross"}
+	}
+	return nil
+}
+
+// 运动段预计完成的时间：按轨迹的速度曲线走完该段(duration大于0时为已知的运动时长，秒)，再加上校准测得的机械臂延迟
+func armMoveDone(iface string, from, to [6]int, duration float64) time.Time {
+	if duration > 0 {
+		return time.Now().Add(seconds(duration + calibrationConfig().Devices[iface].Arm))
+	}
+	d := dist3([3]float64{float64(from[0]), float64(from[1]), float64(from[2])},
+		[3]float64{float64(to[0]), float64(to[1]), float64(to[2])}) / 1000
+	// 姿态变化按1°≈1mm计入，与轨迹规划一致
+	for k := 3; k < 6; k++ {
+		d = math.Max(d, math.Abs(float64(to[k]-from[k]))/1000)
+	}
+	settle := appConfig.Trajectory.segmentDuration(d) + calibrationConfig().Devices[iface].Arm
+	return time.Now().Add(seconds(settle))
+}
+
+// 发送位姿前的防碰撞检查，通过后记录运动段；hold 模式下等待另一只手的运动完成
+func guardArmMove(iface string, target [6]int) error {
+	return guardArmPath(iface, target, 0)
+}
+
+// 按整段检查一次运动，duration为运动时长(秒)，0表示按直线运动估算；平滑轨迹发送中间点前使用
+func guardArmPath(iface string, target [6]int, duration float64) error {
+	rig, side := armOf(iface)
+	cfg := appConfig.Collision
+	if side == "" || !cfg.Enabled {
+		return nil
+	}
+	deadline := time.Now().Add(time.Duration(cfg.HoldTimeout * float64(time.Second)))
+	for {
+		safetyMu.Lock()
+		// 另一只手的运动段完成后收缩为静止点，未完成时按整段检查
+		other := rig.segments["right"]
+		if side == "right" {
+			other = rig.segments["left"]
+		}
+		if other.known && !time.Now().Before(other.done) {
+			other.from = other.to
+		}
+		err := checkArmCollision(cfg, rig.segments, side, target)
+		if err == nil {
+			seg := rig.segments[side]
+			if seg.known {
+				seg.from = seg.to
+			} else {
+				seg.from = target
+			}
+			seg.to, seg.known = target, true
+			seg.done = armMoveDone(iface, seg.from, target, duration)
+			safetyMu.Unlock()
+			return nil
+		}
+		safetyMu.Unlock()
+		if cfg.Mode != "hold" || time.Now().After(deadline) {
+			rig.logger().Warn("防碰撞检查拒绝", "side", side, "interface", iface, "target", target, "err", err)
+			return err
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// 查询安全检查状态：防碰撞和工作空间配置、工位两只手最近的运动段
+func safetyStatusHandler(c *gin.Context) {
+	rig := currentRig(c)
+	safetyMu.Lock()
+	defer safetyMu.Unlock()
+	arms := gin.H{}
+	for side, seg := range rig.segments {
+		if seg.known {
+			arms[side] = gin.H{"from": seg.from, "to": seg.to}
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"collision": appConfig.Collision, "workspace": appConfig.Workspace, "arms": arms})
+}
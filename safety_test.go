@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestArmFrameWorld(t *testing.T) {
+	tests := []struct {
+		name  string
+		frame ArmFrame
+		pose  [6]int
+		want  [3]float64
+	}{
+		{"base offset", ArmFrame{Base: [3]float64{10, -100, 5}}, [6]int{1000, 2000, 3000}, [3]float64{11, -98, 8}},
+		{"yaw 90", ArmFrame{Yaw: 90}, [6]int{1000, 0, 0}, [3]float64{0, 1, 0}},
+		{"yaw 180", ArmFrame{Base: [3]float64{0, 100, 0}, Yaw: 180}, [6]int{0, 20000, 0}, [3]float64{0, 80, 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.frame.world(tt.pose)
+			if dist3(got, tt.want) > 1e-9 {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// 按5mm步长采样，结果不小于真实距离，误差不超过一个步长
+func TestSegmentClearance(t *testing.T) {
+	tests := []struct {
+		name           string
+		a0, a1, b0, b1 [3]float64
+		want           float64
+	}{
+		{"two points", [3]float64{0, 0, 0}, [3]float64{0, 0, 0}, [3]float64{3, 4, 0}, [3]float64{3, 4, 0}, 5},
+		{"parallel moves", [3]float64{0, 0, 0}, [3]float64{100, 0, 0}, [3]float64{0, 50, 0}, [3]float64{100, 50, 0}, 50},
+		{"crossing paths", [3]float64{0, -50, 0}, [3]float64{0, 50, 0}, [3]float64{-50, 0, 0}, [3]float64{50, 0, 0}, 0},
+		{"moving past a resting arm", [3]float64{-100, 0, 0}, [3]float64{100, 0, 0}, [3]float64{0, 30, 0}, [3]float64{0, 30, 0}, 30},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := segmentClearance(tt.a0, tt.a1, tt.b0, tt.b1, 5); got < tt.want-1e-9 || got > tt.want+5 {
+				t.Errorf("got %v, want %v within one step", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckArmCollision(t *testing.T) {
+	cfg := CollisionConfig{
+		Enabled:       true,
+		Left:          ArmFrame{Base: [3]float64{0, -100, 0}, ToolRadius: 45},
+		Right:         ArmFrame{Base: [3]float64{0, 100, 0}, ToolRadius: 45},
+		MinSeparation: 10,
+		CheckStep:     5,
+	}
+	right := &armSegment{known: true}
+	tests := []struct {
+		name   string
+		other  *armSegment
+		target [6]int
+		want   string
+	}{
+		{"other arm unknown", &armSegment{}, [6]int{0, 300000, 0}, ""},
+		{"far apart", right, [6]int{}, ""},
+		{"exactly the minimum", right, [6]int{0, 100000, 0}, ""},
+		{"too close", right, [6]int{0, 110000, 0}, "clearance"},
+		{"right arm moving towards the target", &armSegment{from: [6]int{}, to: [6]int{0, -90000, 0}, known: true}, [6]int{0, 70000, 0}, "clearance"},
+		{"above the other arm but crossed", right, [6]int{0, 250000, 200000}, "arms would cross"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			segments := map[string]*armSegment{"left": {}, "right": tt.other}
+			err := checkArmCollision(cfg, segments, "left", tt.target)
+			if tt.want == "" {
+				if err != nil {
+					t.Errorf("unexpected rejection: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func useCollision(t *testing.T, cfg CollisionConfig) {
+	saved := appConfig.Collision
+	t.Cleanup(func() { appConfig.Collision = saved })
+	appConfig.Collision = cfg
+}
+
+// 默认配置下，附带的乐谱从预设位置开始的每一步都能通过防碰撞检查；开启后示例基座位置也不拒绝附带的乐谱
+func TestBundledScoresPassCollisionGuard(t *testing.T) {
+	files, err := filepath.Glob("json/*.json")
+	if err != nil || len(files) == 0 {
+		t.Fatalf("no bundled scores: %v", err)
+	}
+	enabled := defaultCollisionConfig()
+	enabled.Enabled = true
+	for _, cfg := range []struct {
+		name      string
+		collision CollisionConfig
+	}{{"defaults", defaultCollisionConfig()}, {"enabled", enabled}} {
+		for _, file := range files {
+			t.Run(cfg.name+"/"+filepath.Base(file), func(t *testing.T) {
+				raw, err := os.ReadFile(file)
+				if err != nil {
+					t.Fatal(err)
+				}
+				var data MusicData
+				if err := json.Unmarshal(raw, &data); err != nil {
+					t.Fatal(err)
+				}
+				useCollision(t, cfg.collision)
+				useRigs(t)
+				rig := defaultRig()
+				ifaces := rig.interfaces()
+				left, right := scoreStartPoses(rig, data)
+				if err := guardArmMove(ifaces.LeftArm, left); err != nil {
+					t.Fatalf("left start pose: %v", err)
+				}
+				if err := guardArmMove(ifaces.RightArm, right); err != nil {
+					t.Fatalf("right start pose: %v", err)
+				}
+				for i, note := range data.Music {
+					left[0] += note.Left.Move.X * armStepMM * 1000
+					left[1] += note.Left.Move.Y * armStepMM * 1000
+					right[0] += note.Right.Move.X * armStepMM * 1000
+					right[1] += note.Right.Move.Y * armStepMM * 1000
+					if err := guardArmMove(ifaces.LeftArm, left); err != nil {
+						t.Fatalf("step %d: %v", i, err)
+					}
+					if err := guardArmMove(ifaces.RightArm, right); err != nil {
+						t.Fatalf("step %d: %v", i, err)
+					}
+				}
+			})
+		}
+	}
+}
+
+// 演奏前检查按演奏时的顺序检查起始位姿
+func TestCheckStartPoses(t *testing.T) {
+	enabled := CollisionConfig{
+		Enabled:       true,
+		Left:          ArmFrame{Base: [3]float64{0, -100, 0}, ToolRadius: 45},
+		Right:         ArmFrame{Base: [3]float64{0, 100, 0}, ToolRadius: 45},
+		MinSeparation: 10,
+		CheckStep:     5,
+	}
+	tests := []struct {
+		name      string
+		collision CollisionConfig
+		right     []int
+		want      string
+	}{
+		{"default presets", enabled, nil, ""},
+		{"right arm reaches across", enabled, []int{400, -150, 240, 0, 85, 0}, "start poses"},
+		{"guard disabled", CollisionConfig{}, []int{400, -150, 240, 0, 85, 0}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useCollision(t, tt.collision)
+			useRigs(t)
+			rig := newRig(RigConfig{ID: "test", RightArmPreset: tt.right})
+			err := checkStartPoses(rig, MusicData{})
+			if tt.want == "" {
+				if err != nil {
+					t.Errorf("unexpected rejection: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
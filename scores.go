@@ -0,0 +1,510 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ScoreStore 乐谱库，每个乐谱保存为目录下的一个 <id>.json，历史版本保存在 .history/<id>/ 下
+type ScoreStore struct {
+	mu  sync.Mutex
+	dir string
+}
+
+// ScoreMeta 乐谱元数据
+type ScoreMeta struct {
+	ID       string    `json:"id"`
+	Title    string    `json:"title"`
+	Steps    int       `json:"steps"`    // 节拍数
+	Notes    int       `json:"notes"`    // 按键次数
+	Duration float64   `json:"duration"` // 预计演奏时长(秒)
+	Size     int64     `json:"size"`
+	Updated  time.Time `json:"updated"`
+	Versions int       `json:"versions"`        // 历史版本数
+	Error    string    `json:"error,omitempty"` // 文件无法读取或解析时的错误，此时没有统计信息
+}
+
+// ScoreVersion 乐谱的一个历史版本
+type ScoreVersion struct {
+	Version string    `json:"version"`
+	Size    int64     `json:"size"`
+	Created time.Time `json:"created"`
+}
+
+var scoreStore = &ScoreStore{dir: "json"}
+
+var errScoreNotFound = fmt.Errorf("score not found")
+
+// ScoreError 请求的乐谱ID或内容不合法(400)，或与已有乐谱冲突(409)
+type ScoreError struct {
+	Status int
+	Reason string
+}
+
+func (e *ScoreError) Error() string {
+	return e.Reason
+}
+
+func invalidScore(format string, args ...any) error {
+	return &ScoreError{http.StatusBadRequest, fmt.Sprintf(format, args...)}
+}
+
+func scoreConflict(format string, args ...any) error {
+	return &ScoreError{http.StatusConflict, fmt.Sprintf(format, args...)}
+}
+
+// 乐谱ID即文件名(不含.json)，不允许路径分隔符和隐藏文件
+func validScoreID(id string) bool {
+	return id != "" && !strings.HasPrefix(id, ".") && !strings.ContainsAny(id, `/\`) && len(id) <= 128
+}
+
+func (s *ScoreStore) path(id string) string {
+	return filepath.Join(s.dir, id+".json")
+}
+
+func (s *ScoreStore) historyDir(id string) string {
+	return filepath.Join(s.dir, ".history", id)
+}
+
+func (s *ScoreStore) List() ([]ScoreMeta, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	metas := []ScoreMeta{}
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+		id := strings.TrimSuffix(e.Name(), ".json")
+		if !validScoreID(id) {
+			continue
+		}
+		meta, _, err := s.load(id)
+		if err != nil {
+			// 读不出来的文件也列出，带上错误，方便在乐谱库中修复或删除
+			meta = ScoreMeta{ID: id, Title: id, Error: err.Error()}
+			if info, err := e.Info(); err == nil {
+				meta.Size, meta.Updated = info.Size(), info.ModTime()
+			}
+		}
+		metas = append(metas, meta)
+	}
+	sort.Slice(metas, func(i, j int) bool { return metas[i].ID < metas[j].ID })
+	return metas, nil
+}
+
+func (s *ScoreStore) Get(id string) (ScoreMeta, MusicData, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.load(id)
+}
+
+func (s *ScoreStore) load(id string) (ScoreMeta, MusicData, error) {
+	var data MusicData
+	if !validScoreID(id) {
+		return ScoreMeta{}, data, errScoreNotFound
+	}
+	raw, err := os.ReadFile(s.path(id))
+	if os.IsNotExist(err) {
+		return ScoreMeta{}, data, errScoreNotFound
+	}
+	if err != nil {
+		return ScoreMeta{}, data, err
+	}
+	if err := json.Unmarshal(raw, &data); err != nil {
+		return ScoreMeta{}, data, fmt.Errorf("parse score %s failed: %v", id, err)
+	}
+	info, _ := os.Stat(s.path(id))
+	versions, _ := os.ReadDir(s.historyDir(id))
+	meta := scoreMetaOf(data)
+	meta.ID, meta.Title = id, id
+	meta.Size, meta.Updated = info.Size(), info.ModTime()
+	meta.Versions = len(versions)
+	return meta, data, nil
+}
+
+// 保存乐谱，已存在时先把旧内容存为历史版本
+func (s *ScoreStore) Save(id string, data MusicData) (ScoreMeta, error) {
+	return s.save(id, data, true)
+}
+
+// 新建乐谱，ID已有乐谱时拒绝(409)，不覆盖
+func (s *ScoreStore) Create(id string, data MusicData) (ScoreMeta, error) {
+	return s.save(id, data, false)
+}
+
+func (s *ScoreStore) save(id string, data MusicData, overwrite bool) (ScoreMeta, error) {
+	if !validScoreID(id) {
+		return ScoreMeta{}, invalidScore("invalid score id %q", id)
+	}
+	if err := validateMusicData(data); err != nil {
+		return ScoreMeta{}, invalidScore("%v", err)
+	}
+	raw, err := json.MarshalIndent(data, "", "    ")
+	if err != nil {
+		return ScoreMeta{}, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := os.Stat(s.path(id)); err == nil && !overwrite {
+		return ScoreMeta{}, scoreConflict("score %q already exists", id)
+	}
+	if err := s.archive(id); err != nil {
+		return ScoreMeta{}, err
+	}
+	if err := os.WriteFile(s.path(id), raw, 0644); err != nil {
+		return ScoreMeta{}, err
+	}
+	meta, _, err := s.load(id)
+	return meta, err
+}
+
+// 重命名乐谱，历史版本一起移动；新ID与原ID相同时不做修改，新ID已有乐谱或删除后留下的历史版本时拒绝
+func (s *ScoreStore) Rename(id, newID string) (ScoreMeta, error) {
+	if !validScoreID(newID) {
+		return ScoreMeta{}, invalidScore("invalid score id %q", newID)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !validScoreID(id) {
+		return ScoreMeta{}, errScoreNotFound
+	}
+	if _, err := os.Stat(s.path(id)); err != nil {
+		return ScoreMeta{}, errScoreNotFound
+	}
+	if newID == id {
+		meta, _, err := s.load(id)
+		return meta, err
+	}
+	if _, err := os.Stat(s.path(newID)); err == nil {
+		return ScoreMeta{}, scoreConflict("score %q already exists", newID)
+	}
+	if _, err := os.Stat(s.historyDir(newID)); err == nil {
+		return ScoreMeta{}, scoreConflict("score %q has archived versions", newID)
+	}
+	if err := os.Rename(s.path(id), s.path(newID)); err != nil {
+		return ScoreMeta{}, err
+	}
+	if _, err := os.Stat(s.historyDir(id)); err == nil {
+		if err := os.Rename(s.historyDir(id), s.historyDir(newID)); err != nil {
+			return ScoreMeta{}, err
+		}
+	}
+	meta, _, err := s.load(newID)
+	return meta, err
+}
+
+// 删除乐谱，当前内容保留为历史版本
+func (s *ScoreStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !validScoreID(id) {
+		return errScoreNotFound
+	}
+	if _, err := os.Stat(s.path(id)); err != nil {
+		return errScoreNotFound
+	}
+	if err := s.archive(id); err != nil {
+		return err
+	}
+	return os.Remove(s.path(id))
+}
+
+func (s *ScoreStore) archive(id string) error {
+	raw, err := os.ReadFile(s.path(id))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.historyDir(id), 0755); err != nil {
+		return err
+	}
+	name := time.Now().Format("20060102T150405.000000000") + ".json"
+	return os.WriteFile(filepath.Join(s.historyDir(id), name), raw, 0644)
+}
+
+func (s *ScoreStore) Versions(id string) ([]ScoreVersion, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !validScoreID(id) {
+		return nil, errScoreNotFound
+	}
+	entries, err := os.ReadDir(s.historyDir(id))
+	if os.IsNotExist(err) {
+		return []ScoreVersion{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	versions := []ScoreVersion{}
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		versions = append(versions, ScoreVersion{
+			Version: strings.TrimSuffix(e.Name(), ".json"),
+			Size:    info.Size(),
+			Created: info.ModTime(),
+		})
+	}
+	return versions, nil
+}
+
+func (s *ScoreStore) GetVersion(id, version string) (MusicData, error) {
+	var data MusicData
+	if !validScoreID(id) || !validScoreID(version) {
+		return data, errScoreNotFound
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	raw, err := os.ReadFile(filepath.Join(s.historyDir(id), version+".json"))
+	if err != nil {
+		return data, errScoreNotFound
+	}
+	err = json.Unmarshal(raw, &data)
+	return data, err
+}
+
+// 根据乐谱内容统计元数据
+func scoreMetaOf(data MusicData) ScoreMeta {
+	meta := ScoreMeta{Steps: len(data.Music)}
+	for _, note := range data.Music {
+		meta.Notes += len(note.Left.Fingers) + len(note.Right.Fingers)
+	}
+	meta.Duration = round2(estimateDuration(data.Music))
+	return meta
+}
+
+// 预计演奏时长(秒)
+func estimateDuration(music []MusicNote) float64 {
+	total := 0.0
+	for _, note := range music {
+		total += stepDuration(note, 1)
+	}
+	return total
+}
+
+// 检查乐谱能否被演奏
+func validateMusicData(data MusicData) error {
+	if len(data.Music) == 0 {
+		return fmt.Errorf("score has no music")
+	}
+	for i, note := range data.Music {
+		for side, action := range map[string]HandAction{"left": note.Left, "right": note.Right} {
+			if len(action.Fingers) != len(action.Time) {
+				return fmt.Errorf("music[%d].%s: %d fingers but %d times", i, side, len(action.Fingers), len(action.Time))
+			}
+			for j, f := range action.Fingers {
+				if _, ok := fingerIndexMap[f]; !ok {
+					return fmt.Errorf("music[%d].%s: unknown finger %q", i, side, f)
+				}
+				if action.Time[j] < 0 {
+					return fmt.Errorf("music[%d].%s: negative time", i, side)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// 乐谱库错误的HTTP状态：不存在404，请求不合法或冲突按 ScoreError，读写和解析失败500
+func scoreErrorStatus(err error) int {
+	var scoreErr *ScoreError
+	switch {
+	case errors.Is(err, errScoreNotFound):
+		return http.StatusNotFound
+	case errors.As(err, &scoreErr):
+		return scoreErr.Status
+	}
+	return http.StatusInternalServerError
+}
+
+func listScoresHandler(c *gin.Context) {
+	metas, err := scoreStore.List()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"scores": metas})
+}
+
+func getScoreHandler(c *gin.Context) {
+	meta, data, err := scoreStore.Get(c.Param("id"))
+	if err != nil {
+		c.JSON(scoreErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"meta": meta, "musicData": data})
+}
+
+// 上传乐谱：JSON {"title": "...", "musicData": {...}}，或表单字段 file(可选 title)；已有同名乐谱时返回409，替换用 PUT
+func uploadScoreHandler(c *gin.Context) {
+	var req struct {
+		Title     string    `json:"title"`
+		MusicData MusicData `json:"musicData"`
+	}
+	if fh, err := c.FormFile("file"); err == nil {
+		f, err := fh.Open()
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		defer f.Close()
+		if err := json.NewDecoder(f).Decode(&req.MusicData); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("parse score failed: %v", err)})
+			return
+		}
+		req.Title = c.PostForm("title")
+		if req.Title == "" {
+			req.Title = strings.TrimSuffix(filepath.Base(fh.Filename), filepath.Ext(fh.Filename))
+		}
+	} else if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+		return
+	}
+	meta, err := scoreStore.Create(req.Title, req.MusicData)
+	if err != nil {
+		c.JSON(scoreErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "success", "meta": meta})
+}
+
+func replaceScoreHandler(c *gin.Context) {
+	var data MusicData
+	if err := c.ShouldBindJSON(&data); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+		return
+	}
+	if _, _, err := scoreStore.Get(c.Param("id")); err != nil {
+		c.JSON(scoreErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	meta, err := scoreStore.Save(c.Param("id"), data)
+	if err != nil {
+		c.JSON(scoreErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "success", "meta": meta})
+}
+
+func renameScoreHandler(c *gin.Context) {
+	var req struct {
+		Title string `json:"title"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+		return
+	}
+	meta, err := scoreStore.Rename(c.Param("id"), req.Title)
+	if err != nil {
+		c.JSON(scoreErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "success", "meta": meta})
+}
+
+func deleteScoreHandler(c *gin.Context) {
+	if err := scoreStore.Delete(c.Param("id")); err != nil {
+		c.JSON(scoreErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "success"})
+}
+
+func scoreVersionsHandler(c *gin.Context) {
+	versions, err := scoreStore.Versions(c.Param("id"))
+	if err != nil {
+		c.JSON(scoreErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"versions": versions})
+}
+
+func scoreVersionHandler(c *gin.Context) {
+	data, err := scoreStore.GetVersion(c.Param("id"), c.Param("version"))
+	if err != nil {
+		c.JSON(scoreErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"musicData": data})
+}
+
+// 读取上传内容：表单字段 file 或整个请求体，返回内容和文件名
+func readUploadBody(c *gin.Context) ([]byte, string, error) {
+	if fh, err := c.FormFile("file"); err == nil {
+		f, err := fh.Open()
+		if err != nil {
+			return nil, "", err
+		}
+		defer f.Close()
+		raw, err := io.ReadAll(f)
+		return raw, fh.Filename, err
+	}
+	raw, err := io.ReadAll(c.Request.Body)
+	return raw, "", err
+}
+
+// 把其他格式的乐谱转换为MusicData，需要指法规划的格式同时返回导入报告
+func importScore(format string, raw []byte, opts PlanOptions) (MusicData, *ImportReport, error) {
+	switch format {
+	case "json":
+		var data MusicData
+		err := json.Unmarshal(raw, &data)
+		return data, nil, err
+	case "dsl":
+		data, err := compileDSL(string(raw))
+		return data, nil, err
+	case "musicxml", "mxl":
+		return importMusicXML(raw, opts)
+	case "abc":
+		return importABC(raw, opts)
+	}
+	return MusicData{}, nil, fmt.Errorf("unsupported format %q", format)
+}
+
+// 导入乐谱到乐谱库：?format=dsl|musicxml|abc&title=...&split=...，内容为请求体或表单字段 file
+func importScoreHandler(c *gin.Context) {
+	raw, filename, err := readUploadBody(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	title := c.Query("title")
+	if title == "" {
+		title = strings.TrimSuffix(filepath.Base(filename), filepath.Ext(filename))
+	}
+	opts, err := planOptionsFromQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	data, report, err := importScore(c.DefaultQuery("format", "dsl"), raw, opts)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "report": report})
+		return
+	}
+	meta, err := scoreStore.Create(title, data)
+	if err != nil {
+		c.JSON(scoreErrorStatus(err), gin.H{"error": err.Error(), "report": report})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "success", "meta": meta, "report": report})
+}
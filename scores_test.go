@@ -0,0 +1,203 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// 每个节拍右手按一个手指0.2秒
+func testScore(fingers ...string) MusicData {
+	var data MusicData
+	for i, f := range fingers {
+		data.Music = append(data.Music, MusicNote{
+			Index: i,
+			Left:  HandAction{Fingers: []string{}, Time: []float64{}},
+			Right: HandAction{Fingers: []string{f}, Time: []float64{0.2}},
+		})
+	}
+	return data
+}
+
+func TestScoreStoreCRUD(t *testing.T) {
+	s := &ScoreStore{dir: t.TempDir()}
+	if _, err := s.Save("a", testScore("index")); err != nil {
+		t.Fatal(err)
+	}
+	meta, err := s.Save("a", testScore("index", "ring"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.ID != "a" || meta.Steps != 2 || meta.Notes != 2 || meta.Versions != 1 {
+		t.Errorf("unexpected meta after overwrite: %+v", meta)
+	}
+	if _, err := s.Save("b", testScore("pinky")); err != nil {
+		t.Fatal(err)
+	}
+
+	_, data, err := s.Get("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := testScore("index", "ring"); !reflect.DeepEqual(data, want) {
+		t.Errorf("Get returned %+v, want %+v", data, want)
+	}
+	metas, err := s.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, m := range metas {
+		ids = append(ids, m.ID)
+	}
+	if !reflect.DeepEqual(ids, []string{"a", "b"}) {
+		t.Errorf("List returned %v", ids)
+	}
+
+	// 历史版本保存的是覆盖前的内容
+	versions, err := s.Versions("a")
+	if err != nil || len(versions) != 1 {
+		t.Fatalf("got versions %v, %v", versions, err)
+	}
+	old, err := s.GetVersion("a", versions[0].Version)
+	if err != nil || !reflect.DeepEqual(old, testScore("index")) {
+		t.Errorf("GetVersion returned %+v, %v", old, err)
+	}
+
+	// 删除后当前内容也进入历史版本
+	if err := s.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.Get("a"); err != errScoreNotFound {
+		t.Errorf("Get after delete: %v", err)
+	}
+	if versions, _ := s.Versions("a"); len(versions) != 2 {
+		t.Errorf("got %d versions after delete, want 2", len(versions))
+	}
+	if err := s.Delete("a"); err != errScoreNotFound {
+		t.Errorf("second delete: %v", err)
+	}
+}
+
+func TestScoreStoreRename(t *testing.T) {
+	tests := []struct {
+		name     string
+		from, to string
+		wantErr  bool
+	}{
+		{"rename", "a", "c", false},
+		{"unicode title", "a", "沧海一声笑 v2", false},
+		{"target exists", "a", "b", true},
+		{"missing source", "x", "c", true},
+		{"path separator", "a", "../c", true},
+		{"hidden file", "a", ".c", true},
+		{"same id", "a", "a", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &ScoreStore{dir: t.TempDir()}
+			s.Save("a", testScore("index"))
+			s.Save("a", testScore("middle"))
+			s.Save("b", testScore("ring"))
+			meta, err := s.Rename(tt.from, tt.to)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("rename %q to %q succeeded", tt.from, tt.to)
+				}
+				if _, err := os.Stat(s.path("a")); err != nil {
+					t.Errorf("source removed by failed rename: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if meta.ID != tt.to || meta.Versions != 1 {
+				t.Errorf("unexpected meta %+v", meta)
+			}
+			if tt.from == tt.to {
+				// 重命名为原ID不做修改
+				if _, data, err := s.Get("a"); err != nil || !reflect.DeepEqual(data, testScore("middle")) {
+					t.Errorf("score changed by no-op rename: %+v, %v", data, err)
+				}
+				return
+			}
+			if _, _, err := s.Get(tt.from); err != errScoreNotFound {
+				t.Errorf("old id still readable: %v", err)
+			}
+			if _, err := os.Stat(filepath.Join(s.dir, ".history", tt.from)); !os.IsNotExist(err) {
+				t.Errorf("history left behind under old id: %v", err)
+			}
+		})
+	}
+}
+
+// 新建不覆盖已有乐谱，保存(PUT)覆盖并存档
+func TestScoreStoreCreate(t *testing.T) {
+	s := &ScoreStore{dir: t.TempDir()}
+	if _, err := s.Create("a", testScore("index")); err != nil {
+		t.Fatal(err)
+	}
+	_, err := s.Create("a", testScore("ring"))
+	if scoreErrorStatus(err) != http.StatusConflict {
+		t.Fatalf("create over existing score: %v", err)
+	}
+	if _, data, _ := s.Get("a"); !reflect.DeepEqual(data, testScore("index")) {
+		t.Errorf("existing score overwritten by create: %+v", data)
+	}
+	if versions, _ := s.Versions("a"); len(versions) != 0 {
+		t.Errorf("rejected create archived %d versions", len(versions))
+	}
+	if meta, err := s.Save("a", testScore("ring")); err != nil || meta.Versions != 1 {
+		t.Errorf("save over existing score: %+v, %v", meta, err)
+	}
+	// 删除后可以用原ID重新新建
+	s.Delete("a")
+	if _, err := s.Create("a", testScore("pinky")); err != nil {
+		t.Errorf("create after delete: %v", err)
+	}
+}
+
+// 读不出来的文件带错误列出，隐藏文件不列出
+func TestScoreStoreListErrors(t *testing.T) {
+	s := &ScoreStore{dir: t.TempDir()}
+	s.Save("good", testScore("index"))
+	os.WriteFile(filepath.Join(s.dir, "broken.json"), []byte("{"), 0644)
+	os.WriteFile(filepath.Join(s.dir, ".hidden.json"), []byte("{}"), 0644)
+	metas, err := s.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(metas) != 2 || metas[0].ID != "broken" || metas[1].ID != "good" {
+		t.Fatalf("List returned %+v", metas)
+	}
+	if metas[0].Error == "" || metas[0].Size != 1 {
+		t.Errorf("broken entry without error: %+v", metas[0])
+	}
+	if metas[1].Error != "" || metas[1].Steps != 1 {
+		t.Errorf("good entry: %+v", metas[1])
+	}
+}
+
+func TestValidateMusicData(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    MusicData
+		wantErr bool
+	}{
+		{"valid", testScore("index", "pinky"), false},
+		{"empty", MusicData{}, true},
+		{"unknown finger", testScore("index", "toe"), true},
+		{"missing time", MusicData{Music: []MusicNote{{Right: HandAction{Fingers: []string{"index"}}}}}, true},
+		{"negative time", MusicData{Music: []MusicNote{{Right: HandAction{Fingers: []string{"index"}, Time: []float64{-1}}}}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateMusicData(tt.data); (err != nil) != tt.wantErr {
+				t.Errorf("validateMusicData() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
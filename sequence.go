@@ -0,0 +1,511 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"musicsongling/kinematics"
+)
+
+// 原子操作序列，每行一条指令，# 之后为注释。目标写 L/R(按当前绑定的接口)或接口名(如 can0)，
+// 省略时使用请求中的 interface
+//
+//	press L i m                 按下手指，i/m/r/p 或 index/middle/ring/pinky
+//	release L i                 抬起手指，不写手指时全部回到弹琴预设值
+//	fingers L 0 0 100 225 225 225   设置灵巧手全部6个关节位置(0-255)
+//	joints L 0 30 -60 0 20 0    设置机械臂全部关节角(度)
+//	move L y+21 x-5 z=250       机械臂相对(±)或绝对(=)移动，x/y/z 单位mm，rx/ry/rz 单位度
+//	wait 200                    等待(毫秒)
+//	speed 50                    之后机械臂指令的速度(0-100)
+//	parallel ... end            块内每条指令同时开始，全部完成后继续
+//	seq ... end                 顺序执行的子块，用于 parallel 中的一个分支
+
+// SeqStep 序列中的一条指令，parallel/seq 的内容在 Steps 中
+type SeqStep struct {
+	Line    int       `json:"line"`
+	Op      string    `json:"op"`
+	Target  string    `json:"target,omitempty"`
+	Fingers []string  `json:"fingers,omitempty"`
+	Values  []float64 `json:"values,omitempty"` // fingers/joints 的6个值，wait 的毫秒数，speed 的值
+	Axes    []SeqAxis `json:"axes,omitempty"`
+	Steps   []SeqStep `json:"steps,omitempty"`
+}
+
+// SeqAxis move 指令中的一个坐标
+type SeqAxis struct {
+	Axis     string  `json:"axis"`
+	Value    float64 `json:"value"`
+	Relative bool    `json:"relative"`
+}
+
+var seqAxisIndex = map[string]int{"x": 0, "y": 1, "z": 2, "rx": 3, "ry": 4, "rz": 5}
+
+var seqTargetPattern = regexp.MustCompile(`^(L|R|[a-z]+[0-9]+)$`)
+var seqAxisPattern = regexp.MustCompile(`^(x|y|z|rx|ry|rz)([=+-])([0-9]*\.?[0-9]+)$`)
+
+// 指令作用的设备类型
+var seqOpKinds = map[string]string{
+	"press": "hand", "release": "hand", "fingers": "hand",
+	"joints": "arm", "move": "arm",
+	"wait": "", "speed": "", "parallel": "", "seq": "",
+}
+
+func seqFingerName(s string) (string, bool) {
+	if len(s) == 1 {
+		name, ok := dslFingerLetters[s[0]]
+		return name, ok
+	}
+	_, ok := fingerIndexMap[s]
+	return s, ok
+}
+
+// 解析原子操作序列
+func parseSequence(src string) ([]SeqStep, error) {
+	root := []SeqStep{}
+	type frame struct {
+		step  *SeqStep
+		steps *[]SeqStep
+	}
+	stack := []frame{{nil, &root}}
+	for n, line := range strings.Split(src, "\n") {
+		tokens := tokenizeDSLLine(line)
+		if len(tokens) == 0 {
+			continue
+		}
+		lineNo := n + 1
+		errAt := func(t dslToken, format string, args ...interface{}) error {
+			return &DSLError{Line: lineNo, Col: t.col, Msg: fmt.Sprintf(format, args...)}
+		}
+		op := tokens[0]
+		if op.text == "end" {
+			if len(stack) == 1 {
+				return nil, errAt(op, "end without parallel or seq")
+			}
+			top := stack[len(stack)-1]
+			top.step.Steps = *top.steps
+			stack = stack[:len(stack)-1]
+			parent := stack[len(stack)-1].steps
+			*parent = append(*parent, *top.step)
+			continue
+		}
+		kind, ok := seqOpKinds[op.text]
+		if !ok {
+			return nil, errAt(op, "unknown command %q", op.text)
+		}
+		step := SeqStep{Line: lineNo, Op: op.text}
+		args := tokens[1:]
+		if kind != "" && len(args) > 0 && seqTargetPattern.MatchString(args[0].text) {
+			step.Target = args[0].text
+			args = args[1:]
+		}
+		switch op.text {
+		case "parallel", "seq":
+			if len(args) > 0 {
+				return nil, errAt(args[0], "%s takes no arguments", op.text)
+			}
+			s := step
+			stack = append(stack, frame{&s, &[]SeqStep{}})
+			continue
+		case "press", "release":
+			if op.text == "press" && len(args) == 0 {
+				return nil, errAt(op, "press needs at least one finger")
+			}
+			for _, a := range args {
+				name, ok := seqFingerName(a.text)
+				if !ok {
+					return nil, errAt(a, "unknown finger %q", a.text)
+				}
+				step.Fingers = append(step.Fingers, name)
+			}
+		case "fingers", "joints":
+			if len(args) != 6 {
+				return nil, errAt(op, "%s needs 6 values, got %d", op.text, len(args))
+			}
+			for _, a := range args {
+				v, err := strconv.ParseFloat(a.text, 64)
+				if err != nil {
+					return nil, errAt(a, "invalid number %q", a.text)
+				}
+				if op.text == "fingers" && (v < 0 || v > 255) {
+					return nil, errAt(a, "finger value must be 0-255")
+				}
+				step.Values = append(step.Values, v)
+			}
+		case "move":
+			if len(args) == 0 {
+				return nil, errAt(op, "move needs at least one axis")
+			}
+			for _, a := range args {
+				m := seqAxisPattern.FindStringSubmatch(a.text)
+				if m == nil {
+					return nil, errAt(a, "invalid axis %q, expected e.g. y+21 or z=250", a.text)
+				}
+				v, _ := strconv.ParseFloat(m[3], 64)
+				if m[2] == "-" {
+					v = -v
+				}
+				step.Axes = append(step.Axes, SeqAxis{m[1], v, m[2] != "="})
+			}
+		case "wait", "speed":
+			if len(args) != 1 {
+				return nil, errAt(op, "%s needs one value", op.text)
+			}
+			v, err := strconv.ParseFloat(args[0].text, 64)
+			if err != nil || v < 0 {
+				return nil, errAt(args[0], "invalid value %q", args[0].text)
+			}
+			if op.text == "speed" && v > 100 {
+				return nil, errAt(args[0], "speed must be 0-100")
+			}
+			step.Values = []float64{v}
+		}
+		*stack[len(stack)-1].steps = append(*stack[len(stack)-1].steps, step)
+	}
+	if len(stack) > 1 {
+		top := stack[len(stack)-1].step
+		return nil, &DSLError{Line: top.Line, Col: 1, Msg: top.Op + " without end"}
+	}
+	if len(root) == 0 {
+		return nil, fmt.Errorf("empty sequence")
+	}
+	return root, nil
+}
+
+// 检查序列只包含某类设备的指令(hand/arm)，kind为空时不限制
+func checkSequenceKind(steps []SeqStep, kind string) error {
+	for _, s := range steps {
+		if k := seqOpKinds[s.Op]; kind != "" && k != "" && k != kind {
+			return &DSLError{Line: s.Line, Col: 1, Msg: fmt.Sprintf("%s is not a %s command", s.Op, kind)}
+		}
+		if err := checkSequenceKind(s.Steps, kind); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 序列执行器：手指状态和机械臂位姿按接口记录，parallel 分支之间共享
+type seqExecutor struct {
+	rig     *Rig
+	iface   string // 省略目标时使用的接口
+	mu      sync.Mutex
+	locks   map[string]*sync.Mutex // 每个接口一把锁：同一接口的指令依次发送，不同接口的并行分支互不等待
+	fingers map[string][]byte
+	poses   map[string][6]int
+}
+
+func newSeqExecutor(rig *Rig, iface string) *seqExecutor {
+	return &seqExecutor{rig: rig, iface: iface, locks: map[string]*sync.Mutex{}, fingers: map[string][]byte{}, poses: map[string][6]int{}}
+}
+
+func (e *seqExecutor) ifaceLock(iface string) *sync.Mutex {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	l, ok := e.locks[iface]
+	if !ok {
+		l = &sync.Mutex{}
+		e.locks[iface] = l
+	}
+	return l
+}
+
+func (e *seqExecutor) setPose(iface string, pose [6]int) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.poses[iface] = pose
+}
+
+// L/R 按工位当前绑定的接口解析，其他按接口名
+func (e *seqExecutor) resolve(s SeqStep) (string, error) {
+	kind := seqOpKinds[s.Op]
+	ifaces := e.rig.interfaces()
+	switch s.Target {
+	case "":
+		if e.iface == "" {
+			return "", fmt.Errorf("line %d: %s needs a target", s.Line, s.Op)
+		}
+		return e.iface, nil
+	case "L":
+		if kind == "hand" {
+			return ifaces.LeftHand, nil
+		}
+		return ifaces.LeftArm, nil
+	case "R":
+		if kind == "hand" {
+			return ifaces.RightHand, nil
+		}
+		return ifaces.RightArm, nil
+	}
+	return s.Target, nil
+}
+
+// 机械臂当前位姿：本次序列中发过的位姿，或最近一次指令的目标，都没有时为弹琴预设值，调用方持有 e.mu
+func (e *seqExecutor) armPose(iface string) [6]int {
+	if pose, ok := e.poses[iface]; ok {
+		return pose
+	}
+	if pose, ok := lastArmPose(iface); ok {
+		return pose
+	}
+	preset := e.rig.armPreset("left")
+	if armSideOf(iface) == "right" {
+		preset = e.rig.armPreset("right")
+	}
+	var pose [6]int
+	for i, v := range preset {
+		pose[i] = v * 1000
+	}
+	return pose
+}
+
+// 等待期间可被终止
+func seqSleep(rig *Rig, d time.Duration) error {
+	deadline := time.Now().Add(d)
+	for {
+		if rig.killPiano.Load() {
+			return errPlaybackKilled
+		}
+		left := time.Until(deadline)
+		if left <= 0 {
+			return nil
+		}
+		time.Sleep(min(left, 50*time.Millisecond))
+	}
+}
+
+// 顺序执行，speed 为本块当前的机械臂速度，progress 在每条顶层指令完成后调用
+func (e *seqExecutor) run(steps []SeqStep, speed int, progress func(int)) error {
+	for i, s := range steps {
+		if err := e.rig.waitPlaybackResume(); err != nil {
+			return err
+		}
+		var err error
+		switch s.Op {
+		case "speed":
+			speed = int(s.Values[0])
+		case "wait":
+			err = seqSleep(e.rig, time.Duration(s.Values[0]*float64(time.Millisecond)))
+		case "seq":
+			err = e.run(s.Steps, speed, nil)
+		case "parallel":
+			err = e.parallel(s.Steps, speed)
+		default:
+			err = e.exec(s, speed)
+		}
+		if err != nil {
+			return err
+		}
+		if progress != nil {
+			progress(i + 1)
+		}
+	}
+	return nil
+}
+
+func (e *seqExecutor) parallel(steps []SeqStep, speed int) error {
+	var wg sync.WaitGroup
+	var errMu sync.Mutex
+	var firstErr error
+	for _, s := range steps {
+		wg.Add(1)
+		go func(s SeqStep) {
+			defer wg.Done()
+			if err := e.run([]SeqStep{s}, speed, nil); err != nil {
+				errMu.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				errMu.Unlock()
+			}
+		}(s)
+	}
+	wg.Wait()
+	return firstErr
+}
+
+// 执行一条设备指令，同一设备的指令在锁内发送以保证顺序
+func (e *seqExecutor) exec(s SeqStep, speed int) error {
+	iface, err := e.resolve(s)
+	if err != nil {
+		return err
+	}
+	// 只在接口的锁内发送，状态在 e.mu 内更新后复制出来，发送时不阻塞其他接口
+	l := e.ifaceLock(iface)
+	l.Lock()
+	defer l.Unlock()
+	preset := e.rig.fingerPreset()
+	switch s.Op {
+	case "press", "release", "fingers":
+		e.mu.Lock()
+		state, ok := e.fingers[iface]
+		if !ok {
+			state = append([]byte{}, preset...)
+			e.fingers[iface] = state
+		}
+		switch {
+		case s.Op == "fingers":
+			for i, v := range s.Values {
+				if i < len(state) {
+					state[i] = byte(v)
+				}
+			}
+		case s.Op == "release" && len(s.Fingers) == 0:
+			copy(state, preset)
+		default:
+			for _, name := range s.Fingers {
+				idx := fingerIndexMap[name]
+				if s.Op == "press" {
+					state[idx] = byte(fingerDown)
+				} else {
+					state[idx] = preset[idx]
+				}
+			}
+		}
+		frame := append([]byte{}, state...)
+		e.mu.Unlock()
+		if err := sendL10FingerCommand(iface, frame, e.rig.handIDOf(iface)); err != nil {
+			return fmt.Errorf("line %d: %v", s.Line, err)
+		}
+	case "move":
+		e.mu.Lock()
+		pose := e.armPose(iface)
+		e.mu.Unlock()
+		for _, a := range s.Axes {
+			idx := seqAxisIndex[a.Axis]
+			v := int(math.Round(a.Value * 1000))
+			if a.Relative {
+				pose[idx] += v
+			} else {
+				pose[idx] = v
+			}
+		}
+		if err := sendPoseCommand(pose[0], pose[1], pose[2], pose[3], pose[4], pose[5], speed, iface); err != nil {
+			return fmt.Errorf("line %d: %v", s.Line, err)
+		}
+		e.setPose(iface, pose)
+	case "joints":
+		var joints [6]int
+		var q kinematics.Joints
+		for i, v := range s.Values {
+			joints[i] = int(math.Round(v * 1000))
+			q[i] = v
+		}
+		if !validateJoints(joints) {
+			return fmt.Errorf("line %d: joint angle out of range", s.Line)
+		}
+		if err := sendJointCommand(iface, joints, speed); err != nil {
+			return fmt.Errorf("line %d: %v", s.Line, err)
+		}
+		// 关节运动后的末端位姿由正运动学得到，之后的相对移动以此为起点
+		e.setPose(iface, poseOf(kinematics.Piper.FK(q)))
+	}
+	return nil
+}
+
+// 解析并作为演奏任务执行序列，kind 限制指令类型(hand/arm，空为混合)
+func startSequence(c *gin.Context, name, kind, iface string, steps []SeqStep) {
+	if err := checkSequenceKind(steps, kind); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	rig := currentRig(c)
+	exec := newSeqExecutor(rig, iface)
+	job, err := rig.startPlaybackJob(name, func() error {
+		err := exec.run(steps, 100, func(done int) { rig.updatePlaybackProgress(done, len(steps)) })
+		if err != nil {
+			rig.releaseFingers()
+		}
+		return err
+	})
+	if err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "sequence started", "job": job, "steps": steps})
+}
+
+type sequenceRequest struct {
+	Interface string          `json:"interface"`
+	Sequence  json.RawMessage `json:"sequence"`
+	DryRun    bool            `json:"dryRun"` // 只解析不执行
+}
+
+// sequence 为文本序列
+func (req sequenceRequest) text() (string, error) {
+	var src string
+	if err := json.Unmarshal(req.Sequence, &src); err != nil {
+		return "", fmt.Errorf("sequence must be a string")
+	}
+	return src, nil
+}
+
+// 解析文本序列后执行，dryRun 时只返回解析结果
+func (req sequenceRequest) run(c *gin.Context, name, kind string) {
+	src, err := req.text()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	steps, err := parseSequence(src)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.DryRun {
+		if err := checkSequenceKind(steps, kind); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"steps": steps})
+		return
+	}
+	startSequence(c, name, kind, req.Interface, steps)
+}
+
+func runSequenceHandler(name, kind string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req sequenceRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+			return
+		}
+		req.run(c, name, kind)
+	}
+}
+
+// 机械臂Y序列：sequence 为文本序列，或 [[y(0.001mm), 停留时间(毫秒)], ...]，每项移动到绝对Y后等待
+func ySequenceHandler(c *gin.Context) {
+	var req sequenceRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+		return
+	}
+	var pairs [][2]float64
+	if json.Unmarshal(req.Sequence, &pairs) != nil {
+		req.run(c, "sequence:arm", "arm")
+		return
+	}
+	if len(pairs) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "empty sequence"})
+		return
+	}
+	steps := []SeqStep{}
+	for i, p := range pairs {
+		steps = append(steps,
+			SeqStep{Line: i + 1, Op: "move", Axes: []SeqAxis{{"y", p[0] / 1000, false}}},
+			SeqStep{Line: i + 1, Op: "wait", Values: []float64{p[1]}})
+	}
+	if req.DryRun {
+		c.JSON(http.StatusOK, gin.H{"steps": steps})
+		return
+	}
+	startSequence(c, "sequence:y", "arm", req.Interface, steps)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// 把解析结果写成紧凑的文本，便于比较嵌套结构
+func seqShape(steps []SeqStep) string {
+	var parts []string
+	for _, s := range steps {
+		p := s.Op
+		if s.Target != "" {
+			p += "@" + s.Target
+		}
+		for _, f := range s.Fingers {
+			p += " " + f
+		}
+		for _, v := range s.Values {
+			p += fmt.Sprintf(" %g", v)
+		}
+		for _, a := range s.Axes {
+			op := "="
+			if a.Relative {
+				op = "~"
+			}
+			p += fmt.Sprintf(" %s%s%g", a.Axis, op, a.Value)
+		}
+		if s.Op == "parallel" || s.Op == "seq" {
+			p += "[" + seqShape(s.Steps) + "]"
+		}
+		parts = append(parts, p)
+	}
+	return strings.Join(parts, "; ")
+}
+
+func TestParseSequence(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want string
+	}{
+		{"fingers", "press L i middle\nrelease L\nrelease R p", "press@L index middle; release@L; release@R pinky"},
+		{"default target", "press i", "press index"},
+		{"interface target", "fingers can1 0 0 100 225 225 225", "fingers@can1 0 0 100 225 225 225"},
+		{"move axes", "move L y+21 x-5 z=250 rz=10", "move@L y~21 x~-5 z=250 rz=10"},
+		{"joints wait speed", "joints R 0 30 -60 0 20 0\nwait 200\nspeed 50", "joints@R 0 30 -60 0 20 0; wait 200; speed 50"},
+		{"comments and blank lines", "# 开始\n\npress L i # 食指\n", "press@L index"},
+		{"parallel", "parallel\n  press L i\n  press R i\nend\nwait 100", "parallel[press@L index; press@R index]; wait 100"},
+		{
+			"seq inside parallel",
+			"parallel\n  seq\n    move L y+21\n    press L i\n  end\n  press R m\nend",
+			"parallel[seq[move@L y~21; press@L index]; press@R middle]",
+		},
+		{
+			"parallel inside seq inside parallel",
+			"parallel\n  seq\n    parallel\n      press L i\n      press R i\n    end\n    wait 50\n  end\nend",
+			"parallel[seq[parallel[press@L index; press@R index]; wait 50]]",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			steps, err := parseSequence(tt.src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := seqShape(steps); got != tt.want {
+				t.Errorf("got  %s\nwant %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseSequenceErrors(t *testing.T) {
+	tests := []struct {
+		name      string
+		src       string
+		line, col int
+	}{
+		{"unknown command", "press L i\njump L", 2, 1},
+		{"unknown finger", "press L i q", 1, 11},
+		{"press without fingers", "press L", 1, 1},
+		{"too few joint values", "joints L 0 30 -60", 1, 1},
+		{"finger value out of range", "fingers L 0 0 0 0 0 300", 1, 21},
+		{"invalid number", "joints L 0 a 0 0 0 0", 1, 12},
+		{"invalid axis", "move L w+3", 1, 8},
+		{"negative wait", "wait -5", 1, 6},
+		{"speed above 100", "speed 150", 1, 7},
+		{"parallel with arguments", "parallel L", 1, 10},
+		{"end without block", "press L i\nend", 2, 1},
+		{"unclosed parallel", "press L i\nparallel\n  press R i", 2, 1},
+		{"unclosed seq inside parallel", "parallel\n  seq\n    wait 10\nend", 1, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseSequence(tt.src)
+			dslErr, ok := err.(*DSLError)
+			if !ok {
+				t.Fatalf("got %v, want a DSLError", err)
+			}
+			if dslErr.Line != tt.line || dslErr.Col != tt.col {
+				t.Errorf("got line %d col %d (%s), want line %d col %d", dslErr.Line, dslErr.Col, dslErr.Msg, tt.line, tt.col)
+			}
+		})
+	}
+	if _, err := parseSequence("# 只有注释\n"); err == nil {
+		t.Error("empty sequence accepted")
+	}
+}
+
+func TestCheckSequenceKind(t *testing.T) {
+	tests := []struct {
+		name    string
+		src     string
+		kind    string
+		wantErr bool
+	}{
+		{"hand only", "press L i\nwait 10\nrelease L", "hand", false},
+		{"arm command in hand sequence", "press L i\nmove L y+1", "hand", true},
+		{"nested hand command in arm sequence", "parallel\n  seq\n    press R i\n  end\nend", "arm", true},
+		{"no restriction", "press L i\nmove L y+1", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			steps, err := parseSequence(tt.src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := checkSequenceKind(steps, tt.kind); (err != nil) != tt.wantErr {
+				t.Errorf("checkSequenceKind() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ShutdownConfig 收到退出信号后的安全关闭流程
+type ShutdownConfig struct {
+	Timeout   float64 `json:"timeout"`   // 等待演奏任务结束和HTTP服务关闭的最长时间(秒)
+	ParkArms  bool    `json:"parkArms"`  // 是否把机械臂移到停放位姿
+	LeftPark  []int   `json:"leftPark"`  // 左臂停放位姿(mm/°)，为空时使用弹琴预设值
+	RightPark []int   `json:"rightPark"` // 右臂停放位姿(mm/°)，为空时使用弹琴预设值
+}
+
+func defaultShutdownConfig() ShutdownConfig {
+	return ShutdownConfig{Timeout: 5}
+}
+
+var shuttingDown atomic.Bool
+
+// 关闭过程中拒绝新的控制指令，查询接口仍然可用
+func rejectDuringShutdown() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if shuttingDown.Load() && c.Request.Method != http.MethodGet {
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "server is shutting down"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// 启动HTTP服务，收到 SIGINT/SIGTERM 后执行安全关闭
+func runServer(r *gin.Engine, addr string) {
+	srv := &http.Server{Addr: addr, Handler: r}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			slog.Error("server failed", "err", err)
+			os.Exit(1)
+		}
+	}()
+	<-ctx.Done()
+	// 再次收到信号时直接退出
+	stop()
+	safeShutdown(srv)
+}
+
+func safeShutdown(srv *http.Server) {
+	cfg := appConfig.Shutdown
+	timeout := time.Duration(cfg.Timeout * float64(time.Second))
+	deadline := time.Now().Add(timeout)
+	slog.Info("收到退出信号，开始安全关闭")
+	shuttingDown.Store(true)
+
+	// 1. 终止所有工位的演奏任务并等待结束
+	var stopping []*Rig
+	for _, rig := range allRigs() {
+		if rig.jobActive() {
+			rig.killPlayback()
+			stopping = append(stopping, rig)
+		}
+	}
+	for _, rig := range stopping {
+		for time.Now().Before(deadline) && rig.jobActive() {
+			time.Sleep(50 * time.Millisecond)
+		}
+		job := rig.currentPlaybackJob()
+		slog.Info("演奏任务已停止", "job", job.ID, "state", job.State)
+	}
+
+	// 2. 所有手指抬回预设
+	releaseAllFingers()
+
+	// 3. 所有工位的机械臂移到停放位姿
+	if cfg.ParkArms {
+		for _, rig := range allRigs() {
+			ifaces := rig.interfaces()
+			for _, arm := range []struct {
+				iface string
+				park  []int
+				def   []int
+			}{{ifaces.LeftArm, cfg.LeftPark, rig.armPreset("left")}, {ifaces.RightArm, cfg.RightPark, rig.armPreset("right")}} {
+				pose := arm.park
+				if len(pose) != 6 {
+					pose = arm.def
+				}
+				if err := sendArmPoseCommand(arm.iface, pose); err != nil {
+					slog.Error("机械臂停放失败", "interface", arm.iface, "err", err)
+				}
+			}
+		}
+	}
+
+	// 4. 关闭HTTP服务，等待进行中的请求完成
+	ctx, cancel := context.WithDeadline(context.Background(), deadline.Add(time.Second))
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		slog.Error("HTTP服务关闭超时", "err", err)
+	}
+	slog.Info("安全关闭完成")
+	os.Stderr.Sync()
+	os.Stdout.Sync()
+}
@@ -0,0 +1,418 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TeachEvent 示教录制中的一条手动指令，Time 为相对录制开始的秒数
+type TeachEvent struct {
+	Time      float64 `json:"time"`
+	Kind      string  `json:"kind"` // hand 手指位置，arm 机械臂位姿
+	Side      string  `json:"side"` // left/right，未知时为空，转换时跳过
+	Interface string  `json:"interface"`
+	Fingers   []int   `json:"fingers,omitempty"` // L10 手指位置，与工位的 L10 手指弹琴预设值对应
+	Pose      []int   `json:"pose,omitempty"`    // 末端位姿 xyzrxyz，0.001mm/0.001°
+}
+
+// TeachOptions 示教转换为乐谱的参数
+type TeachOptions struct {
+	ChordWindow float64 `json:"chordWindow"` // 在该时间内(秒)开始的按压合并为同一节拍
+	MinPress    float64 `json:"minPress"`    // 短于该时间(秒)的按压视为误触，忽略
+}
+
+func defaultTeachOptions() TeachOptions {
+	return TeachOptions{ChordWindow: 0.08, MinPress: 0.05}
+}
+
+// TeachKeyframe 关键帧：某一时刻一只手的手指状态和机械臂相对弹琴预设值的移动单位
+type TeachKeyframe struct {
+	Time    float64  `json:"time"`
+	Side    string   `json:"side"`
+	Pressed []string `json:"pressed"` // 此时按下的手指
+	Move    int      `json:"move"`    // 机械臂Y方向相对预设值的单位数(armStepMM)
+	MoveX   int      `json:"moveX"`   // 机械臂X方向相对预设值的单位数
+}
+
+// TeachSession 示教录制，每个工位同一时间只有一个；按工位的预设值判断按压和移动
+type TeachSession struct {
+	mu        sync.Mutex
+	recording bool
+	start     time.Time
+	events    []TeachEvent
+	rig       *Rig
+}
+
+func (t *TeachSession) add(ev TeachEvent) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.recording {
+		return
+	}
+	ev.Time = math.Round(time.Since(t.start).Seconds()*1000) / 1000
+	t.events = append(t.events, ev)
+}
+
+// 记录 /api/hand/l10/control 发出的手指位置指令(data[0] 为 0x01)
+func (t *TeachSession) recordHand(msg CanMessage) {
+	preset := t.rig.fingerPreset()
+	if len(msg.Data) < 1+len(preset) || msg.Data[0] != 0x01 {
+		return
+	}
+	ifaces := t.rig.interfaces()
+	side := ""
+	switch {
+	case msg.Id == 0x28 || msg.Interface == ifaces.LeftHand:
+		side = "left"
+	case msg.Id == 0x27 || msg.Interface == ifaces.RightHand:
+		side = "right"
+	}
+	fingers := make([]int, len(preset))
+	for i := range fingers {
+		fingers[i] = int(msg.Data[1+i])
+	}
+	t.add(TeachEvent{Kind: "hand", Side: side, Interface: msg.Interface, Fingers: fingers})
+}
+
+// 记录 /api/arm/send_pose 发出的位姿指令
+func (t *TeachSession) recordArm(req PoseRequest) {
+	side := req.Side
+	if side != "left" && side != "right" {
+		side = armSideOf(req.Interface)
+	}
+	pose := []int{req.X, req.Y, req.Z, req.RX, req.RY, req.RZ}
+	t.add(TeachEvent{Kind: "arm", Side: side, Interface: req.Interface, Pose: pose})
+}
+
+// 手指位置低于预设值和下压值的中点视为按下
+func (t *TeachSession) fingerPressed(fingers []int, name string) bool {
+	idx := fingerIndexMap[name]
+	preset := t.rig.fingerPreset()
+	if idx >= len(fingers) || idx >= len(preset) {
+		return false
+	}
+	threshold := (int(preset[idx]) + fingerDown) / 2
+	return fingers[idx] <= threshold
+}
+
+// 按固定顺序返回按下的手指
+func (t *TeachSession) pressedFingers(fingers []int) []string {
+	pressed := []string{}
+	for _, name := range []string{"index", "middle", "ring", "pinky"} {
+		if t.fingerPressed(fingers, name) {
+			pressed = append(pressed, name)
+		}
+	}
+	return pressed
+}
+
+// 位姿相对弹琴预设值的移动单位，X和Y分别取整
+func (t *TeachSession) moveUnits(side string, pose []int) (int, int) {
+	preset := t.rig.armPreset(side)
+	x := int(math.Round((float64(pose[0])/1000 - float64(preset[0])) / armStepMM))
+	y := int(math.Round((float64(pose[1])/1000 - float64(preset[1])) / armStepMM))
+	return x, y
+}
+
+// 检查并按时间排序示教事件
+func (t *TeachSession) sortEvents(events []TeachEvent) error {
+	fingers := len(t.rig.fingerPreset())
+	for i, ev := range events {
+		switch {
+		case ev.Time < 0:
+			return fmt.Errorf("events[%d]: negative time", i)
+		case ev.Kind == "hand" && len(ev.Fingers) < fingers:
+			return fmt.Errorf("events[%d]: need %d finger values", i, fingers)
+		case ev.Kind == "arm" && len(ev.Pose) != 6:
+			return fmt.Errorf("events[%d]: pose needs 6 values", i)
+		case ev.Kind != "hand" && ev.Kind != "arm":
+			return fmt.Errorf("events[%d]: unknown kind %q", i, ev.Kind)
+		}
+	}
+	sort.SliceStable(events, func(i, j int) bool { return events[i].Time < events[j].Time })
+	return nil
+}
+
+// 事件转换为关键帧：每条指令之后该手的完整状态
+func (t *TeachSession) keyframes(events []TeachEvent) []TeachKeyframe {
+	type state struct {
+		pressed []string
+		x, y    int
+	}
+	states := map[string]*state{"left": {pressed: []string{}}, "right": {pressed: []string{}}}
+	keyframes := []TeachKeyframe{}
+	for _, ev := range events {
+		st, ok := states[ev.Side]
+		if !ok {
+			continue
+		}
+		if ev.Kind == "hand" {
+			st.pressed = t.pressedFingers(ev.Fingers)
+		} else {
+			st.x, st.y = t.moveUnits(ev.Side, ev.Pose)
+		}
+		keyframes = append(keyframes, TeachKeyframe{Time: ev.Time, Side: ev.Side, Pressed: st.pressed, Move: st.y, MoveX: st.x})
+	}
+	return keyframes
+}
+
+// 一次按压：手指从按下到抬起
+type teachPress struct {
+	side, finger string
+	start, end   float64
+}
+
+// 事件转换为乐谱：相近时间开始的按压合并为一个节拍，节拍之间的机械臂移动记到前一个节拍上。
+// 乐谱没有休止，按压之间的停顿不保留；需要保留原始时间时使用关键帧
+func (t *TeachSession) toMusic(events []TeachEvent, opts TeachOptions) (MusicData, error) {
+	var data MusicData
+	var presses []teachPress
+	type armMove struct {
+		time float64
+		side string
+		x, y int
+	}
+	var moves []armMove
+	down := map[[2]string]float64{} // {side, finger} -> 按下时间
+	last := 0.0
+	for _, ev := range events {
+		if ev.Side != "left" && ev.Side != "right" {
+			continue
+		}
+		last = ev.Time
+		if ev.Kind == "arm" {
+			x, y := t.moveUnits(ev.Side, ev.Pose)
+			moves = append(moves, armMove{ev.Time, ev.Side, x, y})
+			continue
+		}
+		for _, name := range []string{"index", "middle", "ring", "pinky"} {
+			key := [2]string{ev.Side, name}
+			start, isDown := down[key]
+			switch pressed := t.fingerPressed(ev.Fingers, name); {
+			case pressed && !isDown:
+				down[key] = ev.Time
+			case !pressed && isDown:
+				delete(down, key)
+				presses = append(presses, teachPress{ev.Side, name, start, ev.Time})
+			}
+		}
+	}
+	// 录制结束时仍按下的手指在最后一条指令时抬起
+	for key, start := range down {
+		presses = append(presses, teachPress{key[0], key[1], start, last})
+	}
+	sort.SliceStable(presses, func(i, j int) bool { return presses[i].start < presses[j].start })
+
+	// 合并为节拍
+	type stepInfo struct {
+		start float64
+		note  MusicNote
+	}
+	var steps []*stepInfo
+	for _, p := range presses {
+		if p.end-p.start < opts.MinPress {
+			continue
+		}
+		if len(steps) == 0 || p.start-steps[len(steps)-1].start > opts.ChordWindow {
+			steps = append(steps, &stepInfo{start: p.start, note: MusicNote{Left: emptyHandAction(), Right: emptyHandAction()}})
+		}
+		note := &steps[len(steps)-1].note
+		action := &note.Left
+		if p.side == "right" {
+			action = &note.Right
+		}
+		if containsString(action.Fingers, p.finger) {
+			continue
+		}
+		action.Fingers = append(action.Fingers, p.finger)
+		action.Time = append(action.Time, math.Round((p.end-p.start)*1000)/1000)
+	}
+
+	// 机械臂移动：每个节拍之后、下一个节拍之前的最后位置，第一个节拍之前的移动单独成一个空节拍
+	pos := map[string][2]int{"left": {0, 0}, "right": {0, 0}}
+	target := map[string][2]int{"left": {0, 0}, "right": {0, 0}}
+	applyMoves := func(note *MusicNote) {
+		for _, side := range []string{"left", "right"} {
+			dx, dy := target[side][0]-pos[side][0], target[side][1]-pos[side][1]
+			action := &note.Left
+			if side == "right" {
+				action = &note.Right
+			}
+			action.Move = ArmMovement{X: dx, Y: dy}
+			pos[side] = target[side]
+		}
+	}
+	mi := 0
+	collect := func(until float64) bool {
+		moved := false
+		for mi < len(moves) && moves[mi].time < until {
+			target[moves[mi].side] = [2]int{moves[mi].x, moves[mi].y}
+			mi++
+			moved = true
+		}
+		return moved
+	}
+	if len(steps) > 0 && collect(steps[0].start) {
+		lead := MusicNote{Left: emptyHandAction(), Right: emptyHandAction()}
+		applyMoves(&lead)
+		data.Music = append(data.Music, lead)
+	}
+	for i, st := range steps {
+		until := math.Inf(1)
+		if i+1 < len(steps) {
+			until = steps[i+1].start
+		}
+		collect(until)
+		applyMoves(&st.note)
+		data.Music = append(data.Music, st.note)
+	}
+	if len(steps) == 0 && collect(math.Inf(1)) {
+		lead := MusicNote{Left: emptyHandAction(), Right: emptyHandAction()}
+		applyMoves(&lead)
+		data.Music = append(data.Music, lead)
+	}
+	for i := range data.Music {
+		data.Music[i].Index = i + 1
+	}
+	if len(data.Music) == 0 {
+		return data, fmt.Errorf("no finger presses or arm moves recorded")
+	}
+	return data, nil
+}
+
+func emptyHandAction() HandAction {
+	return HandAction{Fingers: []string{}, Time: []float64{}}
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// 当前示教事件的副本
+func (t *TeachSession) snapshot() (bool, []TeachEvent) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.recording, append([]TeachEvent{}, t.events...)
+}
+
+func startTeachHandler(c *gin.Context) {
+	teach := currentRig(c).teach
+	teach.mu.Lock()
+	teach.recording = true
+	teach.start = time.Now()
+	teach.events = nil
+	teach.mu.Unlock()
+	c.JSON(http.StatusOK, gin.H{"status": "recording"})
+}
+
+func stopTeachHandler(c *gin.Context) {
+	teach := currentRig(c).teach
+	teach.mu.Lock()
+	teach.recording = false
+	count := len(teach.events)
+	teach.mu.Unlock()
+	c.JSON(http.StatusOK, gin.H{"status": "stopped", "events": count})
+}
+
+func getTeachHandler(c *gin.Context) {
+	recording, events := currentRig(c).teach.snapshot()
+	c.JSON(http.StatusOK, gin.H{"recording": recording, "events": events})
+}
+
+// 编辑示教事件：整体替换
+func replaceTeachEventsHandler(c *gin.Context) {
+	var req struct {
+		Events []TeachEvent `json:"events"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+		return
+	}
+	teach := currentRig(c).teach
+	if err := teach.sortEvents(req.Events); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	teach.mu.Lock()
+	teach.events = req.Events
+	teach.mu.Unlock()
+	c.JSON(http.StatusOK, gin.H{"events": req.Events})
+}
+
+// 请求体可以带 events 覆盖当前录制，options 为转换参数
+type teachConvertRequest struct {
+	ID      string        `json:"id"`
+	Events  []TeachEvent  `json:"events"`
+	Options *TeachOptions `json:"options"`
+}
+
+// 请求中的参数覆盖在默认值上，没有给出的字段保持默认
+func newTeachConvertRequest() teachConvertRequest {
+	opts := defaultTeachOptions()
+	return teachConvertRequest{Options: &opts}
+}
+
+func (req *teachConvertRequest) convert(teach *TeachSession) ([]TeachEvent, MusicData, error) {
+	events := req.Events
+	if events == nil {
+		_, events = teach.snapshot()
+	}
+	if err := teach.sortEvents(events); err != nil {
+		return nil, MusicData{}, err
+	}
+	opts := defaultTeachOptions()
+	if req.Options != nil {
+		opts = *req.Options
+	}
+	data, err := teach.toMusic(events, opts)
+	return events, data, err
+}
+
+// 转换为乐谱和关键帧，不保存
+func convertTeachHandler(c *gin.Context) {
+	// 请求体可以为空，此时转换当前录制的事件
+	req := newTeachConvertRequest()
+	if err := c.ShouldBindJSON(&req); err != nil && err != io.EOF {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+		return
+	}
+	teach := currentRig(c).teach
+	events, data, err := req.convert(teach)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"musicData": data, "keyframes": teach.keyframes(events), "duration": estimateDuration(data.Music)})
+}
+
+// 转换后保存到乐谱库
+func saveTeachHandler(c *gin.Context) {
+	req := newTeachConvertRequest()
+	if err := c.ShouldBindJSON(&req); err != nil || req.ID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "id is required"})
+		return
+	}
+	_, data, err := req.convert(currentRig(c).teach)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	meta, err := scoreStore.Save(req.ID, data)
+	if err != nil {
+		c.JSON(scoreErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "success", "meta": meta})
+}
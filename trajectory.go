@@ -0,0 +1,286 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TrajectoryConfig 机械臂平滑轨迹配置
+type TrajectoryConfig struct {
+	Enabled    bool    `json:"enabled"`
+	Profile    string  `json:"profile"`    // trapezoid: 梯形速度，scurve: S形速度(加速度连续)
+	Rate       float64 `json:"rate"`       // 中间点发送频率(Hz)
+	MaxSpeed   float64 `json:"maxSpeed"`   // 最大线速度(mm/s)
+	MaxAccel   float64 `json:"maxAccel"`   // 最大加速度(mm/s²)
+	LiftHeight float64 `json:"liftHeight"` // 平移前沿Z轴抬起的高度(mm)，0表示不抬起
+	Threshold  int     `json:"threshold"`  // 演奏中移动单位数达到该值时使用平滑轨迹
+}
+
+func defaultTrajectoryConfig() TrajectoryConfig {
+	return TrajectoryConfig{
+		Enabled:    true,
+		Profile:    "scurve",
+		Rate:       50,
+		MaxSpeed:   300,
+		MaxAccel:   1500,
+		LiftHeight: 15,
+		Threshold:  3,
+	}
+}
+
+// 一段直线运动，位姿单位mm/度
+type trajectorySegment struct {
+	from, to [6]float64
+	duration float64 // 秒
+}
+
+// 最大速度和加速度，配置无效时使用默认值
+func (cfg TrajectoryConfig) limits() (float64, float64) {
+	def := defaultTrajectoryConfig()
+	v, a := cfg.MaxSpeed, cfg.MaxAccel
+	if v <= 0 {
+		v = def.MaxSpeed
+	}
+	if a <= 0 {
+		a = def.MaxAccel
+	}
+	return v, a
+}
+
+// 按速度曲线计算走完distance所需时间
+func (cfg TrajectoryConfig) segmentDuration(distance float64) float64 {
+	if distance <= 0 {
+		return 0
+	}
+	v, a := cfg.limits()
+	if cfg.Profile == "scurve" {
+		// s(τ)=τ-sin(2πτ)/2π，峰值速度 2D/T，峰值加速度 2πD/T²
+		return math.Max(2*distance/v, math.Sqrt(2*math.Pi*distance/a))
+	}
+	if distance < v*v/a {
+		return 2 * math.Sqrt(distance/a)
+	}
+	return distance/v + v/a
+}
+
+// 归一化时间tau(0-1)对应的归一化位移
+func (cfg TrajectoryConfig) progress(tau, duration float64) float64 {
+	if tau >= 1 {
+		return 1
+	}
+	if cfg.Profile == "scurve" {
+		return tau - math.Sin(2*math.Pi*tau)/(2*math.Pi)
+	}
+	// 梯形：加速段时长ta占比，匀速段，减速段对称
+	v, a := cfg.limits()
+	ta := math.Min(v/a/duration, 0.5)
+	vPeak := 1 / (1 - ta) // 归一化峰值速度
+	switch {
+	case tau < ta:
+		return 0.5 * vPeak / ta * tau * tau
+	case tau > 1-ta:
+		r := 1 - tau
+		return 1 - 0.5*vPeak/ta*r*r
+	}
+	return 0.5*vPeak*ta + vPeak*(tau-ta)
+}
+
+// 规划从from到to的轨迹：抬起、平移、放下；LiftHeight为0时直接直线移动
+func (cfg TrajectoryConfig) plan(from, to [6]float64) []trajectorySegment {
+	var points [][6]float64
+	points = append(points, from)
+	if cfg.LiftHeight > 0 {
+		up, over := from, to
+		up[2] += cfg.LiftHeight
+		over[2] += cfg.LiftHeight
+		points = append(points, up, over)
+	}
+	points = append(points, to)
+	var segs []trajectorySegment
+	for i := 1; i < len(points); i++ {
+		a, b := points[i-1], points[i]
+		d := dist3([3]float64{a[0], a[1], a[2]}, [3]float64{b[0], b[1], b[2]})
+		// 姿态变化按1°≈1mm计入
+		for k := 3; k < 6; k++ {
+			d = math.Max(d, math.Abs(b[k]-a[k]))
+		}
+		if d > 0 {
+			segs = append(segs, trajectorySegment{a, b, cfg.segmentDuration(d)})
+		}
+	}
+	return segs
+}
+
+// 按发送频率采样轨迹，返回每个中间点的发送时刻(秒)和位姿
+func (cfg TrajectoryConfig) waypoints(segs []trajectorySegment) ([]float64, [][6]float64) {
+	rate := cfg.Rate
+	if rate <= 0 {
+		rate = 50
+	}
+	var times []float64
+	var poses [][6]float64
+	start := 0.0
+	for _, seg := range segs {
+		n := int(math.Ceil(seg.duration * rate))
+		for i := 1; i <= n; i++ {
+			t := math.Min(float64(i)/rate, seg.duration)
+			s := cfg.progress(t/seg.duration, seg.duration)
+			var p [6]float64
+			for k := range p {
+				p[k] = seg.from[k] + (seg.to[k]-seg.from[k])*s
+			}
+			times = append(times, start+t)
+			poses = append(poses, p)
+		}
+		start += seg.duration
+	}
+	return times, poses
+}
+
+func milliPose(p [6]float64) [6]int {
+	var out [6]int
+	for k := range p {
+		out[k] = int(math.Round(p[k] * 1000))
+	}
+	return out
+}
+
+// 发送前按整条轨迹检查一次，再按时刻依次发送中间点，中间点不再逐个检查，发送时刻不受安全检查影响
+func followTrajectory(armCan string, from, to [6]float64, speed int) error {
+	if speed < 0 || speed > 100 {
+		return fmt.Errorf("speed must be 0-100")
+	}
+	cfg := appConfig.Trajectory
+	segs := cfg.plan(from, to)
+	if err := guardTrajectory(armCan, segs); err != nil {
+		return err
+	}
+	times, poses := cfg.waypoints(segs)
+	start := time.Now()
+	for i, p := range poses {
+		if wait := time.Duration(times[i]*float64(time.Second)) - time.Since(start); wait > 0 {
+			time.Sleep(wait)
+		}
+		m := milliPose(p)
+		if err := sendPoseFrames(m[0], m[1], m[2], m[3], m[4], m[5], speed, armCan); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 轨迹的每一段(抬起、平移、放下)都在工作空间内；防碰撞按起点到终点整段检查，
+// 运动段按轨迹总时长记录，另一只手在轨迹走完前按整段避让
+func guardTrajectory(armCan string, segs []trajectorySegment) error {
+	if len(segs) == 0 {
+		return nil
+	}
+	total := 0.0
+	for _, seg := range segs {
+		from := milliPose(seg.from)
+		if err := guardWorkspaceMove(armCan, &from, milliPose(seg.to)); err != nil {
+			return err
+		}
+		total += seg.duration
+	}
+	return guardArmPath(armCan, milliPose(segs[len(segs)-1].to), total)
+}
+
+// 演奏中的机械臂移动，移动单位达到阈值时走平滑轨迹，否则直接发送目标位姿
+func moveArm(armCan string, from, to []int, units int) error {
+	cfg := appConfig.Trajectory
+	if !cfg.Enabled || units < cfg.Threshold {
+		metricArmMoves.inc(armCan, "direct")
+		return sendArmPoseCommand(armCan, to)
+	}
+	metricArmMoves.inc(armCan, "trajectory")
+	var a, b [6]float64
+	for k := 0; k < 6; k++ {
+		a[k], b[k] = float64(from[k]), float64(to[k])
+	}
+	return armPlaybackError(armCan, followTrajectory(armCan, a, b, 100))
+}
+
+// 演奏中一次移动走平滑轨迹的时长(秒)，与moveArm的判断一致，直接发送的移动返回0
+func (cfg TrajectoryConfig) moveDuration(move ArmMovement) float64 {
+	if !cfg.Enabled || max(abs(move.X), abs(move.Y)) < cfg.Threshold {
+		return 0
+	}
+	to := [6]float64{float64(move.X * armStepMM), float64(move.Y * armStepMM)}
+	total := 0.0
+	for _, seg := range cfg.plan([6]float64{}, to) {
+		total += seg.duration
+	}
+	return total
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+// 手动平滑移动到目标位姿，preview为true时只返回中间点不发送
+func moveSmoothHandler(c *gin.Context) {
+	var req struct {
+		PoseRequest
+		From    *[6]int `json:"from"` // 起始位姿(0.001单位)，默认为该侧最近一次指令的位姿
+		Preview bool    `json:"preview"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+		return
+	}
+	currentRig(c).setManualArmSide(req.Interface, req.Side)
+	speed := req.Speed
+	if speed == 0 {
+		speed = 100
+	}
+	target := [6]int{req.X, req.Y, req.Z, req.RX, req.RY, req.RZ}
+	var from [6]int
+	if req.From != nil {
+		from = *req.From
+	} else {
+		pose, known := lastArmPose(req.Interface)
+		from = pose
+		if !known {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "current pose unknown, specify from"})
+			return
+		}
+	}
+	var a, b [6]float64
+	for k := range a {
+		a[k], b[k] = float64(from[k])/1000, float64(target[k])/1000
+	}
+	cfg := appConfig.Trajectory
+	times, poses := cfg.waypoints(cfg.plan(a, b))
+	if req.Preview {
+		points := make([]gin.H, len(poses))
+		for i, p := range poses {
+			points[i] = gin.H{"t": round2(times[i]), "pose": milliPose(p)}
+		}
+		c.JSON(http.StatusOK, gin.H{"waypoints": points})
+		return
+	}
+	metricArmMoves.inc(req.Interface, "smooth")
+	if err := followTrajectory(req.Interface, a, b, speed); err != nil {
+		status := http.StatusInternalServerError
+		var safetyErr *SafetyError
+		if errors.As(err, &safetyErr) {
+			status = http.StatusConflict
+		}
+		c.JSON(status, gin.H{"error": fmt.Sprintf("trajectory aborted: %v", err)})
+		return
+	}
+	duration := 0.0
+	if len(times) > 0 {
+		duration = times[len(times)-1]
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "trajectory sent", "waypoints": len(poses), "duration": round2(duration)})
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSegmentDuration(t *testing.T) {
+	trapezoid := TrajectoryConfig{Profile: "trapezoid", MaxSpeed: 300, MaxAccel: 1500}
+	scurve := TrajectoryConfig{Profile: "scurve", MaxSpeed: 300, MaxAccel: 1500}
+	tests := []struct {
+		name     string
+		cfg      TrajectoryConfig
+		distance float64
+		want     float64
+	}{
+		{"zero distance", trapezoid, 0, 0},
+		{"trapezoid short: triangle profile", trapezoid, 15, 0.2},
+		{"trapezoid at cruise threshold", trapezoid, 60, 0.4},
+		{"trapezoid long: cruise phase", trapezoid, 150, 0.7},
+		{"scurve short: accel limited", scurve, 15, math.Sqrt(2 * math.Pi * 15 / 1500)},
+		{"scurve long: speed limited", scurve, 150, 1},
+		{"invalid limits use defaults", TrajectoryConfig{Profile: "trapezoid"}, 150, 0.7},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.cfg.segmentDuration(tt.distance); math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("segmentDuration(%v) = %v, want %v", tt.distance, got, tt.want)
+			}
+		})
+	}
+}
+
+// 速度曲线从0走到1、单调、前后对称，数值求导的速度和加速度不超过限制
+func TestProgressProfiles(t *testing.T) {
+	tests := []struct {
+		name     string
+		profile  string
+		distance float64
+	}{
+		{"trapezoid short", "trapezoid", 15},
+		{"trapezoid long", "trapezoid", 150},
+		{"scurve short", "scurve", 15},
+		{"scurve long", "scurve", 150},
+	}
+	const n = 2000
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := TrajectoryConfig{Profile: tt.profile, MaxSpeed: 300, MaxAccel: 1500}
+			v, a := cfg.limits()
+			duration := cfg.segmentDuration(tt.distance)
+			if got := cfg.progress(0, duration); math.Abs(got) > 1e-9 {
+				t.Errorf("progress(0) = %v, want 0", got)
+			}
+			if got := cfg.progress(1, duration); got != 1 {
+				t.Errorf("progress(1) = %v, want 1", got)
+			}
+			dt := duration / n
+			pos := func(i int) float64 { return tt.distance * cfg.progress(float64(i)/n, duration) }
+			for i := 1; i < n; i++ {
+				tau := float64(i) / n
+				if s, mirror := cfg.progress(tau, duration), cfg.progress(1-tau, duration); math.Abs(s+mirror-1) > 1e-9 {
+					t.Fatalf("not symmetric at tau=%v: %v + %v", tau, s, mirror)
+				}
+				speed := (pos(i+1) - pos(i-1)) / (2 * dt)
+				if speed < -1e-9 {
+					t.Fatalf("moving backwards at tau=%v", tau)
+				}
+				if speed > v*1.01 {
+					t.Fatalf("speed %.1fmm/s exceeds %.1f at tau=%v", speed, v, tau)
+				}
+				accel := (pos(i+1) - 2*pos(i) + pos(i-1)) / (dt * dt)
+				if math.Abs(accel) > a*1.01 {
+					t.Fatalf("acceleration %.1fmm/s² exceeds %.1f at tau=%v", accel, a, tau)
+				}
+			}
+		})
+	}
+}
+
+func TestPlanLiftsAndMoves(t *testing.T) {
+	cfg := TrajectoryConfig{Profile: "scurve", MaxSpeed: 300, MaxAccel: 1500, LiftHeight: 15}
+	segs := cfg.plan([6]float64{300, 0, 250}, [6]float64{300, 42, 250})
+	if len(segs) != 3 {
+		t.Fatalf("got %d segments, want lift, traverse and lower", len(segs))
+	}
+	if segs[0].to[2] != 265 || segs[2].from[2] != 265 || segs[2].to[2] != 250 {
+		t.Errorf("unexpected lift heights: %+v", segs)
+	}
+	cfg.LiftHeight = 0
+	if segs := cfg.plan([6]float64{300, 0, 250}, [6]float64{300, 42, 250}); len(segs) != 1 {
+		t.Errorf("got %d segments without lift, want 1", len(segs))
+	}
+}
+
+// 发送中间点前按整条轨迹检查一次：抬起段也要在工作空间内，运动段按轨迹总时长记录
+func TestGuardTrajectory(t *testing.T) {
+	cfg := TrajectoryConfig{Profile: "scurve", MaxSpeed: 300, MaxAccel: 1500, LiftHeight: 15}
+	collision := CollisionConfig{
+		Enabled:       true,
+		Left:          ArmFrame{Base: [3]float64{0, -100, 0}, ToolRadius: 45},
+		Right:         ArmFrame{Base: [3]float64{0, 100, 0}, ToolRadius: 45},
+		MinSeparation: 10,
+		CheckStep:     5,
+		Mode:          "reject",
+	}
+	tests := []struct {
+		name     string
+		from, to [6]float64
+		right    [6]int // 右臂静止的位姿
+		want     string
+	}{
+		{"inside", [6]float64{300, 0, 100}, [6]float64{300, 42, 100}, mmPose(300, 0, 100), ""},
+		{"lift leaves the workspace", [6]float64{300, 0, 540}, [6]float64{300, 42, 540}, mmPose(300, 0, 100), "z=555.0mm"},
+		{"target next to the right arm", [6]float64{300, 0, 100}, [6]float64{300, 84, 100}, mmPose(300, -60, 100), "clearance"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useCollision(t, collision)
+			useCalibration(t, CalibrationConfig{})
+			savedWorkspace := appConfig.Workspace
+			t.Cleanup(func() { appConfig.Workspace = savedWorkspace })
+			appConfig.Workspace = defaultWorkspaceConfig()
+			useRigs(t)
+			rig := defaultRig()
+			rig.segments["right"] = &armSegment{from: tt.right, to: tt.right, known: true}
+
+			segs := cfg.plan(tt.from, tt.to)
+			err := guardTrajectory(rig.interfaces().LeftArm, segs)
+			if tt.want != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.want) {
+					t.Fatalf("got %v, want %q", err, tt.want)
+				}
+				if rig.segments["left"].known {
+					t.Error("rejected trajectory recorded as the arm's segment")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			total := 0.0
+			for _, seg := range segs {
+				total += seg.duration
+			}
+			seg := rig.segments["left"]
+			if seg.to != milliPose(tt.to) {
+				t.Errorf("recorded target %v, want %v", seg.to, milliPose(tt.to))
+			}
+			if d := time.Until(seg.done).Seconds(); math.Abs(d-total) > 0.05 {
+				t.Errorf("segment done in %.3fs, want the trajectory duration %.3fs", d, total)
+			}
+		})
+	}
+}
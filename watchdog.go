@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// WatchdogConfig 远程操作看门狗：界面需要定时发送心跳，超时后暂停或终止演奏
+type WatchdogConfig struct {
+	Enabled      bool    `json:"enabled"`
+	Timeout      float64 `json:"timeout"`      // 心跳超时(秒)
+	Action       string  `json:"action"`       // 超时后的动作：pause 暂停，abort 终止
+	StopArms     bool    `json:"stopArms"`     // 是否同时急停机械臂(0x150)
+	StallTimeout float64 `json:"stallTimeout"` // 演奏进度超过该时间没有推进视为卡住(秒)，0表示不检查
+	// 为 true 时允许只通过接口控制、不发心跳的客户端：任务开始前后没有收到心跳时只检查进度卡住
+	HeartbeatOptional bool `json:"heartbeatOptional"`
+}
+
+func defaultWatchdogConfig() WatchdogConfig {
+	return WatchdogConfig{Enabled: true, Timeout: 3, Action: "pause", StallTimeout: 15}
+}
+
+// WatchdogTrip 一次看门狗触发记录
+type WatchdogTrip struct {
+	Time   time.Time `json:"time"`
+	Rig    string    `json:"rig"`
+	JobID  string    `json:"jobId"`
+	Reason string    `json:"reason"`
+	Action string    `json:"action"`
+}
+
+const maxWatchdogTrips = 50
+
+var watchdogMu sync.Mutex
+var lastHeartbeat = map[string]time.Time{} // 工位ID -> 最近一次心跳
+var watchdogTripped = map[string]string{}  // 工位ID -> 已触发的任务ID
+var watchdogUnarmed = map[string]string{}  // 工位ID -> 没有心跳保护的任务ID，只记录一次日志
+var watchdogTrips []WatchdogTrip
+
+// 后台检查心跳和演奏进度
+func startWatchdog() {
+	go func() {
+		for range time.Tick(200 * time.Millisecond) {
+			checkWatchdog(time.Now())
+		}
+	}()
+}
+
+func checkWatchdog(now time.Time) {
+	for _, rig := range allRigs() {
+		checkRigWatchdog(rig, now)
+	}
+}
+
+// 检查一个工位的演奏任务，每个工位的界面分别发送心跳
+func checkRigWatchdog(rig *Rig, now time.Time) {
+	cfg := appConfig.Watchdog
+	job := rig.currentPlaybackJob()
+	if !cfg.Enabled || job == nil || job.State != jobRunning {
+		return
+	}
+	watchdogMu.Lock()
+	if watchdogTripped[rig.ID] == job.ID {
+		watchdogMu.Unlock()
+		return
+	}
+	// 任务开始时视为收到一次心跳，之后界面必须在超时时间内续期
+	timeout := time.Duration(cfg.Timeout * float64(time.Second))
+	beat, ok := lastHeartbeat[rig.ID]
+	armed := !cfg.HeartbeatOptional || ok && beat.After(job.StartedAt.Add(-timeout))
+	if job.StartedAt.After(beat) {
+		beat = job.StartedAt
+	}
+	if !armed && watchdogUnarmed[rig.ID] != job.ID {
+		watchdogUnarmed[rig.ID] = job.ID
+		rig.logger().Warn("看门狗没有收到心跳，heartbeatOptional 开启，本次演奏只检查进度卡住")
+	}
+	reason := ""
+	switch {
+	case armed && now.Sub(beat) > timeout:
+		reason = fmt.Sprintf("heartbeat lost for %v", now.Sub(beat).Round(time.Millisecond))
+	case cfg.StallTimeout > 0 && !(job.Playlist != nil && job.Playlist.Phase == "pausing") &&
+		!(job.Sync != nil && job.Sync.Waiting) &&
+		now.Sub(job.UpdatedAt) > time.Duration(cfg.StallTimeout*float64(time.Second)):
+		// 播放列表曲间停顿、等待外部时钟不算卡住
+		reason = fmt.Sprintf("playback stalled at step %d for %v", job.Step, now.Sub(job.UpdatedAt).Round(time.Millisecond))
+	}
+	if reason == "" {
+		watchdogMu.Unlock()
+		return
+	}
+	watchdogTripped[rig.ID] = job.ID
+	trip := WatchdogTrip{Time: now, Rig: rig.ID, JobID: job.ID, Reason: reason, Action: cfg.Action}
+	watchdogTrips = append(watchdogTrips, trip)
+	if len(watchdogTrips) > maxWatchdogTrips {
+		watchdogTrips = watchdogTrips[len(watchdogTrips)-maxWatchdogTrips:]
+	}
+	watchdogMu.Unlock()
+
+	rig.logger().Warn("看门狗触发", "reason", reason, "action", cfg.Action)
+	if cfg.Action == "abort" {
+		rig.killPlayback()
+	} else {
+		rig.pausePlayback()
+	}
+	rig.releaseFingers()
+	if cfg.StopArms {
+		ifaces := rig.interfaces()
+		for _, arm := range []string{ifaces.LeftArm, ifaces.RightArm} {
+			if err := emergencyStopArm(arm); err != nil {
+				slog.Error("看门狗急停机械臂失败", "interface", arm, "err", err)
+			}
+		}
+	}
+}
+
+// 工位的所有手指抬回弹琴预设位置，使用与演奏相同的手部ID
+func (r *Rig) releaseFingers() {
+	ifaces := r.interfaces()
+	for side, hand := range map[string]string{"left": ifaces.LeftHand, "right": ifaces.RightHand} {
+		if hand != "" {
+			sendL10FingerCommand(hand, r.fingerPreset(), r.handID(side))
+		}
+	}
+}
+
+// 所有工位的手指抬回弹琴预设位置
+func releaseAllFingers() {
+	for _, rig := range allRigs() {
+		rig.releaseFingers()
+	}
+}
+
+// 机械臂急停 (0x150)
+func emergencyStopArm(iface string) error {
+	return forwardToCanService(CanMessage{
+		Interface: iface,
+		Id:        0x150,
+		Data:      []byte{0x01, 0, 0, 0, 0, 0, 0, 0},
+	})
+}
+
+// 机械臂急停后恢复 (0x150)
+func emergencyResumeArm(iface string) error {
+	return forwardToCanService(CanMessage{
+		Interface: iface,
+		Id:        0x150,
+		Data:      []byte{0x02, 0, 0, 0, 0, 0, 0, 0},
+	})
+}
+
+// 恢复演奏后重新检查，没有心跳时会再次触发
+func rearmWatchdog(rig *Rig) {
+	watchdogMu.Lock()
+	defer watchdogMu.Unlock()
+	delete(watchdogTripped, rig.ID)
+}
+
+// 工位的心跳，界面需要在超时时间内重复调用；只保持该工位的演奏
+func heartbeatHandler(c *gin.Context) {
+	rig := currentRig(c)
+	watchdogMu.Lock()
+	lastHeartbeat[rig.ID] = time.Now()
+	delete(watchdogTripped, rig.ID)
+	watchdogMu.Unlock()
+	c.JSON(http.StatusOK, gin.H{"status": "ok", "timeout": appConfig.Watchdog.Timeout})
+}
+
+// 工位的看门狗状态：最近一次心跳和该工位的触发记录
+func watchdogStatusHandler(c *gin.Context) {
+	rig := currentRig(c)
+	watchdogMu.Lock()
+	defer watchdogMu.Unlock()
+	var last *time.Time
+	if t, ok := lastHeartbeat[rig.ID]; ok {
+		last = &t
+	}
+	trips := []WatchdogTrip{}
+	for _, trip := range watchdogTrips {
+		if trip.Rig == rig.ID {
+			trips = append(trips, trip)
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"config": appConfig.Watchdog, "lastHeartbeat": last, "trips": trips})
+}
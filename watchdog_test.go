@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func useWatchdog(t *testing.T, cfg WatchdogConfig) {
+	saved := appConfig.Watchdog
+	t.Cleanup(func() { appConfig.Watchdog = saved })
+	appConfig.Watchdog = cfg
+}
+
+// 任务开始时视为收到一次心跳；heartbeatOptional 时没有心跳的任务只检查进度卡住
+func TestCheckRigWatchdog(t *testing.T) {
+	start := time.Now()
+	tests := []struct {
+		name     string
+		optional bool
+		beat     time.Duration // 心跳相对任务开始的时间，0表示没有心跳
+		now      time.Duration
+		tripped  bool
+	}{
+		{"no heartbeat within timeout of start", false, 0, 2 * time.Second, false},
+		{"no heartbeat after start", false, 0, 4 * time.Second, true},
+		{"heartbeat renewed", false, 3 * time.Second, 4 * time.Second, false},
+		{"heartbeat lost", false, 1 * time.Second, 5 * time.Second, true},
+		{"optional without heartbeat", true, 0, 10 * time.Second, false},
+		{"optional with heartbeat lost", true, 1 * time.Second, 5 * time.Second, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := defaultWatchdogConfig()
+			cfg.HeartbeatOptional = tt.optional
+			useWatchdog(t, cfg)
+			rig := newRig(RigConfig{ID: "watchdog-test"})
+			rig.job = &PlaybackJob{ID: "job-1", Rig: rig.ID, State: jobRunning, StartedAt: start, UpdatedAt: start.Add(tt.now)}
+			watchdogMu.Lock()
+			delete(lastHeartbeat, rig.ID)
+			delete(watchdogTripped, rig.ID)
+			if tt.beat != 0 {
+				lastHeartbeat[rig.ID] = start.Add(tt.beat)
+			}
+			watchdogMu.Unlock()
+			t.Cleanup(func() {
+				watchdogMu.Lock()
+				delete(lastHeartbeat, rig.ID)
+				delete(watchdogTripped, rig.ID)
+				delete(watchdogUnarmed, rig.ID)
+				watchdogMu.Unlock()
+			})
+
+			checkRigWatchdog(rig, start.Add(tt.now))
+			if got := rig.currentPlaybackJob().State == jobPaused; got != tt.tripped {
+				t.Errorf("paused = %v, want %v", got, tt.tripped)
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// 读取WAV文件，返回混为单声道的采样(-1~1)和采样率。支持16/24/32位PCM和32位浮点
+func readWAV(data []byte) ([]float64, int, error) {
+	if len(data) < 12 || string(data[0:4]) != "RIFF" || string(data[8:12]) != "WAVE" {
+		return nil, 0, fmt.Errorf("not a WAV file")
+	}
+	var format, channels, bits int
+	var rate int
+	var pcm []byte
+	for pos := 12; pos+8 <= len(data); {
+		id := string(data[pos : pos+4])
+		size := int(binary.LittleEndian.Uint32(data[pos+4 : pos+8]))
+		body := data[pos+8 : min(pos+8+size, len(data))]
+		switch id {
+		case "fmt ":
+			if len(body) < 16 {
+				return nil, 0, fmt.Errorf("short fmt chunk")
+			}
+			format = int(binary.LittleEndian.Uint16(body[0:2]))
+			channels = int(binary.LittleEndian.Uint16(body[2:4]))
+			rate = int(binary.LittleEndian.Uint32(body[4:8]))
+			bits = int(binary.LittleEndian.Uint16(body[14:16]))
+			// WAVE_FORMAT_EXTENSIBLE 的实际格式在子格式GUID的前两个字节
+			if format == 0xFFFE && len(body) >= 26 {
+				format = int(binary.LittleEndian.Uint16(body[24:26]))
+			}
+		case "data":
+			pcm = body
+		}
+		pos += 8 + size + size%2
+	}
+	if channels == 0 || rate == 0 {
+		return nil, 0, fmt.Errorf("missing fmt chunk")
+	}
+	if pcm == nil {
+		return nil, 0, fmt.Errorf("missing data chunk")
+	}
+	width := bits / 8
+	switch {
+	case format == 1 && (bits == 16 || bits == 24 || bits == 32):
+	case format == 3 && bits == 32:
+	default:
+		return nil, 0, fmt.Errorf("unsupported WAV format %d with %d bits", format, bits)
+	}
+	frame := width * channels
+	samples := make([]float64, len(pcm)/frame)
+	for i := range samples {
+		sum := 0.0
+		for ch := 0; ch < channels; ch++ {
+			b := pcm[i*frame+ch*width:]
+			var v float64
+			switch {
+			case format == 3:
+				v = float64(math.Float32frombits(binary.LittleEndian.Uint32(b)))
+			case bits == 16:
+				v = float64(int16(binary.LittleEndian.Uint16(b))) / (1 << 15)
+			case bits == 24:
+				v = float64(int32(uint32(b[0])<<8|uint32(b[1])<<16|uint32(b[2])<<24)>>8) / (1 << 23)
+			default:
+				v = float64(int32(binary.LittleEndian.Uint32(b))) / (1 << 31)
+			}
+			sum += v
+		}
+		samples[i] = sum / float64(channels)
+	}
+	return samples, rate, nil
+}
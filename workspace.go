@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+)
+
+// ArmWorkspace 单只机械臂在基座坐标系下允许的工作空间(mm/度)
+type ArmWorkspace struct {
+	Min       [3]float64   `json:"min"`               // X/Y/Z 下限
+	Max       [3]float64   `json:"max"`               // X/Y/Z 上限
+	Polygon   [][2]float64 `json:"polygon,omitempty"` // 可选，XY平面多边形，设置后代替盒子的X/Y范围
+	OrientMin [3]float64   `json:"orientMin"`         // RX/RY/RZ 下限
+	OrientMax [3]float64   `json:"orientMax"`         // RX/RY/RZ 上限
+}
+
+// KeepOutZone 世界坐标系中末端不允许进入的区域，例如键盘表面以下
+type KeepOutZone struct {
+	Name string     `json:"name"`
+	Min  [3]float64 `json:"min"`
+	Max  [3]float64 `json:"max"`
+}
+
+// WorkspaceConfig 笛卡尔工作空间限制
+type WorkspaceConfig struct {
+	Enabled bool          `json:"enabled"`
+	Left    ArmWorkspace  `json:"left"`
+	Right   ArmWorkspace  `json:"right"`
+	KeepOut []KeepOutZone `json:"keepOut"`
+}
+
+func defaultWorkspaceConfig() WorkspaceConfig {
+	arm := ArmWorkspace{
+		Min:       [3]float64{150, -400, 0},
+		Max:       [3]float64{650, 400, 550},
+		OrientMin: [3]float64{-180, -90, -180},
+		OrientMax: [3]float64{180, 120, 180},
+	}
+	return WorkspaceConfig{
+		Enabled: true,
+		Left:    arm,
+		Right:   arm,
+		KeepOut: []KeepOutZone{
+			// 末端中心至少高出键盘表面20mm
+			{Name: "keyboard", Min: [3]float64{-2000, -2000, -1000}, Max: [3]float64{2000, 2000, 20}},
+		},
+	}
+}
+
+// 点是否在多边形内(射线法)
+func pointInPolygon(x, y float64, poly [][2]float64) bool {
+	inside := false
+	for i, j := 0, len(poly)-1; i < len(poly); j, i = i, i+1 {
+		a, b := poly[i], poly[j]
+		if (a[1] > y) != (b[1] > y) && x < (b[0]-a[0])*(y-a[1])/(b[1]-a[1])+a[0] {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+// 检查基座坐标系下的位置(mm)是否在工作空间内
+func (w ArmWorkspace) checkPosition(p [3]float64) error {
+	axes := []string{"x", "y", "z"}
+	for i := range p {
+		if len(w.Polygon) >= 3 && i < 2 {
+			continue
+		}
+		if p[i] < w.Min[i] || p[i] > w.Max[i] {
+			return fmt.Errorf("%s=%.1fmm outside [%.1f, %.1f]", axes[i], p[i], w.Min[i], w.Max[i])
+		}
+	}
+	if len(w.Polygon) >= 3 && !pointInPolygon(p[0], p[1], w.Polygon) {
+		return fmt.Errorf("x=%.1fmm y=%.1fmm outside workspace polygon", p[0], p[1])
+	}
+	return nil
+}
+
+// 检查位姿(0.001mm/0.001°)及从from开始的直线运动是否都在工作空间内且不进入禁区
+func checkWorkspace(cfg WorkspaceConfig, frame ArmFrame, ws ArmWorkspace, from, target [6]int, step float64) error {
+	axes := []string{"rx", "ry", "rz"}
+	for i := 0; i < 3; i++ {
+		v := float64(target[3+i]) / 1000
+		if v < ws.OrientMin[i] || v > ws.OrientMax[i] {
+			return fmt.Errorf("%s=%.1f° outside [%.1f, %.1f]", axes[i], v, ws.OrientMin[i], ws.OrientMax[i])
+		}
+	}
+	local := func(pose [6]int) [3]float64 {
+		return [3]float64{float64(pose[0]) / 1000, float64(pose[1]) / 1000, float64(pose[2]) / 1000}
+	}
+	point := func(p [3]float64) error {
+		if err := ws.checkPosition(p); err != nil {
+			return err
+		}
+		world := frame.world([6]int{int(math.Round(p[0] * 1000)), int(math.Round(p[1] * 1000)), int(math.Round(p[2] * 1000))})
+		for _, zone := range cfg.KeepOut {
+			inside := true
+			for k := range world {
+				inside = inside && world[k] >= zone.Min[k] && world[k] <= zone.Max[k]
+			}
+			if inside {
+				return fmt.Errorf("enters keep-out zone %q at (%.1f, %.1f, %.1f)mm", zone.Name, world[0], world[1], world[2])
+			}
+		}
+		return nil
+	}
+	a, b := local(from), local(target)
+	if err := point(b); err != nil {
+		return err
+	}
+	// 起点已经在限制之外时允许直接移回，不检查路径
+	if point(a) != nil {
+		return nil
+	}
+	if step <= 0 {
+		step = 5
+	}
+	n := int(math.Min(dist3(a, b)/step, 200)) + 1
+	for i := 1; i < n; i++ {
+		if err := point(lerp3(a, b, float64(i)/float64(n))); err != nil {
+			return fmt.Errorf("path leaves workspace: %v", err)
+		}
+	}
+	return nil
+}
+
+// 发送位姿前的工作空间检查，左右未知的接口只要落在任意一只手臂的工作空间内即可
+func guardWorkspace(iface string, target [6]int) error {
+	return guardWorkspaceMove(iface, nil, target)
+}
+
+// 检查从from到target的直线运动，from为nil时从该侧最近一次指令的位姿开始
+func guardWorkspaceMove(iface string, from *[6]int, target [6]int) error {
+	cfg := appConfig.Workspace
+	if !cfg.Enabled {
+		return nil
+	}
+	rig, side := armOf(iface)
+	sides := []string{side}
+	if side == "" {
+		sides = []string{"left", "right"}
+	}
+	var err error
+	for _, s := range sides {
+		frame, ws := appConfig.Collision.Left, cfg.Left
+		if s == "right" {
+			frame, ws = appConfig.Collision.Right, cfg.Right
+		}
+		start := target
+		if from != nil {
+			start = *from
+		} else {
+			safetyMu.Lock()
+			if seg := rig.segments[s]; seg.known && side != "" {
+				start = seg.to
+			}
+			safetyMu.Unlock()
+		}
+		if err = checkWorkspace(cfg, frame, ws, start, target, appConfig.Collision.CheckStep); err == nil {
+			return nil
+		}
+	}
+	slog.Warn("工作空间检查拒绝", "interface", iface, "target", target, "err", err)
+	return &SafetyError{side, err.Error()}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// 位置单位mm，换算为位姿的0.001mm
+func mmPose(x, y, z float64, orient ...float64) [6]int {
+	pose := [6]int{int(x * 1000), int(y * 1000), int(z * 1000)}
+	for i, v := range orient {
+		pose[3+i] = int(v * 1000)
+	}
+	return pose
+}
+
+func TestPointInPolygon(t *testing.T) {
+	square := [][2]float64{{0, 0}, {10, 0}, {10, 10}, {0, 10}}
+	triangle := [][2]float64{{0, 0}, {10, 0}, {0, 10}}
+	tests := []struct {
+		name string
+		x, y float64
+		poly [][2]float64
+		want bool
+	}{
+		{"square center", 5, 5, square, true},
+		{"square outside", 15, 5, square, false},
+		{"triangle inside", 2, 2, triangle, true},
+		{"triangle beyond hypotenuse", 6, 6, triangle, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := pointInPolygon(tt.x, tt.y, tt.poly); got != tt.want {
+				t.Errorf("pointInPolygon(%v, %v) = %v, want %v", tt.x, tt.y, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckWorkspace(t *testing.T) {
+	cfg := defaultWorkspaceConfig()
+	pillar := cfg
+	pillar.KeepOut = append([]KeepOutZone{{Name: "pillar", Min: [3]float64{390, -1000, 0}, Max: [3]float64{410, 1000, 1000}}}, cfg.KeepOut...)
+	polygon := cfg.Left
+	polygon.Polygon = [][2]float64{{200, -200}, {600, -200}, {200, 200}}
+	home := mmPose(300, 0, 100)
+	tests := []struct {
+		name   string
+		cfg    WorkspaceConfig
+		frame  ArmFrame
+		ws     ArmWorkspace
+		from   [6]int
+		target [6]int
+		want   string
+	}{
+		{"inside", cfg, ArmFrame{}, cfg.Left, home, mmPose(400, 100, 200, 0, 90, 0), ""},
+		{"outside box", cfg, ArmFrame{}, cfg.Left, home, mmPose(700, 0, 100), "x=700.0mm"},
+		{"orientation limit", cfg, ArmFrame{}, cfg.Left, home, mmPose(300, 0, 100, 0, 130, 0), "ry=130.0°"},
+		{"below keyboard surface", cfg, ArmFrame{}, cfg.Left, home, mmPose(300, 0, 10), `keep-out zone "keyboard"`},
+		{"keep-out uses world coordinates", cfg, ArmFrame{Base: [3]float64{0, 0, -100}}, cfg.Left, mmPose(300, 0, 200), mmPose(300, 0, 110), `keep-out zone "keyboard"`},
+		{"path through keep-out", pillar, ArmFrame{}, cfg.Left, home, mmPose(500, 0, 100), "path leaves workspace"},
+		{"moving back from outside", pillar, ArmFrame{}, cfg.Left, mmPose(400, 0, 100), mmPose(300, 0, 100), ""},
+		{"inside polygon", cfg, ArmFrame{}, polygon, mmPose(250, -100, 100), mmPose(300, 0, 100), ""},
+		{"outside polygon", cfg, ArmFrame{}, polygon, home, mmPose(500, 150, 100), "outside workspace polygon"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkWorkspace(tt.cfg, tt.frame, tt.ws, tt.from, tt.target, 5)
+			if tt.want == "" {
+				if err != nil {
+					t.Errorf("unexpected rejection: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got %v, want %q", err, tt.want)
+			}
+		})
+	}
+}